@@ -0,0 +1,338 @@
+// dbasik provides a service with which to convert spreadsheets containing
+// data to JSON for further processing.
+
+// Copyright (C) 2024 M R Lemon
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// DatamapLineError is a problem with one line of an uploaded datamap file. Line is the
+// number of the line, or row of a workbook, counting from 1, and Field is the field of
+// the DatamapLine with the problem, if there is one.
+type DatamapLineError struct {
+	Line    int    `json:"line"`
+	Field   string `json:"field,omitempty"`
+	Message string `json:"message"`
+}
+
+// DatamapErrors lists every problem found with an uploaded datamap file, in the order
+// of the lines they are on. It is sent to the client as a JSON list.
+type DatamapErrors []DatamapLineError
+
+func (e DatamapErrors) Error() string {
+	if len(e) == 0 {
+		return "no errors"
+	}
+	msg := fmt.Sprintf("line %d: ", e[0].Line)
+	if e[0].Field != "" {
+		msg += e[0].Field + " "
+	}
+	msg += e[0].Message
+	if len(e) > 1 {
+		msg += fmt.Sprintf(" (and %d more errors)", len(e)-1)
+	}
+	return msg
+}
+
+// datamapHeadings maps the headings we recognise for the columns of a datamap file,
+// once normalised by datamapHeading, to the field they hold.
+var datamapHeadings = map[string]string{
+	"key":           "key",
+	"sheet":         "sheet",
+	"datatype":      "datatype",
+	"type":          "datatype",
+	"cellref":       "cellref",
+	"cellreference": "cellref",
+	"cell":          "cellref",
+	"rules":         "rules",
+	"columns":       "columns",
+}
+
+// datamapHeading returns the field held by the column headed s, whatever its case and
+// however its words are separated, or "" if we don't recognise it.
+func datamapHeading(s string) string {
+	s = strings.ToLower(strings.NewReplacer(" ", "", "_", "", "-", "").Replace(s))
+	return datamapHeadings[s]
+}
+
+// datamapDelimiters are the field delimiters readDatamapCSV recognises
+var datamapDelimiters = []rune{',', ';', '\t', '|'}
+
+// sniffDelimiter returns the delimiter which appears most often outside quotes in the
+// first non-blank line of data, or a comma if none of them does.
+func sniffDelimiter(data []byte) rune {
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		counts := map[rune]int{}
+		quoted := false
+		for _, c := range string(line) {
+			if c == '"' {
+				quoted = !quoted
+			} else if !quoted {
+				counts[c]++
+			}
+		}
+		best := ','
+		for _, d := range datamapDelimiters {
+			if counts[d] > counts[best] {
+				best = d
+			}
+		}
+		return best
+	}
+	return ','
+}
+
+// readDatamapCSV reads datamap CSV from r. Each line has four fields (key, sheet, data
+// type and cell reference) and may have two more holding its rules and table columns
+// as JSON, as written by writeDatamapCSV. The first line may instead be a row of
+// headings naming the fields, in which case the columns can be in any order. A
+// leading byte order mark is ignored, and the fields may be separated by semicolons,
+// tabs or pipes rather than commas.
+//
+// Each line is checked with ValidateDatamapLine, and no key, nor sheet and cell
+// reference, may be used twice. Every problem found is returned in DatamapErrors,
+// against the number of the line it is on.
+func readDatamapCSV(r io.Reader) ([]DatamapLine, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	data = bytes.TrimPrefix(data, utf8BOM)
+
+	reader := csv.NewReader(bytes.NewReader(data))
+	reader.Comma = sniffDelimiter(data)
+	reader.FieldsPerRecord = -1
+
+	var p datamapLineChecker
+	var columns []string
+	first := true
+	for {
+		record, err := reader.Read()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break // end of file
+			}
+			// We can't be sure where the next line starts after a parse error
+			var parseErr *csv.ParseError
+			if errors.As(err, &parseErr) {
+				p.errs = append(p.errs, DatamapLineError{Line: parseErr.Line, Message: parseErr.Err.Error()})
+				return nil, p.errs
+			}
+			return nil, err
+		}
+		line, _ := reader.FieldPos(0)
+
+		if first {
+			first = false
+			if headings, ok := p.header(line, record); ok {
+				columns = headings
+				continue
+			}
+		}
+
+		if columns == nil {
+			if len(record) != 4 && len(record) != 6 {
+				p.errorf(line, "", "must have 4 fields (key, sheet, datatype and cellref), or 6 with rules and columns, but has %d", len(record))
+				continue
+			}
+			p.add(line, record)
+			continue
+		}
+
+		if len(record) > len(columns) {
+			p.errorf(line, "", "has %d fields, but the header only names %d", len(record), len(columns))
+			continue
+		}
+		var fields [6]string
+		for i, value := range record {
+			for j, name := range datamapColumns {
+				if columns[i] == name {
+					fields[j] = value
+				}
+			}
+		}
+		p.add(line, fields[:])
+	}
+	return p.lines()
+}
+
+// datamapLineChecker builds the lines of a datamap from the fields read from a file,
+// checking each and collecting the problems it finds.
+type datamapLineChecker struct {
+	dmls  []DatamapLine
+	errs  DatamapErrors
+	keys  map[string]int
+	cells map[string]int
+}
+
+func (p *datamapLineChecker) errorf(line int, field, format string, args ...any) {
+	p.errs = append(p.errs, DatamapLineError{Line: line, Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// header returns the field held by each column if record is a row of headings: each
+// of its fields is a heading we recognise and the key, sheet, datatype and cellref are
+// all named. If most of its fields are headings but it isn't a valid header, the
+// problem is recorded.
+func (p *datamapLineChecker) header(line int, record []string) ([]string, bool) {
+	columns := make([]string, len(record))
+	named := map[string]bool{}
+	recognised := 0
+	for i, heading := range record {
+		columns[i] = datamapHeading(heading)
+		if columns[i] != "" {
+			recognised++
+			if named[columns[i]] {
+				p.errorf(line, "", "the header names the %s column more than once", columns[i])
+			}
+			named[columns[i]] = true
+		}
+	}
+	if recognised*2 <= len(record) {
+		return nil, false
+	}
+
+	for i, heading := range record {
+		if columns[i] == "" {
+			p.errorf(line, "", "the header has an unknown column %q", heading)
+		}
+	}
+	for _, name := range datamapColumns[:4] {
+		if !named[name] {
+			p.errorf(line, "", "the header has no %s column", name)
+		}
+	}
+	return columns, true
+}
+
+// add checks the line made from fields, which are the key, sheet, datatype, cellref,
+// rules and columns, the last two of which are optional.
+func (p *datamapLineChecker) add(line int, fields []string) {
+	dml := DatamapLine{Key: fields[0], Sheet: fields[1], DataType: fields[2], CellRef: fields[3]}
+	if len(fields) > 4 {
+		var err error
+		if dml.Rules, err = decodeRules(fields[4]); err != nil {
+			p.errorf(line, "rules", "%s", err)
+		}
+		if dml.Columns, err = decodeColumns(fields[5]); err != nil {
+			p.errorf(line, "columns", "%s", err)
+		}
+	}
+	p.check(line, dml)
+}
+
+// check checks dml with ValidateDatamapLine, and that neither its key nor its sheet
+// and cell reference have been used by an earlier line.
+func (p *datamapLineChecker) check(line int, dml DatamapLine) {
+	if p.keys == nil {
+		p.keys = map[string]int{}
+		p.cells = map[string]int{}
+	}
+
+	v := NewValidator()
+	ValidateDatamapLine(v, dml)
+	fieldNames := make([]string, 0, len(v.Errors))
+	for field := range v.Errors {
+		fieldNames = append(fieldNames, field)
+	}
+	sort.Strings(fieldNames)
+	for _, field := range fieldNames {
+		p.errorf(line, field, "%s", v.Errors[field])
+	}
+
+	if dml.Key != "" {
+		if other, ok := p.keys[dml.Key]; ok {
+			p.errorf(line, "key", "%q is already used on line %d", dml.Key, other)
+		} else {
+			p.keys[dml.Key] = line
+		}
+	}
+	if dml.Sheet != "" && dml.CellRef != "" {
+		// Defined names aren't case sensitive, but cell references must be upper case
+		cell := dml.Sheet + "!" + dml.CellRef
+		if validateDefinedName(dml.CellRef) {
+			cell = dml.Sheet + "!" + strings.ToLower(dml.CellRef)
+		}
+		if other, ok := p.cells[cell]; ok {
+			p.errorf(line, "cellref", "%s on sheet %s is already used on line %d", dml.CellRef, dml.Sheet, other)
+		} else {
+			p.cells[cell] = line
+		}
+	}
+
+	p.dmls = append(p.dmls, dml)
+}
+
+// lines returns the lines added, or the problems found with them.
+func (p *datamapLineChecker) lines() ([]DatamapLine, error) {
+	if len(p.errs) > 0 {
+		return nil, p.errs
+	}
+	if p.dmls == nil {
+		return []DatamapLine{}, nil
+	}
+	return p.dmls, nil
+}
+
+// checkDatamapLines checks dmls, decoded from a JSON or YAML datamap, just as
+// readDatamapCSV checks the lines it reads. Problems are reported against the position
+// of the line in the datamap, counting from 1.
+func checkDatamapLines(dmls []DatamapLine) ([]DatamapLine, error) {
+	var p datamapLineChecker
+	for i, dml := range dmls {
+		p.check(i+1, dml)
+	}
+	return p.lines()
+}
+
+// writeDatamapCSV writes dmls as headerless, four column datamap CSV, which
+// readDatamapCSV reads back. If any of the lines has rules or table columns, two more
+// columns hold them as JSON.
+func writeDatamapCSV(w io.Writer, dmls []DatamapLine) error {
+	extended := false
+	for _, dml := range dmls {
+		if dml.Rules != nil || len(dml.Columns) > 0 {
+			extended = true
+		}
+	}
+
+	cw := csv.NewWriter(w)
+	for _, dml := range dmls {
+		record := []string{dml.Key, dml.Sheet, dml.DataType, dml.CellRef}
+		if extended {
+			rules, columns, err := encodeLineExtras(dml)
+			if err != nil {
+				return err
+			}
+			record = append(record, rules, columns)
+		}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
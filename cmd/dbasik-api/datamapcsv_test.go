@@ -0,0 +1,183 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadDatamapCSV(t *testing.T) {
+	want := []DatamapLine{
+		{Key: "Project Name", Sheet: "Introduction", DataType: "TEXT", CellRef: "C5"},
+		{Key: "Budget; total", Sheet: "9 - Costs", DataType: "NUMBER", CellRef: "Budget"},
+	}
+	withRules := []DatamapLine{
+		{Key: "Project Name", Sheet: "Introduction", DataType: "TEXT", CellRef: "C5", Rules: &Rules{Required: true}},
+		{Key: "Budget; total", Sheet: "9 - Costs", DataType: "NUMBER", CellRef: "Budget"},
+	}
+
+	tests := []struct {
+		name string
+		data string
+		want []DatamapLine
+	}{
+		{
+			name: "headerless",
+			data: "Project Name,Introduction,TEXT,C5\n\"Budget; total\",9 - Costs,NUMBER,Budget\n",
+			want: want,
+		},
+		{
+			name: "byte order mark and CRLF",
+			data: "\xef\xbb\xbfProject Name,Introduction,TEXT,C5\r\n\r\n\"Budget; total\",9 - Costs,NUMBER,Budget\r\n",
+			want: want,
+		},
+		{
+			name: "header",
+			data: "Key,Sheet,Data type,Cell reference\nProject Name,Introduction,TEXT,C5\n\"Budget; total\",9 - Costs,NUMBER,Budget\n",
+			want: want,
+		},
+		{
+			name: "header in another order",
+			data: "cell_ref,sheet,KEY,type,rules\nC5,Introduction,Project Name,TEXT,\"{\"\"required\"\":true}\"\nBudget,9 - Costs,\"Budget; total\",NUMBER\n",
+			want: withRules,
+		},
+		{
+			name: "semicolons",
+			data: "Project Name;Introduction;TEXT;C5\n\"Budget; total\";9 - Costs;NUMBER;Budget\n",
+			want: want,
+		},
+		{
+			name: "tabs",
+			data: "key\tsheet\tdatatype\tcellref\nProject Name\tIntroduction\tTEXT\tC5\nBudget; total\t9 - Costs\tNUMBER\tBudget\n",
+			want: want,
+		},
+		{
+			name: "pipes with rules",
+			data: "Project Name|Introduction|TEXT|C5|\"{\"\"required\"\":true}\"|\nBudget; total|9 - Costs|NUMBER|Budget||\n",
+			want: withRules,
+		},
+		{
+			name: "empty",
+			data: "",
+			want: []DatamapLine{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readDatamapCSV(strings.NewReader(tt.data))
+			if err != nil {
+				t.Fatalf("readDatamapCSV() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("readDatamapCSV() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadDatamapCSVErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want DatamapErrors
+	}{
+		{
+			name: "every problem",
+			data: strings.Join([]string{
+				"Project Name,Introduction,TEXT,C5",
+				"Project Name,Introduction,TEXT,C6",
+				"Budget,Introduction,NUMBER,c5",
+				"Start,Introduction,DATE,C5",
+				"Too short,Introduction,TEXT",
+				"Cost,Introduction,MONEY,A1:B",
+				"Named,Introduction,TEXT,ProjectName",
+				"Named again,Introduction,TEXT,projectname",
+			}, "\n"),
+			want: DatamapErrors{
+				{Line: 2, Field: "key", Message: `"Project Name" is already used on line 1`},
+				{Line: 3, Field: "cellref", Message: "must be a cell reference in A1 format or a defined name"},
+				{Line: 4, Field: "cellref", Message: "C5 on sheet Introduction is already used on line 1"},
+				{Line: 5, Message: "must have 4 fields (key, sheet, datatype and cellref), or 6 with rules and columns, but has 3"},
+				{Line: 6, Field: "cellref", Message: "must be a cell reference in A1 format or a defined name"},
+				{Line: 6, Field: "datatype", Message: "must be one of " + strings.Join(DataTypes, ", ")},
+				{Line: 8, Field: "cellref", Message: "projectname on sheet Introduction is already used on line 7"},
+			},
+		},
+		{
+			name: "bad header",
+			data: "key,sheet,cellref,owner\nProject Name,Introduction,C5,me\n",
+			want: DatamapErrors{
+				{Line: 1, Message: `the header has an unknown column "owner"`},
+				{Line: 1, Message: "the header has no datatype column"},
+				{Line: 2, Field: "datatype", Message: "must be provided"},
+			},
+		},
+		{
+			name: "too many fields for header",
+			data: "key,sheet,datatype,cellref\nProject Name,Introduction,TEXT,C5,extra\n",
+			want: DatamapErrors{
+				{Line: 2, Message: "has 5 fields, but the header only names 4"},
+			},
+		},
+		{
+			name: "bad rules",
+			data: "Project Name,Introduction,TEXT,C5,\"{\"\"requred\"\":true}\",\n",
+			want: DatamapErrors{
+				{Line: 1, Field: "rules", Message: `must be a JSON object of rules: json: unknown field "requred"`},
+			},
+		},
+		{
+			name: "bad quotes",
+			data: "Project Name,Introduction,TEXT,C5\nBudget,\"Intro\"duction,NUMBER,C6\n",
+			want: DatamapErrors{
+				{Line: 2, Message: `extraneous or missing " in quoted-field`},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := readDatamapCSV(strings.NewReader(tt.data))
+			var got DatamapErrors
+			if !errors.As(err, &got) {
+				t.Fatalf("readDatamapCSV() error = %v, want DatamapErrors", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("readDatamapCSV() errors =\n%+v\nwant\n%+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDatamapErrorsError(t *testing.T) {
+	errs := DatamapErrors{
+		{Line: 3, Field: "cellref", Message: "must be provided"},
+		{Line: 4, Message: "must have 4 fields"},
+	}
+	if got, want := errs.Error(), "line 3: cellref must be provided (and 1 more errors)"; got != want {
+		t.Errorf("Error() = %q, want %q", got, want)
+	}
+}
+
+func TestSniffDelimiter(t *testing.T) {
+	tests := []struct {
+		data string
+		want rune
+	}{
+		{"a,b,c,d", ','},
+		{"\n\na;b;c;d", ';'},
+		{"\"a,b,c\";d;e;f", ';'},
+		{"a\tb\tc\td", '\t'},
+		{"a|b|c|d", '|'},
+		{"a;b,c,d,e", ','},
+		{"abcd", ','},
+	}
+
+	for _, tt := range tests {
+		if got := sniffDelimiter([]byte(tt.data)); got != tt.want {
+			t.Errorf("sniffDelimiter(%q) = %q, want %q", tt.data, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,458 @@
+// dbasik provides a service with which to convert spreadsheets containing
+// data to JSON for further processing.
+
+// Copyright (C) 2024 M R Lemon
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/tealeg/xlsx/v3"
+	"gopkg.in/yaml.v3"
+)
+
+// DatamapFormat is one of the file formats a datamap can be exported to and uploaded
+// in.
+type DatamapFormat struct {
+	Name        string
+	Ext         string
+	ContentType string
+}
+
+// The datamap formats, in the order we prefer them when a client will accept any.
+// CSV and Excel files hold only the lines of a datamap; JSON and YAML files hold its
+// name and description too.
+var (
+	DatamapJSON = &DatamapFormat{Name: "json", Ext: ".json", ContentType: "application/json"}
+	DatamapYAML = &DatamapFormat{Name: "yaml", Ext: ".yaml", ContentType: "application/yaml"}
+	DatamapCSV  = &DatamapFormat{Name: "csv", Ext: ".csv", ContentType: "text/csv"}
+	DatamapXLSX = &DatamapFormat{Name: "xlsx", Ext: ".xlsx", ContentType: FormatXLSX.ContentType}
+
+	DatamapFormats = []*DatamapFormat{DatamapJSON, DatamapYAML, DatamapCSV, DatamapXLSX}
+
+	// datamapContentTypes includes the other content types commonly sent for each format
+	datamapContentTypes = map[string]*DatamapFormat{
+		"application/json":     DatamapJSON,
+		"application/yaml":     DatamapYAML,
+		"application/x-yaml":   DatamapYAML,
+		"text/yaml":            DatamapYAML,
+		"text/x-yaml":          DatamapYAML,
+		"text/csv":             DatamapCSV,
+		"application/csv":      DatamapCSV,
+		FormatXLSX.ContentType: DatamapXLSX,
+	}
+
+	datamapExts = map[string]*DatamapFormat{
+		".json": DatamapJSON,
+		".yaml": DatamapYAML,
+		".yml":  DatamapYAML,
+		".csv":  DatamapCSV,
+		".xlsx": DatamapXLSX,
+	}
+)
+
+// ErrUnsupportedDatamapFormat is returned for a datamap uploaded with a content type
+// which isn't one of DatamapFormats.
+var ErrUnsupportedDatamapFormat = errors.New("datamap must be CSV, JSON, YAML or an Excel workbook")
+
+// datamapSheet is the name of the sheet holding the lines of a datamap exported as an
+// Excel workbook
+const datamapSheet = "Datamap"
+
+// datamapColumns are the headings of the columns of a datamap exported as an Excel
+// workbook, and of the CSV columns for the rules and table columns of its lines
+var datamapColumns = []string{"key", "sheet", "datatype", "cellref", "rules", "columns"}
+
+// DatamapFormatByName returns the format called name, such as "yaml", or nil.
+func DatamapFormatByName(name string) *DatamapFormat {
+	for _, f := range DatamapFormats {
+		if strings.EqualFold(f.Name, name) {
+			return f
+		}
+	}
+	if strings.EqualFold(name, "yml") {
+		return DatamapYAML
+	}
+	return nil
+}
+
+// DatamapFormatForContentType returns the format with the content type of a request
+// or an uploaded file, ignoring any parameters such as charset, or nil.
+func DatamapFormatForContentType(contentType string) *DatamapFormat {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil
+	}
+	return datamapContentTypes[mediaType]
+}
+
+// DetectDatamapFormat works out the format of an uploaded datamap file: from its
+// content type if that names one of our formats, then from its content if it is a
+// zip archive, which can only be a workbook, then from the extension of its filename.
+// Anything else is read as CSV, which is what datamaps were first uploaded as.
+func DetectDatamapFormat(contentType, filename string, data []byte) *DatamapFormat {
+	if f := DatamapFormatForContentType(contentType); f != nil {
+		return f
+	}
+	if bytes.HasPrefix(data, zipMagic) {
+		return DatamapXLSX
+	}
+	if f, ok := datamapExts[strings.ToLower(filepath.Ext(filename))]; ok {
+		return f
+	}
+	return DatamapCSV
+}
+
+// NegotiateDatamapFormat chooses the format to send a datamap in from the Accept
+// header of a request. The acceptable format with the highest quality wins, with ties
+// going to the one listed first. JSON is sent if the header is empty or accepts
+// anything, and nil is returned if none of our formats is acceptable.
+func NegotiateDatamapFormat(accept string) *DatamapFormat {
+	if strings.TrimSpace(accept) == "" {
+		return DatamapJSON
+	}
+
+	var best *DatamapFormat
+	bestQ := 0.0
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if s, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(s, 64); err != nil {
+				continue
+			}
+		}
+
+		var f *DatamapFormat
+		switch {
+		case mediaType == "*/*":
+			f = DatamapJSON
+		case strings.HasSuffix(mediaType, "/*"):
+			prefix := strings.TrimSuffix(mediaType, "*")
+			for _, df := range DatamapFormats {
+				if strings.HasPrefix(df.ContentType, prefix) {
+					f = df
+					break
+				}
+			}
+		default:
+			f = datamapContentTypes[mediaType]
+		}
+		if f != nil && q > bestQ {
+			best, bestQ = f, q
+		}
+	}
+	return best
+}
+
+// datamapDocument is a datamap as written to a JSON or YAML file. It leaves out the
+// ids, revision and creation time of a stored datamap, so that exporting the same
+// lines again gives the same file.
+type datamapDocument struct {
+	Name         string                `json:"name" yaml:"name"`
+	Description  string                `json:"description,omitempty" yaml:"description,omitempty"`
+	ValueMode    ValueMode             `json:"value_mode,omitempty" yaml:"value_mode,omitempty"`
+	IdentityKeys *IdentityKeys         `json:"identity_keys,omitempty" yaml:"identity_keys,omitempty"`
+	Lines        []datamapDocumentLine `json:"datamap_lines" yaml:"datamap_lines"`
+}
+
+type datamapDocumentLine struct {
+	Key      string       `json:"key" yaml:"key"`
+	Sheet    string       `json:"sheet" yaml:"sheet"`
+	DataType string       `json:"datatype" yaml:"datatype"`
+	CellRef  string       `json:"cellref" yaml:"cellref"`
+	Rules    *Rules       `json:"rules,omitempty" yaml:"rules,omitempty"`
+	Columns  TableColumns `json:"columns,omitempty" yaml:"columns,omitempty"`
+}
+
+func newDatamapDocument(dm *Datamap) datamapDocument {
+	doc := datamapDocument{
+		Name:         dm.Name,
+		Description:  dm.Description,
+		ValueMode:    dm.ValueMode,
+		IdentityKeys: dm.IdentityKeys,
+		Lines:        make([]datamapDocumentLine, len(dm.DMLs)),
+	}
+	for i, dml := range dm.DMLs {
+		doc.Lines[i] = datamapDocumentLine{
+			Key:      dml.Key,
+			Sheet:    dml.Sheet,
+			DataType: dml.DataType,
+			CellRef:  dml.CellRef,
+			Rules:    dml.Rules,
+			Columns:  dml.Columns,
+		}
+	}
+	return doc
+}
+
+func (doc datamapDocument) datamap() *Datamap {
+	dm := &Datamap{
+		Name:         doc.Name,
+		Description:  doc.Description,
+		ValueMode:    doc.ValueMode,
+		IdentityKeys: doc.IdentityKeys,
+		DMLs:         make([]DatamapLine, len(doc.Lines)),
+	}
+	for i, l := range doc.Lines {
+		dm.DMLs[i] = DatamapLine{
+			Key:      l.Key,
+			Sheet:    l.Sheet,
+			DataType: l.DataType,
+			CellRef:  l.CellRef,
+			Rules:    l.Rules,
+			Columns:  l.Columns,
+		}
+	}
+	return dm
+}
+
+// checkedDatamap returns the Datamap described by doc once its lines have passed
+// checkDatamapLines.
+func (doc datamapDocument) checkedDatamap() (*Datamap, error) {
+	dm := doc.datamap()
+	dmls, err := checkDatamapLines(dm.DMLs)
+	if err != nil {
+		return nil, err
+	}
+	dm.DMLs = dmls
+	return dm, nil
+}
+
+// WriteDatamap writes the lines of dm to w in format f, and, for JSON and YAML, its
+// name, description, value mode and identity keys.
+func WriteDatamap(w io.Writer, dm *Datamap, f *DatamapFormat) error {
+	switch f {
+	case DatamapJSON:
+		b, err := json.MarshalIndent(newDatamapDocument(dm), "", "\t")
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(append(b, '\n'))
+		return err
+	case DatamapYAML:
+		enc := yaml.NewEncoder(w)
+		enc.SetIndent(2)
+		if err := enc.Encode(newDatamapDocument(dm)); err != nil {
+			return err
+		}
+		return enc.Close()
+	case DatamapCSV:
+		return writeDatamapCSV(w, dm.DMLs)
+	case DatamapXLSX:
+		wb, err := buildDatamapWorkbook(dm.DMLs)
+		if err != nil {
+			return err
+		}
+		return wb.Write(w)
+	default:
+		return ErrUnsupportedDatamapFormat
+	}
+}
+
+// ReadDatamap reads a datamap written in format f. Only JSON and YAML files give the
+// datamap a name, description, value mode and identity keys. Whatever the format, the
+// lines are checked the same way, and every problem found with them is returned in
+// DatamapErrors.
+func ReadDatamap(data []byte, f *DatamapFormat) (*Datamap, error) {
+	switch f {
+	case DatamapJSON:
+		var doc datamapDocument
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&doc); err != nil {
+			return nil, fmt.Errorf("invalid JSON datamap: %w", err)
+		}
+		return doc.checkedDatamap()
+	case DatamapYAML:
+		var doc datamapDocument
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		if err := dec.Decode(&doc); err != nil {
+			return nil, fmt.Errorf("invalid YAML datamap: %w", err)
+		}
+		return doc.checkedDatamap()
+	case DatamapCSV:
+		dmls, err := readDatamapCSV(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		return &Datamap{DMLs: dmls}, nil
+	case DatamapXLSX:
+		dmls, err := readDatamapWorkbook(data)
+		if err != nil {
+			return nil, err
+		}
+		return &Datamap{DMLs: dmls}, nil
+	default:
+		return nil, ErrUnsupportedDatamapFormat
+	}
+}
+
+// encodeLineExtras returns the rules and table columns of dml as JSON, or as empty
+// strings if it has none.
+func encodeLineExtras(dml DatamapLine) (rules, columns string, err error) {
+	if dml.Rules != nil {
+		b, err := json.Marshal(dml.Rules)
+		if err != nil {
+			return "", "", err
+		}
+		rules = string(b)
+	}
+	if len(dml.Columns) > 0 {
+		b, err := json.Marshal(dml.Columns)
+		if err != nil {
+			return "", "", err
+		}
+		columns = string(b)
+	}
+	return rules, columns, nil
+}
+
+// decodeRules reads rules written as JSON by encodeLineExtras, or nil rules from an
+// empty string.
+func decodeRules(s string) (*Rules, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	rules := &Rules{}
+	dec := json.NewDecoder(strings.NewReader(s))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(rules); err != nil {
+		return nil, fmt.Errorf("must be a JSON object of rules: %w", err)
+	}
+	return rules, nil
+}
+
+// decodeColumns reads table columns written as JSON by encodeLineExtras, or no columns
+// from an empty string.
+func decodeColumns(s string) (TableColumns, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	var columns TableColumns
+	dec := json.NewDecoder(strings.NewReader(s))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&columns); err != nil {
+		return nil, fmt.Errorf("must be a JSON array of columns: %w", err)
+	}
+	return columns, nil
+}
+
+// buildDatamapWorkbook writes dmls to the "Datamap" sheet of a new workbook, one line
+// to a row under a row of headings.
+func buildDatamapWorkbook(dmls []DatamapLine) (*xlsx.File, error) {
+	wb := xlsx.NewFile()
+	sh, err := wb.AddSheet(datamapSheet)
+	if err != nil {
+		return nil, err
+	}
+
+	header := sh.AddRow()
+	for _, heading := range datamapColumns {
+		header.AddCell().SetString(heading)
+	}
+	for _, dml := range dmls {
+		rules, columns, err := encodeLineExtras(dml)
+		if err != nil {
+			return nil, err
+		}
+		row := sh.AddRow()
+		for _, value := range []string{dml.Key, dml.Sheet, dml.DataType, dml.CellRef, rules, columns} {
+			row.AddCell().SetString(value)
+		}
+	}
+
+	sh.SetColWidth(1, 1, 50)
+	sh.SetColWidth(2, 4, 20)
+	return wb, nil
+}
+
+// readDatamapWorkbook reads the lines of a datamap from a workbook written by
+// buildDatamapWorkbook. The lines are read from the "Datamap" sheet, or the first
+// sheet if there isn't one, and their fields from the columns under the headings in
+// its first row, in any order. Blank rows are skipped, and the other rows are checked
+// as readDatamapCSV checks lines, with problems reported against the row number.
+func readDatamapWorkbook(data []byte) ([]DatamapLine, error) {
+	wb, err := xlsx.OpenBinary(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Excel datamap: %w", err)
+	}
+	sh, ok := wb.Sheet[datamapSheet]
+	if !ok {
+		if len(wb.Sheets) == 0 {
+			return nil, errors.New("invalid Excel datamap: the workbook has no sheets")
+		}
+		sh = wb.Sheets[0]
+	}
+
+	columns := map[string]int{}
+	for col := 0; col < sh.MaxCol; col++ {
+		cell, err := sh.Cell(0, col)
+		if err != nil {
+			return nil, err
+		}
+		heading := datamapHeading(cell.Value)
+		if _, ok := columns[heading]; heading != "" && !ok {
+			columns[heading] = col
+		}
+	}
+	for _, heading := range datamapColumns[:4] {
+		if _, ok := columns[heading]; !ok {
+			return nil, fmt.Errorf("invalid Excel datamap: sheet %s has no %s column", sh.Name, heading)
+		}
+	}
+
+	var p datamapLineChecker
+	for row := 1; row < sh.MaxRow; row++ {
+		value := func(heading string) (string, error) {
+			col, ok := columns[heading]
+			if !ok {
+				return "", nil
+			}
+			cell, err := sh.Cell(row, col)
+			if err != nil {
+				return "", err
+			}
+			return cell.Value, nil
+		}
+
+		var fields [6]string
+		blank := true
+		for i, heading := range datamapColumns {
+			if fields[i], err = value(heading); err != nil {
+				return nil, err
+			}
+			blank = blank && strings.TrimSpace(fields[i]) == ""
+		}
+		if blank {
+			continue
+		}
+		p.add(row+1, fields[:])
+	}
+	return p.lines()
+}
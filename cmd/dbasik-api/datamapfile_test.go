@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/tealeg/xlsx/v3"
+)
+
+func testExportDatamap() *Datamap {
+	min, max := 0.0, 1.5e6
+	return &Datamap{
+		ID:           3,
+		Name:         "Quarterly return",
+		Description:  `Costs, "milestones" and names`,
+		Revision:     2,
+		ValueMode:    ValueFormula,
+		IdentityKeys: &IdentityKeys{Name: "Project Name"},
+		DMLs: []DatamapLine{
+			{ID: 10, Key: "Project Name", Sheet: "Introduction", DataType: "TEXT", CellRef: "C5", Rules: &Rules{Required: true, Pattern: `^[A-Z]`}},
+			{ID: 11, Key: "Budget, total", Sheet: "9 - Costs", DataType: "NUMBER", CellRef: "Budget", Rules: &Rules{Min: &min, Max: &max, Warn: true}},
+			{ID: 12, Key: "Coût", Sheet: "Introduction", DataType: "DATE", CellRef: "B6"},
+			{ID: 13, Key: "Milestones", Sheet: "6a - Milestones", DataType: "TABLE", CellRef: "B4:F", Columns: TableColumns{{Name: "Date", DataType: "DATE"}}},
+		},
+	}
+}
+
+func TestDatamapRoundTrip(t *testing.T) {
+	dm := testExportDatamap()
+
+	for _, format := range DatamapFormats {
+		t.Run(format.Name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := WriteDatamap(&buf, dm, format); err != nil {
+				t.Fatalf("WriteDatamap() error = %v", err)
+			}
+			got, err := ReadDatamap(buf.Bytes(), format)
+			if err != nil {
+				t.Fatalf("ReadDatamap() error = %v", err)
+			}
+
+			want := make([]DatamapLine, len(dm.DMLs))
+			for i, dml := range dm.DMLs {
+				dml.ID = 0
+				want[i] = dml
+			}
+			if !reflect.DeepEqual(got.DMLs, want) {
+				t.Errorf("ReadDatamap() lines = %+v, want %+v", got.DMLs, want)
+			}
+			if format == DatamapJSON || format == DatamapYAML {
+				if got.Name != dm.Name || got.Description != dm.Description {
+					t.Errorf("ReadDatamap() = %q, %q, want %q, %q", got.Name, got.Description, dm.Name, dm.Description)
+				}
+				if got.ValueMode != dm.ValueMode {
+					t.Errorf("ReadDatamap() value mode = %s, want %s", got.ValueMode, dm.ValueMode)
+				}
+				if !reflect.DeepEqual(got.IdentityKeys, dm.IdentityKeys) {
+					t.Errorf("ReadDatamap() identity keys = %+v, want %+v", got.IdentityKeys, dm.IdentityKeys)
+				}
+			}
+
+			// Exporting what was read gives the same file
+			var again bytes.Buffer
+			if err := WriteDatamap(&again, got, format); err != nil {
+				t.Fatal(err)
+			}
+			if format != DatamapXLSX && again.String() != buf.String() {
+				t.Errorf("second export differs:\n%s\nwant:\n%s", again.String(), buf.String())
+			}
+		})
+	}
+}
+
+func TestWriteDatamapCSV(t *testing.T) {
+	dm := loadTestDatamap(t)
+
+	var buf bytes.Buffer
+	if err := WriteDatamap(&buf, dm, DatamapCSV); err != nil {
+		t.Fatal(err)
+	}
+	// Lines without rules or columns are written as four column CSV
+	first, _, _ := strings.Cut(buf.String(), "\n")
+	if n := strings.Count(first, ",") + 1; n != 4 {
+		t.Errorf("WriteDatamap() wrote %d columns, want 4: %s", n, first)
+	}
+
+	got, err := readDatamapCSV(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, dm.DMLs) {
+		t.Error("readDatamapCSV() did not read back the datamap written")
+	}
+}
+
+func TestWriteDatamapYAML(t *testing.T) {
+	dm := &Datamap{Name: "Small", DMLs: []DatamapLine{
+		{ID: 1, Key: "Project Name", Sheet: "Introduction", DataType: "TEXT", CellRef: "C5", Rules: &Rules{Required: true}},
+	}}
+
+	var buf bytes.Buffer
+	if err := WriteDatamap(&buf, dm, DatamapYAML); err != nil {
+		t.Fatal(err)
+	}
+	want := `name: Small
+datamap_lines:
+  - key: Project Name
+    sheet: Introduction
+    datatype: TEXT
+    cellref: C5
+    rules:
+      required: true
+`
+	if buf.String() != want {
+		t.Errorf("WriteDatamap() =\n%s\nwant:\n%s", buf.String(), want)
+	}
+}
+
+func TestReadDatamapErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		format *DatamapFormat
+		data   string
+		want   string
+	}{
+		{"unknown yaml field", DatamapYAML, "name: a\nowner: b\n", "field owner not found"},
+		{"unknown json field", DatamapJSON, `{"name":"a","datamap_lines":[{"key":"k","cell":"A1"}]}`, `unknown field "cell"`},
+		{"csv columns", DatamapCSV, "a,b,c\n", "line 1: must have 4 fields"},
+		{"csv rules", DatamapCSV, "k,s,TEXT,A1,\"{\"\"requred\"\":true}\",\n", "line 1: rules must be a JSON object"},
+		{"csv table columns", DatamapCSV, "k,s,TABLE,A1:B,,Date\n", "line 1: columns must be a JSON array"},
+		{"json duplicate key", DatamapJSON,
+			`{"name":"a","datamap_lines":[{"key":"k","sheet":"s","datatype":"TEXT","cellref":"A1"},{"key":"k","sheet":"s","datatype":"TEXT","cellref":"A2"}]}`,
+			`line 2: key "k" is already used on line 1`},
+		{"yaml duplicate cell", DatamapYAML,
+			"name: a\ndatamap_lines:\n  - {key: a, sheet: s, datatype: TEXT, cellref: A1}\n  - {key: b, sheet: s, datatype: TEXT, cellref: A1}\n",
+			"line 2: cellref A1 on sheet s is already used on line 1"},
+		{"xlsx", DatamapXLSX, "not a workbook", "invalid Excel datamap"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ReadDatamap([]byte(tt.data), tt.format)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("ReadDatamap() error = %v, want it to contain %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadDatamapWorkbook(t *testing.T) {
+	wb := xlsx.NewFile()
+	notes, _ := wb.AddSheet("Notes")
+	notes.AddRow().AddCell().SetString("Keep this sheet first")
+	sh, _ := wb.AddSheet("Datamap")
+	for _, values := range [][]string{
+		{"Cell reference", "Key", "Data type", "Sheet", "Notes"},
+		{"C5", "Project Name", "TEXT", "Introduction", "from the template"},
+		{"", "", "", "", ""},
+		{"C6", "Budget", "NUMBER", "Introduction", ""},
+	} {
+		row := sh.AddRow()
+		for _, value := range values {
+			row.AddCell().SetString(value)
+		}
+	}
+	var buf bytes.Buffer
+	if err := wb.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ReadDatamap(buf.Bytes(), DatamapXLSX)
+	if err != nil {
+		t.Fatalf("ReadDatamap() error = %v", err)
+	}
+	want := []DatamapLine{
+		{Key: "Project Name", Sheet: "Introduction", DataType: "TEXT", CellRef: "C5"},
+		{Key: "Budget", Sheet: "Introduction", DataType: "NUMBER", CellRef: "C6"},
+	}
+	if !reflect.DeepEqual(got.DMLs, want) {
+		t.Errorf("ReadDatamap() = %+v, want %+v", got.DMLs, want)
+	}
+}
+
+func TestNegotiateDatamapFormat(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   *DatamapFormat
+	}{
+		{"", DatamapJSON},
+		{"*/*", DatamapJSON},
+		{"application/yaml", DatamapYAML},
+		{"application/x-yaml", DatamapYAML},
+		{"text/csv; charset=utf-8", DatamapCSV},
+		{"text/*", DatamapCSV},
+		{FormatXLSX.ContentType, DatamapXLSX},
+		{"application/json;q=0.5, application/yaml", DatamapYAML},
+		{"text/csv, application/yaml", DatamapCSV},
+		{"text/html, */*;q=0.1", DatamapJSON},
+		{"text/html", nil},
+		{"application/yaml;q=0", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.accept, func(t *testing.T) {
+			if got := NegotiateDatamapFormat(tt.accept); got != tt.want {
+				t.Errorf("NegotiateDatamapFormat(%q) = %v, want %v", tt.accept, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDetectDatamapFormat(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		filename    string
+		data        string
+		want        *DatamapFormat
+	}{
+		{"content type", "application/yaml", "datamap.txt", "name: a", DatamapYAML},
+		{"charset", "application/json; charset=utf-8", "datamap", "{}", DatamapJSON},
+		{"zip", "application/octet-stream", "datamap", "PK\x03\x04", DatamapXLSX},
+		{"yml", "application/octet-stream", "datamap.YML", "name: a", DatamapYAML},
+		{"json", "", "datamap.json", "{}", DatamapJSON},
+		{"csv", "application/octet-stream", "datamap.csv", "a,b,c,d", DatamapCSV},
+		{"unknown", "", "datamap", "a,b,c,d", DatamapCSV},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := DetectDatamapFormat(tt.contentType, tt.filename, []byte(tt.data)); got != tt.want {
+				t.Errorf("DetectDatamapFormat() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
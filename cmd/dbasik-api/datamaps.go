@@ -18,62 +18,134 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"errors"
+	"fmt"
+	"strings"
 	"time"
+
+	"github.com/mattn/go-sqlite3"
 )
 
 // ErrRecordNotFound A custom err to return from our Get() method when looking up a Datamap
-// that doesn't exist
+// that doesn't exist. ErrEditConflict is returned when a datamap has been given a new
+// revision by someone else between us reading it and writing our changes back.
 var (
 	ErrRecordNotFound = errors.New("record not found")
+	ErrEditConflict   = errors.New("edit conflict")
 )
 
+// isUniqueViolation reports whether err is sqlite's error for a write which broke a
+// UNIQUE constraint.
+func isUniqueViolation(err error) bool {
+	var sqliteErr sqlite3.Error
+	return errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique
+}
+
 // A Models struct wraps the DatmapModel. We can add other models to this as
 // we progress
 type Models struct {
 	Datamaps     datamapModel
 	DatamapLines datamapLineModel
+	Returns      returnModel
+	Jobs         jobModel
+	Periods      periodModel
+	Projects     projectModel
 }
 
 // DatamapLine holds the data parsed from each line of a submitted Datamap CSV file.
 // The fields need to be exported otherwise they won't be included when encoding
-// the struct to json.
+// the struct to json. Rules, if set, are checked against the value of the cell when
+// a return is parsed. A TABLE line has a range for its CellRef and may give the data
+// types of the range's columns in Columns.
 type DatamapLine struct {
-	ID       int64  `json:"id"`
-	Key      string `json:"key"`
-	Sheet    string `json:"sheet"`
-	DataType string `json:"datatype"`
-	CellRef  string `json:"cellref"`
+	ID       int64        `json:"id"`
+	Key      string       `json:"key"`
+	Sheet    string       `json:"sheet"`
+	DataType string       `json:"datatype"`
+	CellRef  string       `json:"cellref"`
+	Rules    *Rules       `json:"rules,omitempty"`
+	Columns  TableColumns `json:"columns,omitempty"`
 }
 
 type datamapLineModel struct {
 	DB *sql.DB
 }
 
-// Datamap includes a slice of DatamapLine objects alongside header metadata
+// Datamap includes a slice of DatamapLine objects alongside header metadata.
+// Revision is the number of the revision the DMLs belong to. Revisions are
+// immutable: any change to the lines of a stored Datamap creates revision N+1.
 type Datamap struct {
-	ID          int64         `json:"id"`
-	Name        string        `json:"name"`
-	Description string        `json:"description"`
-	Created     time.Time     `json:"created"`
-	DMLs        []DatamapLine `json:"datamap_lines"`
+	ID           int64         `json:"id"`
+	Name         string        `json:"name"`
+	Description  string        `json:"description"`
+	Created      time.Time     `json:"created"`
+	Revision     int           `json:"revision"`
+	ValueMode    ValueMode     `json:"value_mode"`
+	IdentityKeys *IdentityKeys `json:"identity_keys,omitempty"`
+	DMLs         []DatamapLine `json:"datamap_lines,omitempty"`
+}
+
+// DatamapRevision summarises one historical version of a stored Datamap.
+type DatamapRevision struct {
+	Revision  int       `json:"revision"`
+	Created   time.Time `json:"created"`
+	LineCount int       `json:"line_count"`
 }
 
 type datamapModel struct {
 	DB *sql.DB
 }
 
-// GetSheetsFromDM extracts a set of sheet names from a Datamap struct
+// maxKeyLength is the longest a datamap key may be, in bytes.
+const maxKeyLength = 500
+
+// ValidateDatamapLine checks that each field of a DatamapLine has been provided, that
+// the DataType and CellRef are ones we understand and that any Rules make sense.
+func ValidateDatamapLine(v *Validator, dml DatamapLine) {
+	v.Check(dml.Key != "", "key", "must be provided")
+	v.Check(len(dml.Key) <= maxKeyLength, "key", fmt.Sprintf("must not be more than %d bytes long", maxKeyLength))
+	v.Check(dml.Sheet != "", "sheet", "must be provided")
+	v.Check(dml.DataType != "", "datatype", "must be provided")
+	v.Check(ValidDataType(dml.DataType), "datatype", "must be one of "+strings.Join(DataTypes, ", "))
+	ValidateTableLine(v, dml)
+	ValidateRules(v, dml.DataType, dml.Rules)
+}
+
+// ValidateDatamap checks the header fields of a Datamap and each of its DatamapLines.
+func ValidateDatamap(v *Validator, dm Datamap) {
+	v.Check(dm.Name != "", "name", "must be provided")
+	v.Check(len(dm.Name) <= 500, "name", "must not be more than 500 bytes long")
+	v.Check(dm.ValueMode == "" || PermittedValue(dm.ValueMode, ValueModes...), "value_mode", "must be one of cached, formatted or formula")
+
+	ValidateDatamapLines(v, dm.DMLs)
+}
+
+// ValidateDatamapLines checks each of dmls. Errors are keyed on the (zero-based)
+// position of the line, e.g. "datamap_lines[3].cellref".
+func ValidateDatamapLines(v *Validator, dmls []DatamapLine) {
+	for i, dml := range dmls {
+		lv := NewValidator()
+		ValidateDatamapLine(lv, dml)
+		for key, message := range lv.Errors {
+			v.AddError(fmt.Sprintf("datamap_lines[%d].%s", i, key), message)
+		}
+	}
+}
+
+// GetSheetsFromDM extracts a set of sheet names from a Datamap struct, in the order
+// in which they first appear
 func GetSheetsFromDM(dm Datamap) []string {
 	// this is basically how sets are done in Go - see https://www.sohamkamani.com/golang/sets/
 	sheets := map[string]struct{}{}
+	var out []string
 	for _, dml := range dm.DMLs {
+		if _, ok := sheets[dml.Sheet]; ok {
+			continue
+		}
 		sheets[dml.Sheet] = struct{}{}
-	}
-	var out []string
-	for sheet := range sheets {
-		out = append(out, sheet)
+		out = append(out, dml.Sheet)
 	}
 	return out
 }
@@ -82,6 +154,10 @@ func NewModels(db *sql.DB) Models {
 	return Models{
 		Datamaps:     datamapModel{DB: db},
 		DatamapLines: datamapLineModel{DB: db},
+		Returns:      returnModel{DB: db},
+		Jobs:         jobModel{DB: db},
+		Periods:      periodModel{DB: db},
+		Projects:     projectModel{DB: db},
 	}
 }
 
@@ -91,34 +167,575 @@ func (m *datamapLineModel) Insert(dm Datamap, dmls []DatamapLine) (int, error) {
 	if err != nil {
 		return 0, err
 	}
-	err = m.DB.QueryRow(`INSERT INTO datamaps (name, description, created)
-		 VALUES ($1, $2, CURRENT_TIMESTAMP)
-		 RETURNING id`, dm.Name, dm.Description).Scan(&datamapID)
+	// Rollback is a no-op once the transaction has been committed
+	defer tx.Rollback()
+
+	if dm.ValueMode == "" {
+		dm.ValueMode = ValueCached
+	}
+	err = tx.QueryRow(`INSERT INTO datamaps (name, description, value_mode, identity_keys, created, revision)
+		 VALUES ($1, $2, $3, $4, CURRENT_TIMESTAMP, 1)
+		 RETURNING id`, dm.Name, dm.Description, dm.ValueMode, dm.IdentityKeys).Scan(&datamapID)
 	if err != nil {
 		return 0, err
 	}
 
-	stmt, err := tx.Prepare(`INSERT INTO datamap_lines
-				(datamap_id, key, sheet, data_type, cellref)
-				VALUES ($1, $2, $3, $4, $5)`)
+	revisionID, err := insertRevision(tx, datamapID, 1)
+	if err != nil {
+		return 0, err
+	}
+
+	// Every line of a new datamap is a new line, whatever ID it came with
+	for i := range dmls {
+		dmls[i].ID = 0
+	}
+	err = insertLines(tx, datamapID, revisionID, dmls)
 	if err != nil {
 		return 0, err
 	}
 
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+	return int(datamapID), nil
+}
+
+// insertRevision records revision number n of the datamap with the given id, inside
+// the transaction tx, and returns the id of the new datamap_revisions row.
+func insertRevision(tx *sql.Tx, datamapID int64, n int) (int64, error) {
+	var revisionID int64
+	err := tx.QueryRow(`INSERT INTO datamap_revisions (datamap_id, revision, created)
+		VALUES ($1, $2, CURRENT_TIMESTAMP)
+		RETURNING id`, datamapID, n).Scan(&revisionID)
+	return revisionID, err
+}
+
+// insertLines adds dmls to a revision of the datamap with the given id, inside the
+// transaction tx. A line with an ID is one copied from an earlier revision, and keeps
+// it. A new line has an ID of 0, and is given the id of its new row, which it keeps
+// in later revisions.
+func insertLines(tx *sql.Tx, datamapID, revisionID int64, dmls []DatamapLine) error {
+	stmt, err := tx.Prepare(`INSERT INTO datamap_lines
+				(datamap_id, revision_id, line_id, key, sheet, data_type, cellref, rules, table_columns)
+				VALUES ($1, $2, NULLIF($3, 0), $4, $5, $6, $7, $8, $9)
+				RETURNING datamap_line_id`)
+	if err != nil {
+		return err
+	}
+
 	defer stmt.Close()
 
-	for _, line := range dmls {
-		_, err := stmt.Exec(
-			int64(datamapID),
+	for i, line := range dmls {
+		var rowID int64
+		err := stmt.QueryRow(
+			datamapID,
+			revisionID,
+			line.ID,
 			line.Key,
 			line.Sheet,
 			line.DataType,
-			line.CellRef)
+			line.CellRef,
+			line.Rules,
+			line.Columns).Scan(&rowID)
 		if err != nil {
-			tx.Rollback()
-			return 0, err
+			return err
+		}
+		if line.ID == 0 {
+			dmls[i].ID = rowID
 		}
 	}
-	tx.Commit()
-	return int(datamapID), nil
+
+	_, err = tx.Exec(`UPDATE datamap_lines SET line_id = datamap_line_id
+		WHERE revision_id = $1 AND line_id IS NULL`, revisionID)
+	return err
+}
+
+// keepLineIDs makes sure that dmls, which are to become the lines of the revision
+// after revision n of the datamap with the given id, only keep IDs belonging to lines
+// of revision n, each at most once. A line without one takes the ID of the line with
+// the same key, so that lines keep their IDs when a new revision is uploaded. Any
+// other line is given an ID of 0, to be treated as new by insertLines.
+func keepLineIDs(tx *sql.Tx, datamapID int64, n int, dmls []DatamapLine) error {
+	rows, err := tx.Query(`SELECT l.line_id, l.key
+		FROM datamap_lines l
+		INNER JOIN datamap_revisions r ON r.id = l.revision_id
+		WHERE r.datamap_id = $1 AND r.revision = $2`, datamapID, n)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	ids := map[int64]bool{}
+	keys := map[string]int64{}
+	for rows.Next() {
+		var id int64
+		var key string
+		if err := rows.Scan(&id, &key); err != nil {
+			return err
+		}
+		ids[id] = true
+		keys[key] = id
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	used := map[int64]bool{}
+	for i, dml := range dmls {
+		if dml.ID != 0 && (!ids[dml.ID] || used[dml.ID]) {
+			dmls[i].ID = 0
+		}
+		used[dmls[i].ID] = true
+	}
+	// Only then are lines matched by key, so as not to take an ID given to another
+	for i, dml := range dmls {
+		if id := keys[dml.Key]; dml.ID == 0 && id != 0 && !used[id] {
+			dmls[i].ID = id
+			used[id] = true
+		}
+	}
+	return nil
+}
+
+// Get retrieves the Datamap with the given id, along with the DatamapLines of its
+// current revision. ErrRecordNotFound is returned if there is no matching datamap.
+func (m *datamapModel) Get(id int64) (*Datamap, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `SELECT id, name, description, created, revision, value_mode, identity_keys
+		FROM datamaps
+		WHERE id = $1`
+
+	var dm Datamap
+	var identityKeys sql.NullString
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&dm.ID,
+		&dm.Name,
+		&dm.Description,
+		&dm.Created,
+		&dm.Revision,
+		&dm.ValueMode,
+		&identityKeys,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	if identityKeys.Valid {
+		dm.IdentityKeys = &IdentityKeys{}
+		if err := dm.IdentityKeys.Scan(identityKeys.String); err != nil {
+			return nil, err
+		}
+	}
+
+	dmls, err := m.GetLines(dm.ID, dm.Revision)
+	if err != nil {
+		return nil, err
+	}
+	dm.DMLs = dmls
+
+	return &dm, nil
+}
+
+// GetRevision retrieves the Datamap with the given id as it was at revision n, or
+// at its current revision if n is 0. ErrRecordNotFound is returned if either the
+// datamap or the revision doesn't exist.
+func (m *datamapModel) GetRevision(id int64, n int) (*Datamap, error) {
+	dm, err := m.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 || n == dm.Revision {
+		return dm, nil
+	}
+
+	query := `SELECT revision
+		FROM datamap_revisions
+		WHERE datamap_id = $1 AND revision = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err = m.DB.QueryRowContext(ctx, query, id, n).Scan(&dm.Revision)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	dm.DMLs, err = m.GetLines(dm.ID, dm.Revision)
+	if err != nil {
+		return nil, err
+	}
+
+	return dm, nil
+}
+
+// GetLines retrieves the DatamapLines belonging to revision n of the datamap with the
+// given id, in the order in which they were inserted.
+func (m *datamapModel) GetLines(datamapID int64, n int) ([]DatamapLine, error) {
+	query := `SELECT l.line_id, l.key, l.sheet, l.data_type, l.cellref, l.rules, l.table_columns
+		FROM datamap_lines l
+		INNER JOIN datamap_revisions r ON r.id = l.revision_id
+		WHERE r.datamap_id = $1 AND r.revision = $2
+		ORDER BY l.datamap_line_id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, datamapID, n)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	dmls := []DatamapLine{}
+	for rows.Next() {
+		var dml DatamapLine
+		err := rows.Scan(
+			&dml.ID,
+			&dml.Key,
+			&dml.Sheet,
+			&dml.DataType,
+			&dml.CellRef,
+			&dml.Rules,
+			&dml.Columns,
+		)
+		if err != nil {
+			return nil, err
+		}
+		dmls = append(dmls, dml)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return dmls, nil
+}
+
+// GetRevisions lists every revision of the datamap with the given id, oldest first.
+func (m *datamapModel) GetRevisions(datamapID int64) ([]DatamapRevision, error) {
+	query := `SELECT r.revision, r.created, count(l.datamap_line_id)
+		FROM datamap_revisions r
+		LEFT JOIN datamap_lines l ON l.revision_id = r.id
+		WHERE r.datamap_id = $1
+		GROUP BY r.id, r.revision, r.created
+		ORDER BY r.revision`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, datamapID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	revisions := []DatamapRevision{}
+	for rows.Next() {
+		var rev DatamapRevision
+		err := rows.Scan(&rev.Revision, &rev.Created, &rev.LineCount)
+		if err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, rev)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return revisions, nil
+}
+
+// GetAll returns a page of datamaps, without their lines, whose name or description
+// contains search (case-insensitively). An empty search matches every datamap. The
+// pagination Metadata for the full result set is returned alongside.
+func (m *datamapModel) GetAll(search string, filters Filters) ([]*Datamap, Metadata, error) {
+	query := fmt.Sprintf(`SELECT count(*) OVER(), id, name, description, created, revision, value_mode, identity_keys
+		FROM datamaps
+		WHERE ($1 = '' OR LOWER(name) LIKE '%%' || LOWER($1) || '%%' ESCAPE '\'
+			OR LOWER(description) LIKE '%%' || LOWER($1) || '%%' ESCAPE '\')
+		ORDER BY %s %s, id ASC
+		LIMIT $2 OFFSET $3`, filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, escapeLike(search), filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	datamaps := []*Datamap{}
+
+	for rows.Next() {
+		var dm Datamap
+		var identityKeys sql.NullString
+		err := rows.Scan(
+			&totalRecords,
+			&dm.ID,
+			&dm.Name,
+			&dm.Description,
+			&dm.Created,
+			&dm.Revision,
+			&dm.ValueMode,
+			&identityKeys,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		if identityKeys.Valid {
+			dm.IdentityKeys = &IdentityKeys{}
+			if err := dm.IdentityKeys.Scan(identityKeys.String); err != nil {
+				return nil, Metadata{}, err
+			}
+		}
+		datamaps = append(datamaps, &dm)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return datamaps, metadata, nil
+}
+
+// Update changes the name, description and value mode of a stored Datamap. If dm.DMLs
+// is not nil, they become the lines of a new revision, and dm.Revision is updated to
+// match. Lines keep their IDs as described by keepLineIDs, and new lines are given
+// theirs. ErrEditConflict is returned if dm.Revision is no longer the current
+// revision. Everything happens in a single transaction so a failure leaves
+// the stored datamap as it was.
+func (m *datamapModel) Update(dm *Datamap) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	next := dm.Revision
+	if dm.DMLs != nil {
+		next++
+	}
+
+	result, err := tx.ExecContext(ctx, `UPDATE datamaps
+		SET name = $1, description = $2, value_mode = $3, revision = $4
+		WHERE id = $5 AND revision = $6`, dm.Name, dm.Description, dm.ValueMode, next, dm.ID, dm.Revision)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrEditConflict
+	}
+
+	if dm.DMLs != nil {
+		err = keepLineIDs(tx, dm.ID, dm.Revision, dm.DMLs)
+		if err != nil {
+			return err
+		}
+		revisionID, err := insertRevision(tx, dm.ID, next)
+		if err != nil {
+			return err
+		}
+		err = insertLines(tx, dm.ID, revisionID, dm.DMLs)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	dm.Revision = next
+	return nil
+}
+
+// SetIdentityKeys changes the identity keys of the Datamap with the given id, which
+// are used to match its returns to projects. Nil keys return it to
+// DefaultIdentityKeys. ErrRecordNotFound is returned if there is no matching datamap.
+func (m *datamapModel) SetIdentityKeys(id int64, keys *IdentityKeys) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, `UPDATE datamaps SET identity_keys = $1 WHERE id = $2`, keys, id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+// Delete removes the Datamap with the given id. Its lines are removed by the
+// ON DELETE CASCADE on datamap_lines.
+func (m *datamapModel) Delete(id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, `DELETE FROM datamaps WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// revise applies edit to the lines of the current revision of the datamap with the
+// given id and stores the result as a new revision, returning the new lines. The
+// edited lines are checked together by checkDatamapLines, just as those of an
+// uploaded datamap are, and any problems found are returned in DatamapErrors.
+func (m *datamapLineModel) revise(datamapID int64, edit func([]DatamapLine) ([]DatamapLine, error)) ([]DatamapLine, error) {
+	datamaps := datamapModel{DB: m.DB}
+
+	dm, err := datamaps.Get(datamapID)
+	if err != nil {
+		return nil, err
+	}
+
+	dm.DMLs, err = edit(dm.DMLs)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = checkDatamapLines(dm.DMLs); err != nil {
+		return nil, err
+	}
+
+	err = datamaps.Update(dm)
+	if err != nil {
+		return nil, err
+	}
+	return dm.DMLs, nil
+}
+
+// indexOfLine returns the position of the line with the given id in dmls, or
+// ErrRecordNotFound.
+func indexOfLine(dmls []DatamapLine, id int64) (int, error) {
+	for i, dml := range dmls {
+		if dml.ID == id {
+			return i, nil
+		}
+	}
+	return -1, ErrRecordNotFound
+}
+
+// Add appends a DatamapLine to the datamap with the given id, creating a new
+// revision. dml.ID is set to the ID of the new line.
+func (m *datamapLineModel) Add(datamapID int64, dml *DatamapLine) error {
+	dmls, err := m.revise(datamapID, func(dmls []DatamapLine) ([]DatamapLine, error) {
+		line := *dml
+		line.ID = 0
+		return append(dmls, line), nil
+	})
+	if err != nil {
+		return err
+	}
+	dml.ID = dmls[len(dmls)-1].ID
+	return nil
+}
+
+// Get retrieves a single DatamapLine from the current revision of the datamap with
+// the given id.
+func (m *datamapLineModel) Get(datamapID, id int64) (*DatamapLine, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `SELECT l.line_id, l.key, l.sheet, l.data_type, l.cellref, l.rules, l.table_columns
+		FROM datamap_lines l
+		INNER JOIN datamap_revisions r ON r.id = l.revision_id
+		INNER JOIN datamaps d ON d.id = r.datamap_id AND d.revision = r.revision
+		WHERE d.id = $1 AND l.line_id = $2`
+
+	var dml DatamapLine
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, datamapID, id).Scan(
+		&dml.ID,
+		&dml.Key,
+		&dml.Sheet,
+		&dml.DataType,
+		&dml.CellRef,
+		&dml.Rules,
+		&dml.Columns,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &dml, nil
+}
+
+// Update replaces the line with id dml.ID in a new revision of the datamap with the
+// given id. The line keeps its ID, as do the other lines copied into the revision.
+func (m *datamapLineModel) Update(datamapID int64, dml *DatamapLine) error {
+	_, err := m.revise(datamapID, func(dmls []DatamapLine) ([]DatamapLine, error) {
+		i, err := indexOfLine(dmls, dml.ID)
+		if err != nil {
+			return nil, err
+		}
+		dmls[i] = *dml
+		return dmls, nil
+	})
+	return err
+}
+
+// Delete leaves the line with the given id out of a new revision of the datamap.
+func (m *datamapLineModel) Delete(datamapID, id int64) error {
+	_, err := m.revise(datamapID, func(dmls []DatamapLine) ([]DatamapLine, error) {
+		i, err := indexOfLine(dmls, id)
+		if err != nil {
+			return nil, err
+		}
+		return append(dmls[:i], dmls[i+1:]...), nil
+	})
+	return err
 }
@@ -1,7 +1,11 @@
 package main
 
 import (
+	"net/http"
+	"net/http/httptest"
 	"slices"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 )
@@ -56,3 +60,150 @@ func TestGetSheetsFromDM(t *testing.T) {
 		})
 	}
 }
+
+func TestValidateDatamap(t *testing.T) {
+	dm := Datamap{
+		Name: "Test Name",
+		DMLs: []DatamapLine{
+			{Key: "Test Key", Sheet: "Test Sheet", DataType: "TEXT", CellRef: "A10"},
+			{Key: "", Sheet: "Test Sheet", DataType: "TEXT", CellRef: "10A"},
+			{Key: "Test Key 2", Sheet: "Test Sheet", DataType: "STRING", CellRef: "B10"},
+		},
+	}
+
+	v := NewValidator()
+	ValidateDatamap(v, dm)
+	if v.Valid() {
+		t.Fatal("ValidateDatamap() did not report any errors")
+	}
+	for _, key := range []string{"datamap_lines[1].key", "datamap_lines[1].cellref", "datamap_lines[2].datatype"} {
+		if _, ok := v.Errors[key]; !ok {
+			t.Errorf("ValidateDatamap() did not report an error for %q, got %v", key, v.Errors)
+		}
+	}
+	if len(v.Errors) != 3 {
+		t.Errorf("ValidateDatamap() reported %d errors, expected 3: %v", len(v.Errors), v.Errors)
+	}
+
+	v = NewValidator()
+	ValidateDatamap(v, Datamap{})
+	if _, ok := v.Errors["name"]; !ok {
+		t.Errorf("ValidateDatamap() did not report a missing name")
+	}
+}
+
+func TestDatamapLineIDs(t *testing.T) {
+	app := newTestApp(t)
+	datamapID := insertTestDatamap(t, app, []DatamapLine{
+		{Key: "Key 1", Sheet: "Sheet1", DataType: "TEXT", CellRef: "A1"},
+		{Key: "Key 2", Sheet: "Sheet1", DataType: "TEXT", CellRef: "A2"},
+	})
+	dm, err := app.models.Datamaps.Get(datamapID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, second := dm.DMLs[0], dm.DMLs[1]
+
+	// Each edit makes a new revision, but the IDs the client was given still work
+	first.CellRef = "B1"
+	if err := app.models.DatamapLines.Update(datamapID, &first); err != nil {
+		t.Fatal(err)
+	}
+	second.CellRef = "B2"
+	if err := app.models.DatamapLines.Update(datamapID, &second); err != nil {
+		t.Fatalf("Update() of the second line by its ID error = %v", err)
+	}
+	added := DatamapLine{Key: "Key 3", Sheet: "Sheet1", DataType: "TEXT", CellRef: "A3"}
+	if err := app.models.DatamapLines.Add(datamapID, &added); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.models.DatamapLines.Delete(datamapID, first.ID); err != nil {
+		t.Fatalf("Delete() of the first line by its ID error = %v", err)
+	}
+	for _, want := range []DatamapLine{second, added} {
+		got, err := app.models.DatamapLines.Get(datamapID, want.ID)
+		if err != nil {
+			t.Fatalf("Get() of line %d error = %v", want.ID, err)
+		}
+		if got.CellRef != want.CellRef {
+			t.Errorf("Get() of line %d cellref = %s, want %s", want.ID, got.CellRef, want.CellRef)
+		}
+	}
+
+	// A revision uploaded without IDs keeps those of the lines whose keys it shares
+	dm, err = app.models.Datamaps.Get(datamapID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dm.DMLs = []DatamapLine{
+		{Key: "Key 2", Sheet: "Sheet1", DataType: "TEXT", CellRef: "C2"},
+		{Key: "Key 4", Sheet: "Sheet1", DataType: "TEXT", CellRef: "C4"},
+	}
+	if err := app.models.Datamaps.Update(dm); err != nil {
+		t.Fatal(err)
+	}
+	if dm.DMLs[0].ID != second.ID {
+		t.Errorf("Update() ID of a line with an existing key = %d, want %d", dm.DMLs[0].ID, second.ID)
+	}
+	if id := dm.DMLs[1].ID; id == 0 || id == first.ID || id == second.ID || id == added.ID {
+		t.Errorf("Update() ID of a new line = %d, want a new one", id)
+	}
+}
+
+func TestEditDatamapDuplicateLines(t *testing.T) {
+	app := newTestApp(t)
+	datamapID := insertTestDatamap(t, app, []DatamapLine{
+		{Key: "Key 1", Sheet: "Sheet1", DataType: "TEXT", CellRef: "A1"},
+		{Key: "Key 2", Sheet: "Sheet1", DataType: "TEXT", CellRef: "A2"},
+	})
+	dm, err := app.models.Datamaps.Get(datamapID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := "/v1/datamaps/" + strconv.FormatInt(datamapID, 10)
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+	}{
+		{
+			name:   "lines with the same key",
+			method: http.MethodPatch,
+			path:   path,
+			body: `{"datamap_lines": [{"key": "Key 1", "sheet": "Sheet1", "datatype": "TEXT", "cellref": "A1"},
+				{"key": "Key 1", "sheet": "Sheet1", "datatype": "TEXT", "cellref": "A2"}]}`,
+		},
+		{
+			name:   "added line with a used cell",
+			method: http.MethodPost,
+			path:   path + "/lines",
+			body:   `{"key": "Key 3", "sheet": "Sheet1", "datatype": "TEXT", "cellref": "A1"}`,
+		},
+		{
+			name:   "updated line with a used key",
+			method: http.MethodPatch,
+			path:   path + "/lines/" + strconv.FormatInt(dm.DMLs[1].ID, 10),
+			body:   `{"key": "Key 1"}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			app.routes().ServeHTTP(rr, httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body)))
+			if rr.Code != http.StatusUnprocessableEntity {
+				t.Errorf("%s %s = %d %s, want 422", tt.method, tt.path, rr.Code, rr.Body)
+			}
+		})
+	}
+
+	got, err := app.models.Datamaps.Get(datamapID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Revision != dm.Revision {
+		t.Errorf("datamap revision = %d after rejected edits, want %d", got.Revision, dm.Revision)
+	}
+}
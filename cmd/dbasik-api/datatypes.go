@@ -0,0 +1,245 @@
+// dbasik provides a service with which to convert spreadsheets containing
+// data to JSON for further processing.
+
+// Copyright (C) 2024 M R Lemon
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tealeg/xlsx/v3"
+)
+
+// The data types which a DatamapLine can give the cell it points at. GBP is an alias
+// for CURRENCY. A TABLE line points at a range of cells rather than a single one.
+const (
+	TypeText       = "TEXT"
+	TypeNumber     = "NUMBER"
+	TypeInteger    = "INTEGER"
+	TypeDate       = "DATE"
+	TypeDateTime   = "DATETIME"
+	TypeBool       = "BOOL"
+	TypePercentage = "PERCENTAGE"
+	TypeCurrency   = "CURRENCY"
+	TypeGBP        = "GBP"
+	TypeTable      = "TABLE"
+)
+
+// DataTypes lists every data type accepted in a datamap.
+var DataTypes = []string{
+	TypeText, TypeNumber, TypeInteger, TypeDate, TypeDateTime,
+	TypeBool, TypePercentage, TypeCurrency, TypeGBP, TypeTable,
+}
+
+// ISO 8601 layouts used for converted DATE and DATETIME values
+const (
+	isoDate     = "2006-01-02"
+	isoDateTime = "2006-01-02T15:04:05"
+)
+
+// Layouts, other than an Excel serial number, in which we accept dates typed into a
+// cell as text. Day-first layouts are used as the returns come from UK organisations.
+var dateLayouts = []string{
+	isoDate,
+	isoDateTime,
+	time.RFC3339,
+	"2006-01-02 15:04:05",
+	"02/01/2006",
+	"2/1/2006",
+	"02/01/2006 15:04",
+	"02/01/2006 15:04:05",
+	"02-Jan-2006",
+	"2 Jan 2006",
+	"2 January 2006",
+}
+
+// normaliseDataType returns the canonical, upper-case form of dataType. An empty data
+// type is treated as TEXT.
+func normaliseDataType(dataType string) string {
+	dt := strings.ToUpper(strings.TrimSpace(dataType))
+	if dt == "" {
+		return TypeText
+	}
+	return dt
+}
+
+// ValidDataType reports whether dataType is one of DataTypes, ignoring case.
+func ValidDataType(dataType string) bool {
+	return PermittedValue(strings.ToUpper(strings.TrimSpace(dataType)), DataTypes...)
+}
+
+// ConvertValue converts the raw string value of a cell to the Go value for dataType:
+// a string for TEXT, DATE and DATETIME (the latter two in ISO 8601 form), a float64
+// for NUMBER, PERCENTAGE and CURRENCY, an int64 for INTEGER, a bool for BOOL and the
+// records of a TABLE, from their JSON form, as a []map[string]any.
+// Percentages are returned as a fraction, so "25%" becomes 0.25. Dates may be Excel
+// serial numbers, interpreted according to date1904. A blank cell is nil for every
+// type except TEXT.
+//
+// ConvertValue is idempotent: converting the string form of a converted value (see
+// formatValue) gives the same value again.
+func ConvertValue(dataType, raw string, date1904 bool) (any, error) {
+	dt := normaliseDataType(dataType)
+	if dt == TypeText {
+		return raw, nil
+	}
+
+	s := strings.TrimSpace(raw)
+	if s == "" {
+		return nil, nil
+	}
+
+	var v any
+	var err error
+	switch dt {
+	case TypeNumber:
+		v, err = parseNumber(s)
+	case TypeInteger:
+		v, err = parseInteger(s)
+	case TypePercentage:
+		v, err = parsePercentage(s)
+	case TypeCurrency, TypeGBP:
+		v, err = parseCurrency(s)
+	case TypeBool:
+		v, err = parseBool(s)
+	case TypeDate:
+		v, err = parseDate(s, date1904, isoDate)
+	case TypeDateTime:
+		v, err = parseDate(s, date1904, isoDateTime)
+	case TypeTable:
+		v, err = parseTable(s)
+	default:
+		return nil, fmt.Errorf("unknown data type %q", dataType)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot convert %q to %s", raw, dt)
+	}
+	return v, nil
+}
+
+// formatValue returns the string form of a value returned by ConvertValue.
+func formatValue(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case bool:
+		return strconv.FormatBool(v)
+	case []map[string]any:
+		b, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Sprint(v)
+		}
+		return string(b)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func parseNumber(s string) (float64, error) {
+	f, err := strconv.ParseFloat(strings.ReplaceAll(s, ",", ""), 64)
+	if err != nil {
+		return 0, err
+	}
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0, fmt.Errorf("%q is not a finite number", s)
+	}
+	return f, nil
+}
+
+func parseInteger(s string) (int64, error) {
+	f, err := parseNumber(s)
+	if err != nil {
+		return 0, err
+	}
+	if f != math.Trunc(f) || math.Abs(f) > 1<<53 {
+		return 0, fmt.Errorf("%q is not a whole number", s)
+	}
+	return int64(f), nil
+}
+
+func parsePercentage(s string) (float64, error) {
+	if strings.HasSuffix(s, "%") {
+		f, err := parseNumber(strings.TrimSpace(strings.TrimSuffix(s, "%")))
+		return f / 100, err
+	}
+	return parseNumber(s)
+}
+
+// parseCurrency accepts amounts such as "1234.5", "£1,234.50", "-£12" and the
+// accounting style "(£12.00)" for a negative amount.
+func parseCurrency(s string) (float64, error) {
+	negative := false
+	if strings.HasPrefix(s, "(") && strings.HasSuffix(s, ")") {
+		negative = true
+		s = s[1 : len(s)-1]
+	}
+	if strings.HasPrefix(s, "-") {
+		negative = !negative
+		s = s[1:]
+	}
+	s = strings.TrimSpace(strings.TrimLeft(s, "£$€"))
+
+	f, err := parseNumber(s)
+	if err != nil {
+		return 0, err
+	}
+	if negative {
+		f = -f
+	}
+	return f, nil
+}
+
+func parseBool(s string) (bool, error) {
+	switch strings.ToLower(s) {
+	case "yes", "y":
+		return true, nil
+	case "no", "n":
+		return false, nil
+	}
+	return strconv.ParseBool(s)
+}
+
+// parseDate converts an Excel serial date number, or a date in one of dateLayouts, to
+// a string in the given layout.
+func parseDate(s string, date1904 bool, layout string) (string, error) {
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		if f < 0 {
+			return "", fmt.Errorf("%q is not a date", s)
+		}
+		t := xlsx.TimeFromExcelTime(f, date1904)
+		// Excel serial numbers are only accurate to the millisecond, so round to the
+		// nearest second before formatting
+		return t.Round(time.Second).Format(layout), nil
+	}
+
+	for _, l := range dateLayouts {
+		if t, err := time.Parse(l, s); err == nil {
+			return t.Format(layout), nil
+		}
+	}
+	return "", fmt.Errorf("%q is not a date", s)
+}
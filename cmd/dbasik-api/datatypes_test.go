@@ -0,0 +1,79 @@
+package main
+
+import "testing"
+
+func TestConvertValue(t *testing.T) {
+	tests := []struct {
+		name     string
+		dataType string
+		raw      string
+		date1904 bool
+		want     any
+		wantErr  bool
+	}{
+		{"text", "TEXT", " Knocker ", false, " Knocker ", false},
+		{"empty type is text", "", "Knocker", false, "Knocker", false},
+		{"blank text", "TEXT", "", false, "", false},
+		{"number", "NUMBER", "1234.5", false, 1234.5, false},
+		{"number with commas", "number", "1,234.5", false, 1234.5, false},
+		{"blank number", "NUMBER", "  ", false, nil, false},
+		{"text in number", "NUMBER", "n/a", false, nil, true},
+		{"integer", "INTEGER", "42", false, int64(42), false},
+		{"integer from float", "INTEGER", "42.0", false, int64(42), false},
+		{"fractional integer", "INTEGER", "42.5", false, nil, true},
+		{"percentage fraction", "PERCENTAGE", "0.25", false, 0.25, false},
+		{"percentage with sign", "PERCENTAGE", "25%", false, 0.25, false},
+		{"currency", "CURRENCY", "£1,234.50", false, 1234.5, false},
+		{"gbp", "GBP", "-£12", false, -12.0, false},
+		{"accounting negative", "GBP", "(£12.00)", false, -12.0, false},
+		{"bad currency", "GBP", "£lots", false, nil, true},
+		{"bool", "BOOL", "TRUE", false, true, false},
+		{"bool yes", "BOOL", "Yes", false, true, false},
+		{"bool n", "BOOL", "n", false, false, false},
+		{"bool numeric", "BOOL", "0", false, false, false},
+		{"bad bool", "BOOL", "maybe", false, nil, true},
+		{"serial date", "DATE", "45474", false, "2024-07-01", false},
+		{"serial date 1904", "DATE", "44012", true, "2024-07-01", false},
+		{"serial date with time", "DATE", "45474.75", false, "2024-07-01", false},
+		{"iso date", "DATE", "2024-07-01", false, "2024-07-01", false},
+		{"uk date", "DATE", "01/07/2024", false, "2024-07-01", false},
+		{"bad date", "DATE", "next Tuesday", false, nil, true},
+		{"serial datetime", "DATETIME", "45474.75", false, "2024-07-01T18:00:00", false},
+		{"iso datetime", "DATETIME", "2024-07-01T18:00:00", false, "2024-07-01T18:00:00", false},
+		{"unknown type", "STRING", "Knocker", false, nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ConvertValue(tt.dataType, tt.raw, tt.date1904)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ConvertValue() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Fatalf("ConvertValue() = %#v, want %#v", got, tt.want)
+			}
+			if err != nil {
+				return
+			}
+
+			// Converting the string form of the value should give the same value
+			again, err := ConvertValue(tt.dataType, formatValue(got), false)
+			if err != nil || again != got {
+				t.Errorf("ConvertValue(%q) = %#v, %v; want %#v", formatValue(got), again, err, got)
+			}
+		})
+	}
+}
+
+func TestValidDataType(t *testing.T) {
+	for _, dt := range []string{"TEXT", "text", " Date ", "GBP", "CURRENCY", "INTEGER"} {
+		if !ValidDataType(dt) {
+			t.Errorf("ValidDataType(%q) = false, want true", dt)
+		}
+	}
+	for _, dt := range []string{"", "STRING", "FLOAT"} {
+		if ValidDataType(dt) {
+			t.Errorf("ValidDataType(%q) = true, want false", dt)
+		}
+	}
+}
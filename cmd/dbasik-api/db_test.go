@@ -0,0 +1,73 @@
+package main
+
+import (
+	"database/sql"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"testing"
+)
+
+// testSchema is the schema built by the migrations, in SQLite's dialect.
+const testSchema = `
+CREATE TABLE datamaps (id INTEGER PRIMARY KEY, name text, description text, created timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	revision integer NOT NULL DEFAULT 1, identity_keys text, value_mode text NOT NULL DEFAULT 'cached');
+CREATE TABLE datamap_revisions (id INTEGER PRIMARY KEY, datamap_id integer NOT NULL REFERENCES datamaps ON DELETE CASCADE,
+	revision integer NOT NULL, created timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP, UNIQUE (datamap_id, revision));
+CREATE TABLE datamap_lines (datamap_line_id INTEGER PRIMARY KEY, datamap_id integer REFERENCES datamaps ON DELETE CASCADE,
+	key text, sheet text, data_type text, cellref text, revision_id integer REFERENCES datamap_revisions ON DELETE CASCADE,
+	rules text, table_columns text, line_id integer, UNIQUE (revision_id, line_id));
+CREATE TABLE projects (id INTEGER PRIMARY KEY, name text NOT NULL UNIQUE, department text NOT NULL DEFAULT '',
+	delivery_body text NOT NULL DEFAULT '', gmpp_id text UNIQUE, created timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP);
+CREATE TABLE periods (id INTEGER PRIMARY KEY, name text NOT NULL UNIQUE, description text NOT NULL DEFAULT '',
+	datamap_id integer NOT NULL REFERENCES datamaps ON DELETE CASCADE, revision integer NOT NULL,
+	created timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP);
+CREATE TABLE period_projects (period_id integer NOT NULL REFERENCES periods ON DELETE CASCADE, position integer NOT NULL,
+	project text NOT NULL, PRIMARY KEY (period_id, position));
+CREATE TABLE returns (id INTEGER PRIMARY KEY, name text NOT NULL, datamap_id integer REFERENCES datamaps ON DELETE SET NULL,
+	revision integer, created timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP, period_id integer REFERENCES periods ON DELETE SET NULL,
+	project text, project_id integer REFERENCES projects ON DELETE SET NULL, project_match text NOT NULL DEFAULT 'unmatched',
+	project_candidates text, value_mode text NOT NULL DEFAULT 'cached');
+CREATE TABLE return_lines (return_line_id INTEGER PRIMARY KEY, return_id integer NOT NULL REFERENCES returns ON DELETE CASCADE,
+	datamap_line_id integer REFERENCES datamap_lines ON DELETE SET NULL, key text, sheet text, cellref text,
+	data_type text NOT NULL DEFAULT 'TEXT', value text, raw text, status text NOT NULL DEFAULT 'ok', messages text NOT NULL DEFAULT 'null');
+CREATE TABLE jobs (id INTEGER PRIMARY KEY, status text NOT NULL DEFAULT 'pending', datamap_id integer NOT NULL REFERENCES datamaps ON DELETE CASCADE,
+	revision integer NOT NULL, value_mode text NOT NULL DEFAULT 'cached', dir text NOT NULL,
+	created timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP, updated timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP);
+CREATE TABLE job_items (job_item_id INTEGER PRIMARY KEY, job_id integer NOT NULL REFERENCES jobs ON DELETE CASCADE,
+	file text NOT NULL, path text NOT NULL, status text NOT NULL DEFAULT 'pending',
+	return_id integer REFERENCES returns ON DELETE SET NULL, error text NOT NULL DEFAULT '');
+`
+
+// newTestApp returns an application whose models use a new SQLite database, created
+// with testSchema, which is removed when the test finishes.
+func newTestApp(t *testing.T) *application {
+	t.Helper()
+	db, err := sql.Open("sqlite3", sqliteDSN("file:"+filepath.Join(t.TempDir(), "test.db")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	if _, err := db.Exec(testSchema); err != nil {
+		t.Fatal(err)
+	}
+
+	app := &application{
+		logger:   slog.New(slog.NewTextHandler(io.Discard, nil)),
+		models:   NewModels(db),
+		jobQueue: make(chan int64, 100),
+	}
+	app.config.jobs.dir = t.TempDir()
+	return app
+}
+
+// insertTestDatamap saves a datamap holding dmls and returns its id.
+func insertTestDatamap(t *testing.T, app *application, dmls []DatamapLine) int64 {
+	t.Helper()
+	id, err := app.models.DatamapLines.Insert(Datamap{Name: "Test datamap", Description: "For testing"}, dmls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return int64(id)
+}
@@ -0,0 +1,179 @@
+// dbasik provides a service with which to convert spreadsheets containing
+// data to JSON for further processing.
+
+// Copyright (C) 2024 M R Lemon
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+// DiffSide identifies one of the two datamap revisions being compared.
+type DiffSide struct {
+	DatamapID int64  `json:"datamap_id"`
+	Name      string `json:"name"`
+	Revision  int    `json:"revision"`
+}
+
+// LineMove records a key whose Sheet or CellRef differs between two datamaps.
+type LineMove struct {
+	Key         string `json:"key"`
+	FromSheet   string `json:"from_sheet"`
+	FromCellRef string `json:"from_cellref"`
+	ToSheet     string `json:"to_sheet"`
+	ToCellRef   string `json:"to_cellref"`
+}
+
+// DataTypeChange records a key whose DataType differs between two datamaps.
+type DataTypeChange struct {
+	Key          string `json:"key"`
+	FromDataType string `json:"from_datatype"`
+	ToDataType   string `json:"to_datatype"`
+}
+
+// DatamapDiff is the structural difference between two datamaps, with lines matched
+// on their Key. A key can appear in both Moved and DataTypeChanged.
+type DatamapDiff struct {
+	From            DiffSide         `json:"from"`
+	To              DiffSide         `json:"to"`
+	Added           []DatamapLine    `json:"added"`
+	Removed         []DatamapLine    `json:"removed"`
+	Moved           []LineMove       `json:"moved"`
+	DataTypeChanged []DataTypeChange `json:"datatype_changed"`
+}
+
+// Empty reports whether the two datamaps have identical lines.
+func (d DatamapDiff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Moved) == 0 && len(d.DataTypeChanged) == 0
+}
+
+// DiffDatamaps compares the lines of from and to by key. Removed lines are listed in
+// the order they appear in from; everything else in the order it appears in to. If a
+// datamap contains the same key more than once, only the first line is compared.
+func DiffDatamaps(from, to *Datamap) DatamapDiff {
+	d := DatamapDiff{
+		From:            DiffSide{DatamapID: from.ID, Name: from.Name, Revision: from.Revision},
+		To:              DiffSide{DatamapID: to.ID, Name: to.Name, Revision: to.Revision},
+		Added:           []DatamapLine{},
+		Removed:         []DatamapLine{},
+		Moved:           []LineMove{},
+		DataTypeChanged: []DataTypeChange{},
+	}
+
+	fromLines := linesByKey(from.DMLs)
+	toLines := linesByKey(to.DMLs)
+
+	seen := map[string]bool{}
+	for _, dml := range from.DMLs {
+		if seen[dml.Key] {
+			continue // a duplicate key
+		}
+		seen[dml.Key] = true
+		if _, ok := toLines[dml.Key]; !ok {
+			d.Removed = append(d.Removed, dml)
+		}
+	}
+
+	seen = map[string]bool{}
+	for _, dml := range to.DMLs {
+		if seen[dml.Key] {
+			continue // a duplicate key
+		}
+		seen[dml.Key] = true
+		old, ok := fromLines[dml.Key]
+		if !ok {
+			d.Added = append(d.Added, dml)
+			continue
+		}
+		if old.Sheet != dml.Sheet || old.CellRef != dml.CellRef {
+			d.Moved = append(d.Moved, LineMove{
+				Key:         dml.Key,
+				FromSheet:   old.Sheet,
+				FromCellRef: old.CellRef,
+				ToSheet:     dml.Sheet,
+				ToCellRef:   dml.CellRef,
+			})
+		}
+		if old.DataType != dml.DataType {
+			d.DataTypeChanged = append(d.DataTypeChanged, DataTypeChange{
+				Key:          dml.Key,
+				FromDataType: old.DataType,
+				ToDataType:   dml.DataType,
+			})
+		}
+	}
+
+	return d
+}
+
+// linesByKey indexes dmls on their Key, keeping the first line for each key.
+func linesByKey(dmls []DatamapLine) map[string]DatamapLine {
+	out := make(map[string]DatamapLine, len(dmls))
+	for _, dml := range dmls {
+		if _, ok := out[dml.Key]; !ok {
+			out[dml.Key] = dml
+		}
+	}
+	return out
+}
+
+// WriteText writes d to w as a human-readable report.
+func (d DatamapDiff) WriteText(w io.Writer) error {
+	var err error
+	printf := func(format string, a ...any) {
+		if err == nil {
+			_, err = fmt.Fprintf(w, format, a...)
+		}
+	}
+
+	printf("Comparing %q (datamap %d, revision %d) with %q (datamap %d, revision %d)\n",
+		d.From.Name, d.From.DatamapID, d.From.Revision, d.To.Name, d.To.DatamapID, d.To.Revision)
+
+	if d.Empty() {
+		printf("\nNo differences.\n")
+		return err
+	}
+
+	if len(d.Added) > 0 {
+		printf("\nAdded keys (%d):\n", len(d.Added))
+		for _, dml := range d.Added {
+			printf("  + %s  %s!%s  %s\n", dml.Key, dml.Sheet, dml.CellRef, dml.DataType)
+		}
+	}
+	if len(d.Removed) > 0 {
+		printf("\nRemoved keys (%d):\n", len(d.Removed))
+		for _, dml := range d.Removed {
+			printf("  - %s  %s!%s  %s\n", dml.Key, dml.Sheet, dml.CellRef, dml.DataType)
+		}
+	}
+	if len(d.Moved) > 0 {
+		printf("\nMoved keys (%d):\n", len(d.Moved))
+		for _, mv := range d.Moved {
+			printf("  ~ %s  %s!%s -> %s!%s\n", mv.Key, mv.FromSheet, mv.FromCellRef, mv.ToSheet, mv.ToCellRef)
+		}
+	}
+	if len(d.DataTypeChanged) > 0 {
+		printf("\nData type changes (%d):\n", len(d.DataTypeChanged))
+		for _, tc := range d.DataTypeChanged {
+			printf("  ~ %s  %s -> %s\n", tc.Key, tc.FromDataType, tc.ToDataType)
+		}
+	}
+
+	printf("\n%d added, %d removed, %d moved, %d data type changes\n",
+		len(d.Added), len(d.Removed), len(d.Moved), len(d.DataTypeChanged))
+	return err
+}
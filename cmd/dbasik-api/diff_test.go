@@ -0,0 +1,74 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDiffDatamaps(t *testing.T) {
+	from := &Datamap{
+		ID:       1,
+		Name:     "Q1",
+		Revision: 1,
+		DMLs: []DatamapLine{
+			{Key: "Project Name", Sheet: "Introduction", DataType: "TEXT", CellRef: "C11"},
+			{Key: "Total Cost", Sheet: "9 - Costs", DataType: "TEXT", CellRef: "D10"},
+			{Key: "Old Milestone", Sheet: "6a - Milestones - Approvals", DataType: "DATE", CellRef: "C20"},
+			{Key: "Start Date", Sheet: "Introduction", DataType: "TEXT", CellRef: "C15"},
+		},
+	}
+	to := &Datamap{
+		ID:       1,
+		Name:     "Q1",
+		Revision: 2,
+		DMLs: []DatamapLine{
+			{Key: "Project Name", Sheet: "Introduction", DataType: "TEXT", CellRef: "C11"},
+			{Key: "Total Cost", Sheet: "9 - Costs", DataType: "NUMBER", CellRef: "E10"},
+			{Key: "Start Date", Sheet: "Introduction", DataType: "DATE", CellRef: "C15"},
+			{Key: "New Milestone", Sheet: "6a - Milestones - Approvals", DataType: "DATE", CellRef: "C21"},
+		},
+	}
+
+	d := DiffDatamaps(from, to)
+
+	if len(d.Added) != 1 || d.Added[0].Key != "New Milestone" {
+		t.Errorf("DiffDatamaps() Added = %v, expected New Milestone", d.Added)
+	}
+	if len(d.Removed) != 1 || d.Removed[0].Key != "Old Milestone" {
+		t.Errorf("DiffDatamaps() Removed = %v, expected Old Milestone", d.Removed)
+	}
+	expectedMove := LineMove{Key: "Total Cost", FromSheet: "9 - Costs", FromCellRef: "D10", ToSheet: "9 - Costs", ToCellRef: "E10"}
+	if len(d.Moved) != 1 || d.Moved[0] != expectedMove {
+		t.Errorf("DiffDatamaps() Moved = %v, expected %v", d.Moved, expectedMove)
+	}
+	if len(d.DataTypeChanged) != 2 {
+		t.Fatalf("DiffDatamaps() DataTypeChanged = %v, expected 2 changes", d.DataTypeChanged)
+	}
+	if d.DataTypeChanged[0].Key != "Total Cost" || d.DataTypeChanged[1].Key != "Start Date" {
+		t.Errorf("DiffDatamaps() DataTypeChanged in wrong order: %v", d.DataTypeChanged)
+	}
+
+	var sb strings.Builder
+	if err := d.WriteText(&sb); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"+ New Milestone",
+		"- Old Milestone",
+		"~ Total Cost  9 - Costs!D10 -> 9 - Costs!E10",
+		"~ Start Date  TEXT -> DATE",
+		"1 added, 1 removed, 1 moved, 2 data type changes",
+	} {
+		if !strings.Contains(sb.String(), want) {
+			t.Errorf("WriteText() output does not contain %q:\n%s", want, sb.String())
+		}
+	}
+}
+
+func TestDiffDatamapsIdentical(t *testing.T) {
+	dm := &Datamap{DMLs: []DatamapLine{{Key: "Project Name", Sheet: "Introduction", DataType: "TEXT", CellRef: "C11"}}}
+	d := DiffDatamaps(dm, dm)
+	if !d.Empty() {
+		t.Errorf("DiffDatamaps() of a datamap with itself was not empty: %+v", d)
+	}
+}
@@ -0,0 +1,320 @@
+// dbasik provides a service with which to convert spreadsheets containing
+// data to JSON for further processing.
+
+// Copyright (C) 2024 M R Lemon
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+package main
+
+import (
+	"archive/zip"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/tealeg/xlsx/v3"
+)
+
+// DraftOptions chooses how DraftDatamap finds the input cells of a template.
+type DraftOptions struct {
+	// Fill is the colour of the template's input cells as six hex digits, such as
+	// "FFFF99". Without it, input cells are only found by their labels and notes.
+	Fill string
+}
+
+// rxDraftFill matches the colour given as DraftOptions.Fill, with or without a leading
+// # and with or without the alpha of an ARGB colour.
+var rxDraftFill = regexp.MustCompile(`^#?([0-9A-Fa-f]{2})?([0-9A-Fa-f]{6})$`)
+
+// normaliseFill returns the six upper-case hex digits of the colour fill, or "" if it
+// isn't a colour.
+func normaliseFill(fill string) string {
+	m := rxDraftFill.FindStringSubmatch(strings.TrimSpace(fill))
+	if m == nil {
+		return ""
+	}
+	return strings.ToUpper(m[2])
+}
+
+// rxCommentKey matches the line of a note which gives the key of its cell, such as
+// "Key: Project Name".
+var rxCommentKey = regexp.MustCompile(`(?im)^\s*key\s*:[ \t]*(\S.*?)\s*$`)
+
+// draftCell is an input cell found by DraftDatamap, with the key it is given.
+type draftCell struct {
+	col, row int
+	key      string
+}
+
+// DraftDatamap scans the blank template workbook src for the cells a return fills in
+// and makes a datamap with a line for each, for someone to check and edit rather than
+// write from scratch. A cell is taken as an input cell if, in order of precedence:
+//
+//   - it has a note with a line such as "Key: Project Name", which gives its key;
+//   - it is empty and unlocked and has a label, a cell of text, to its left, which
+//     gives its key;
+//   - it is empty and filled with the colour opts.Fill, in which case the nearest text
+//     to its left in the row gives its key, or its address if there isn't any.
+//
+// The data type of each line is guessed from the cell's data validation or number
+// format, and is otherwise TEXT; a list validation whose values aren't a yes or no
+// becomes a rule allowing only those values. Keys which have been used already are
+// made unique by adding the cell's address. Lines are in the order of the sheets, then
+// by row and column.
+func DraftDatamap(src *zip.Reader, opts DraftOptions) (*Datamap, error) {
+	book, err := readWorkbookParts(src)
+	if err != nil {
+		return nil, err
+	}
+	tr := &templateReader{src: src, book: book, sheets: make(map[string]*templateSheet)}
+	if err := tr.readStyles(); err != nil {
+		return nil, err
+	}
+	fill := normaliseFill(opts.Fill)
+
+	dm := &Datamap{}
+	keys := make(map[string]bool)
+	for _, name := range book.sheetNames {
+		sh, err := tr.sheet(name)
+		if err != nil {
+			return nil, err
+		}
+		for _, dc := range tr.draftCells(sh, fill) {
+			dml, err := tr.draftLine(sh, dc)
+			if err != nil {
+				return nil, err
+			}
+			if keys[dml.Key] {
+				dml.Key = uniqueKey(dc.key, fmt.Sprintf(" (%s!%s)", sh.name, dml.CellRef), keys)
+			}
+			keys[dml.Key] = true
+			dm.DMLs = append(dm.DMLs, dml)
+		}
+	}
+	return dm, nil
+}
+
+// draftCells finds the input cells of sh, sorted by row and column.
+func (tr *templateReader) draftCells(sh *templateSheet, fill string) []draftCell {
+	found := make(map[[2]int]string)
+
+	for coord, comment := range sh.comments {
+		if m := rxCommentKey.FindStringSubmatch(comment); m != nil {
+			found[coord] = m[1]
+		}
+	}
+
+	for coord, cell := range sh.cells {
+		label := draftLabel(cell)
+		if label == "" {
+			continue
+		}
+		input := [2]int{coord[0] + 1, coord[1]}
+		if _, ok := found[input]; ok || input[0] >= maxSheetCols {
+			continue
+		}
+		if next, style := sh.cell(input[0], input[1]); next.value == "" && !next.formula && !tr.isLocked(style) {
+			found[input] = label
+		}
+	}
+
+	if fill != "" {
+		for coord, cell := range sh.cells {
+			if _, ok := found[coord]; ok || cell.value != "" || cell.formula || tr.style(cell.style).fill != fill {
+				continue
+			}
+			found[coord] = sh.labelLeftOf(coord[0], coord[1])
+		}
+	}
+
+	cells := make([]draftCell, 0, len(found))
+	for coord, key := range found {
+		cells = append(cells, draftCell{col: coord[0], row: coord[1], key: key})
+	}
+	sort.Slice(cells, func(i, j int) bool {
+		if cells[i].row != cells[j].row {
+			return cells[i].row < cells[j].row
+		}
+		return cells[i].col < cells[j].col
+	})
+	return cells
+}
+
+// labelLeftOf returns the nearest label to the left of the cell at col and row, or
+// the cell's address if there is none.
+func (sh *templateSheet) labelLeftOf(col, row int) string {
+	for c := col - 1; c >= 0; c-- {
+		if label := draftLabel(sh.cells[[2]int{c, row}]); label != "" {
+			return label
+		}
+	}
+	return sh.name + "!" + xlsx.GetCellIDStringFromCoords(col, row)
+}
+
+// draftLabel returns the text of cell as a key, with its spacing tidied and without a
+// trailing colon, or "" if the cell isn't a label.
+func draftLabel(cell templateCell) string {
+	if !cell.text || cell.formula {
+		return ""
+	}
+	return truncateKey(strings.TrimSpace(strings.TrimRight(strings.Join(strings.Fields(cell.value), " "), ":")), maxKeyLength)
+}
+
+// truncateKey shortens key to at most n bytes, without splitting a character.
+func truncateKey(key string, n int) string {
+	if len(key) <= n {
+		return key
+	}
+	key = key[:max(n, 0)]
+	for !utf8.ValidString(key) {
+		key = key[:len(key)-1]
+	}
+	return key
+}
+
+// uniqueKey makes key unique among used by adding suffix to it, and then a number if
+// that isn't enough. key is shortened first to leave room for what is added, so the
+// result is never longer than maxKeyLength.
+func uniqueKey(key, suffix string, used map[string]bool) string {
+	for n := 1; ; n++ {
+		s := suffix
+		if n > 1 {
+			s = fmt.Sprintf("%s %d", suffix, n)
+		}
+		if candidate := truncateKey(key, maxKeyLength-len(s)) + s; !used[candidate] {
+			return candidate
+		}
+	}
+}
+
+// draftLine makes the datamap line for the input cell dc of sh.
+func (tr *templateReader) draftLine(sh *templateSheet, dc draftCell) (DatamapLine, error) {
+	dml := DatamapLine{
+		Key:      dc.key,
+		Sheet:    sh.name,
+		DataType: TypeText,
+		CellRef:  xlsx.GetCellIDStringFromCoords(dc.col, dc.row),
+	}
+
+	for _, dv := range sh.validationsFor(dc.col, dc.row) {
+		switch dv.typ {
+		case "whole":
+			dml.DataType = TypeInteger
+		case "decimal":
+			dml.DataType = TypeNumber
+		case "date":
+			dml.DataType = TypeDate
+		case "time":
+			dml.DataType = TypeDateTime
+		case "list":
+			items, ok, err := tr.listItems(sh, dv.formula1)
+			if err != nil {
+				return DatamapLine{}, err
+			}
+			if !ok || len(items) == 0 {
+				continue
+			}
+			if isYesNo(items) {
+				dml.DataType = TypeBool
+			} else {
+				dml.Rules = &Rules{Allowed: items}
+			}
+		default:
+			continue
+		}
+		return dml, nil
+	}
+
+	_, style := sh.cell(dc.col, dc.row)
+	dml.DataType = numFmtDataType(tr.style(style).numFmt)
+	return dml, nil
+}
+
+// isYesNo reports whether items are the two values of a BOOL, such as Yes and No.
+func isYesNo(items []string) bool {
+	if len(items) != 2 {
+		return false
+	}
+	a, errA := parseBool(items[0])
+	b, errB := parseBool(items[1])
+	return errA == nil && errB == nil && a != b
+}
+
+// numFmtDataType guesses the data type of a cell from the code of its number format.
+func numFmtDataType(code string) string {
+	// Leave out literal text, which is quoted or escaped, other than currency symbols,
+	// and colours and locales, which are in brackets
+	var sb strings.Builder
+	for i := 0; i < len(code); i++ {
+		switch code[i] {
+		case '"':
+			if j := strings.IndexByte(code[i+1:], '"'); j >= 0 {
+				sb.WriteString(currencySymbols(code[i+1 : i+1+j]))
+				i += j + 1
+			}
+		case '\\', '_', '*':
+			if i+1 < len(code) {
+				_, size := utf8.DecodeRuneInString(code[i+1:])
+				if code[i] == '\\' {
+					sb.WriteString(currencySymbols(code[i+1 : i+1+size]))
+				}
+				i += size
+			}
+		case '[':
+			// A locale such as [$£-809] gives a currency symbol
+			if j := strings.IndexByte(code[i:], ']'); j >= 0 {
+				if strings.HasPrefix(code[i:], "[$") {
+					symbol, _, _ := strings.Cut(code[i+2:i+j], "-")
+					sb.WriteString(symbol)
+				}
+				i += j
+			}
+		default:
+			sb.WriteByte(code[i])
+		}
+	}
+	format := strings.ToLower(sb.String())
+
+	switch {
+	case format == "" || format == "general" || format == "@":
+		return TypeText
+	case strings.Contains(format, "%"):
+		return TypePercentage
+	case currencySymbols(format) != "":
+		return TypeCurrency
+	case strings.ContainsAny(format, "dy"):
+		if strings.ContainsAny(format, "hs") {
+			return TypeDateTime
+		}
+		return TypeDate
+	case strings.ContainsAny(format, "hs"):
+		// A time of day on its own has no data type of its own
+		return TypeText
+	case strings.ContainsAny(format, "0#?"):
+		return TypeNumber
+	}
+	return TypeText
+}
+
+// currencySymbols returns the currency symbols in s.
+func currencySymbols(s string) string {
+	return strings.Map(func(r rune) rune {
+		if strings.ContainsRune("£$€¥", r) {
+			return r
+		}
+		return -1
+	}, s)
+}
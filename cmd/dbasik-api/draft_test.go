@@ -0,0 +1,161 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestDraftDatamap(t *testing.T) {
+	tests := []struct {
+		name string
+		fill string
+		want []DatamapLine
+	}{
+		{
+			name: "labels and notes",
+			want: []DatamapLine{
+				{Key: "Project Name", Sheet: "Introduction", DataType: TypeText, CellRef: "B3"},
+				{Key: "Reference Number", Sheet: "Introduction", DataType: TypeText, CellRef: "D3"},
+				{Key: "Start Date", Sheet: "Introduction", DataType: TypeDate, CellRef: "B4"},
+				{Key: "Budget", Sheet: "Introduction", DataType: TypeCurrency, CellRef: "B5"},
+				{Key: "Complete?", Sheet: "Introduction", DataType: TypeBool, CellRef: "B6"},
+				{Key: "Status", Sheet: "Introduction", DataType: TypeText, CellRef: "B7", Rules: &Rules{Allowed: []string{"Green", "Amber", "Red"}}},
+				{Key: "Headcount", Sheet: "Introduction", DataType: TypeInteger, CellRef: "B8"},
+				{Key: "Budget (Finance!B1)", Sheet: "Finance", DataType: TypeText, CellRef: "B1"},
+			},
+		},
+		{
+			name: "fill colour",
+			fill: "#ffff99",
+			want: []DatamapLine{
+				{Key: "Project Name", Sheet: "Introduction", DataType: TypeText, CellRef: "B3"},
+				{Key: "Reference Number", Sheet: "Introduction", DataType: TypeText, CellRef: "D3"},
+				{Key: "Start Date", Sheet: "Introduction", DataType: TypeDate, CellRef: "B4"},
+				{Key: "Budget", Sheet: "Introduction", DataType: TypeCurrency, CellRef: "B5"},
+				{Key: "Complete?", Sheet: "Introduction", DataType: TypeBool, CellRef: "B6"},
+				{Key: "Status", Sheet: "Introduction", DataType: TypeText, CellRef: "B7", Rules: &Rules{Allowed: []string{"Green", "Amber", "Red"}}},
+				{Key: "Headcount", Sheet: "Introduction", DataType: TypeInteger, CellRef: "B8"},
+				{Key: "Completion", Sheet: "Introduction", DataType: TypePercentage, CellRef: "C12"},
+				{Key: "Introduction!B14", Sheet: "Introduction", DataType: TypePercentage, CellRef: "B14"},
+				{Key: "Budget (Finance!B1)", Sheet: "Finance", DataType: TypeText, CellRef: "B1"},
+			},
+		},
+	}
+
+	template, err := os.ReadFile("../../testdata/draft_template.xlsx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dm, err := DraftDatamap(openZip(t, template), DraftOptions{Fill: tt.fill})
+			if err != nil {
+				t.Fatalf("DraftDatamap() error = %v", err)
+			}
+			if !reflect.DeepEqual(dm.DMLs, tt.want) {
+				t.Errorf("DraftDatamap() =\n%+v\nwant\n%+v", dm.DMLs, tt.want)
+			}
+
+			// The draft is a valid datamap which fits the template it came from
+			dm.Name = "Draft"
+			v := NewValidator()
+			ValidateDatamap(v, *dm)
+			if !v.Valid() {
+				t.Errorf("draft is not valid: %v", v.Errors)
+			}
+			check, err := CheckTemplate(openZip(t, template), dm)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !check.OK {
+				t.Errorf("CheckTemplate() issues = %+v", check.Issues)
+			}
+		})
+	}
+}
+
+func TestUniqueKey(t *testing.T) {
+	long := strings.Repeat("é", maxKeyLength)
+	tests := []struct {
+		name string
+		key  string
+		used []string
+		want string
+	}{
+		{"address added", "Budget", []string{"Budget"}, "Budget (Finance!B1)"},
+		{"address already used", "Budget", []string{"Budget", "Budget (Finance!B1)"}, "Budget (Finance!B1) 2"},
+		{"numbers already used", "Budget", []string{"Budget", "Budget (Finance!B1)", "Budget (Finance!B1) 2"}, "Budget (Finance!B1) 3"},
+		{"long key shortened", long, []string{long}, strings.Repeat("é", (maxKeyLength-len(" (Finance!B1)"))/2) + " (Finance!B1)"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			used := make(map[string]bool)
+			for _, key := range tt.used {
+				used[key] = true
+			}
+			got := uniqueKey(tt.key, " (Finance!B1)", used)
+			if got != tt.want {
+				t.Errorf("uniqueKey() = %q, want %q", got, tt.want)
+			}
+			if len(got) > maxKeyLength || !utf8.ValidString(got) {
+				t.Errorf("uniqueKey() = %q is not a valid key", got)
+			}
+		})
+	}
+}
+
+func TestNumFmtDataType(t *testing.T) {
+	tests := []struct {
+		code string
+		want string
+	}{
+		{"", TypeText},
+		{"General", TypeText},
+		{"@", TypeText},
+		{"0", TypeNumber},
+		{"#,##0.00", TypeNumber},
+		{"0.00E+00", TypeNumber},
+		{"0%", TypePercentage},
+		{`"£"#,##0.00`, TypeCurrency},
+		{`\£#,##0`, TypeCurrency},
+		{"[$£-809]#,##0.00;[Red]-[$£-809]#,##0.00", TypeCurrency},
+		{"[$-409]d-mmm-yy", TypeDate},
+		{"dd/mm/yyyy", TypeDate},
+		{"dd/mm/yyyy hh:mm", TypeDateTime},
+		{"h:mm", TypeText},
+		{`0 "days"`, TypeNumber},
+		{`"Year "0`, TypeNumber},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.code, func(t *testing.T) {
+			if got := numFmtDataType(tt.code); got != tt.want {
+				t.Errorf("numFmtDataType(%q) = %s, want %s", tt.code, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNormaliseFill(t *testing.T) {
+	tests := []struct {
+		fill string
+		want string
+	}{
+		{"FFFF99", "FFFF99"},
+		{"#ffff99", "FFFF99"},
+		{"FFFFFF99", "FFFF99"},
+		{"yellow", ""},
+		{"#FFF", ""},
+		{"", ""},
+	}
+
+	for _, tt := range tests {
+		if got := normaliseFill(tt.fill); got != tt.want {
+			t.Errorf("normaliseFill(%q) = %q, want %q", tt.fill, got, tt.want)
+		}
+	}
+}
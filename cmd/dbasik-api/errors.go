@@ -18,8 +18,10 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
+	"strings"
 )
 
 // The logError() method is a generic helper for logging an error message.
@@ -57,6 +59,55 @@ func (app *application) notFoundResponse(w http.ResponseWriter, r *http.Request)
 	app.errorResponse(w, r, http.StatusNotFound, message)
 }
 
+// The badRequestResponse() method will be used to send a 400 Bad Request status code
+// and the error message to the client.
+func (app *application) badRequestResponse(w http.ResponseWriter, r *http.Request, err error) {
+	app.errorResponse(w, r, http.StatusBadRequest, err.Error())
+}
+
+// The failedValidationResponse() method will be used to send a 422 Unprocessable Entity
+// status code and the map of validation errors to the client.
+func (app *application) failedValidationResponse(w http.ResponseWriter, r *http.Request, errors map[string]string) {
+	app.errorResponse(w, r, http.StatusUnprocessableEntity, errors)
+}
+
+// The editConflictResponse() method will be used to send a 409 Conflict status code
+// when a datamap has been revised by another request while we were editing it.
+func (app *application) editConflictResponse(w http.ResponseWriter, r *http.Request) {
+	message := "unable to update the record due to an edit conflict, please try again"
+	app.errorResponse(w, r, http.StatusConflict, message)
+}
+
+// The unsupportedMediaTypeResponse() method will be used to send a 415 Unsupported
+// Media Type status code when the body of a request is in a format we can't read.
+func (app *application) unsupportedMediaTypeResponse(w http.ResponseWriter, r *http.Request, err error) {
+	app.errorResponse(w, r, http.StatusUnsupportedMediaType, err.Error())
+}
+
+// The datamapUploadErrorResponse() method will be used to send the reason an uploaded
+// datamap couldn't be read: a 415 Unsupported Media Type status code if it wasn't in
+// one of our formats, a 422 Unprocessable Entity status code with the list of problems
+// found with its lines, or a 400 Bad Request status code for anything else. The lines
+// of an edited datamap are reported in the same way.
+func (app *application) datamapUploadErrorResponse(w http.ResponseWriter, r *http.Request, err error) {
+	var lineErrors DatamapErrors
+	switch {
+	case errors.Is(err, ErrUnsupportedDatamapFormat):
+		app.unsupportedMediaTypeResponse(w, r, err)
+	case errors.As(err, &lineErrors):
+		app.errorResponse(w, r, http.StatusUnprocessableEntity, lineErrors)
+	default:
+		app.badRequestResponse(w, r, err)
+	}
+}
+
+// The notAcceptableResponse() method will be used to send a 406 Not Acceptable status
+// code when we can't send a resource in any of the formats the client accepts.
+func (app *application) notAcceptableResponse(w http.ResponseWriter, r *http.Request, accepted []string) {
+	message := fmt.Sprintf("the resource can only be sent as %s", strings.Join(accepted, ", "))
+	app.errorResponse(w, r, http.StatusNotAcceptable, message)
+}
+
 func (app *application) methodNotAllowed(w http.ResponseWriter, r *http.Request) {
 	message := fmt.Sprintf("the %s method is not supported for this resource", r.Method)
 	app.errorResponse(w, r, http.StatusMethodNotAllowed, message)
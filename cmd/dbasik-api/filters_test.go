@@ -0,0 +1,82 @@
+package main
+
+import "testing"
+
+func TestCalculateMetadata(t *testing.T) {
+	tests := []struct {
+		name         string
+		totalRecords int
+		page         int
+		pageSize     int
+		want         Metadata
+	}{
+		{
+			name: "No records",
+			page: 1, pageSize: 20,
+			want: Metadata{},
+		},
+		{
+			name:         "Partial last page",
+			totalRecords: 41, page: 2, pageSize: 20,
+			want: Metadata{CurrentPage: 2, PageSize: 20, FirstPage: 1, LastPage: 3, TotalRecords: 41},
+		},
+		{
+			name:         "Exact last page",
+			totalRecords: 40, page: 1, pageSize: 20,
+			want: Metadata{CurrentPage: 1, PageSize: 20, FirstPage: 1, LastPage: 2, TotalRecords: 40},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := calculateMetadata(tt.totalRecords, tt.page, tt.pageSize)
+			if got != tt.want {
+				t.Errorf("calculateMetadata() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateFilters(t *testing.T) {
+	safelist := []string{"name", "-name"}
+
+	v := NewValidator()
+	ValidateFilters(v, Filters{Page: 1, PageSize: 20, Sort: "-name", SortSafelist: safelist})
+	if !v.Valid() {
+		t.Errorf("ValidateFilters() returned errors for valid filters: %v", v.Errors)
+	}
+
+	v = NewValidator()
+	ValidateFilters(v, Filters{Page: 0, PageSize: 101, Sort: "bobbins", SortSafelist: safelist})
+	for _, key := range []string{"page", "page_size", "sort"} {
+		if _, ok := v.Errors[key]; !ok {
+			t.Errorf("ValidateFilters() did not report an error for %q", key)
+		}
+	}
+}
+
+func TestFiltersSort(t *testing.T) {
+	f := Filters{Sort: "-created", SortSafelist: []string{"created", "-created"}}
+	if got := f.sortColumn(); got != "created" {
+		t.Errorf("sortColumn() = %q, want %q", got, "created")
+	}
+	if got := f.sortDirection(); got != "DESC" {
+		t.Errorf("sortDirection() = %q, want %q", got, "DESC")
+	}
+}
+
+func TestEscapeLike(t *testing.T) {
+	tests := map[string]string{
+		"":            "",
+		"bridge":      "bridge",
+		"100%":        `100\%`,
+		"road_works":  `road\_works`,
+		`C:\returns`:  `C:\\returns`,
+		`50%_off\now`: `50\%\_off\\now`,
+	}
+	for search, want := range tests {
+		if got := escapeLike(search); got != want {
+			t.Errorf("escapeLike(%q) = %q, want %q", search, got, want)
+		}
+	}
+}
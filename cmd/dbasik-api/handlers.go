@@ -1,14 +1,18 @@
 package main
 
 import (
-	"encoding/csv"
+	"archive/zip"
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
 	"path"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -16,7 +20,8 @@ func (app *application) createReturnHandler(w http.ResponseWriter, r *http.Reque
 	// Parse the multipart form
 	err := r.ParseMultipartForm(10 << 20) // 10Mb max
 	if err != nil {
-		app.serverErrorResponse(w, r, err)
+		app.badRequestResponse(w, r, err)
+		return
 	}
 
 	// Get form values
@@ -32,6 +37,17 @@ func (app *application) createReturnHandler(w http.ResponseWriter, r *http.Reque
 	}
 	defer returnFile.Close()
 
+	// Check what we've been sent by its content, as the filename can't be relied on
+	format, err := DetectSpreadsheetFormat(returnFile, header.Size)
+	if err != nil {
+		msg := err.Error()
+		if errors.Is(err, ErrNotWorkbook) {
+			msg = "must be an Excel workbook, an OpenDocument spreadsheet or a zip of CSV files"
+		}
+		app.failedValidationResponse(w, r, map[string]string{"returnfile": msg})
+		return
+	}
+
 	tmpDir, err := os.MkdirTemp("", "dbasik-returns")
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -39,7 +55,13 @@ func (app *application) createReturnHandler(w http.ResponseWriter, r *http.Reque
 	}
 	defer os.RemoveAll(tmpDir) // clean the tempdir up
 
-	dst, err := os.Create(path.Join(tmpDir, header.Filename))
+	returnName := filepath.Base(header.Filename)
+	if returnName == "." || returnName == string(filepath.Separator) {
+		returnName = "return" + format.Ext
+	}
+	returnPath := filepath.Join(tmpDir, returnName)
+
+	dst, err := os.Create(returnPath)
 	if err != nil {
 		http.Error(w, "Cannot create new file object from uplaoded file.", http.StatusInternalServerError)
 		return
@@ -52,203 +74,2398 @@ func (app *application) createReturnHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	// Get the uploaded csv file and name
-	file, _, err := r.FormFile("file")
-	if err != nil {
-		http.Error(w, "Missing file", http.StatusBadRequest)
-		return
-	}
-	defer file.Close()
-
-	// parse the csv
-	reader := csv.NewReader(file)
-	var dmls []DatamapLine
+	// Parse against a datamap which is already stored in the database if we have been
+	// given its id, otherwise against one uploaded alongside the return as CSV.
+	var dm *Datamap
+	if r.FormValue("datamap_id") != "" {
+		v := NewValidator()
+		datamapID := app.readInt(r.Form, "datamap_id", 0, v)
+		revision := app.readInt(r.Form, "revision", 0, v)
+		v.Check(datamapID > 0, "datamap_id", "must be a positive integer")
+		v.Check(revision >= 0, "revision", "must be a positive integer")
+		if !v.Valid() {
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+		}
 
-	for {
-		line, err := reader.Read()
+		dm, err = app.models.Datamaps.GetRevision(int64(datamapID), revision)
 		if err != nil {
-			if err.Error() == "EOF" {
-				break // end of file
+			switch {
+			case errors.Is(err, ErrRecordNotFound):
+				app.notFoundResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
 			}
-			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		if len(line) != 4 {
-			http.Error(w, "Invalid CSV Format", http.StatusBadRequest)
+	} else {
+		// Get the uploaded datamap file and name
+		file, header, err := r.FormFile("file")
+		if err != nil {
+			http.Error(w, "Missing file", http.StatusBadRequest)
+			return
+		}
+		defer file.Close()
+
+		// parse the datamap, in whichever format it was sent
+		uploaded, err := readDatamapFile(file, header)
+		if err != nil {
+			app.datamapUploadErrorResponse(w, r, err)
+			return
+		}
+
+		v := NewValidator()
+		if ValidateDatamapLines(v, uploaded.DMLs); !v.Valid() {
+			app.failedValidationResponse(w, r, v.Errors)
 			return
 		}
+		dm = &Datamap{Name: dmName, Description: dmDesc, Created: time.Now(), DMLs: uploaded.DMLs}
+	}
 
-		dmls = append(dmls, DatamapLine{
-			Key:      line[0],
-			Sheet:    line[1],
-			DataType: line[2],
-			CellRef:  line[3],
-		})
+	// Formulas are read as the datamap says unless the request asks otherwise
+	v := NewValidator()
+	valueMode := app.readValueMode(r.Form, dm, v)
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
 	}
-	dm := Datamap{Name: dmName, Description: dmDesc, Created: time.Now(), DMLs: dmls}
 
-	// we can pass the file path to ParseXLSX.
-	ret, err := ParseXLSX(path.Join(tmpDir, header.Filename), &dm)
+	// we can pass the file path to ParseXLSXMode.
+	ret, err := ParseXLSXMode(returnPath, dm, valueMode)
 	if err != nil {
+		if errors.Is(err, ErrDefinedName) {
+			app.failedValidationResponse(w, r, map[string]string{"returnfile": err.Error()})
+			return
+		}
 		app.serverErrorResponse(w, r, err)
+		return
 	}
 
-	err = app.writeJSON(w, http.StatusOK, envelope{"return": ret}, nil)
+	err = app.matchProject(ret, dm)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// save the return and its values to the database
+	err = app.models.Returns.Insert(ret)
 	if err != nil {
-		app.logger.Debug("writing out csv", "err", err)
 		app.serverErrorResponse(w, r, err)
+		return
 	}
 
-	// fmt.Fprintf(w, "file successfully uploaded\n")
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/returns/%d", ret.ID))
 
+	err = app.writeJSON(w, http.StatusCreated, envelope{"return": ret}, headers)
+	if err != nil {
+		app.logger.Debug("writing out csv", "err", err)
+		app.serverErrorResponse(w, r, err)
+	}
 }
 
+// createDatamapHandler reads an uploaded datamap, in any of the DatamapFormats, and
+// sends it back as JSON once its lines have been validated, without saving it.
 func (app *application) createDatamapHandler(w http.ResponseWriter, r *http.Request) {
-	// Parse the multipart form
-	err := r.ParseMultipartForm(10 << 20) // 10Mb max
+	dm, err := app.readDatamapUpload(w, r)
 	if err != nil {
-		app.serverErrorResponse(w, r, err)
+		app.datamapUploadErrorResponse(w, r, err)
+		return
 	}
+	dm.Created = time.Now()
 
-	// Get form values
-	dmName := r.FormValue("name")
-	app.logger.Info("obtain value from form", "name", dmName)
-	dmDesc := r.FormValue("description")
-	app.logger.Info("obtain value from form", "description", dmDesc)
+	v := NewValidator()
+	if ValidateDatamapLines(v, dm.DMLs); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
 
-	// Get the uploaded file and name
-	file, _, err := r.FormFile("file")
+	err = app.writeJSON(w, http.StatusOK, envelope{"datamap": dm}, nil)
 	if err != nil {
-		http.Error(w, "Missing file", http.StatusBadRequest)
-		return
+		app.logger.Debug("writing out csv", "err", err)
+		app.serverErrorResponse(w, r, err)
 	}
-	defer file.Close()
+}
 
-	// parse the csv
-	reader := csv.NewReader(file)
-	var dmls []DatamapLine
-	var dm Datamap
+// saveDatamapHandler reads an uploaded datamap, in any of the DatamapFormats, and saves
+// it as a new datamap.
+func (app *application) saveDatamapHandler(w http.ResponseWriter, r *http.Request) {
+	dm, err := app.readDatamapUpload(w, r)
+	if err != nil {
+		app.datamapUploadErrorResponse(w, r, err)
+		return
+	}
+	app.logger.Info("obtain value from form", "name", dm.Name)
+	dm.Created = time.Now()
 
-	for {
-		line, err := reader.Read()
-		if err != nil {
-			if err.Error() == "EOF" {
-				break // end of file
+	v := NewValidator()
+	ValidateDatamap(v, *dm)
+	// Identity keys come from a JSON or YAML datamap, and must be keys of its lines
+	if dm.IdentityKeys != nil {
+		kv := NewValidator()
+		ValidateIdentityKeys(kv, *dm.IdentityKeys, dm)
+		for field, message := range kv.Errors {
+			if field != "identity_keys" {
+				field = "identity_keys." + field
 			}
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+			v.AddError(field, message)
 		}
-		if len(line) != 4 {
-			http.Error(w, "Invalid CSV Format", http.StatusBadRequest)
-			return
+	}
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// save to the database
+	id, err := app.models.DatamapLines.Insert(*dm, dm.DMLs)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	dm.ID = int64(id)
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/datamaps/%d", dm.ID))
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"datamap": dm}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) getJSONForDatamap(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	// Get the DM out of the database
+	dm, err := app.models.Datamaps.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
 		}
+		return
+	}
+
+	err = app.writeJSONPretty(w, http.StatusOK, envelope{"datamap": dm}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) showDatamapHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	app.logger.Info("the id requested", "id", id)
 
-		dmls = append(dmls, DatamapLine{
-			Key:      line[0],
-			Sheet:    line[1],
-			DataType: line[2],
-			CellRef:  line[3],
-		})
+	dm, err := app.models.Datamaps.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
 	}
-	dm = Datamap{Name: dmName, Description: dmDesc, Created: time.Now(), DMLs: dmls}
 
 	err = app.writeJSON(w, http.StatusOK, envelope{"datamap": dm}, nil)
 	if err != nil {
-		app.logger.Debug("writing out csv", "err", err)
 		app.serverErrorResponse(w, r, err)
 	}
+}
+
+// exportDatamapHandler sends datamap {id} as a file, in the format asked for with
+// ?format= or, failing that, the Accept header: CSV, which can be uploaded again to
+// createDatamapHandler, JSON, YAML or an Excel workbook. The current revision is sent
+// unless another is given with ?revision=.
+func (app *application) exportDatamapHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	v := NewValidator()
+	qs := r.URL.Query()
+	revision := app.readInt(qs, "revision", 0, v)
+	v.Check(revision >= 0, "revision", "must be a positive integer")
+
+	format := app.readDatamapFormat(r, qs, v)
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	if format == nil {
+		app.notAcceptableResponse(w, r, datamapContentTypeList())
+		return
+	}
+
+	dm, err := app.models.Datamaps.GetRevision(id, revision)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
 
-	// fmt.Fprintf(w, "file successfully uploaded")
+	app.writeDatamapFile(w, r, dm, format, fmt.Sprintf("datamap-%d", dm.ID))
 }
 
-func (app *application) saveDatamapHandler(w http.ResponseWriter, r *http.Request) {
-	// Parse the multipart form
-	err := r.ParseMultipartForm(10 << 20) // 10Mb max
+func (app *application) listDatamapsHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Search string
+		Filters
+	}
+
+	v := NewValidator()
+	qs := r.URL.Query()
+
+	input.Search = app.readString(qs, "search", "")
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Filters.Sort = app.readString(qs, "sort", "id")
+	input.Filters.SortSafelist = []string{"id", "name", "created", "-id", "-name", "-created"}
+
+	if ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	datamaps, metadata, err := app.models.Datamaps.GetAll(input.Search, input.Filters)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"datamaps": datamaps, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) updateDatamapHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
 	}
-	// Get form values
-	dmName := r.FormValue("name")
-	app.logger.Info("obtain value from form", "name", dmName)
-	dmDesc := r.FormValue("description")
-	app.logger.Info("obtain value from form", "description", dmDesc)
 
-	// Get the uploaded file and name
-	file, _, err := r.FormFile("file")
+	dm, err := app.models.Datamaps.Get(id)
 	if err != nil {
-		http.Error(w, "Missing file", http.StatusBadRequest)
+		switch {
+		case errors.Is(err, ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
 		return
 	}
-	defer file.Close()
 
-	// parse the csv
-	reader := csv.NewReader(file)
-	var dmls []DatamapLine
-	var dm Datamap
+	// Pointers let us tell the difference between a field which was left out of
+	// a PATCH and one which was deliberately set to its zero value.
+	var input struct {
+		Name        *string       `json:"name"`
+		Description *string       `json:"description"`
+		ValueMode   *ValueMode    `json:"value_mode"`
+		DMLs        []DatamapLine `json:"datamap_lines"`
+	}
 
-	for {
-		line, err := reader.Read()
-		if err != nil {
-			if err.Error() == "EOF" {
-				break // end of file
-			}
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := NewValidator()
+	if r.Method == http.MethodPut {
+		v.Check(input.Name != nil, "name", "must be provided")
+		v.Check(input.Description != nil, "description", "must be provided")
+	}
+	if input.Name != nil {
+		dm.Name = *input.Name
+	}
+	if input.Description != nil {
+		dm.Description = *input.Description
+	}
+	if input.ValueMode != nil {
+		dm.ValueMode = *input.ValueMode
+		v.Check(dm.ValueMode != "", "value_mode", "must be provided")
+	}
+	// Lines are only replaced if the client sent them
+	dm.DMLs = input.DMLs
+
+	if ValidateDatamap(v, *dm); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	// New lines are checked together for duplicates, as those of an upload are
+	if dm.DMLs != nil {
+		if _, err := checkDatamapLines(dm.DMLs); err != nil {
+			app.datamapUploadErrorResponse(w, r, err)
 			return
 		}
-		if len(line) != 4 {
-			http.Error(w, "Invalid CSV Format", http.StatusBadRequest)
-			return
+	}
+
+	err = app.models.Datamaps.Update(dm)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		case errors.Is(err, ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
 		}
+		return
+	}
 
-		dmls = append(dmls, DatamapLine{
-			ID:       0,
-			Key:      line[0],
-			Sheet:    line[1],
-			DataType: line[2],
-			CellRef:  line[3],
-		})
+	dm, err = app.models.Datamaps.Get(id)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
 
+	err = app.writeJSON(w, http.StatusOK, envelope{"datamap": dm}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
 	}
-	dm = Datamap{Name: dmName, Description: dmDesc, Created: time.Now(), DMLs: dmls}
+}
 
-	// save to the database
-	_, err = app.models.DatamapLines.Insert(dm, dmls)
+func (app *application) deleteDatamapHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.models.Datamaps.Delete(id)
 	if err != nil {
-		http.Error(w, "Cannot save to database", http.StatusBadRequest)
+		switch {
+		case errors.Is(err, ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
 		return
 	}
 
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "datamap successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
 }
 
-func (app *application) getJSONForDatamap(w http.ResponseWriter, r *http.Request) {
-	// Get the DM out of the database
-	// dm = Datamap{Name: dmName, Description: dmDesc, Created: time.Now(), DMLs: dmls}
+func (app *application) listDatamapLinesHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	dm, err := app.models.Datamaps.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
 
-	// err = app.writeJSONPretty(w, http.StatusOK, envelope{"Datamap": dm}, nil)
-	// if err != nil {
-	// 	app.logger.Debug("writing out csv", "err", err)
-	// 	app.serverErrorResponse(w, r, err)
-	// }
+	err = app.writeJSON(w, http.StatusOK, envelope{"datamap_lines": dm.DMLs}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
 
-	// fmt.Fprintf(w, "file successfully uploaded")
+// datamapLineInput is the body of a request to add a line to a datamap.
+type datamapLineInput struct {
+	Key      string        `json:"key"`
+	Sheet    string        `json:"sheet"`
+	DataType string        `json:"datatype"`
+	CellRef  string        `json:"cellref"`
+	Rules    *Rules        `json:"rules"`
+	Columns  []TableColumn `json:"columns"`
 }
 
-func (app *application) showDatamapHandler(w http.ResponseWriter, r *http.Request) {
-	id := r.PathValue("id")
-	app.logger.Info("the id requested", "id", id)
-	id_int, err := strconv.ParseInt(id, 10, 64)
-	if err != nil || id_int < 1 {
+func (app *application) createDatamapLine(w http.ResponseWriter, r *http.Request) {
+	datamapID, err := app.readIDParam(r)
+	if err != nil {
 		app.notFoundResponse(w, r)
+		return
+	}
+
+	var input datamapLineInput
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	app.addDatamapLine(w, r, datamapID, input)
+}
+
+// createDatamapLineByBody adds a line to the datamap given as "datamap_id" in the
+// body. It serves the original POST /v1/datamapline route, which is kept for existing
+// clients; new ones should use POST /v1/datamaps/{id}/lines.
+func (app *application) createDatamapLineByBody(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		DatamapID int64 `json:"datamap_id"`
+		datamapLineInput
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := NewValidator()
+	if v.Check(input.DatamapID > 0, "datamap_id", "must be provided"); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
 	}
-	fmt.Fprintf(w, "show the details for Datamap %d\n", id_int)
+
+	app.addDatamapLine(w, r, input.DatamapID, input.datamapLineInput)
 }
 
-func (app *application) createDatamapLine(w http.ResponseWriter, r *http.Request) {
-	var input DatamapLine
-	err := json.NewDecoder(r.Body).Decode(&input)
+// addDatamapLine validates input and adds it to the current revision of the datamap
+// with the given id, as a new revision.
+func (app *application) addDatamapLine(w http.ResponseWriter, r *http.Request, datamapID int64, input datamapLineInput) {
+	dml := &DatamapLine{
+		Key:      input.Key,
+		Sheet:    input.Sheet,
+		DataType: input.DataType,
+		CellRef:  input.CellRef,
+		Rules:    input.Rules,
+		Columns:  input.Columns,
+	}
+
+	v := NewValidator()
+	if ValidateDatamapLine(v, *dml); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err := app.models.DatamapLines.Add(datamapID, dml)
 	if err != nil {
-		app.errorResponse(w, r, http.StatusBadRequest, err.Error())
+		var lineErrors DatamapErrors
+		switch {
+		case errors.Is(err, ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		case errors.Is(err, ErrEditConflict):
+			app.editConflictResponse(w, r)
+		case errors.As(err, &lineErrors):
+			app.datamapUploadErrorResponse(w, r, err)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/datamaps/%d/lines/%d", datamapID, dml.ID))
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"datamap_line": dml}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) showDatamapLineHandler(w http.ResponseWriter, r *http.Request) {
+	datamapID, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	lineID, err := app.readNamedIDParam(r, "lineID")
+	if err != nil {
+		app.notFoundResponse(w, r)
 		return
 	}
-	fmt.Fprintf(w, "%v\n", input)
+
+	dml, err := app.models.DatamapLines.Get(datamapID, lineID)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"datamap_line": dml}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) updateDatamapLineHandler(w http.ResponseWriter, r *http.Request) {
+	datamapID, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	lineID, err := app.readNamedIDParam(r, "lineID")
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	dml, err := app.models.DatamapLines.Get(datamapID, lineID)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	var input struct {
+		Key      *string        `json:"key"`
+		Sheet    *string        `json:"sheet"`
+		DataType *string        `json:"datatype"`
+		CellRef  *string        `json:"cellref"`
+		Rules    *Rules         `json:"rules"`
+		Columns  *[]TableColumn `json:"columns"`
+	}
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := NewValidator()
+	if r.Method == http.MethodPut {
+		v.Check(input.Key != nil, "key", "must be provided")
+		v.Check(input.Sheet != nil, "sheet", "must be provided")
+		v.Check(input.DataType != nil, "datatype", "must be provided")
+		v.Check(input.CellRef != nil, "cellref", "must be provided")
+	}
+	if input.Key != nil {
+		dml.Key = *input.Key
+	}
+	if input.Sheet != nil {
+		dml.Sheet = *input.Sheet
+	}
+	if input.DataType != nil {
+		dml.DataType = *input.DataType
+	}
+	if input.CellRef != nil {
+		dml.CellRef = *input.CellRef
+	}
+	// Rules and columns are optional, so a PUT without them removes any the line had
+	if input.Rules != nil || r.Method == http.MethodPut {
+		dml.Rules = input.Rules
+	}
+	if input.Columns != nil {
+		dml.Columns = *input.Columns
+	} else if r.Method == http.MethodPut {
+		dml.Columns = nil
+	}
+
+	if ValidateDatamapLine(v, *dml); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.DatamapLines.Update(datamapID, dml)
+	if err != nil {
+		var lineErrors DatamapErrors
+		switch {
+		case errors.Is(err, ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		case errors.Is(err, ErrEditConflict):
+			app.editConflictResponse(w, r)
+		case errors.As(err, &lineErrors):
+			app.datamapUploadErrorResponse(w, r, err)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"datamap_line": dml}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteDatamapLineHandler(w http.ResponseWriter, r *http.Request) {
+	datamapID, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	lineID, err := app.readNamedIDParam(r, "lineID")
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.models.DatamapLines.Delete(datamapID, lineID)
+	if err != nil {
+		var lineErrors DatamapErrors
+		switch {
+		case errors.Is(err, ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		case errors.Is(err, ErrEditConflict):
+			app.editConflictResponse(w, r)
+		case errors.As(err, &lineErrors):
+			app.datamapUploadErrorResponse(w, r, err)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "datamap line successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) listDatamapRevisionsHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	dm, err := app.models.Datamaps.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	revisions, err := app.models.Datamaps.GetRevisions(dm.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"revisions": revisions}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) showDatamapRevisionHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	n, err := app.readNamedIDParam(r, "revision")
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	dm, err := app.models.Datamaps.GetRevision(id, int(n))
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"datamap": dm}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// createDatamapRevisionHandler replaces the lines of a stored datamap with those in an
+// uploaded datamap file, in any of the DatamapFormats, as a new revision.
+func (app *application) createDatamapRevisionHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	uploaded, err := app.readDatamapUpload(w, r)
+	if err != nil {
+		app.datamapUploadErrorResponse(w, r, err)
+		return
+	}
+
+	dm, err := app.models.Datamaps.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	dm.DMLs = uploaded.DMLs
+
+	v := NewValidator()
+	if ValidateDatamap(v, *dm); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Datamaps.Update(dm)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/datamaps/%d/revisions/%d", dm.ID, dm.Revision))
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"datamap": dm}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// diffDatamapsHandler compares datamap {a} with datamap {b}. The current revision of
+// each is used unless revision_a or revision_b is given in the query string. The
+// report is JSON unless the client asks for text with ?format=text or an Accept
+// header of text/plain.
+func (app *application) diffDatamapsHandler(w http.ResponseWriter, r *http.Request) {
+	idA, err := app.readNamedIDParam(r, "a")
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	idB, err := app.readNamedIDParam(r, "b")
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	v := NewValidator()
+	qs := r.URL.Query()
+	revA := app.readInt(qs, "revision_a", 0, v)
+	revB := app.readInt(qs, "revision_b", 0, v)
+	format := app.readString(qs, "format", "json")
+	if r.Header.Get("Accept") == "text/plain" {
+		format = "text"
+	}
+
+	v.Check(revA >= 0, "revision_a", "must be a positive integer")
+	v.Check(revB >= 0, "revision_b", "must be a positive integer")
+	v.Check(PermittedValue(format, "json", "text"), "format", "must be json or text")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	var dms [2]*Datamap
+	for i, side := range []struct {
+		id  int64
+		rev int
+	}{{idA, revA}, {idB, revB}} {
+		dms[i], err = app.models.Datamaps.GetRevision(side.id, side.rev)
+		if err != nil {
+			switch {
+			case errors.Is(err, ErrRecordNotFound):
+				app.notFoundResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+	}
+
+	diff := DiffDatamaps(dms[0], dms[1])
+
+	if format == "text" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		err = diff.WriteText(w)
+		if err != nil {
+			app.logError(r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"diff": diff}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// returnSortSafelist holds the values by which a listing of returns may be sorted
+var returnSortSafelist = []string{"id", "name", "project", "created", "-id", "-name", "-project", "-created"}
+
+func (app *application) listReturnsHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Search       string
+		DatamapID    int
+		PeriodID     int
+		ProjectID    int
+		ProjectMatch string
+		Filters
+	}
+
+	v := NewValidator()
+	qs := r.URL.Query()
+
+	input.Search = app.readString(qs, "search", "")
+	input.DatamapID = app.readInt(qs, "datamap_id", 0, v)
+	input.PeriodID = app.readInt(qs, "period_id", 0, v)
+	input.ProjectID = app.readInt(qs, "project_id", 0, v)
+	input.ProjectMatch = app.readString(qs, "project_match", "")
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Filters.Sort = app.readString(qs, "sort", "id")
+	input.Filters.SortSafelist = returnSortSafelist
+
+	v.Check(input.DatamapID >= 0, "datamap_id", "must be a positive integer")
+	v.Check(input.PeriodID >= 0, "period_id", "must be a positive integer")
+	v.Check(input.ProjectID >= 0, "project_id", "must be a positive integer")
+	v.Check(input.ProjectMatch == "" || PermittedValue(input.ProjectMatch, ProjectMatches...), "project_match",
+		"must be one of "+strings.Join(ProjectMatches, ", "))
+	if ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	returns, metadata, err := app.models.Returns.GetAll(ReturnQuery{
+		Search:       input.Search,
+		DatamapID:    int64(input.DatamapID),
+		PeriodID:     int64(input.PeriodID),
+		ProjectID:    int64(input.ProjectID),
+		ProjectMatch: input.ProjectMatch,
+	}, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"returns": returns, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) showReturnHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	ret, err := app.models.Returns.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"return": ret}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// maxMasterReturns is the most returns which can be compiled into one master workbook
+const maxMasterReturns = 500
+
+// showDatamapMasterHandler compiles the returns given as a comma-separated list of ids
+// in the returns parameter into a master workbook for the datamap, which is sent as
+// an .xlsx file. The keys are taken from the current revision of the datamap, or the
+// one given in the revision parameter.
+func (app *application) showDatamapMasterHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	v := NewValidator()
+	qs := r.URL.Query()
+	returnIDs := app.readIDList(qs, "returns", v)
+	revision := app.readInt(qs, "revision", 0, v)
+
+	v.Check(len(returnIDs) > 0, "returns", "must be provided")
+	v.Check(len(returnIDs) <= maxMasterReturns, "returns", fmt.Sprintf("must not contain more than %d ids", maxMasterReturns))
+	v.Check(revision >= 0, "revision", "must be a positive integer")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	dm, err := app.models.Datamaps.GetRevision(id, revision)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	returns := make([]*Return, 0, len(returnIDs))
+	for _, returnID := range returnIDs {
+		ret, err := app.models.Returns.Get(returnID)
+		if err != nil {
+			switch {
+			case errors.Is(err, ErrRecordNotFound):
+				v.AddError("returns", fmt.Sprintf("return %d does not exist", returnID))
+				continue
+			default:
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+		}
+		v.Check(ret.DatamapID == dm.ID, "returns", fmt.Sprintf("return %d was not parsed against this datamap", returnID))
+		returns = append(returns, ret)
+	}
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	wb, err := BuildMaster(dm, returns)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", FormatXLSX.ContentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", fmt.Sprintf("datamap-%d-master.xlsx", dm.ID)))
+	err = wb.Write(w)
+	if err != nil {
+		app.logError(r, err)
+	}
+}
+
+// populateTemplateHandler writes values into the blank template workbook uploaded as
+// "template", at the cells given by the datamap, and sends back the filled workbook.
+// The values come from exactly one of: a stored return ("return_id"), a JSON object
+// mapping keys to values ("values"), or a column of a master workbook ("master", with
+// "column" naming the return whose values to use). The number of cells written and
+// skipped are sent in the X-Cells-Written and X-Cells-Skipped headers.
+func (app *application) populateTemplateHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = r.ParseMultipartForm(10 << 20) // 10Mb max
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := NewValidator()
+	revision := app.readInt(r.Form, "revision", 0, v)
+	returnID := app.readInt(r.Form, "return_id", 0, v)
+	rawValues := r.FormValue("values")
+	master, _, err := r.FormFile("master")
+	if err == nil {
+		defer master.Close()
+	}
+	column := r.FormValue("column")
+
+	sources := 0
+	for _, given := range []bool{returnID != 0, rawValues != "", master != nil} {
+		if given {
+			sources++
+		}
+	}
+	v.Check(revision >= 0, "revision", "must be a positive integer")
+	v.Check(returnID >= 0, "return_id", "must be a positive integer")
+	v.Check(sources == 1, "values", "exactly one of return_id, values or master must be provided")
+	v.Check(master == nil || column != "", "column", "must be provided with a master")
+
+	template, templateHeader, err := r.FormFile("template")
+	if err != nil {
+		v.AddError("template", "must be provided")
+	} else {
+		defer template.Close()
+	}
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	dm, err := app.models.Datamaps.GetRevision(id, revision)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	var values map[string]ReturnLine
+	switch {
+	case returnID != 0:
+		ret, err := app.models.Returns.Get(int64(returnID))
+		if err != nil {
+			switch {
+			case errors.Is(err, ErrRecordNotFound):
+				v.AddError("return_id", "return does not exist")
+				app.failedValidationResponse(w, r, v.Errors)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+		values = ReturnValues(ret)
+
+	case rawValues != "":
+		raw, err := decodeValues(rawValues)
+		if err != nil {
+			app.badRequestResponse(w, r, err)
+			return
+		}
+		values = TypedValues(dm, raw, false)
+
+	default:
+		tmpDir, err := os.MkdirTemp("", "dbasik-master")
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		defer os.RemoveAll(tmpDir)
+
+		// The client's name for the file isn't needed, and may not be usable as one
+		masterPath := filepath.Join(tmpDir, "master.xlsx")
+		dst, err := os.Create(masterPath)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		_, err = io.Copy(dst, master)
+		dst.Close()
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		raw, date1904, err := ReadMasterColumn(masterPath, column)
+		if err != nil {
+			app.badRequestResponse(w, r, err)
+			return
+		}
+		values = TypedValues(dm, raw, date1904)
+	}
+
+	format, err := DetectWorkbookFormat(template, templateHeader.Size)
+	if err != nil {
+		app.failedValidationResponse(w, r, map[string]string{"template": err.Error()})
+		return
+	}
+	src, err := zip.NewReader(template, templateHeader.Size)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	// The workbook is built in memory so that a failure can still be reported as JSON
+	var buf bytes.Buffer
+	result, err := PopulateTemplate(src, &buf, dm, values)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrNotWorkbook):
+			app.badRequestResponse(w, r, err)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	for _, skipped := range result.Skipped {
+		app.logger.Info("value not written to template", "key", skipped.Key, "reason", skipped.Reason)
+	}
+
+	filename := workbookFilename(templateHeader.Filename, format)
+	w.Header().Set("Content-Type", format.ContentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	w.Header().Set("X-Cells-Written", strconv.Itoa(result.Written))
+	w.Header().Set("X-Cells-Skipped", strconv.Itoa(len(result.Skipped)))
+	_, err = buf.WriteTo(w)
+	if err != nil {
+		app.logError(r, err)
+	}
+}
+
+// checkTemplateHandler checks datamap {id}, or the revision given as "revision",
+// against the blank template workbook uploaded as "template", and reports any lines
+// which point at cells that can't be read or filled in. See CheckTemplate.
+func (app *application) checkTemplateHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = r.ParseMultipartForm(10 << 20) // 10Mb max
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := NewValidator()
+	revision := app.readInt(r.Form, "revision", 0, v)
+	v.Check(revision >= 0, "revision", "must be a positive integer")
+	template, templateHeader, err := r.FormFile("template")
+	if err != nil {
+		v.AddError("template", "must be provided")
+	} else {
+		defer template.Close()
+	}
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	_, err = DetectWorkbookFormat(template, templateHeader.Size)
+	if err != nil {
+		app.failedValidationResponse(w, r, map[string]string{"template": err.Error()})
+		return
+	}
+	src, err := zip.NewReader(template, templateHeader.Size)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	dm, err := app.models.Datamaps.GetRevision(id, revision)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	result, err := CheckTemplate(src, dm)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrNotWorkbook):
+			app.badRequestResponse(w, r, err)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"check": result}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// draftDatamapHandler makes a draft datamap from the blank template workbook uploaded
+// as "template", finding its input cells by their labels and notes and, if "fill" is
+// given, by their fill colour. See DraftDatamap. The draft is sent as a file in the
+// format chosen as for exportDatamapHandler, named "name" or after the template, ready
+// to be edited and uploaded to saveDatamapHandler.
+func (app *application) draftDatamapHandler(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseMultipartForm(10 << 20) // 10Mb max
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := NewValidator()
+	format := app.readDatamapFormat(r, r.URL.Query(), v)
+	fill := r.FormValue("fill")
+	v.Check(fill == "" || normaliseFill(fill) != "", "fill", "must be a colour such as FFFF99 or #FFFF99")
+	template, templateHeader, err := r.FormFile("template")
+	if err != nil {
+		v.AddError("template", "must be provided")
+	} else {
+		defer template.Close()
+	}
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	if format == nil {
+		app.notAcceptableResponse(w, r, datamapContentTypeList())
+		return
+	}
+
+	_, err = DetectWorkbookFormat(template, templateHeader.Size)
+	if err != nil {
+		app.failedValidationResponse(w, r, map[string]string{"template": err.Error()})
+		return
+	}
+	src, err := zip.NewReader(template, templateHeader.Size)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	dm, err := DraftDatamap(src, DraftOptions{Fill: fill})
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrNotWorkbook):
+			app.badRequestResponse(w, r, err)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	dm.Name = r.FormValue("name")
+	if dm.Name == "" {
+		dm.Name = strings.TrimSuffix(filepath.Base(templateHeader.Filename), filepath.Ext(templateHeader.Filename))
+	}
+	dm.Description = fmt.Sprintf("Draft made from %s", filepath.Base(templateHeader.Filename))
+
+	app.writeDatamapFile(w, r, dm, format, "draft-datamap")
+}
+
+// decodeValues decodes a JSON object mapping datamap keys to values into the string
+// form of each value, ready to be converted according to the datamap. Null values are
+// left out.
+func decodeValues(s string) (map[string]string, error) {
+	dec := json.NewDecoder(strings.NewReader(s))
+	dec.UseNumber()
+
+	var values map[string]any
+	if err := dec.Decode(&values); err != nil {
+		return nil, errors.New("values must be a JSON object mapping keys to values")
+	}
+
+	raw := make(map[string]string, len(values))
+	for key, value := range values {
+		switch value := value.(type) {
+		case nil:
+		case string:
+			raw[key] = value
+		case json.Number:
+			raw[key] = value.String()
+		case bool:
+			raw[key] = strconv.FormatBool(value)
+		default:
+			return nil, fmt.Errorf("value for %q must be a string, number or boolean", key)
+		}
+	}
+	return raw, nil
+}
+
+// showReturnReportHandler sends the validation report for a stored return, as JSON or,
+// with format=csv or an Accept header of text/csv, as CSV. The status parameter limits
+// the lines in the report to those with the given, comma-separated statuses.
+func (app *application) showReturnReportHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	v := NewValidator()
+	qs := r.URL.Query()
+	format := app.readString(qs, "format", "json")
+	if r.Header.Get("Accept") == "text/csv" {
+		format = "csv"
+	}
+	var statuses []string
+	if s := app.readString(qs, "status", ""); s != "" {
+		statuses = strings.Split(s, ",")
+	}
+
+	v.Check(PermittedValue(format, "json", "csv"), "format", "must be json or csv")
+	for _, status := range statuses {
+		v.Check(PermittedValue(status, StatusOK, StatusWarning, StatusError), "status", "must be a list of ok, warning or error")
+	}
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	ret, err := app.models.Returns.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	report := NewValidationReport(ret, statuses...)
+
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", fmt.Sprintf("return-%d-report.csv", ret.ID)))
+		err = report.WriteCSV(w)
+		if err != nil {
+			app.logError(r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"report": report}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// maxBatchUploadSize is the largest zip archive we accept in a single batch upload
+const maxBatchUploadSize = 100 << 20 // 100Mb
+
+// createReturnBatchHandler accepts a zip archive of workbooks to be parsed against a
+// stored datamap. The archive is extracted into a job directory and a Job with an item
+// for each workbook is created, which the background workers then process. The
+// response is sent straight away with the job, which can be polled at /v1/jobs/{id}.
+func (app *application) createReturnBatchHandler(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxBatchUploadSize)
+
+	err := r.ParseMultipartForm(10 << 20) // 10Mb held in memory, the rest on disk
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := NewValidator()
+	datamapID := app.readInt(r.Form, "datamap_id", 0, v)
+	revision := app.readInt(r.Form, "revision", 0, v)
+	v.Check(datamapID > 0, "datamap_id", "must be provided")
+	v.Check(revision >= 0, "revision", "must be a positive integer")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Load the datamap now so that we can report a missing one straight away, and so
+	// the job is pinned to the revision which is current at the time of upload.
+	dm, err := app.models.Datamaps.GetRevision(int64(datamapID), revision)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	v = NewValidator()
+	valueMode := app.readValueMode(r.Form, dm, v)
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	zipFile, _, err := r.FormFile("zipfile")
+	if err != nil {
+		app.errorResponse(w, r, http.StatusBadRequest, "Missing zip file")
+		return
+	}
+	defer zipFile.Close()
+
+	jobDir, err := os.MkdirTemp(app.config.jobs.dir, "job-")
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	// The job directory is only kept if the job is successfully created
+	keep := false
+	defer func() {
+		if !keep {
+			os.RemoveAll(jobDir)
+		}
+	}()
+
+	// zip.OpenReader needs a file on disk, so copy the upload there
+	zipPath := path.Join(jobDir, "upload.zip")
+	dst, err := os.Create(zipPath)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	_, err = io.Copy(dst, zipFile)
+	dst.Close()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	extractDir := path.Join(jobDir, "files")
+	files, err := PrepareFiles(NewZipFilePackage(zipPath, extractDir))
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	os.Remove(zipPath)
+
+	job := &Job{DatamapID: dm.ID, Revision: dm.Revision, ValueMode: valueMode, Dir: jobDir, Items: []JobItem{}}
+	for _, f := range files {
+		rel, err := filepath.Rel(extractDir, f)
+		if err != nil {
+			rel = filepath.Base(f)
+		}
+		if isArchiveJunk(rel) {
+			continue
+		}
+
+		item := JobItem{File: filepath.ToSlash(rel), Path: f}
+		if _, err := DetectSpreadsheetFile(f); err != nil {
+			item.Status = ItemFailed
+			item.Error = err.Error()
+		}
+		job.Items = append(job.Items, item)
+	}
+
+	err = app.models.Jobs.Insert(job)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	keep = job.Status != JobCompleted
+
+	if job.Status != JobCompleted {
+		app.enqueueJobs([]int64{job.ID})
+	}
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/jobs/%d", job.ID))
+
+	err = app.writeJSON(w, http.StatusAccepted, envelope{"job": job}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) showJobHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	job, err := app.models.Jobs.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"job": job}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// createPeriodHandler creates a reporting period bound to a revision of a datamap,
+// the current one unless "revision" is given, with the projects expected to submit a
+// return for it.
+func (app *application) createPeriodHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Name        string   `json:"name"`
+		Description string   `json:"description"`
+		DatamapID   int64    `json:"datamap_id"`
+		Revision    int      `json:"revision"`
+		Projects    []string `json:"projects"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	p := &Period{
+		Name:        strings.TrimSpace(input.Name),
+		Description: input.Description,
+		DatamapID:   input.DatamapID,
+		Revision:    input.Revision,
+		Projects:    input.Projects,
+	}
+	if p.Projects == nil {
+		p.Projects = []string{}
+	}
+
+	v := NewValidator()
+	if ValidatePeriod(v, *p); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	dm, err := app.models.Datamaps.GetRevision(p.DatamapID, p.Revision)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrRecordNotFound):
+			app.failedValidationResponse(w, r, map[string]string{"datamap_id": "must be a datamap with the given revision"})
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	p.Revision = dm.Revision
+
+	err = app.models.Periods.Insert(p)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrDuplicatePeriodName):
+			app.failedValidationResponse(w, r, map[string]string{"name": "a period with this name already exists"})
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/periods/%d", p.ID))
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"period": p}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) listPeriodsHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Search    string
+		DatamapID int
+		Filters
+	}
+
+	v := NewValidator()
+	qs := r.URL.Query()
+
+	input.Search = app.readString(qs, "search", "")
+	input.DatamapID = app.readInt(qs, "datamap_id", 0, v)
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Filters.Sort = app.readString(qs, "sort", "id")
+	input.Filters.SortSafelist = []string{"id", "name", "created", "-id", "-name", "-created"}
+
+	v.Check(input.DatamapID >= 0, "datamap_id", "must be a positive integer")
+	if ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	periods, metadata, err := app.models.Periods.GetAll(input.Search, int64(input.DatamapID), input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"periods": periods, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// readPeriod retrieves the period given by the "id" path value, sending a 404 Not
+// Found response and returning nil if there isn't one.
+func (app *application) readPeriod(w http.ResponseWriter, r *http.Request) *Period {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil
+	}
+
+	p, err := app.models.Periods.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil
+	}
+	return p
+}
+
+func (app *application) showPeriodHandler(w http.ResponseWriter, r *http.Request) {
+	p := app.readPeriod(w, r)
+	if p == nil {
+		return
+	}
+
+	err := app.writeJSON(w, http.StatusOK, envelope{"period": p}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// updatePeriodHandler changes the name, description or expected projects of a period.
+// A PUT must give all three.
+func (app *application) updatePeriodHandler(w http.ResponseWriter, r *http.Request) {
+	p := app.readPeriod(w, r)
+	if p == nil {
+		return
+	}
+
+	var input struct {
+		Name        *string  `json:"name"`
+		Description *string  `json:"description"`
+		Projects    []string `json:"projects"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := NewValidator()
+	if r.Method == http.MethodPut {
+		v.Check(input.Name != nil, "name", "must be provided")
+		v.Check(input.Description != nil, "description", "must be provided")
+		v.Check(input.Projects != nil, "projects", "must be provided")
+	}
+	if input.Name != nil {
+		p.Name = strings.TrimSpace(*input.Name)
+	}
+	if input.Description != nil {
+		p.Description = *input.Description
+	}
+	if input.Projects != nil {
+		p.Projects = input.Projects
+	}
+
+	if ValidatePeriod(v, *p); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Periods.Update(p)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		case errors.Is(err, ErrDuplicatePeriodName):
+			app.failedValidationResponse(w, r, map[string]string{"name": "a period with this name already exists"})
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"period": p}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deletePeriodHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.models.Periods.Delete(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "period successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// attachPeriodReturnHandler attaches a stored return to a period as the submission of
+// a project. The return must have been parsed against the period's datamap revision.
+func (app *application) attachPeriodReturnHandler(w http.ResponseWriter, r *http.Request) {
+	p := app.readPeriod(w, r)
+	if p == nil {
+		return
+	}
+
+	var input struct {
+		ReturnID int64  `json:"return_id"`
+		Project  string `json:"project"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := NewValidator()
+	v.Check(input.ReturnID > 0, "return_id", "must be provided")
+	v.Check(len(input.Project) <= 500, "project", "must not be more than 500 bytes long")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	rtn, err := app.models.Returns.GetHeader(input.ReturnID)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrRecordNotFound):
+			app.failedValidationResponse(w, r, map[string]string{"return_id": fmt.Sprintf("return %d does not exist", input.ReturnID)})
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// Without a project, the return is submitted by the project it is linked to
+	if projectKey(input.Project) == "" && rtn.ProjectID > 0 {
+		project, err := app.models.Projects.Get(rtn.ProjectID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		input.Project = project.Name
+	}
+	if projectKey(input.Project) == "" {
+		app.failedValidationResponse(w, r, map[string]string{"project": "must be provided, as the return is not linked to a project"})
+		return
+	}
+	if rtn.DatamapID != p.DatamapID || rtn.Revision != p.Revision {
+		app.failedValidationResponse(w, r, map[string]string{"return_id": fmt.Sprintf(
+			"return %d was not parsed against revision %d of datamap %d", rtn.ID, p.Revision, p.DatamapID)})
+		return
+	}
+
+	err = app.models.Periods.AttachReturn(p.ID, rtn.ID, input.Project)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		case errors.Is(err, ErrReturnInOtherPeriod):
+			app.failedValidationResponse(w, r, map[string]string{"return_id": fmt.Sprintf(
+				"return %d is attached to period %d; detach it from there first", rtn.ID, rtn.PeriodID)})
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	rtn.PeriodID = p.ID
+	rtn.Project = strings.TrimSpace(input.Project)
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"return": rtn}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) detachPeriodReturnHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	returnID, err := app.readNamedIDParam(r, "returnID")
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.models.Periods.DetachReturn(id, returnID)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "return successfully detached from period"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// listPeriodReturnsHandler lists the returns attached to a period, in the same way as
+// listReturnsHandler.
+func (app *application) listPeriodReturnsHandler(w http.ResponseWriter, r *http.Request) {
+	p := app.readPeriod(w, r)
+	if p == nil {
+		return
+	}
+
+	var input struct {
+		Search string
+		Filters
+	}
+
+	v := NewValidator()
+	qs := r.URL.Query()
+
+	input.Search = app.readString(qs, "search", "")
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Filters.Sort = app.readString(qs, "sort", "project")
+	input.Filters.SortSafelist = returnSortSafelist
+
+	if ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	returns, metadata, err := app.models.Returns.GetAll(ReturnQuery{Search: input.Search, PeriodID: p.ID}, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"returns": returns, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// showPeriodStatusHandler reports which of the projects expected to submit a return
+// for a period have done so. See NewPeriodStatus.
+func (app *application) showPeriodStatusHandler(w http.ResponseWriter, r *http.Request) {
+	p := app.readPeriod(w, r)
+	if p == nil {
+		return
+	}
+
+	returns, err := app.models.Periods.GetReturns(p.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"period": p, "status": NewPeriodStatus(p, returns)}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// showPeriodMasterHandler compiles the latest return from each project which has
+// submitted one for a period into a master workbook, as showDatamapMasterHandler does,
+// with a column for each project: those expected first, in order, then any others.
+func (app *application) showPeriodMasterHandler(w http.ResponseWriter, r *http.Request) {
+	p := app.readPeriod(w, r)
+	if p == nil {
+		return
+	}
+
+	dm, err := app.models.Datamaps.GetRevision(p.DatamapID, p.Revision)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	attached, err := app.models.Periods.GetReturns(p.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	status := NewPeriodStatus(p, attached)
+	submissions := append(status.Submitted, status.Unexpected...)
+	if len(submissions) > maxMasterReturns {
+		app.failedValidationResponse(w, r, map[string]string{"returns": fmt.Sprintf("must not be more than %d to compile a master", maxMasterReturns)})
+		return
+	}
+
+	returns := make([]*Return, 0, len(submissions))
+	for _, sub := range submissions {
+		rtn, err := app.models.Returns.Get(sub.ReturnID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		rtn.Name = sub.Project
+		returns = append(returns, rtn)
+	}
+
+	wb, err := BuildMaster(dm, returns)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", FormatXLSX.ContentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", fmt.Sprintf("period-%d-master.xlsx", p.ID)))
+	err = wb.Write(w)
+	if err != nil {
+		app.logError(r, err)
+	}
+}
+
+// projectWriteError sends the response for a failed write of a project.
+func (app *application) projectWriteError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, ErrRecordNotFound):
+		app.notFoundResponse(w, r)
+	case errors.Is(err, ErrDuplicateGMPPID):
+		app.failedValidationResponse(w, r, map[string]string{"gmpp_id": "a project with this GMPP ID already exists"})
+	case errors.Is(err, ErrDuplicateProjectName):
+		app.failedValidationResponse(w, r, map[string]string{"name": "a project with this name already exists"})
+	default:
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// createProjectHandler adds a project to the registry against which returns are
+// matched.
+func (app *application) createProjectHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Name         string `json:"name"`
+		Department   string `json:"department"`
+		DeliveryBody string `json:"delivery_body"`
+		GMPPID       string `json:"gmpp_id"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	p := &Project{
+		Name:         strings.TrimSpace(input.Name),
+		Department:   strings.TrimSpace(input.Department),
+		DeliveryBody: strings.TrimSpace(input.DeliveryBody),
+		GMPPID:       strings.TrimSpace(input.GMPPID),
+	}
+
+	v := NewValidator()
+	if ValidateProject(v, *p); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	projects, err := app.models.Projects.All()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if ValidateProjectUnique(v, *p, projects); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Projects.Insert(p)
+	if err != nil {
+		app.projectWriteError(w, r, err)
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/projects/%d", p.ID))
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"project": p}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) listProjectsHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Search string
+		Filters
+	}
+
+	v := NewValidator()
+	qs := r.URL.Query()
+
+	input.Search = app.readString(qs, "search", "")
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Filters.Sort = app.readString(qs, "sort", "id")
+	input.Filters.SortSafelist = []string{"id", "name", "department", "delivery_body", "gmpp_id", "created",
+		"-id", "-name", "-department", "-delivery_body", "-gmpp_id", "-created"}
+
+	if ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	projects, metadata, err := app.models.Projects.GetAll(input.Search, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"projects": projects, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// readProject retrieves the project given by the "id" path value, sending a 404 Not
+// Found response and returning nil if there isn't one.
+func (app *application) readProject(w http.ResponseWriter, r *http.Request) *Project {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil
+	}
+
+	p, err := app.models.Projects.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil
+	}
+	return p
+}
+
+func (app *application) showProjectHandler(w http.ResponseWriter, r *http.Request) {
+	p := app.readProject(w, r)
+	if p == nil {
+		return
+	}
+
+	err := app.writeJSON(w, http.StatusOK, envelope{"project": p}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// updateProjectHandler changes the fields of a project. A PUT must give all of them.
+// Returns already matched to the project stay matched to it.
+func (app *application) updateProjectHandler(w http.ResponseWriter, r *http.Request) {
+	p := app.readProject(w, r)
+	if p == nil {
+		return
+	}
+
+	var input struct {
+		Name         *string `json:"name"`
+		Department   *string `json:"department"`
+		DeliveryBody *string `json:"delivery_body"`
+		GMPPID       *string `json:"gmpp_id"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := NewValidator()
+	fields := []struct {
+		name  string
+		input *string
+		field *string
+	}{
+		{"name", input.Name, &p.Name},
+		{"department", input.Department, &p.Department},
+		{"delivery_body", input.DeliveryBody, &p.DeliveryBody},
+		{"gmpp_id", input.GMPPID, &p.GMPPID},
+	}
+	for _, f := range fields {
+		if r.Method == http.MethodPut {
+			v.Check(f.input != nil, f.name, "must be provided")
+		}
+		if f.input != nil {
+			*f.field = strings.TrimSpace(*f.input)
+		}
+	}
+
+	if ValidateProject(v, *p); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	projects, err := app.models.Projects.All()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if ValidateProjectUnique(v, *p, projects); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Projects.Update(p)
+	if err != nil {
+		app.projectWriteError(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"project": p}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// deleteProjectHandler removes a project from the registry. The returns matched to it
+// become unmatched.
+func (app *application) deleteProjectHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.models.Projects.Delete(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "project successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// showIdentityKeysHandler sends the keys of datamap {id} whose values identify the
+// project a return comes from, and whether they are the defaults.
+func (app *application) showIdentityKeysHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	dm, err := app.models.Datamaps.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"identity_keys": dm.identityKeys(), "default": dm.IdentityKeys == nil}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// updateIdentityKeysHandler sets the keys of datamap {id} whose values identify the
+// project a return comes from. Each key given must be in the current revision of the
+// datamap. Returns already stored are not matched again.
+func (app *application) updateIdentityKeysHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	var input IdentityKeys
+
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	dm, err := app.models.Datamaps.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	v := NewValidator()
+	if ValidateIdentityKeys(v, input, dm); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Datamaps.SetIdentityKeys(dm.ID, &input)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"identity_keys": input, "default": false}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// deleteIdentityKeysHandler returns datamap {id} to DefaultIdentityKeys.
+func (app *application) deleteIdentityKeysHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.models.Datamaps.SetIdentityKeys(id, nil)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"identity_keys": DefaultIdentityKeys, "default": true}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// setReturnProjectHandler links a return to the project given as "project_id" by
+// hand, for when it couldn't be matched automatically or was matched wrongly.
+func (app *application) setReturnProjectHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	var input struct {
+		ProjectID int64 `json:"project_id"`
+	}
+
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := NewValidator()
+	if v.Check(input.ProjectID > 0, "project_id", "must be provided"); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	_, err = app.models.Projects.Get(input.ProjectID)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrRecordNotFound):
+			app.failedValidationResponse(w, r, map[string]string{"project_id": fmt.Sprintf("project %d does not exist", input.ProjectID)})
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.writeReturnProject(w, r, id, ProjectMatch{Status: MatchManual, ProjectID: input.ProjectID})
+}
+
+// rematchReturnProjectHandler drops any link made by hand between a return and a
+// project and matches the return again against the projects now registered, using
+// the identity keys of its datamap.
+func (app *application) rematchReturnProjectHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	rtn, err := app.models.Returns.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// A return whose datamap has been deleted is matched with the default keys
+	dm, err := app.models.Datamaps.Get(rtn.DatamapID)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrRecordNotFound):
+			dm = &Datamap{}
+		default:
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	err = app.matchProject(rtn, dm)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.writeReturnProject(w, r, id, ProjectMatch{Status: rtn.ProjectMatch, ProjectID: rtn.ProjectID, Candidates: rtn.ProjectCandidates})
+}
+
+// writeReturnProject saves match for the return with the given id and sends the
+// return, without its lines.
+func (app *application) writeReturnProject(w http.ResponseWriter, r *http.Request, id int64, match ProjectMatch) {
+	err := app.models.Returns.SetProject(id, match)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	rtn, err := app.models.Returns.GetHeader(id)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"return": rtn}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
 }
@@ -18,18 +18,332 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
 	"net/http"
+	"net/url"
 	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tealeg/xlsx/v3"
 )
 
-// validateSpreadsheetCell checks that the cellRef is in a valid format
+// validateSpreadsheetCell checks that the cellRef is in a valid format and lies
+// within the bounds of a sheet, so that a defined name such as XFE1 isn't taken for a
+// cell
 func validateSpreadsheetCell(cellRef string) bool {
-	pattern := `^[A-Z]+[1-9][0-9]*$`
+	pattern := `^([A-Z]+)([1-9][0-9]*)$`
 
 	regExp := regexp.MustCompile(pattern)
 
-	return regExp.MatchString(cellRef)
+	m := regExp.FindStringSubmatch(cellRef)
+	if m == nil {
+		return false
+	}
+	row, err := strconv.Atoi(m[2])
+	return err == nil && row <= maxSheetRows && xlsx.ColLettersToIndex(m[1]) < maxSheetCols
+}
+
+// validateSpreadsheetRange checks that ref is a range such as B5:F40, or an open range
+// such as B5:F, which is no bigger than a TABLE line may read.
+func validateSpreadsheetRange(ref string) bool {
+	_, err := parseCellRange(ref)
+	return err == nil
+}
+
+// readIDParam retrieves the "id" path value from the current request, converts it to
+// an integer and returns it. If the operation isn't successful, it returns 0 and an error.
+func (app *application) readIDParam(r *http.Request) (int64, error) {
+	return app.readNamedIDParam(r, "id")
+}
+
+// readNamedIDParam does the same as readIDParam for the path value called name, for
+// routes which carry more than one id, e.g. /v1/datamaps/{id}/lines/{lineID}.
+func (app *application) readNamedIDParam(r *http.Request, name string) (int64, error) {
+	id, err := strconv.ParseInt(r.PathValue(name), 10, 64)
+	if err != nil || id < 1 {
+		return 0, fmt.Errorf("invalid %s parameter", name)
+	}
+	return id, nil
+}
+
+// readJSON decodes the JSON request body into dst. The body is limited to 1MB, must
+// contain a single JSON value and must not contain fields which don't exist in dst.
+// Decoding errors are translated into messages which are safe to send to the client.
+func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dst any) error {
+	maxBytes := 1_048_576
+	r.Body = http.MaxBytesReader(w, r.Body, int64(maxBytes))
+
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+
+	err := dec.Decode(dst)
+	if err != nil {
+		var syntaxError *json.SyntaxError
+		var unmarshalTypeError *json.UnmarshalTypeError
+		var invalidUnmarshalError *json.InvalidUnmarshalError
+		var maxBytesError *http.MaxBytesError
+
+		switch {
+		case errors.As(err, &syntaxError):
+			return fmt.Errorf("body contains badly-formed JSON (at character %d)", syntaxError.Offset)
+
+		case errors.Is(err, io.ErrUnexpectedEOF):
+			return errors.New("body contains badly-formed JSON")
+
+		case errors.As(err, &unmarshalTypeError):
+			if unmarshalTypeError.Field != "" {
+				return fmt.Errorf("body contains incorrect JSON type for field %q", unmarshalTypeError.Field)
+			}
+			return fmt.Errorf("body contains incorrect JSON type (at character %d)", unmarshalTypeError.Offset)
+
+		case errors.Is(err, io.EOF):
+			return errors.New("body must not be empty")
+
+		case strings.HasPrefix(err.Error(), "json: unknown field "):
+			fieldName := strings.TrimPrefix(err.Error(), "json: unknown field ")
+			return fmt.Errorf("body contains unknown key %s", fieldName)
+
+		case errors.As(err, &maxBytesError):
+			return fmt.Errorf("body must not be larger than %d bytes", maxBytesError.Limit)
+
+		case errors.As(err, &invalidUnmarshalError):
+			panic(err)
+
+		default:
+			return err
+		}
+	}
+
+	err = dec.Decode(&struct{}{})
+	if !errors.Is(err, io.EOF) {
+		return errors.New("body must only contain a single JSON value")
+	}
+
+	return nil
+}
+
+// maxDatamapUploadSize is the largest datamap file we accept
+const maxDatamapUploadSize = 10 << 20 // 10Mb
+
+// readDatamapUpload reads the datamap sent with r, either as the "file" field of a
+// multipart form, whose format is worked out by DetectDatamapFormat, or as the body of
+// the request, whose format is given by its Content-Type. A name or description given
+// in the form or the query string replaces any in the file. It returns
+// ErrUnsupportedDatamapFormat for a body in a format we don't read.
+func (app *application) readDatamapUpload(w http.ResponseWriter, r *http.Request) (*Datamap, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxDatamapUploadSize)
+
+	var dm *Datamap
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "multipart/form-data" {
+		err := r.ParseMultipartForm(maxDatamapUploadSize)
+		if err != nil {
+			return nil, err
+		}
+		file, header, err := r.FormFile("file")
+		if err != nil {
+			return nil, errors.New("Missing file")
+		}
+		defer file.Close()
+
+		dm, err = readDatamapFile(file, header)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		format := DatamapFormatForContentType(r.Header.Get("Content-Type"))
+		if format == nil {
+			return nil, ErrUnsupportedDatamapFormat
+		}
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			return nil, err
+		}
+		dm, err = ReadDatamap(data, format)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if name := r.FormValue("name"); name != "" {
+		dm.Name = name
+	}
+	if description := r.FormValue("description"); description != "" {
+		dm.Description = description
+	}
+	if mode := r.FormValue("value_mode"); mode != "" {
+		dm.ValueMode = ValueMode(mode)
+	}
+	return dm, nil
+}
+
+// readDatamapFile reads a datamap uploaded as a file in a multipart form.
+func readDatamapFile(file multipart.File, header *multipart.FileHeader) (*Datamap, error) {
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+	format := DetectDatamapFormat(header.Header.Get("Content-Type"), header.Filename, data)
+	return ReadDatamap(data, format)
+}
+
+// readDatamapFormat reads the format in which to send a datamap from the "format"
+// value in the query string or, without one, from the Accept header. If the format
+// named isn't one of DatamapFormats, then we record an error message in the provided
+// Validator instance. It returns nil if the Accept header allows none of them.
+func (app *application) readDatamapFormat(r *http.Request, qs url.Values, v *Validator) *DatamapFormat {
+	format := NegotiateDatamapFormat(r.Header.Get("Accept"))
+	if name := app.readString(qs, "format", ""); name != "" {
+		var names []string
+		for _, f := range DatamapFormats {
+			names = append(names, f.Name)
+		}
+		format = DatamapFormatByName(name)
+		v.Check(format != nil, "format", "must be one of "+strings.Join(names, ", "))
+	}
+	return format
+}
+
+// datamapContentTypeList returns the content types of DatamapFormats, for a 406 Not
+// Acceptable response.
+func datamapContentTypeList() []string {
+	var contentTypes []string
+	for _, f := range DatamapFormats {
+		contentTypes = append(contentTypes, f.ContentType)
+	}
+	return contentTypes
+}
+
+// writeDatamapFile sends dm in format as a file to download called filename, to which
+// the format's extension is added.
+func (app *application) writeDatamapFile(w http.ResponseWriter, r *http.Request, dm *Datamap, format *DatamapFormat, filename string) {
+	// Encode first so that a failure can still be sent as an error response
+	var buf bytes.Buffer
+	err := WriteDatamap(&buf, dm, format)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	contentType := format.ContentType
+	if format != DatamapXLSX {
+		contentType += "; charset=utf-8"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename+format.Ext))
+	w.Header().Add("Vary", "Accept")
+	_, err = buf.WriteTo(w)
+	if err != nil {
+		app.logError(r, err)
+	}
+}
+
+// readString returns a string value from the query string, or the provided default
+// value if no matching key could be found.
+func (app *application) readString(qs url.Values, key string, defaultValue string) string {
+	s := qs.Get(key)
+	if s == "" {
+		return defaultValue
+	}
+	return s
+}
+
+// readInt reads a string value from the query string and converts it to an integer
+// before returning. If no matching key could be found it returns the provided default
+// value. If the value couldn't be converted to an integer, then we record an error
+// message in the provided Validator instance.
+func (app *application) readInt(qs url.Values, key string, defaultValue int, v *Validator) int {
+	s := qs.Get(key)
+	if s == "" {
+		return defaultValue
+	}
+
+	i, err := strconv.Atoi(s)
+	if err != nil {
+		v.AddError(key, "must be an integer value")
+		return defaultValue
+	}
+	return i
+}
+
+// readIDList reads a comma-separated list of ids, such as "1,4,7", from the query
+// string. If no matching key could be found it returns nil. If any of the values isn't
+// a positive integer, then we record an error message in the provided Validator
+// instance.
+func (app *application) readIDList(qs url.Values, key string, v *Validator) []int64 {
+	s := qs.Get(key)
+	if s == "" {
+		return nil
+	}
+
+	var ids []int64
+	for _, part := range strings.Split(s, ",") {
+		id, err := strconv.ParseInt(strings.TrimSpace(part), 10, 64)
+		if err != nil || id < 1 {
+			v.AddError(key, "must be a comma-separated list of ids")
+			return nil
+		}
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// readValueMode reads the "value_mode" value from the query string, which chooses what
+// is read from cells holding a formula. If no matching key could be found it returns
+// the default mode of dm, or ValueCached if it has none. If the value isn't one of
+// ValueModes, then we record an error message in the provided Validator instance.
+func (app *application) readValueMode(qs url.Values, dm *Datamap, v *Validator) ValueMode {
+	def := dm.ValueMode
+	if def == "" {
+		def = ValueCached
+	}
+	mode := ValueMode(app.readString(qs, "value_mode", string(def)))
+	v.Check(PermittedValue(mode, ValueModes...), "value_mode", "must be one of cached, formatted or formula")
+	return mode
+}
+
+// background runs fn in a new goroutine, recovering and logging any panic so that it
+// can't bring down the server.
+func (app *application) background(fn func()) {
+	go func() {
+		defer func() {
+			if err := recover(); err != nil {
+				app.logger.Error(fmt.Sprintf("%v", err))
+			}
+		}()
+
+		fn()
+	}()
+}
+
+// uploadTimeout is how long a client has to send a file upload and read the response.
+// The server's ReadTimeout and WriteTimeout are far too short for a large batch of
+// returns.
+const uploadTimeout = 5 * time.Minute
+
+// allowUpload extends the read and write deadlines of the connection to uploadTimeout
+// before calling next, for the routes which accept file uploads.
+func (app *application) allowUpload(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rc := http.NewResponseController(w)
+		deadline := time.Now().Add(uploadTimeout)
+		for _, extend := range []func(time.Time) error{rc.SetReadDeadline, rc.SetWriteDeadline} {
+			// Recorders used in tests don't support deadlines
+			if err := extend(deadline); err != nil && !errors.Is(err, http.ErrNotSupported) {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+		}
+		next(w, r)
+	}
 }
 
 // We want this so that our JSON is nested under a key at the top, e.g. "Datamap:"...
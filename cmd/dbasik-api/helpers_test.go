@@ -0,0 +1,161 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestReadIDParam(t *testing.T) {
+	app := &application{}
+
+	tests := []struct {
+		id      string
+		want    int64
+		wantErr bool
+	}{
+		{id: "1", want: 1},
+		{id: "42", want: 42},
+		{id: "0", wantErr: true},
+		{id: "-3", wantErr: true},
+		{id: "bobbins", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.id, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/v1/datamaps/"+tt.id, nil)
+			r.SetPathValue("id", tt.id)
+			got, err := app.readIDParam(r)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("readIDParam() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("readIDParam() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadIDList(t *testing.T) {
+	app := &application{}
+
+	tests := []struct {
+		qs      string
+		want    []int64
+		wantErr bool
+	}{
+		{qs: "", want: nil},
+		{qs: "returns=3", want: []int64{3}},
+		{qs: "returns=3,1, 2", want: []int64{3, 1, 2}},
+		{qs: "returns=3,,2", wantErr: true},
+		{qs: "returns=3,0", wantErr: true},
+		{qs: "returns=all", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.qs, func(t *testing.T) {
+			qs, err := url.ParseQuery(tt.qs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			v := NewValidator()
+			got := app.readIDList(qs, "returns", v)
+			if v.Valid() == tt.wantErr {
+				t.Fatalf("readIDList() errors = %v, wantErr %v", v.Errors, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("readIDList() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadValueMode(t *testing.T) {
+	app := &application{}
+
+	tests := []struct {
+		qs      string
+		dm      Datamap
+		want    ValueMode
+		wantErr bool
+	}{
+		{qs: "", want: ValueCached},
+		{qs: "", dm: Datamap{ValueMode: ValueFormula}, want: ValueFormula},
+		{qs: "value_mode=formatted", dm: Datamap{ValueMode: ValueFormula}, want: ValueFormatted},
+		{qs: "value_mode=raw", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.qs+"/"+string(tt.dm.ValueMode), func(t *testing.T) {
+			qs, err := url.ParseQuery(tt.qs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			v := NewValidator()
+			got := app.readValueMode(qs, &tt.dm, v)
+			if v.Valid() == tt.wantErr {
+				t.Fatalf("readValueMode() errors = %v, wantErr %v", v.Errors, tt.wantErr)
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Errorf("readValueMode() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAllowUpload(t *testing.T) {
+	app := &application{}
+	read := func(w http.ResponseWriter, r *http.Request) {
+		b, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Write(b)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /slow", read)
+	mux.HandleFunc("POST /upload", app.allowUpload(read))
+
+	srv := httptest.NewUnstartedServer(mux)
+	srv.Config.ReadTimeout = 100 * time.Millisecond
+	srv.Start()
+	defer srv.Close()
+
+	// slowBody sends its data a byte at a time, taking longer than the ReadTimeout
+	slowBody := func() io.Reader {
+		pr, pw := io.Pipe()
+		go func() {
+			for _, c := range []byte("return") {
+				time.Sleep(50 * time.Millisecond)
+				pw.Write([]byte{c})
+			}
+			pw.Close()
+		}()
+		return pr
+	}
+
+	res, err := http.Post(srv.URL+"/upload", "application/octet-stream", slowBody())
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || string(body) != "return" {
+		t.Errorf("slow upload = %d %q, want 200 \"return\"", res.StatusCode, body)
+	}
+
+	// Without allowUpload the same request runs out of time
+	res, err = http.Post(srv.URL+"/slow", "application/octet-stream", slowBody())
+	if err == nil {
+		body, _ = io.ReadAll(res.Body)
+		res.Body.Close()
+		if res.StatusCode == http.StatusOK && string(body) == "return" {
+			t.Errorf("slow request without allowUpload succeeded")
+		}
+	}
+}
@@ -0,0 +1,464 @@
+// dbasik provides a service with which to convert spreadsheets containing
+// data to JSON for further processing.
+
+// Copyright (C) 2024 M R Lemon
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"os"
+	"time"
+)
+
+// Statuses of a Job
+const (
+	JobPending   = "pending"
+	JobRunning   = "running"
+	JobCompleted = "completed"
+)
+
+// Statuses of a JobItem
+const (
+	ItemPending    = "pending"
+	ItemProcessing = "processing"
+	ItemSucceeded  = "succeeded"
+	ItemFailed     = "failed"
+)
+
+// Job is a batch of workbooks which are parsed in the background against one
+// revision of a Datamap, reading each cell according to ValueMode. Dir is the working
+// directory holding the workbooks, which is removed when the job completes.
+type Job struct {
+	ID        int64     `json:"id"`
+	Status    string    `json:"status"`
+	DatamapID int64     `json:"datamap_id"`
+	Revision  int       `json:"revision"`
+	ValueMode ValueMode `json:"value_mode"`
+	Created   time.Time `json:"created"`
+	Updated   time.Time `json:"updated"`
+	Counts    JobCounts `json:"counts"`
+	Items     []JobItem `json:"items,omitempty"`
+	Dir       string    `json:"-"`
+}
+
+// JobCounts tallies the items of a Job by status.
+type JobCounts struct {
+	Total      int `json:"total"`
+	Pending    int `json:"pending"`
+	Processing int `json:"processing"`
+	Succeeded  int `json:"succeeded"`
+	Failed     int `json:"failed"`
+}
+
+// JobItem is a single workbook within a Job. ReturnID is set once the workbook has
+// been parsed and saved, Error if that failed.
+type JobItem struct {
+	ID       int64  `json:"id"`
+	JobID    int64  `json:"-"`
+	File     string `json:"file"`
+	Path     string `json:"-"`
+	Status   string `json:"status"`
+	ReturnID int64  `json:"return_id,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+type jobModel struct {
+	DB *sql.DB
+}
+
+// countItems tallies items by status.
+func countItems(items []JobItem) JobCounts {
+	c := JobCounts{Total: len(items)}
+	for _, item := range items {
+		switch item.Status {
+		case ItemPending:
+			c.Pending++
+		case ItemProcessing:
+			c.Processing++
+		case ItemSucceeded:
+			c.Succeeded++
+		case ItemFailed:
+			c.Failed++
+		}
+	}
+	return c
+}
+
+// Insert saves a new Job and its items in a single transaction, setting the IDs of
+// each. Items which haven't already failed are saved as pending. A job with nothing
+// to process is saved as completed.
+func (m *jobModel) Insert(job *Job) error {
+	for i := range job.Items {
+		if job.Items[i].Status != ItemFailed {
+			job.Items[i].Status = ItemPending
+		}
+	}
+	job.Counts = countItems(job.Items)
+
+	job.Status = JobPending
+	if job.Counts.Pending == 0 {
+		job.Status = JobCompleted
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if job.ValueMode == "" {
+		job.ValueMode = ValueCached
+	}
+
+	err = tx.QueryRowContext(ctx, `INSERT INTO jobs (status, datamap_id, revision, value_mode, dir, created, updated)
+		VALUES ($1, $2, $3, $4, $5, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)
+		RETURNING id, created, updated`, job.Status, job.DatamapID, job.Revision, job.ValueMode, job.Dir,
+	).Scan(&job.ID, &job.Created, &job.Updated)
+	if err != nil {
+		return err
+	}
+
+	stmt, err := tx.PrepareContext(ctx, `INSERT INTO job_items (job_id, file, path, status, error)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING job_item_id`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for i := range job.Items {
+		item := &job.Items[i]
+		item.JobID = job.ID
+		err := stmt.QueryRowContext(ctx, item.JobID, item.File, item.Path, item.Status, item.Error).Scan(&item.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Get retrieves the Job with the given id along with all of its items.
+func (m *jobModel) Get(id int64) (*Job, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var job Job
+	err := m.DB.QueryRowContext(ctx, `SELECT id, status, datamap_id, revision, value_mode, dir, created, updated
+		FROM jobs
+		WHERE id = $1`, id).Scan(
+		&job.ID,
+		&job.Status,
+		&job.DatamapID,
+		&job.Revision,
+		&job.ValueMode,
+		&job.Dir,
+		&job.Created,
+		&job.Updated,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	rows, err := m.DB.QueryContext(ctx, `SELECT job_item_id, job_id, file, path, status, return_id, error
+		FROM job_items
+		WHERE job_id = $1
+		ORDER BY job_item_id`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	job.Items = []JobItem{}
+	for rows.Next() {
+		var item JobItem
+		var returnID sql.NullInt64
+		err := rows.Scan(&item.ID, &item.JobID, &item.File, &item.Path, &item.Status, &returnID, &item.Error)
+		if err != nil {
+			return nil, err
+		}
+		item.ReturnID = returnID.Int64
+		job.Items = append(job.Items, item)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	job.Counts = countItems(job.Items)
+
+	return &job, nil
+}
+
+// Claim marks a pending item as processing, and its job as running, and returns the
+// item. ErrRecordNotFound is returned if the item doesn't exist or has already been
+// claimed, so that no item is ever processed twice. Both changes are made in one
+// transaction, and the item is only claimed by the UPDATE which finds it pending, so
+// two workers can't claim the same item.
+func (m *jobModel) Claim(itemID int64) (*JobItem, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	item := JobItem{ID: itemID, Status: ItemProcessing}
+	err = tx.QueryRowContext(ctx, `UPDATE job_items
+		SET status = $1
+		WHERE job_item_id = $2 AND status = $3
+		RETURNING job_id, file, path`, ItemProcessing, itemID, ItemPending,
+	).Scan(&item.JobID, &item.File, &item.Path)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, `UPDATE jobs SET status = $1, updated = CURRENT_TIMESTAMP
+		WHERE id = $2 AND status = $3`, JobRunning, item.JobID, JobPending)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return &item, nil
+}
+
+// Finish records the outcome of a claimed item and returns the status of its job,
+// which becomes completed once none of its items are left to process.
+func (m *jobModel) Finish(item *JobItem) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `UPDATE job_items
+		SET status = $1, return_id = $2, error = $3
+		WHERE job_item_id = $4`, item.Status, nullInt64(item.ReturnID), item.Error, item.ID)
+	if err != nil {
+		return "", err
+	}
+
+	var status string
+	err = tx.QueryRowContext(ctx, `UPDATE jobs
+		SET status = CASE WHEN EXISTS (
+				SELECT 1 FROM job_items WHERE job_id = $1 AND status IN ($2, $3)
+			) THEN $4 ELSE $5 END,
+			updated = CURRENT_TIMESTAMP
+		WHERE id = $1
+		RETURNING status`, item.JobID, ItemPending, ItemProcessing, JobRunning, JobCompleted,
+	).Scan(&status)
+	if err != nil {
+		return "", err
+	}
+
+	return status, tx.Commit()
+}
+
+// Unfinished returns the ids of every job with items still to process, oldest first.
+// Items left processing by a previous run of the server are put back to pending.
+func (m *jobModel) Unfinished() ([]int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `UPDATE job_items SET status = $1 WHERE status = $2`,
+		ItemPending, ItemProcessing)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := m.DB.QueryContext(ctx, `SELECT DISTINCT job_id FROM job_items
+		WHERE status = $1
+		ORDER BY job_id`, ItemPending)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []int64{}
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// startJobWorkers starts n goroutines which process jobs as their ids arrive on
+// app.jobQueue, then queues any jobs left unfinished by a previous run.
+func (app *application) startJobWorkers(n int) error {
+	for i := 0; i < n; i++ {
+		go func() {
+			for id := range app.jobQueue {
+				app.processJob(id)
+			}
+		}()
+	}
+
+	ids, err := app.models.Jobs.Unfinished()
+	if err != nil {
+		return err
+	}
+	if len(ids) > 0 {
+		app.logger.Info("resuming unfinished jobs", "count", len(ids))
+		app.enqueueJobs(ids)
+	}
+	return nil
+}
+
+// enqueueJobs sends ids to the workers from a background goroutine, so that the
+// caller never blocks on a full queue.
+func (app *application) enqueueJobs(ids []int64) {
+	app.background(func() {
+		for _, id := range ids {
+			app.jobQueue <- id
+		}
+	})
+}
+
+// processJob claims the pending items of a job and parses their workbooks with
+// ParseWorkbooks, app.config.jobs.concurrency at a time. The workbooks are parsed in
+// rounds of that size so that the outcome of each item is recorded as the job goes,
+// rather than once every workbook has been parsed.
+func (app *application) processJob(id int64) {
+	job, err := app.models.Jobs.Get(id)
+	if err != nil {
+		if !errors.Is(err, ErrRecordNotFound) {
+			app.logger.Error("cannot load job", "id", id, "error", err)
+		}
+		return
+	}
+
+	items := []*JobItem{}
+	for _, pending := range job.Items {
+		if pending.Status != ItemPending {
+			continue
+		}
+		item, err := app.models.Jobs.Claim(pending.ID)
+		if err != nil {
+			if !errors.Is(err, ErrRecordNotFound) {
+				app.logger.Error("cannot claim job item", "id", pending.ID, "error", err)
+			}
+			continue
+		}
+		items = append(items, item)
+	}
+	if len(items) == 0 {
+		return
+	}
+
+	dm, dmErr := app.models.Datamaps.GetRevision(job.DatamapID, job.Revision)
+	concurrency := max(1, app.config.jobs.concurrency)
+	for start := 0; start < len(items); start += concurrency {
+		round := items[start:min(start+concurrency, len(items))]
+
+		var results []ParseResult
+		if dmErr != nil {
+			results = make([]ParseResult, len(round))
+			for i := range results {
+				results[i].Err = dmErr
+			}
+		} else {
+			paths := make([]string, len(round))
+			for i, item := range round {
+				paths[i] = item.Path
+			}
+			results = ParseWorkbooks(context.Background(), paths, dm, concurrency, job.ValueMode)
+		}
+
+		for i, res := range results {
+			app.finishJobItem(job, round[i], dm, res)
+		}
+	}
+}
+
+// finishJobItem saves the Return parsed for item and records the outcome against the
+// item. Once the last item of the job has been processed the job's working directory
+// is removed.
+func (app *application) finishJobItem(job *Job, item *JobItem, dm *Datamap, res ParseResult) {
+	rtn, err := res.Return, res.Err
+	if err == nil {
+		err = app.saveJobReturn(item, rtn, dm)
+	}
+	if err != nil {
+		item.Status = ItemFailed
+		item.Error = err.Error()
+	} else {
+		item.Status = ItemSucceeded
+		item.ReturnID = rtn.ID
+	}
+
+	status, err := app.models.Jobs.Finish(item)
+	if err != nil {
+		app.logger.Error("cannot record job item outcome", "id", item.ID, "error", err)
+		return
+	}
+
+	if status == JobCompleted {
+		job, err := app.models.Jobs.Get(job.ID)
+		if err != nil {
+			app.logger.Error("cannot load completed job", "id", item.JobID, "error", err)
+			return
+		}
+		if err := os.RemoveAll(job.Dir); err != nil {
+			app.logger.Error("cannot remove job directory", "dir", job.Dir, "error", err)
+		}
+		app.logger.Info("job completed", "id", job.ID, "succeeded", job.Counts.Succeeded, "failed", job.Counts.Failed)
+	}
+}
+
+// saveJobReturn matches rtn, parsed from the workbook for item, to a project and
+// saves it. A return which can't be matched is saved as unmatched rather than thrown
+// away, as it can be matched again later.
+func (app *application) saveJobReturn(item *JobItem, rtn *Return, dm *Datamap) error {
+	err := app.matchProject(rtn, dm)
+	if err != nil {
+		app.logger.Error("cannot match return to a project", "file", item.File, "error", err)
+		rtn.ProjectID, rtn.ProjectMatch, rtn.ProjectCandidates = 0, MatchUnmatched, nil
+	}
+	err = app.models.Returns.Insert(rtn)
+	if err != nil {
+		app.logger.Error("cannot save return", "file", item.File, "error", err)
+		return errors.New("the return could not be saved")
+	}
+	return nil
+}
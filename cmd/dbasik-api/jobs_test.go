@@ -0,0 +1,269 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestCountItems(t *testing.T) {
+	items := []JobItem{
+		{Status: ItemPending},
+		{Status: ItemProcessing},
+		{Status: ItemSucceeded},
+		{Status: ItemSucceeded},
+		{Status: ItemFailed},
+	}
+	want := JobCounts{Total: 5, Pending: 1, Processing: 1, Succeeded: 2, Failed: 1}
+	if got := countItems(items); got != want {
+		t.Errorf("countItems() = %+v, want %+v", got, want)
+	}
+}
+
+// insertTestJob saves a job against a new datamap with an item for each of files.
+func insertTestJob(t *testing.T, app *application, files ...string) *Job {
+	t.Helper()
+	datamapID := insertTestDatamap(t, app, []DatamapLine{{Key: "Key 1", Sheet: "Sheet1", DataType: "TEXT", CellRef: "A1"}})
+	job := &Job{DatamapID: datamapID, Revision: 1, Dir: t.TempDir()}
+	for _, file := range files {
+		job.Items = append(job.Items, JobItem{File: file, Path: filepath.Join(job.Dir, file)})
+	}
+	if err := app.models.Jobs.Insert(job); err != nil {
+		t.Fatal(err)
+	}
+	return job
+}
+
+func TestJobInsert(t *testing.T) {
+	app := newTestApp(t)
+
+	job := &Job{DatamapID: insertTestDatamap(t, app, nil), Revision: 1, Dir: t.TempDir(), Items: []JobItem{
+		{File: "a.xlsx", Path: "/jobs/a.xlsx", Status: ItemSucceeded},
+		{File: "notes.txt", Status: ItemFailed, Error: "not a workbook"},
+	}}
+	if err := app.models.Jobs.Insert(job); err != nil {
+		t.Fatal(err)
+	}
+	if job.ID == 0 || job.Items[0].ID == 0 || job.Items[1].ID == 0 {
+		t.Fatalf("Insert() did not set the ids of %+v", job)
+	}
+	if job.Status != JobPending || job.ValueMode != ValueCached {
+		t.Errorf("Insert() status = %s, value mode = %s, want %s and %s", job.Status, job.ValueMode, JobPending, ValueCached)
+	}
+
+	got, err := app.models.Jobs.Get(job.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := JobCounts{Total: 2, Pending: 1, Failed: 1}
+	if got.Counts != want {
+		t.Errorf("Get() counts = %+v, want %+v", got.Counts, want)
+	}
+	if got.Items[1].Error != "not a workbook" {
+		t.Errorf("Get() error of failed item = %q, want %q", got.Items[1].Error, "not a workbook")
+	}
+
+	// A job whose items have all failed has nothing left to do
+	done := &Job{DatamapID: job.DatamapID, Revision: 1, Dir: t.TempDir(), Items: []JobItem{{File: "x", Status: ItemFailed}}}
+	if err := app.models.Jobs.Insert(done); err != nil {
+		t.Fatal(err)
+	}
+	if done.Status != JobCompleted {
+		t.Errorf("Insert() status of job with no pending items = %s, want %s", done.Status, JobCompleted)
+	}
+}
+
+func TestJobClaim(t *testing.T) {
+	app := newTestApp(t)
+	job := insertTestJob(t, app, "a.xlsx")
+	itemID := job.Items[0].ID
+
+	item, err := app.models.Jobs.Claim(itemID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.Status != ItemProcessing || item.JobID != job.ID || item.File != "a.xlsx" {
+		t.Errorf("Claim() = %+v", item)
+	}
+	got, err := app.models.Jobs.Get(job.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Status != JobRunning || got.Items[0].Status != ItemProcessing {
+		t.Errorf("after Claim() job status = %s, item status = %s", got.Status, got.Items[0].Status)
+	}
+
+	if _, err := app.models.Jobs.Claim(itemID); !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("Claim() of a claimed item error = %v, expected ErrRecordNotFound", err)
+	}
+	if _, err := app.models.Jobs.Claim(itemID + 100); !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("Claim() of a missing item error = %v, expected ErrRecordNotFound", err)
+	}
+}
+
+func TestJobClaimConcurrently(t *testing.T) {
+	app := newTestApp(t)
+	job := insertTestJob(t, app, "a.xlsx")
+
+	const workers = 8
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := app.models.Jobs.Claim(job.Items[0].ID)
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	claimed := 0
+	for err := range errs {
+		switch {
+		case err == nil:
+			claimed++
+		case !errors.Is(err, ErrRecordNotFound):
+			t.Errorf("Claim() error = %v", err)
+		}
+	}
+	if claimed != 1 {
+		t.Errorf("item was claimed %d times, want once", claimed)
+	}
+}
+
+func TestJobFinish(t *testing.T) {
+	app := newTestApp(t)
+	job := insertTestJob(t, app, "a.xlsx", "b.xlsx")
+
+	rtn := &Return{Name: "a.xlsx", DatamapID: job.DatamapID, Revision: 1}
+	if err := app.models.Returns.Insert(rtn); err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := app.models.Jobs.Claim(job.Items[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first.Status, first.ReturnID = ItemSucceeded, rtn.ID
+	status, err := app.models.Jobs.Finish(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != JobRunning {
+		t.Errorf("Finish() with an item left = %s, want %s", status, JobRunning)
+	}
+
+	second, err := app.models.Jobs.Claim(job.Items[1].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second.Status, second.Error = ItemFailed, "cannot parse workbook"
+	status, err = app.models.Jobs.Finish(second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != JobCompleted {
+		t.Errorf("Finish() of the last item = %s, want %s", status, JobCompleted)
+	}
+
+	got, err := app.models.Jobs.Get(job.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Status != JobCompleted || got.Counts != (JobCounts{Total: 2, Succeeded: 1, Failed: 1}) {
+		t.Errorf("Get() status = %s, counts = %+v", got.Status, got.Counts)
+	}
+	if got.Items[0].ReturnID != rtn.ID || got.Items[1].Error != "cannot parse workbook" {
+		t.Errorf("Get() items = %+v", got.Items)
+	}
+}
+
+func TestJobUnfinished(t *testing.T) {
+	app := newTestApp(t)
+	job := insertTestJob(t, app, "a.xlsx", "b.xlsx", "c.xlsx")
+
+	// a.xlsx was being processed when the server stopped, and c.xlsx had finished
+	if _, err := app.models.Jobs.Claim(job.Items[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	done, err := app.models.Jobs.Claim(job.Items[2].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done.Status = ItemSucceeded
+	if _, err := app.models.Jobs.Finish(done); err != nil {
+		t.Fatal(err)
+	}
+
+	finished := insertTestJob(t, app, "d.xlsx")
+	item, err := app.models.Jobs.Claim(finished.Items[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	item.Status = ItemFailed
+	if _, err := app.models.Jobs.Finish(item); err != nil {
+		t.Fatal(err)
+	}
+
+	ids, err := app.models.Jobs.Unfinished()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 1 || ids[0] != job.ID {
+		t.Errorf("Unfinished() = %v, want [%d]", ids, job.ID)
+	}
+	if _, err := app.models.Jobs.Claim(job.Items[0].ID); err != nil {
+		t.Errorf("Claim() of a resumed item error = %v", err)
+	}
+}
+
+func TestProcessJob(t *testing.T) {
+	app := newTestApp(t)
+	app.config.jobs.concurrency = 2
+	job := insertTestJob(t, app, "valid_excel.xlsx", "notes.xlsx", "other.xlsx")
+
+	workbook, err := os.ReadFile("../../testdata/valid_excel.xlsx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(job.Items[0].Path, workbook, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(job.Items[1].Path, []byte("not a workbook"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(job.Items[2].Path, workbook, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	app.processJob(job.ID)
+
+	got, err := app.models.Jobs.Get(job.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Status != JobCompleted || got.Counts != (JobCounts{Total: 3, Succeeded: 2, Failed: 1}) {
+		t.Fatalf("Get() status = %s, counts = %+v", got.Status, got.Counts)
+	}
+	if got.Items[1].Error == "" {
+		t.Errorf("failed item has no error")
+	}
+
+	rtn, err := app.models.Returns.Get(got.Items[0].ReturnID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rtn.ValueMode != ValueCached {
+		t.Errorf("saved return value mode = %s, want the job's %s", rtn.ValueMode, ValueCached)
+	}
+	if len(rtn.ReturnLines) != 1 || rtn.ReturnLines[0].Value != "Value 1" {
+		t.Errorf("saved return lines = %+v, want Value 1 from A1", rtn.ReturnLines)
+	}
+	if _, err := os.Stat(job.Dir); !os.IsNotExist(err) {
+		t.Errorf("job directory %s was not removed when the job completed", job.Dir)
+	}
+}
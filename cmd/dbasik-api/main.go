@@ -29,6 +29,9 @@ import (
 	"log/slog"
 	"net/http"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
 	"time"
 
 	"github.com/joho/godotenv"
@@ -43,14 +46,20 @@ type config struct {
 	port int
 	env  string
 	db   string
+	jobs struct {
+		workers     int
+		concurrency int
+		dir         string
+	}
 }
 
 // This application struct holds the dependencies for our HTTP handlers, helpers and
 // middleware.
 type application struct {
-	config config
-	logger *slog.Logger
-	models Models
+	config   config
+	logger   *slog.Logger
+	models   Models
+	jobQueue chan int64
 }
 
 func main() {
@@ -66,6 +75,9 @@ func main() {
 	flag.IntVar(&cfg.port, "port", 5000, "API server port")
 	flag.StringVar(&cfg.env, "env", "development", "Environment (development|staging|production)")
 	flag.StringVar(&cfg.db, "db-dsn", os.Getenv("DBASIK_DB_DSN"), "sqlite3 DSN")
+	flag.IntVar(&cfg.jobs.workers, "job-workers", 4, "Number of batches of returns parsed at once in the background")
+	flag.IntVar(&cfg.jobs.concurrency, "job-concurrency", runtime.NumCPU(), "Number of workbooks parsed at once within each batch")
+	flag.StringVar(&cfg.jobs.dir, "job-dir", filepath.Join(os.TempDir(), "dbasik-jobs"), "Directory holding workbooks waiting to be parsed")
 
 	flag.Parse()
 
@@ -83,9 +95,23 @@ func main() {
 
 	// An instance of application struct, containing the config struct and the logger
 	app := &application{
-		config: cfg,
-		logger: logger,
-		models: NewModels(db),
+		config:   cfg,
+		logger:   logger,
+		models:   NewModels(db),
+		jobQueue: make(chan int64, 100),
+	}
+
+	// Start the workers which parse batches of returns in the background. This also
+	// picks up anything left unfinished when the server last stopped.
+	err = os.MkdirAll(cfg.jobs.dir, 0o755)
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+	err = app.startJobWorkers(cfg.jobs.workers)
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
 	}
 
 	// Declare an http server which listens provided in the config struct and has
@@ -108,7 +134,7 @@ func main() {
 }
 
 func openDB(cfg config) (*sql.DB, error) {
-	db, err := sql.Open("sqlite3", cfg.db)
+	db, err := sql.Open("sqlite3", sqliteDSN(cfg.db))
 	if err != nil {
 		return nil, err
 	}
@@ -125,3 +151,16 @@ func openDB(cfg config) (*sql.DB, error) {
 
 	return db, nil
 }
+
+// sqliteDSN turns on foreign key enforcement in dsn, which SQLite leaves off unless
+// each connection asks for it, so that the ON DELETE CASCADE and SET NULL actions
+// the schema relies on are carried out. A dsn which already sets it is left alone.
+func sqliteDSN(dsn string) string {
+	if strings.Contains(dsn, "_foreign_keys=") || strings.Contains(dsn, "_fk=") {
+		return dsn
+	}
+	if strings.Contains(dsn, "?") {
+		return dsn + "&_foreign_keys=on"
+	}
+	return dsn + "?_foreign_keys=on"
+}
@@ -0,0 +1,17 @@
+package main
+
+import "testing"
+
+func TestSqliteDSN(t *testing.T) {
+	tests := map[string]string{
+		"dbasik.db":                        "dbasik.db?_foreign_keys=on",
+		"file:dbasik.db?cache=shared":      "file:dbasik.db?cache=shared&_foreign_keys=on",
+		"file:dbasik.db?_foreign_keys=off": "file:dbasik.db?_foreign_keys=off",
+		"dbasik.db?_fk=1":                  "dbasik.db?_fk=1",
+	}
+	for dsn, want := range tests {
+		if got := sqliteDSN(dsn); got != want {
+			t.Errorf("sqliteDSN(%q) = %q, want %q", dsn, got, want)
+		}
+	}
+}
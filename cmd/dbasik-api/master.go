@@ -0,0 +1,188 @@
+// dbasik provides a service with which to convert spreadsheets containing
+// data to JSON for further processing.
+
+// Copyright (C) 2024 M R Lemon
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/tealeg/xlsx/v3"
+)
+
+// masterSheet is the name of the sheet in a master workbook
+const masterSheet = "Master"
+
+// Excel number formats given to typed values written to a workbook
+const (
+	dateFormat       = "yyyy-mm-dd"
+	dateTimeFormat   = "yyyy-mm-dd hh:mm:ss"
+	percentageFormat = "0.00%"
+	currencyFormat   = `"£"#,##0.00`
+)
+
+// BuildMaster compiles the master workbook for dm from returns: the datamap's keys
+// down column A and the values from each return in the columns which follow, headed
+// with the name of the return. Values are matched to keys by key, so a return parsed
+// against an earlier revision of dm contributes the values for the keys it shares with
+// dm. Keys are written once, in datamap order, even if dm repeats them.
+func BuildMaster(dm *Datamap, returns []*Return) (*xlsx.File, error) {
+	wb := xlsx.NewFile()
+	sh, err := wb.AddSheet(masterSheet)
+	if err != nil {
+		return nil, err
+	}
+
+	header := sh.AddRow()
+	header.AddCell().SetString("Key")
+	for _, rtn := range returns {
+		header.AddCell().SetString(rtn.Name)
+	}
+
+	values := make([]map[string]ReturnLine, len(returns))
+	for i, rtn := range returns {
+		values[i] = make(map[string]ReturnLine, len(rtn.ReturnLines))
+		for _, rl := range rtn.ReturnLines {
+			if _, ok := values[i][rl.Key]; !ok {
+				values[i][rl.Key] = rl
+			}
+		}
+	}
+
+	seen := make(map[string]bool, len(dm.DMLs))
+	for _, dml := range dm.DMLs {
+		if seen[dml.Key] {
+			continue
+		}
+		seen[dml.Key] = true
+
+		row := sh.AddRow()
+		row.AddCell().SetString(dml.Key)
+		for i := range returns {
+			cell := row.AddCell()
+			if rl, ok := values[i][dml.Key]; ok {
+				if err := setCellValue(cell, rl); err != nil {
+					return nil, fmt.Errorf("%s in return %q: %w", dml.Key, returns[i].Name, err)
+				}
+			}
+		}
+	}
+
+	sh.SetColWidth(1, 1, 50)
+	if len(returns) > 0 {
+		sh.SetColWidth(2, len(returns)+1, 25)
+	}
+
+	return wb, nil
+}
+
+// setCellValue writes the value of rl to cell with the cell type and number format for
+// rl.DataType. A value which couldn't be converted when the return was parsed is
+// written as the raw string from the return, so that nothing submitted is lost.
+func setCellValue(cell *xlsx.Cell, rl ReturnLine) error {
+	if rl.Value == nil {
+		if rl.Raw != "" {
+			cell.SetString(rl.Raw)
+		}
+		return nil
+	}
+
+	switch v := rl.Value.(type) {
+	case string:
+		t, err := parseISODate(rl.DataType, v)
+		if err != nil {
+			cell.SetString(v)
+			break
+		}
+		format := dateFormat
+		if normaliseDataType(rl.DataType) == TypeDateTime {
+			format = dateTimeFormat
+		}
+		cell.SetDateWithOptions(t, xlsx.DateTimeOptions{Location: time.UTC, ExcelTimeFormat: format})
+	case float64:
+		switch normaliseDataType(rl.DataType) {
+		case TypePercentage:
+			cell.SetFloatWithFormat(v, percentageFormat)
+		case TypeCurrency, TypeGBP:
+			cell.SetFloatWithFormat(v, currencyFormat)
+		default:
+			cell.SetFloat(v)
+		}
+	case int64:
+		cell.SetInt64(v)
+	case bool:
+		cell.SetBool(v)
+	case []map[string]any:
+		// The records of a TABLE line go into a single cell, as JSON
+		cell.SetString(formatValue(v))
+	default:
+		return fmt.Errorf("cannot write a value of type %T", v)
+	}
+	return nil
+}
+
+// ReadMasterColumn reads the values of the return headed column in a master workbook
+// made by BuildMaster, keyed by the keys in column A. The values are the raw strings
+// held in the cells, ready to be converted according to a datamap; date1904 reports
+// the date system of the workbook for doing so.
+func ReadMasterColumn(filePath, column string) (values map[string]string, date1904 bool, err error) {
+	wb, err := xlsx.OpenFile(filePath)
+	if err != nil {
+		return nil, false, err
+	}
+
+	sh, ok := wb.Sheet[masterSheet]
+	if !ok {
+		if len(wb.Sheets) == 0 {
+			return nil, false, errors.New("master workbook has no sheets")
+		}
+		sh = wb.Sheets[0]
+	}
+
+	col := -1
+	for c := 1; c < sh.MaxCol; c++ {
+		cell, err := sh.Cell(0, c)
+		if err != nil {
+			return nil, false, err
+		}
+		if cell.Value == column {
+			col = c
+			break
+		}
+	}
+	if col < 0 {
+		return nil, false, fmt.Errorf("master workbook has no column headed %q", column)
+	}
+
+	values = make(map[string]string)
+	for r := 1; r < sh.MaxRow; r++ {
+		key, err := sh.Cell(r, 0)
+		if err != nil {
+			return nil, false, err
+		}
+		cell, err := sh.Cell(r, col)
+		if err != nil {
+			return nil, false, err
+		}
+		if _, ok := values[key.Value]; key.Value != "" && !ok {
+			values[key.Value] = cell.Value
+		}
+	}
+
+	return values, wb.Date1904, nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/tealeg/xlsx/v3"
+)
+
+func TestBuildMaster(t *testing.T) {
+	dm := &Datamap{
+		DMLs: []DatamapLine{
+			{Key: "Project Name", Sheet: "Introduction", DataType: "TEXT", CellRef: "C5"},
+			{Key: "Total Cost", Sheet: "9 - Costs", DataType: "GBP", CellRef: "D10"},
+			{Key: "Start Date", Sheet: "Introduction", DataType: "DATE", CellRef: "C7"},
+			{Key: "Complete", Sheet: "Introduction", DataType: "PERCENTAGE", CellRef: "C8"},
+			{Key: "Project Name", Sheet: "Summary", DataType: "TEXT", CellRef: "B2"},
+		},
+	}
+	returns := []*Return{
+		{Name: "alpha.xlsx", ReturnLines: []ReturnLine{
+			newTypedReturnLine(dm.DMLs[0], "Alpha", false),
+			newTypedReturnLine(dm.DMLs[1], "£1,250.50", false),
+			newTypedReturnLine(dm.DMLs[2], "45474", false),
+			newTypedReturnLine(dm.DMLs[3], "25%", false),
+		}},
+		// Parsed against an older revision, without the percentage, and with a cost
+		// which couldn't be converted
+		{Name: "beta.xlsx", ReturnLines: []ReturnLine{
+			newTypedReturnLine(dm.DMLs[0], "Beta", false),
+			newTypedReturnLine(dm.DMLs[1], "TBC", false),
+			newTypedReturnLine(dm.DMLs[2], "", false),
+		}},
+	}
+
+	wb, err := BuildMaster(dm, returns)
+	if err != nil {
+		t.Fatalf("BuildMaster() error = %v", err)
+	}
+
+	// Read the workbook back as a client would
+	path := filepath.Join(t.TempDir(), "master.xlsx")
+	if err := wb.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	wb, err = xlsx.OpenFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sh, ok := wb.Sheet[masterSheet]
+	if !ok {
+		t.Fatalf("master has no %q sheet", masterSheet)
+	}
+	if sh.MaxRow != 5 || sh.MaxCol != 3 {
+		t.Errorf("master is %d rows by %d columns, want 5 by 3", sh.MaxRow, sh.MaxCol)
+	}
+
+	cell := func(row, col int) *xlsx.Cell {
+		t.Helper()
+		c, err := sh.Cell(row, col)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	for _, tt := range []struct {
+		row, col int
+		want     string
+	}{
+		{0, 0, "Key"}, {0, 1, "alpha.xlsx"}, {0, 2, "beta.xlsx"},
+		{1, 0, "Project Name"}, {1, 1, "Alpha"}, {1, 2, "Beta"},
+		{2, 0, "Total Cost"}, {2, 1, "1250.5"}, {2, 2, "TBC"},
+		{3, 0, "Start Date"}, {3, 2, ""},
+		{4, 0, "Complete"}, {4, 1, "0.25"}, {4, 2, ""},
+	} {
+		if got := cell(tt.row, tt.col).Value; got != tt.want {
+			t.Errorf("cell(%d, %d) = %q, want %q", tt.row, tt.col, got, tt.want)
+		}
+	}
+
+	if got := cell(2, 1).Type(); got != xlsx.CellTypeNumeric {
+		t.Errorf("Total Cost cell type = %v, want numeric", got)
+	}
+	if got := cell(2, 1).GetNumberFormat(); got != currencyFormat {
+		t.Errorf("Total Cost number format = %q, want %q", got, currencyFormat)
+	}
+	if got := cell(4, 1).GetNumberFormat(); got != percentageFormat {
+		t.Errorf("Complete number format = %q, want %q", got, percentageFormat)
+	}
+	start, err := cell(3, 1).GetTime(false)
+	if err != nil || !start.Equal(time.Date(2024, 7, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("Start Date = %v, %v; want 2024-07-01", start, err)
+	}
+}
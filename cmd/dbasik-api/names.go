@@ -0,0 +1,219 @@
+// dbasik provides a service with which to convert spreadsheets containing
+// data to JSON for further processing.
+
+// Copyright (C) 2024 M R Lemon
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/tealeg/xlsx/v3"
+)
+
+// definedName is a name given to a cell or range of a spreadsheet, which a DatamapLine
+// can use as its CellRef so that it keeps pointing at the right cell when the template
+// is rearranged. Scope is the sheet the name belongs to, or "" if it belongs to the
+// whole workbook. Sheet and Ref are the cell or range the name refers to, or, if it
+// doesn't refer to one, err says why.
+type definedName struct {
+	Name   string
+	Scope  string
+	Sheet  string
+	Ref    string
+	Target string
+	err    error
+}
+
+// ErrDefinedName is wrapped by the errors returned when a DatamapLine uses a defined
+// name which a spreadsheet doesn't have, or which doesn't refer to a cell or range the
+// line can read.
+var ErrDefinedName = errors.New("defined name")
+
+// nameResolver looks up the defined names of a spreadsheet. It is implemented by each
+// Spreadsheet, and by workbookParts for templates.
+type nameResolver interface {
+	DefinedName(sheet, name string) (string, string, error)
+}
+
+// resolveLine returns a copy of dml pointing at the sheet and cell, or range for a
+// TABLE line, which its CellRef refers to in r, if its CellRef is a defined name.
+func resolveLine(r nameResolver, dml DatamapLine) (DatamapLine, error) {
+	if !validateDefinedName(dml.CellRef) {
+		return dml, nil
+	}
+
+	sheet, ref, err := r.DefinedName(dml.Sheet, dml.CellRef)
+	if err != nil {
+		return dml, err
+	}
+	isTable := normaliseDataType(dml.DataType) == TypeTable
+	if isTable && validateSpreadsheetCell(ref) {
+		return dml, fmt.Errorf("%w %s refers to the single cell %s!%s, but a TABLE line needs a range", ErrDefinedName, dml.CellRef, sheet, ref)
+	}
+	if !isTable && !validateSpreadsheetCell(ref) {
+		return dml, fmt.Errorf("%w %s refers to the range %s!%s, which needs a TABLE line", ErrDefinedName, dml.CellRef, sheet, ref)
+	}
+
+	dml.Sheet, dml.CellRef = sheet, ref
+	return dml, nil
+}
+
+// definedNames holds the defined names of a spreadsheet.
+type definedNames []definedName
+
+// newDefinedName creates the definedName called name which refers to target, written
+// as in an Excel formula, such as 'Sheet 1'!$B$5:$F$40.
+func newDefinedName(name, scope, target string) definedName {
+	dn := definedName{Name: name, Scope: scope, Target: target}
+	dn.Sheet, dn.Ref, dn.err = parseExcelReference(target)
+	return dn
+}
+
+// resolve returns the sheet and the cell or range, in A1 form, which name refers to
+// when used on sheet. As in Excel, a name which belongs to sheet takes precedence over
+// the same name belonging to the workbook, and names are not case sensitive.
+func (dns definedNames) resolve(sheet, name string) (string, string, error) {
+	var found *definedName
+	var otherScopes []string
+	for i, dn := range dns {
+		if !strings.EqualFold(dn.Name, name) {
+			continue
+		}
+		switch dn.Scope {
+		case sheet:
+			found = &dns[i]
+		case "":
+			if found == nil {
+				found = &dns[i]
+			}
+		default:
+			otherScopes = append(otherScopes, dn.Scope)
+		}
+	}
+
+	if found == nil {
+		if len(otherScopes) > 0 {
+			return "", "", fmt.Errorf("%w %s not found for sheet %s; it is only defined for sheet %s",
+				ErrDefinedName, name, sheet, strings.Join(otherScopes, ", "))
+		}
+		return "", "", fmt.Errorf("%w %s not found in spreadsheet", ErrDefinedName, name)
+	}
+	if found.err != nil {
+		return "", "", fmt.Errorf("%w %s refers to %s, which is not a cell or range on one sheet", ErrDefinedName, name, found.Target)
+	}
+	return found.Sheet, found.Ref, nil
+}
+
+// rxColumnRange matches whole columns, such as B:F, which are read as an open range
+var rxColumnRange = regexp.MustCompile(`^([A-Z]+):([A-Z]+)$`)
+
+// parseExcelReference splits a reference to a cell or range on a sheet, such as
+// 'Sheet 1'!$B$5:$F$40, into its sheet and its cell or range without the $ signs. A
+// range of whole columns, such as $B:$F, becomes an open range starting in row 1.
+func parseExcelReference(target string) (string, string, error) {
+	target = strings.TrimPrefix(strings.TrimSpace(target), "=")
+	parts := splitOutsideQuotes(target, '!')
+	if len(parts) != 2 || parts[0] == "" {
+		return "", "", fmt.Errorf("%q is not a reference to a sheet", target)
+	}
+
+	sheet := unquoteSheetName(parts[0])
+	ref := strings.ReplaceAll(parts[1], "$", "")
+	if m := rxColumnRange.FindStringSubmatch(ref); m != nil {
+		ref = m[1] + "1:" + m[2]
+	}
+	if !validateSpreadsheetCell(ref) && !validateSpreadsheetRange(ref) {
+		return "", "", fmt.Errorf("%q is not a cell or range", parts[1])
+	}
+	return sheet, ref, nil
+}
+
+// parseODSAddress does the same as parseExcelReference for an OpenDocument cell range
+// address, such as $'Sheet 1'.$B$5:.$F$40.
+func parseODSAddress(address string) (string, string, error) {
+	var sheet string
+	var cells []string
+	for i, part := range splitOutsideQuotes(address, ':') {
+		pieces := splitOutsideQuotes(part, '.')
+		if len(pieces) != 2 {
+			return "", "", fmt.Errorf("%q is not a cell address", part)
+		}
+		if i == 0 {
+			sheet = unquoteSheetName(strings.TrimPrefix(pieces[0], "$"))
+		}
+		cells = append(cells, strings.ReplaceAll(pieces[1], "$", ""))
+	}
+
+	ref := strings.Join(cells, ":")
+	if sheet == "" || len(cells) > 2 || (!validateSpreadsheetCell(ref) && !validateSpreadsheetRange(ref)) {
+		return "", "", fmt.Errorf("%q is not a cell or range on one sheet", address)
+	}
+	return sheet, ref, nil
+}
+
+// splitOutsideQuotes splits s at each sep which isn't inside a quoted sheet name.
+func splitOutsideQuotes(s string, sep byte) []string {
+	var parts []string
+	quoted := false
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\'':
+			quoted = !quoted
+		case sep:
+			if !quoted {
+				parts = append(parts, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// unquoteSheetName removes the quotes which surround a sheet name in a reference when
+// it isn't a simple word, and undoes the doubling of any quotes within it.
+func unquoteSheetName(s string) string {
+	if len(s) >= 2 && s[0] == '\'' && s[len(s)-1] == '\'' {
+		return strings.ReplaceAll(s[1:len(s)-1], "''", "'")
+	}
+	return s
+}
+
+// maxDefinedNameLength is the longest name Excel allows.
+const maxDefinedNameLength = 255
+
+var (
+	rxDefinedName = regexp.MustCompile(`^[\p{L}_\\][\p{L}\p{N}_.\\]*$`)
+	rxA1Like      = regexp.MustCompile(`^([A-Za-z]{1,3})([0-9]+)$`)
+	rxR1C1Like    = regexp.MustCompile(`^(?i)(R[0-9]*C?[0-9]*|C[0-9]*)$`)
+)
+
+// validateDefinedName checks that name is one which Excel would accept as a defined
+// name, and so can't be mistaken for a cell reference: it starts with a letter,
+// underscore or backslash, has no spaces, and isn't a reference such as A1 or R1C1 in
+// any case.
+func validateDefinedName(name string) bool {
+	if len(name) > maxDefinedNameLength || !rxDefinedName.MatchString(name) || rxR1C1Like.MatchString(name) {
+		return false
+	}
+	if m := rxA1Like.FindStringSubmatch(name); m != nil {
+		return xlsx.ColLettersToIndex(strings.ToUpper(m[1])) >= maxSheetCols
+	}
+	return true
+}
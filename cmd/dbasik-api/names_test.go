@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestValidateDefinedName(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"ProjectName", true},
+		{"_total", true},
+		{"\\backslash", true},
+		{"Cost.Total_2024", true},
+		{"Coûts", true},
+		{"TAXYEAR2024", true},
+		{"XFE1", true},
+		{"A1", false},
+		{"b5", false},
+		{"TAX2024", false},
+		{"R1C1", false},
+		{"r", false},
+		{"C", false},
+		{"RC3", false},
+		{"1stQuarter", false},
+		{"Project Name", false},
+		{"B5:F40", false},
+		{"Sheet1!A1", false},
+		{"", false},
+		{strings.Repeat("a", 256), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := validateDefinedName(tt.name); got != tt.want {
+				t.Errorf("validateDefinedName(%q) = %v, want %v", tt.name, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseReferences(t *testing.T) {
+	tests := []struct {
+		target    string
+		ods       bool
+		wantSheet string
+		wantRef   string
+		wantErr   bool
+	}{
+		{target: "Introduction!$C$5", wantSheet: "Introduction", wantRef: "C5"},
+		{target: "'6a - Milestones'!$B$4:$C$6", wantSheet: "6a - Milestones", wantRef: "B4:C6"},
+		{target: "'Bob''s sheet'!A1", wantSheet: "Bob's sheet", wantRef: "A1"},
+		{target: "'a!b'!$B:$C", wantSheet: "a!b", wantRef: "B1:C"},
+		{target: "#REF!", wantErr: true},
+		{target: "Introduction!#REF!", wantErr: true},
+		{target: "Introduction!$C$5,Introduction!$C$6", wantErr: true},
+		{target: "0.2", wantErr: true},
+		{target: "$Introduction.$C$5", ods: true, wantSheet: "Introduction", wantRef: "C5"},
+		{target: "$'6a - Milestones'.$B$4:.$C$6", ods: true, wantSheet: "6a - Milestones", wantRef: "B4:C6"},
+		{target: "$'a.b'.$B$4:$'a.b'.$C$6", ods: true, wantSheet: "a.b", wantRef: "B4:C6"},
+		{target: "$Introduction.$C$5:.$C$6:.$C$7", ods: true, wantErr: true},
+		{target: "C5", ods: true, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.target, func(t *testing.T) {
+			parse := parseExcelReference
+			if tt.ods {
+				parse = parseODSAddress
+			}
+			sheet, ref, err := parse(tt.target)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parse(%q) error = %v, wantErr %v", tt.target, err, tt.wantErr)
+			}
+			if sheet != tt.wantSheet || ref != tt.wantRef {
+				t.Errorf("parse(%q) = %q, %q, want %q, %q", tt.target, sheet, ref, tt.wantSheet, tt.wantRef)
+			}
+		})
+	}
+}
+
+func TestParseXLSXDefinedNames(t *testing.T) {
+	dm := &Datamap{DMLs: []DatamapLine{
+		{Key: "Project Name", Sheet: "Introduction", DataType: "TEXT", CellRef: "ProjectName"},
+		{Key: "Budget", Sheet: "Introduction", DataType: "NUMBER", CellRef: "budget"},
+		{Key: "Workbook Budget", Sheet: "6a - Milestones", DataType: "NUMBER", CellRef: "Budget"},
+		{Key: "Milestones", Sheet: "6a - Milestones", DataType: "TABLE", CellRef: "Milestones", Columns: TableColumns{{Name: "C", DataType: "DATE"}}},
+		{Key: "Headed", Sheet: "6a - Milestones", DataType: "TABLE", CellRef: "MilestoneColumns"},
+	}}
+
+	rtn, err := ParseXLSX("../../testdata/defined_names.xlsx", dm)
+	if err != nil {
+		t.Fatalf("ParseXLSX() error = %v", err)
+	}
+
+	want := []any{
+		"Big Bridge",
+		1500000.0,
+		99.0,
+		[]map[string]any{{"B": "Milestone", "C": nil}, {"B": "Start", "C": "2024-04-01"}, {"B": "Build", "C": "2025-04-01"}},
+		[]map[string]any{{"B": "Local", "C": "99"}},
+	}
+	for i, rl := range rtn.ReturnLines {
+		if !reflect.DeepEqual(rl.Value, want[i]) {
+			t.Errorf("%s = %v, want %v", rl.Key, rl.Value, want[i])
+		}
+		// The line keeps the name it was given
+		if rl.CellRef != dm.DMLs[i].CellRef || rl.Sheet != dm.DMLs[i].Sheet {
+			t.Errorf("%s is at %s!%s, want %s!%s", rl.Key, rl.Sheet, rl.CellRef, dm.DMLs[i].Sheet, dm.DMLs[i].CellRef)
+		}
+	}
+}
+
+func TestParseXLSXDefinedNameErrors(t *testing.T) {
+	tests := []struct {
+		dml  DatamapLine
+		want string
+	}{
+		{
+			DatamapLine{Sheet: "Introduction", CellRef: "Missing"},
+			"defined name Missing not found in spreadsheet",
+		},
+		{
+			DatamapLine{Sheet: "Introduction", CellRef: "LocalOnly"},
+			"defined name LocalOnly not found for sheet Introduction; it is only defined for sheet 6a - Milestones",
+		},
+		{
+			DatamapLine{Sheet: "Introduction", CellRef: "Broken"},
+			"defined name Broken refers to #REF!, which is not a cell or range on one sheet",
+		},
+		{
+			DatamapLine{Sheet: "Introduction", CellRef: "TwoAreas"},
+			"defined name TwoAreas refers to Introduction!$C$5,Introduction!$C$6, which is not a cell or range on one sheet",
+		},
+		{
+			DatamapLine{Sheet: "Introduction", CellRef: "Milestones"},
+			"defined name Milestones refers to the range 6a - Milestones!B4:C6, which needs a TABLE line",
+		},
+		{
+			DatamapLine{Sheet: "Introduction", DataType: "TABLE", CellRef: "ProjectName"},
+			"defined name ProjectName refers to the single cell Introduction!C5, but a TABLE line needs a range",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.dml.CellRef, func(t *testing.T) {
+			_, err := ParseXLSX("../../testdata/defined_names.xlsx", &Datamap{DMLs: []DatamapLine{tt.dml}})
+			if !errors.Is(err, ErrDefinedName) || err.Error() != tt.want {
+				t.Errorf("ParseXLSX() error = %v, want %s", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseXLSXUnreadableDefinedNames(t *testing.T) {
+	data, err := os.ReadFile("../../testdata/defined_names.xlsx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "return.xlsx")
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	ss, err := OpenSpreadsheet(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The names are only read when one is looked up, by which time they can't be
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+
+	rtn, err := parseSpreadsheet(ss, "return.xlsx", &Datamap{DMLs: []DatamapLine{{Key: "Project Name", Sheet: "Introduction", CellRef: "C5"}}}, ValueCached)
+	if err != nil {
+		t.Fatalf("parseSpreadsheet() of a cell reference error = %v", err)
+	}
+	if rtn.ReturnLines[0].Value != "Big Bridge" {
+		t.Errorf("C5 = %v, want Big Bridge", rtn.ReturnLines[0].Value)
+	}
+
+	_, err = parseSpreadsheet(ss, "return.xlsx", &Datamap{DMLs: []DatamapLine{{Key: "Project Name", Sheet: "Introduction", CellRef: "ProjectName"}}}, ValueCached)
+	if !errors.Is(err, ErrDefinedName) {
+		t.Errorf("parseSpreadsheet() of a defined name error = %v, want ErrDefinedName", err)
+	}
+}
+
+func TestOpenODSDefinedNames(t *testing.T) {
+	content := `<?xml version="1.0" encoding="UTF-8"?>
+<office:document-content xmlns:office="urn:oasis:names:tc:opendocument:xmlns:office:1.0" xmlns:table="urn:oasis:names:tc:opendocument:xmlns:table:1.0" xmlns:text="urn:oasis:names:tc:opendocument:xmlns:text:1.0">
+<office:body><office:spreadsheet>
+<table:table table:name="Introduction">
+<table:table-row><table:table-cell office:value-type="string"><text:p>Big Bridge</text:p></table:table-cell><table:table-cell office:value-type="float" office:value="10"><text:p>10</text:p></table:table-cell></table:table-row>
+<table:named-expressions><table:named-range table:name="Budget" table:base-cell-address="$Introduction.$B$1" table:cell-range-address="$Introduction.$B$1"/></table:named-expressions>
+</table:table>
+<table:named-expressions>
+<table:named-range table:name="ProjectName" table:base-cell-address="$Introduction.$A$1" table:cell-range-address="$Introduction.$A$1"/>
+<table:named-range table:name="Budget" table:base-cell-address="$Introduction.$A$1" table:cell-range-address="$Introduction.$A$1"/>
+</table:named-expressions>
+</office:spreadsheet></office:body>
+</office:document-content>`
+	path := writeTestZip(t, map[string][]byte{
+		"mimetype":    []byte(FormatODS.ContentType),
+		"content.xml": []byte(content),
+	})
+
+	dm := &Datamap{DMLs: []DatamapLine{
+		{Key: "Project Name", Sheet: "Introduction", DataType: "TEXT", CellRef: "ProjectName"},
+		{Key: "Budget", Sheet: "Introduction", DataType: "NUMBER", CellRef: "Budget"},
+	}}
+	rtn, err := ParseXLSX(path, dm)
+	if err != nil {
+		t.Fatalf("ParseXLSX() error = %v", err)
+	}
+	if got := []any{rtn.ReturnLines[0].Value, rtn.ReturnLines[1].Value}; !reflect.DeepEqual(got, []any{"Big Bridge", 10.0}) {
+		t.Errorf("ParseXLSX() values = %v, want [Big Bridge 10]", got)
+	}
+}
+
+func TestPopulateTemplateDefinedNames(t *testing.T) {
+	template, err := os.ReadFile("../../testdata/defined_names.xlsx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dm := &Datamap{DMLs: []DatamapLine{
+		{Key: "Project Name", Sheet: "Introduction", DataType: "TEXT", CellRef: "ProjectName"},
+		{Key: "Missing", Sheet: "Introduction", DataType: "TEXT", CellRef: "Missing"},
+	}}
+	values := TypedValues(dm, map[string]string{"Project Name": "Small Tunnel", "Missing": "x"}, false)
+
+	var buf bytes.Buffer
+	result, err := PopulateTemplate(openZip(t, template), &buf, dm, values)
+	if err != nil {
+		t.Fatalf("PopulateTemplate() error = %v", err)
+	}
+	if result.Written != 1 || len(result.Skipped) != 1 || result.Skipped[0].Reason != "defined name Missing not found in spreadsheet" {
+		t.Fatalf("PopulateTemplate() = %+v, want the name written and the missing one skipped", result)
+	}
+
+	path := t.TempDir() + "/populated.xlsx"
+	if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	rtn, err := ParseXLSX(path, &Datamap{DMLs: dm.DMLs[:1]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := rtn.ReturnLines[0].Value; got != "Small Tunnel" {
+		t.Errorf("populated ProjectName = %v, want Small Tunnel", got)
+	}
+}
@@ -0,0 +1,486 @@
+// dbasik provides a service with which to convert spreadsheets containing
+// data to JSON for further processing.
+
+// Copyright (C) 2024 M R Lemon
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ErrDuplicatePeriodName is returned when a Period is given the name of another.
+// ErrReturnInOtherPeriod is returned when attaching a Return which is already attached
+// to a different period.
+var (
+	ErrDuplicatePeriodName = errors.New("duplicate period name")
+	ErrReturnInOtherPeriod = errors.New("return is attached to another period")
+)
+
+// Period is a reporting period, such as "Q2 2026/27", in which returns are collected
+// from the projects expected to submit one. Every return attached to a period has been
+// parsed against the revision of the datamap given by DatamapID and Revision, so that
+// they can be compared. Projects lists the names of the expected projects.
+type Period struct {
+	ID          int64     `json:"id"`
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	DatamapID   int64     `json:"datamap_id"`
+	Revision    int       `json:"revision"`
+	Projects    []string  `json:"projects"`
+	Created     time.Time `json:"created"`
+}
+
+// ProjectSubmission is the latest return a project has submitted for a Period, and
+// how many returns it has submitted in all.
+type ProjectSubmission struct {
+	Project   string    `json:"project"`
+	ReturnID  int64     `json:"return_id"`
+	Returns   int       `json:"returns"`
+	Submitted time.Time `json:"submitted"`
+}
+
+// PeriodStatus reports which of the projects expected to submit a return for a Period
+// have done so and which are outstanding, in the order in which they are expected, and
+// which projects have submitted a return without being expected to, in name order.
+type PeriodStatus struct {
+	Expected    int                 `json:"expected"`
+	Submitted   []ProjectSubmission `json:"submitted"`
+	Outstanding []string            `json:"outstanding"`
+	Unexpected  []ProjectSubmission `json:"unexpected"`
+}
+
+type periodModel struct {
+	DB *sql.DB
+}
+
+// projectKey is the form of a project's name used to match the returns attached to a
+// Period with the projects it expects, so that case and spacing don't matter.
+func projectKey(name string) string {
+	return strings.ToLower(strings.Join(strings.Fields(name), " "))
+}
+
+// ValidatePeriod checks the fields of a Period. Projects must be named, and named only
+// once.
+func ValidatePeriod(v *Validator, p Period) {
+	v.Check(strings.TrimSpace(p.Name) != "", "name", "must be provided")
+	v.Check(len(p.Name) <= 500, "name", "must not be more than 500 bytes long")
+	v.Check(p.DatamapID > 0, "datamap_id", "must be provided")
+	v.Check(p.Revision >= 0, "revision", "must be a positive integer")
+
+	seen := make(map[string]bool, len(p.Projects))
+	for _, project := range p.Projects {
+		key := projectKey(project)
+		v.Check(key != "", "projects", "must each have a name")
+		v.Check(len(project) <= 500, "projects", "must each be no more than 500 bytes long")
+		v.Check(!seen[key], "projects", fmt.Sprintf("must not contain %q more than once", project))
+		seen[key] = true
+	}
+}
+
+// NewPeriodStatus works out the status of p from the returns attached to it. A
+// project's latest return is the one created last.
+func NewPeriodStatus(p *Period, returns []*Return) PeriodStatus {
+	status := PeriodStatus{
+		Expected:    len(p.Projects),
+		Submitted:   []ProjectSubmission{},
+		Outstanding: []string{},
+		Unexpected:  []ProjectSubmission{},
+	}
+
+	latest := make(map[string]*ProjectSubmission)
+	for _, rtn := range returns {
+		key := projectKey(rtn.Project)
+		sub, ok := latest[key]
+		if !ok {
+			sub = &ProjectSubmission{Project: rtn.Project}
+			latest[key] = sub
+		}
+		sub.Returns++
+		if sub.ReturnID == 0 || rtn.Created.After(sub.Submitted) || (rtn.Created.Equal(sub.Submitted) && rtn.ID > sub.ReturnID) {
+			sub.ReturnID = rtn.ID
+			sub.Submitted = rtn.Created
+		}
+	}
+
+	for _, project := range p.Projects {
+		key := projectKey(project)
+		if sub, ok := latest[key]; ok {
+			sub.Project = project
+			status.Submitted = append(status.Submitted, *sub)
+			delete(latest, key)
+		} else {
+			status.Outstanding = append(status.Outstanding, project)
+		}
+	}
+	for _, sub := range latest {
+		status.Unexpected = append(status.Unexpected, *sub)
+	}
+	sort.Slice(status.Unexpected, func(i, j int) bool {
+		return projectKey(status.Unexpected[i].Project) < projectKey(status.Unexpected[j].Project)
+	})
+	return status
+}
+
+// Insert saves a Period with its expected projects, setting p.ID and p.Created.
+// ErrDuplicatePeriodName is returned if there is already a period with its name.
+func (m *periodModel) Insert(p *Period) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRowContext(ctx, `INSERT INTO periods (name, description, datamap_id, revision, created)
+		VALUES ($1, $2, $3, $4, CURRENT_TIMESTAMP)
+		RETURNING id, created`,
+		p.Name, p.Description, p.DatamapID, p.Revision,
+	).Scan(&p.ID, &p.Created)
+	if err != nil {
+		return periodError(err)
+	}
+
+	if err := insertPeriodProjects(ctx, tx, p.ID, p.Projects); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// periodError translates a failed write to the periods table, whose only UNIQUE
+// constraint is on the name.
+func periodError(err error) error {
+	switch {
+	case isUniqueViolation(err):
+		return ErrDuplicatePeriodName
+	default:
+		return err
+	}
+}
+
+func insertPeriodProjects(ctx context.Context, tx *sql.Tx, periodID int64, projects []string) error {
+	stmt, err := tx.PrepareContext(ctx, `INSERT INTO period_projects (period_id, position, project)
+		VALUES ($1, $2, $3)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for i, project := range projects {
+		_, err = stmt.ExecContext(ctx, periodID, i, strings.TrimSpace(project))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Get retrieves the Period with the given id along with its expected projects.
+// ErrRecordNotFound is returned if there is no matching period.
+func (m *periodModel) Get(id int64) (*Period, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `SELECT id, name, description, datamap_id, revision, created
+		FROM periods
+		WHERE id = $1`
+
+	var p Period
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&p.ID,
+		&p.Name,
+		&p.Description,
+		&p.DatamapID,
+		&p.Revision,
+		&p.Created,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	p.Projects, err = m.getProjects(p.ID)
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// getProjects retrieves the names of the projects expected to submit a return for the
+// period with the given id, in the order they were given.
+func (m *periodModel) getProjects(periodID int64) ([]string, error) {
+	query := `SELECT project
+		FROM period_projects
+		WHERE period_id = $1
+		ORDER BY position`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, periodID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	projects := []string{}
+	for rows.Next() {
+		var project string
+		if err := rows.Scan(&project); err != nil {
+			return nil, err
+		}
+		projects = append(projects, project)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return projects, nil
+}
+
+// GetAll returns a page of periods whose name contains search (case-insensitively).
+// If datamapID is not 0, only periods bound to that datamap are included.
+func (m *periodModel) GetAll(search string, datamapID int64, filters Filters) ([]*Period, Metadata, error) {
+	query := fmt.Sprintf(`SELECT count(*) OVER(), id, name, description, datamap_id, revision, created
+		FROM periods
+		WHERE ($1 = '' OR LOWER(name) LIKE '%%' || LOWER($1) || '%%' ESCAPE '\')
+		AND ($2 = 0 OR datamap_id = $2)
+		ORDER BY %s %s, id ASC
+		LIMIT $3 OFFSET $4`, filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, escapeLike(search), datamapID, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	periods := []*Period{}
+
+	for rows.Next() {
+		var p Period
+		err := rows.Scan(
+			&totalRecords,
+			&p.ID,
+			&p.Name,
+			&p.Description,
+			&p.DatamapID,
+			&p.Revision,
+			&p.Created,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		periods = append(periods, &p)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+	rows.Close()
+
+	for _, p := range periods {
+		p.Projects, err = m.getProjects(p.ID)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return periods, metadata, nil
+}
+
+// Update saves the name, description and expected projects of p. The datamap revision
+// a period is bound to can't be changed, as its returns were parsed against it.
+func (m *periodModel) Update(p *Period) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, `UPDATE periods
+		SET name = $1, description = $2
+		WHERE id = $3`, p.Name, p.Description, p.ID)
+	if err != nil {
+		return periodError(err)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM period_projects WHERE period_id = $1`, p.ID)
+	if err != nil {
+		return err
+	}
+	if err := insertPeriodProjects(ctx, tx, p.ID, p.Projects); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Delete removes the Period with the given id. Its returns are kept, but are no
+// longer attached to a period.
+func (m *periodModel) Delete(id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// A return only has a project within a period
+	_, err = tx.ExecContext(ctx, `UPDATE returns SET period_id = NULL, project = NULL WHERE period_id = $1`, id)
+	if err != nil {
+		return err
+	}
+
+	result, err := tx.ExecContext(ctx, `DELETE FROM periods WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return tx.Commit()
+}
+
+// AttachReturn attaches the return with id returnID to the period with id periodID as
+// submitted by project. A return which is already attached to the period is given the
+// new project. ErrReturnInOtherPeriod is returned if the return is attached to another
+// period, and ErrRecordNotFound if it doesn't exist.
+func (m *periodModel) AttachReturn(periodID, returnID int64, project string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, `UPDATE returns
+		SET period_id = $1, project = $2
+		WHERE id = $3 AND (period_id IS NULL OR period_id = $1)`,
+		periodID, strings.TrimSpace(project), returnID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected > 0 {
+		return nil
+	}
+
+	var exists bool
+	err = m.DB.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM returns WHERE id = $1)`, returnID).Scan(&exists)
+	switch {
+	case err != nil:
+		return err
+	case exists:
+		return ErrReturnInOtherPeriod
+	default:
+		return ErrRecordNotFound
+	}
+}
+
+// DetachReturn removes the return with id returnID from the period with id periodID.
+// ErrRecordNotFound is returned if the return isn't attached to the period.
+func (m *periodModel) DetachReturn(periodID, returnID int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, `UPDATE returns
+		SET period_id = NULL, project = NULL
+		WHERE period_id = $1 AND id = $2`, periodID, returnID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+// GetReturns retrieves every return attached to the period with id periodID, without
+// their lines, in the order they were created.
+func (m *periodModel) GetReturns(periodID int64) ([]*Return, error) {
+	query := `SELECT ` + returnColumns + `
+		FROM returns
+		WHERE period_id = $1
+		ORDER BY created, id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, periodID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	returns := []*Return{}
+	for rows.Next() {
+		rtn, err := scanReturn(rows)
+		if err != nil {
+			return nil, err
+		}
+		returns = append(returns, rtn)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return returns, nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestValidatePeriod(t *testing.T) {
+	tests := []struct {
+		name   string
+		period Period
+		want   map[string]string
+	}{
+		{
+			name:   "valid",
+			period: Period{Name: "Q2 2026/27", DatamapID: 1, Projects: []string{"Big Bridge", "Small Tunnel"}},
+			want:   map[string]string{},
+		},
+		{
+			name:   "missing name and datamap",
+			period: Period{Name: " "},
+			want:   map[string]string{"name": "must be provided", "datamap_id": "must be provided"},
+		},
+		{
+			name:   "unnamed project",
+			period: Period{Name: "Q2", DatamapID: 1, Projects: []string{"Big Bridge", "  "}},
+			want:   map[string]string{"projects": "must each have a name"},
+		},
+		{
+			name:   "repeated project",
+			period: Period{Name: "Q2", DatamapID: 1, Projects: []string{"Big Bridge", "big  bridge"}},
+			want:   map[string]string{"projects": `must not contain "big  bridge" more than once`},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := NewValidator()
+			ValidatePeriod(v, tt.period)
+			if !reflect.DeepEqual(v.Errors, tt.want) {
+				t.Errorf("ValidatePeriod() errors = %v, want %v", v.Errors, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewPeriodStatus(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2026, 7, d, 0, 0, 0, 0, time.UTC) }
+	p := &Period{Projects: []string{"Big Bridge", "Small Tunnel", "Long Road"}}
+	returns := []*Return{
+		{ID: 1, Project: "big bridge", Created: day(1)},
+		{ID: 2, Project: "Zebra Crossing", Created: day(2)},
+		{ID: 3, Project: "Big Bridge", Created: day(3)},
+		{ID: 4, Project: "Long Road", Created: day(3)},
+		{ID: 5, Project: "Long  Road", Created: day(3)},
+		{ID: 6, Project: "Airport", Created: day(4)},
+	}
+
+	want := PeriodStatus{
+		Expected: 3,
+		Submitted: []ProjectSubmission{
+			{Project: "Big Bridge", ReturnID: 3, Returns: 2, Submitted: day(3)},
+			{Project: "Long Road", ReturnID: 5, Returns: 2, Submitted: day(3)},
+		},
+		Outstanding: []string{"Small Tunnel"},
+		Unexpected: []ProjectSubmission{
+			{Project: "Airport", ReturnID: 6, Returns: 1, Submitted: day(4)},
+			{Project: "Zebra Crossing", ReturnID: 2, Returns: 1, Submitted: day(2)},
+		},
+	}
+	if got := NewPeriodStatus(p, returns); !reflect.DeepEqual(got, want) {
+		t.Errorf("NewPeriodStatus() =\n%+v\nwant\n%+v", got, want)
+	}
+
+	empty := NewPeriodStatus(&Period{Projects: []string{}}, nil)
+	if empty.Submitted == nil || empty.Outstanding == nil || empty.Unexpected == nil {
+		t.Errorf("NewPeriodStatus() = %+v, want empty lists rather than null", empty)
+	}
+}
+
+func TestPeriodDuplicateName(t *testing.T) {
+	app := newTestApp(t)
+	datamapID := insertTestDatamap(t, app, nil)
+
+	first := &Period{Name: "Q1", DatamapID: datamapID, Revision: 1}
+	if err := app.models.Periods.Insert(first); err != nil {
+		t.Fatal(err)
+	}
+	second := &Period{Name: "Q2", DatamapID: datamapID, Revision: 1}
+	if err := app.models.Periods.Insert(second); err != nil {
+		t.Fatal(err)
+	}
+
+	err := app.models.Periods.Insert(&Period{Name: "Q1", DatamapID: datamapID, Revision: 1})
+	if !errors.Is(err, ErrDuplicatePeriodName) {
+		t.Errorf("Insert() error = %v, want ErrDuplicatePeriodName", err)
+	}
+	second.Name = "Q1"
+	if err := app.models.Periods.Update(second); !errors.Is(err, ErrDuplicatePeriodName) {
+		t.Errorf("Update() error = %v, want ErrDuplicatePeriodName", err)
+	}
+}
@@ -0,0 +1,521 @@
+// dbasik provides a service with which to convert spreadsheets containing
+// data to JSON for further processing.
+
+// Copyright (C) 2024 M R Lemon
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// ErrDuplicateProjectName and ErrDuplicateGMPPID are returned when a Project is given
+// the name or the GMPP ID of another.
+var (
+	ErrDuplicateProjectName = errors.New("duplicate project name")
+	ErrDuplicateGMPPID      = errors.New("duplicate GMPP ID")
+)
+
+// Project is one of the projects which submit returns. GMPPID is its identifier on the
+// Government Major Projects Portfolio, if it has one.
+type Project struct {
+	ID           int64     `json:"id"`
+	Name         string    `json:"name"`
+	Department   string    `json:"department"`
+	DeliveryBody string    `json:"delivery_body"`
+	GMPPID       string    `json:"gmpp_id"`
+	Created      time.Time `json:"created"`
+}
+
+type projectModel struct {
+	DB *sql.DB
+}
+
+// The outcomes of matching a Return to a Project. A manual match is one made through
+// the API rather than by MatchProject.
+const (
+	MatchMatched   = "matched"
+	MatchAmbiguous = "ambiguous"
+	MatchUnmatched = "unmatched"
+	MatchManual    = "manual"
+)
+
+// ProjectMatches lists every outcome of matching a Return to a Project.
+var ProjectMatches = []string{MatchMatched, MatchAmbiguous, MatchUnmatched, MatchManual}
+
+// IdentityKeys names the keys of a datamap whose values in a return identify the
+// project it comes from. Either may be empty.
+type IdentityKeys struct {
+	GMPPID string `json:"gmpp_id" yaml:"gmpp_id"`
+	Name   string `json:"name" yaml:"name"`
+}
+
+// DefaultIdentityKeys are used for a datamap which hasn't been given its own. They are
+// the keys of the standard GMPP datamap.
+var DefaultIdentityKeys = IdentityKeys{
+	GMPPID: "GMPP - IPA ID Number",
+	Name:   "Project/Programme Name",
+}
+
+// IdentityKeys are stored in the database as JSON. A nil *IdentityKeys is stored as
+// NULL.
+func (k IdentityKeys) Value() (driver.Value, error) {
+	b, err := json.Marshal(k)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+// Scan reads IdentityKeys stored by Value.
+func (k *IdentityKeys) Scan(src any) error {
+	switch src := src.(type) {
+	case []byte:
+		return json.Unmarshal(src, k)
+	case string:
+		return json.Unmarshal([]byte(src), k)
+	default:
+		return fmt.Errorf("cannot scan %T into IdentityKeys", src)
+	}
+}
+
+// identityKeys returns the identity keys of dm, or DefaultIdentityKeys if it has none.
+func (dm *Datamap) identityKeys() IdentityKeys {
+	if dm.IdentityKeys == nil {
+		return DefaultIdentityKeys
+	}
+	return *dm.IdentityKeys
+}
+
+// ValidateIdentityKeys checks that keys names at least one key, and that each key it
+// names is a key of dm.
+func ValidateIdentityKeys(v *Validator, keys IdentityKeys, dm *Datamap) {
+	v.Check(keys.GMPPID != "" || keys.Name != "", "identity_keys", "must name at least one key")
+
+	has := make(map[string]bool, len(dm.DMLs))
+	for _, dml := range dm.DMLs {
+		has[dml.Key] = true
+	}
+	for field, key := range map[string]string{"gmpp_id": keys.GMPPID, "name": keys.Name} {
+		v.Check(key == "" || has[key], field, fmt.Sprintf("%q is not a key of the datamap", key))
+	}
+}
+
+// ValidateProject checks the fields of a Project.
+func ValidateProject(v *Validator, p Project) {
+	v.Check(projectKey(p.Name) != "", "name", "must be provided")
+	v.Check(len(p.Name) <= 500, "name", "must not be more than 500 bytes long")
+	v.Check(len(p.Department) <= 500, "department", "must not be more than 500 bytes long")
+	v.Check(len(p.DeliveryBody) <= 500, "delivery_body", "must not be more than 500 bytes long")
+	v.Check(len(p.GMPPID) <= 100, "gmpp_id", "must not be more than 100 bytes long")
+}
+
+// ValidateProjectUnique checks that no other of projects has the name or GMPP ID of p,
+// ignoring case and spacing, as MatchProject couldn't tell them apart.
+func ValidateProjectUnique(v *Validator, p Project, projects []*Project) {
+	for _, other := range projects {
+		if other.ID == p.ID {
+			continue
+		}
+		v.Check(projectKey(other.Name) != projectKey(p.Name), "name", fmt.Sprintf("is the same as project %d, %q", other.ID, other.Name))
+		v.Check(p.GMPPID == "" || gmppKey(other.GMPPID) != gmppKey(p.GMPPID), "gmpp_id", fmt.Sprintf("is the same as project %d, %q", other.ID, other.Name))
+	}
+}
+
+// gmppKey is the form of a GMPP ID used for matching, so that case and spacing don't
+// matter.
+func gmppKey(id string) string {
+	return strings.ToUpper(strings.Join(strings.Fields(id), ""))
+}
+
+// minSimilarName is the shortest project name which MatchProject will find inside a
+// longer one, so that short names don't turn up everywhere.
+const minSimilarName = 5
+
+// ProjectMatch is the outcome of matching a Return to a Project with MatchProject.
+// ProjectID is set for a match, and Candidates lists the projects it might be when
+// the match is ambiguous.
+type ProjectMatch struct {
+	Status     string
+	ProjectID  int64
+	Candidates []int64
+}
+
+// MatchProject works out which of projects rtn comes from, from the values of the
+// identity keys in rtn. A project whose GMPP ID is the one in the return matches, as
+// does one with exactly the same name, ignoring case and spacing, but the match is
+// ambiguous if the GMPP ID and the name point at different projects. Without either,
+// projects whose name contains, or is contained in, the one in the return are only
+// candidates, which someone has to choose between.
+func MatchProject(rtn *Return, keys IdentityKeys, projects []*Project) ProjectMatch {
+	gmpp := gmppKey(identityValue(rtn, keys.GMPPID))
+	name := projectKey(identityValue(rtn, keys.Name))
+
+	var byID, byName *Project
+	var similar []int64
+	for _, p := range projects {
+		if gmpp != "" && gmppKey(p.GMPPID) == gmpp {
+			byID = p
+		}
+		if name == "" {
+			continue
+		}
+		key := projectKey(p.Name)
+		switch {
+		case key == name:
+			byName = p
+		case len(key) >= minSimilarName && len(name) >= minSimilarName && (strings.Contains(key, name) || strings.Contains(name, key)):
+			similar = append(similar, p.ID)
+		}
+	}
+
+	switch {
+	case byID != nil && byName != nil && byID != byName:
+		return ProjectMatch{Status: MatchAmbiguous, Candidates: []int64{byID.ID, byName.ID}}
+	case byID != nil:
+		return ProjectMatch{Status: MatchMatched, ProjectID: byID.ID}
+	case byName != nil && gmpp != "" && byName.GMPPID != "":
+		// The project has a different GMPP ID to the one in the return
+		return ProjectMatch{Status: MatchAmbiguous, Candidates: []int64{byName.ID}}
+	case byName != nil:
+		return ProjectMatch{Status: MatchMatched, ProjectID: byName.ID}
+	case len(similar) > 0:
+		return ProjectMatch{Status: MatchAmbiguous, Candidates: similar}
+	}
+	return ProjectMatch{Status: MatchUnmatched}
+}
+
+// identityValue returns the string held in rtn for key, or "" if key is empty or not
+// in rtn.
+func identityValue(rtn *Return, key string) string {
+	if key == "" {
+		return ""
+	}
+	for _, rl := range rtn.ReturnLines {
+		if rl.Key != key {
+			continue
+		}
+		if rl.Raw != "" || rl.Value == nil {
+			return strings.TrimSpace(rl.Raw)
+		}
+		return strings.TrimSpace(formatValue(rl.Value))
+	}
+	return ""
+}
+
+// matchProject links rtn, which was parsed against dm, to one of the registered
+// projects using dm's identity keys. See MatchProject.
+func (app *application) matchProject(rtn *Return, dm *Datamap) error {
+	projects, err := app.models.Projects.All()
+	if err != nil {
+		return err
+	}
+	match := MatchProject(rtn, dm.identityKeys(), projects)
+	rtn.ProjectID = match.ProjectID
+	rtn.ProjectMatch = match.Status
+	rtn.ProjectCandidates = match.Candidates
+	return nil
+}
+
+// nullString converts a string which is empty when unset into a value which is stored
+// as NULL, so that unset values don't clash in a UNIQUE column.
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+// projectError translates a failed write of p to the projects table. Both the name and
+// the GMPP ID are UNIQUE, so when one of them is taken the other projects are checked
+// to find out which.
+func (m *projectModel) projectError(ctx context.Context, p *Project, err error) error {
+	if !isUniqueViolation(err) {
+		return err
+	}
+	if p.GMPPID != "" {
+		var taken bool
+		err := m.DB.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM projects WHERE gmpp_id = $1 AND id <> $2)`,
+			p.GMPPID, p.ID).Scan(&taken)
+		if err != nil {
+			return err
+		}
+		if taken {
+			return ErrDuplicateGMPPID
+		}
+	}
+	return ErrDuplicateProjectName
+}
+
+// Insert saves a Project, setting p.ID and p.Created. ErrDuplicateProjectName or
+// ErrDuplicateGMPPID is returned if another project has its name or GMPP ID.
+func (m *projectModel) Insert(p *Project) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, `INSERT INTO projects (name, department, delivery_body, gmpp_id, created)
+		VALUES ($1, $2, $3, $4, CURRENT_TIMESTAMP)
+		RETURNING id, created`,
+		p.Name, p.Department, p.DeliveryBody, nullString(p.GMPPID),
+	).Scan(&p.ID, &p.Created)
+	if err != nil {
+		return m.projectError(ctx, p, err)
+	}
+	return nil
+}
+
+// Get retrieves the Project with the given id. ErrRecordNotFound is returned if there
+// is no matching project.
+func (m *projectModel) Get(id int64) (*Project, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `SELECT id, name, department, delivery_body, gmpp_id, created
+		FROM projects
+		WHERE id = $1`
+
+	var p Project
+	var gmppID sql.NullString
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&p.ID,
+		&p.Name,
+		&p.Department,
+		&p.DeliveryBody,
+		&gmppID,
+		&p.Created,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	p.GMPPID = gmppID.String
+
+	return &p, nil
+}
+
+// GetAll returns a page of projects whose name, department, delivery body or GMPP ID
+// contains search (case-insensitively).
+func (m *projectModel) GetAll(search string, filters Filters) ([]*Project, Metadata, error) {
+	query := fmt.Sprintf(`SELECT count(*) OVER(), id, name, department, delivery_body, gmpp_id, created
+		FROM projects
+		WHERE ($1 = '' OR LOWER(name) LIKE '%%' || LOWER($1) || '%%' ESCAPE '\'
+			OR LOWER(department) LIKE '%%' || LOWER($1) || '%%' ESCAPE '\'
+			OR LOWER(delivery_body) LIKE '%%' || LOWER($1) || '%%' ESCAPE '\'
+			OR LOWER(gmpp_id) LIKE '%%' || LOWER($1) || '%%' ESCAPE '\')
+		ORDER BY %s %s, id ASC
+		LIMIT $2 OFFSET $3`, filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, escapeLike(search), filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	projects := []*Project{}
+
+	for rows.Next() {
+		var p Project
+		var gmppID sql.NullString
+		err := rows.Scan(
+			&totalRecords,
+			&p.ID,
+			&p.Name,
+			&p.Department,
+			&p.DeliveryBody,
+			&gmppID,
+			&p.Created,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		p.GMPPID = gmppID.String
+		projects = append(projects, &p)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return projects, metadata, nil
+}
+
+// All returns every project, for matching returns against.
+func (m *projectModel) All() ([]*Project, error) {
+	query := `SELECT id, name, department, delivery_body, gmpp_id, created
+		FROM projects
+		ORDER BY id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	projects := []*Project{}
+	for rows.Next() {
+		var p Project
+		var gmppID sql.NullString
+		err := rows.Scan(&p.ID, &p.Name, &p.Department, &p.DeliveryBody, &gmppID, &p.Created)
+		if err != nil {
+			return nil, err
+		}
+		p.GMPPID = gmppID.String
+		projects = append(projects, &p)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return projects, nil
+}
+
+// Update saves the fields of p. ErrDuplicateProjectName or ErrDuplicateGMPPID is
+// returned if another project has its name or GMPP ID.
+func (m *projectModel) Update(p *Project) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, `UPDATE projects
+		SET name = $1, department = $2, delivery_body = $3, gmpp_id = $4
+		WHERE id = $5`, p.Name, p.Department, p.DeliveryBody, nullString(p.GMPPID), p.ID)
+	if err != nil {
+		return m.projectError(ctx, p, err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+// Delete removes the Project with the given id. The returns matched to it become
+// unmatched, and it is dropped from the candidates of ambiguous matches.
+func (m *projectModel) Delete(id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `UPDATE returns
+		SET project_id = NULL, project_match = $1, project_candidates = NULL
+		WHERE project_id = $2`, MatchUnmatched, id)
+	if err != nil {
+		return err
+	}
+
+	err = dropCandidate(ctx, tx, id)
+	if err != nil {
+		return err
+	}
+
+	result, err := tx.ExecContext(ctx, `DELETE FROM projects WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return tx.Commit()
+}
+
+// dropCandidate removes the project with the given id from the candidates of every
+// ambiguous match. A match left without candidates becomes unmatched.
+func dropCandidate(ctx context.Context, tx *sql.Tx, id int64) error {
+	rows, err := tx.QueryContext(ctx, `SELECT id, project_candidates
+		FROM returns
+		WHERE project_candidates IS NOT NULL`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	changed := map[int64][]int64{}
+	for rows.Next() {
+		var returnID int64
+		var stored string
+		if err := rows.Scan(&returnID, &stored); err != nil {
+			return err
+		}
+		var candidates []int64
+		if err := json.Unmarshal([]byte(stored), &candidates); err != nil {
+			return err
+		}
+		kept := slices.DeleteFunc(candidates, func(c int64) bool { return c == id })
+		if len(kept) < len(candidates) {
+			changed[returnID] = kept
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	for returnID, kept := range changed {
+		match := ProjectMatch{Status: MatchAmbiguous, Candidates: kept}
+		if len(kept) == 0 {
+			match.Status = MatchUnmatched
+		}
+		candidates, err := projectCandidates(match.Candidates)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `UPDATE returns
+			SET project_match = $1, project_candidates = $2
+			WHERE id = $3`, match.Status, candidates, returnID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
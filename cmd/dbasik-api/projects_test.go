@@ -0,0 +1,224 @@
+// dbasik provides a service with which to convert spreadsheets containing
+// data to JSON for further processing.
+
+// Copyright (C) 2024 M R Lemon
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestMatchProject(t *testing.T) {
+	projects := []*Project{
+		{ID: 1, Name: "Big Bridge", GMPPID: "GMPP-001"},
+		{ID: 2, Name: "Small Tunnel", GMPPID: "GMPP-002"},
+		{ID: 3, Name: "Long Road"},
+		{ID: 4, Name: "Long Road Widening"},
+	}
+	rtn := func(gmppID, name string) *Return {
+		return &Return{ReturnLines: []ReturnLine{
+			{Key: "GMPP - IPA ID Number", Raw: gmppID},
+			{Key: "Project/Programme Name", Raw: name},
+		}}
+	}
+
+	tests := []struct {
+		name string
+		rtn  *Return
+		keys IdentityKeys
+		want ProjectMatch
+	}{
+		{
+			name: "GMPP ID",
+			rtn:  rtn(" gmpp-001", ""),
+			keys: DefaultIdentityKeys,
+			want: ProjectMatch{Status: MatchMatched, ProjectID: 1},
+		},
+		{
+			name: "GMPP ID and name",
+			rtn:  rtn("GMPP-002", "small  tunnel"),
+			keys: DefaultIdentityKeys,
+			want: ProjectMatch{Status: MatchMatched, ProjectID: 2},
+		},
+		{
+			name: "name",
+			rtn:  rtn("", "LONG ROAD"),
+			keys: DefaultIdentityKeys,
+			want: ProjectMatch{Status: MatchMatched, ProjectID: 3},
+		},
+		{
+			name: "name of a project without a GMPP ID",
+			rtn:  rtn("GMPP-099", "Long Road"),
+			keys: DefaultIdentityKeys,
+			want: ProjectMatch{Status: MatchMatched, ProjectID: 3},
+		},
+		{
+			name: "GMPP ID and name of different projects",
+			rtn:  rtn("GMPP-001", "Small Tunnel"),
+			keys: DefaultIdentityKeys,
+			want: ProjectMatch{Status: MatchAmbiguous, Candidates: []int64{1, 2}},
+		},
+		{
+			name: "name of a project with another GMPP ID",
+			rtn:  rtn("GMPP-099", "Big Bridge"),
+			keys: DefaultIdentityKeys,
+			want: ProjectMatch{Status: MatchAmbiguous, Candidates: []int64{1}},
+		},
+		{
+			name: "similar names",
+			rtn:  rtn("", "Long Road Scheme"),
+			keys: DefaultIdentityKeys,
+			want: ProjectMatch{Status: MatchAmbiguous, Candidates: []int64{3}},
+		},
+		{
+			name: "name key only",
+			rtn:  rtn("GMPP-001", "Small Tunnel"),
+			keys: IdentityKeys{Name: "Project/Programme Name"},
+			want: ProjectMatch{Status: MatchMatched, ProjectID: 2},
+		},
+		{
+			name: "no match",
+			rtn:  rtn("GMPP-099", "Airport"),
+			keys: DefaultIdentityKeys,
+			want: ProjectMatch{Status: MatchUnmatched},
+		},
+		{
+			name: "keys not in the return",
+			rtn:  &Return{},
+			keys: DefaultIdentityKeys,
+			want: ProjectMatch{Status: MatchUnmatched},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := MatchProject(tt.rtn, tt.keys, projects); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("MatchProject() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateIdentityKeys(t *testing.T) {
+	dm := &Datamap{DMLs: []DatamapLine{{Key: "GMPP - IPA ID Number"}, {Key: "Project/Programme Name"}}}
+
+	tests := []struct {
+		name string
+		keys IdentityKeys
+		want map[string]string
+	}{
+		{
+			name: "valid",
+			keys: DefaultIdentityKeys,
+			want: map[string]string{},
+		},
+		{
+			name: "no keys",
+			keys: IdentityKeys{},
+			want: map[string]string{"identity_keys": "must name at least one key"},
+		},
+		{
+			name: "unknown key",
+			keys: IdentityKeys{GMPPID: "GMPP - IPA ID Number", Name: "Name"},
+			want: map[string]string{"name": `"Name" is not a key of the datamap`},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := NewValidator()
+			ValidateIdentityKeys(v, tt.keys, dm)
+			if !reflect.DeepEqual(v.Errors, tt.want) {
+				t.Errorf("ValidateIdentityKeys() errors = %v, want %v", v.Errors, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateProjectUnique(t *testing.T) {
+	projects := []*Project{
+		{ID: 1, Name: "Big Bridge", GMPPID: "GMPP-001"},
+		{ID: 2, Name: "Small Tunnel"},
+	}
+
+	tests := []struct {
+		name    string
+		project Project
+		want    map[string]string
+	}{
+		{
+			name:    "new project",
+			project: Project{Name: "Long Road"},
+			want:    map[string]string{},
+		},
+		{
+			name:    "unchanged project",
+			project: Project{ID: 1, Name: "Big Bridge", GMPPID: "GMPP-001"},
+			want:    map[string]string{},
+		},
+		{
+			name:    "name in another case",
+			project: Project{Name: "big  BRIDGE"},
+			want:    map[string]string{"name": `is the same as project 1, "Big Bridge"`},
+		},
+		{
+			name:    "GMPP ID in another case",
+			project: Project{ID: 2, Name: "Small Tunnel", GMPPID: "gmpp-001"},
+			want:    map[string]string{"gmpp_id": `is the same as project 1, "Big Bridge"`},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := NewValidator()
+			ValidateProjectUnique(v, tt.project, projects)
+			if !reflect.DeepEqual(v.Errors, tt.want) {
+				t.Errorf("ValidateProjectUnique() errors = %v, want %v", v.Errors, tt.want)
+			}
+		})
+	}
+}
+
+func TestProjectDuplicate(t *testing.T) {
+	app := newTestApp(t)
+
+	if err := app.models.Projects.Insert(&Project{Name: "Big Bridge", GMPPID: "GMPP-001"}); err != nil {
+		t.Fatal(err)
+	}
+	second := &Project{Name: "Small Tunnel", GMPPID: "GMPP-002"}
+	if err := app.models.Projects.Insert(second); err != nil {
+		t.Fatal(err)
+	}
+
+	err := app.models.Projects.Insert(&Project{Name: "Big Bridge"})
+	if !errors.Is(err, ErrDuplicateProjectName) {
+		t.Errorf("Insert() error = %v, want ErrDuplicateProjectName", err)
+	}
+	err = app.models.Projects.Insert(&Project{Name: "Long Road", GMPPID: "GMPP-001"})
+	if !errors.Is(err, ErrDuplicateGMPPID) {
+		t.Errorf("Insert() error = %v, want ErrDuplicateGMPPID", err)
+	}
+	second.Name = "Big Bridge"
+	if err := app.models.Projects.Update(second); !errors.Is(err, ErrDuplicateProjectName) {
+		t.Errorf("Update() error = %v, want ErrDuplicateProjectName", err)
+	}
+	second.Name, second.GMPPID = "Small Tunnel", "GMPP-001"
+	if err := app.models.Projects.Update(second); !errors.Is(err, ErrDuplicateGMPPID) {
+		t.Errorf("Update() error = %v, want ErrDuplicateGMPPID", err)
+	}
+}
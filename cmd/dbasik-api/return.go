@@ -2,10 +2,18 @@ package main
 
 import (
 	"archive/zip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"os"
+	"path"
 	"path/filepath"
-
-	"github.com/tealeg/xlsx/v3"
+	"strings"
+	"sync"
+	"time"
 )
 
 type FilePreparer interface {
@@ -20,21 +28,83 @@ type DirectoryFilePackage struct {
 	FileSource
 }
 
+// ReturnLine holds the value of a single cell. DatamapLineID and Key identify the
+// DatamapLine which pointed at the cell; DatamapLineID is 0 if the datamap wasn't
+// stored in the database. Value is Raw, the string held in the cell, converted
+// according to DataType (see ConvertValue), or nil if it couldn't be converted.
+// Status is the outcome of validating the value against the line's Rules, with
+// Messages saying what was wrong.
 type ReturnLine struct {
-	Sheet   string
-	CellRef string
-	Value   string
+	DatamapLineID int64
+	Key           string
+	Sheet         string
+	CellRef       string
+	DataType      string
+	Value         any
+	Raw           string
+	Status        string
+	Messages      []string `json:",omitempty"`
 }
 
+// Return holds the values taken from a spreadsheet. DatamapID and Revision record
+// the exact revision of the Datamap which was used to parse it. ID and Created are
+// set once the Return has been saved. A return which has been attached to a reporting
+// Period records it in PeriodID, with the name of the Project which submitted it.
+// ProjectID links the return to a registered Project, as found by MatchProject or
+// chosen by hand, with ProjectMatch saying how, and ProjectCandidates listing the
+// projects it might be when the match is ambiguous. ValueMode records what was read
+// from cells holding a formula.
 type Return struct {
-	Name        string
-	ReturnLines []ReturnLine
+	ID                int64
+	Name              string
+	DatamapID         int64
+	Revision          int
+	ValueMode         ValueMode
+	PeriodID          int64   `json:",omitempty"`
+	Project           string  `json:",omitempty"`
+	ProjectID         int64   `json:",omitempty"`
+	ProjectMatch      string  `json:",omitempty"`
+	ProjectCandidates []int64 `json:",omitempty"`
+	Created           time.Time
+	ReturnLines       []ReturnLine `json:",omitempty"`
+}
+
+// ReturnQuery narrows a listing of returns. Fields left at their zero value don't
+// narrow it.
+type ReturnQuery struct {
+	Search       string
+	DatamapID    int64
+	PeriodID     int64
+	ProjectID    int64
+	ProjectMatch string
 }
 
+type returnModel struct {
+	DB *sql.DB
+}
+
+// ZipFilePackage is a zip archive of workbooks. Prepare extracts the archive into Dir.
 type ZipFilePackage struct {
 	FileSource
+	Dir string
 }
 
+// Limits on what we are prepared to extract from an uploaded zip archive, to protect
+// against zip bombs. Sizes are checked against the bytes actually extracted rather
+// than the sizes claimed in the archive.
+const (
+	maxZipEntries   = 500
+	maxZipEntrySize = 50 << 20  // 50Mb
+	maxZipTotalSize = 500 << 20 // 500Mb
+)
+
+var (
+	ErrZipUnsafePath   = errors.New("zip entry has an unsafe path")
+	ErrZipTooManyFiles = fmt.Errorf("zip archive contains more than %d files", maxZipEntries)
+	ErrZipTooLarge     = errors.New("zip archive is too large when extracted")
+	ErrZipDuplicate    = errors.New("zip archive contains more than one file with the same name")
+)
+
 // NewReturnLine creates a new ReturnLine object
 func NewReturnLine(sheet, cellRef, value string) (*ReturnLine, error) {
 	if err := validateInputs(sheet, cellRef, value); err != nil {
@@ -46,12 +116,67 @@ func NewReturnLine(sheet, cellRef, value string) (*ReturnLine, error) {
 	}
 
 	return &ReturnLine{
-		Sheet:   sheet,
-		CellRef: cellRef,
-		Value:   value,
+		Sheet:    sheet,
+		CellRef:  cellRef,
+		DataType: TypeText,
+		Value:    value,
+		Raw:      value,
+		Status:   StatusOK,
 	}, nil
 }
 
+// newTypedReturnLine creates the ReturnLine for the cell pointed at by dml, which
+// holds raw, converting raw according to dml.DataType and validating it against
+// dml.Rules.
+func newTypedReturnLine(dml DatamapLine, raw string, date1904 bool) ReturnLine {
+	rl := ReturnLine{
+		DatamapLineID: dml.ID,
+		Key:           dml.Key,
+		Sheet:         dml.Sheet,
+		CellRef:       dml.CellRef,
+		DataType:      normaliseDataType(dml.DataType),
+		Raw:           raw,
+	}
+	value, err := ConvertValue(rl.DataType, raw, date1904)
+	if err == nil {
+		rl.Value = value
+	}
+	validateReturnLine(&rl, dml, err)
+	return rl
+}
+
+// newCellReturnLine creates the ReturnLine for cell, which is pointed at by dml, reading
+// it according to mode. A cell holding an error value is always an error, whatever
+// its type and mode. In ValueFormula mode a formula is returned as TEXT, as it isn't a
+// value of dml.DataType, and isn't checked against dml.Rules.
+func newCellReturnLine(dml DatamapLine, cell SpreadsheetCell, mode ValueMode, date1904 bool) ReturnLine {
+	switch {
+	case cell.Error != "":
+		rl := ReturnLine{
+			DatamapLineID: dml.ID,
+			Key:           dml.Key,
+			Sheet:         dml.Sheet,
+			CellRef:       dml.CellRef,
+			DataType:      normaliseDataType(dml.DataType),
+			Raw:           cell.Text(mode),
+		}
+		validateReturnLine(&rl, dml, fmt.Errorf("cell contains the error %s", cell.Error))
+		return rl
+	case mode == ValueFormula && cell.Formula != "":
+		return ReturnLine{
+			DatamapLineID: dml.ID,
+			Key:           dml.Key,
+			Sheet:         dml.Sheet,
+			CellRef:       dml.CellRef,
+			DataType:      TypeText,
+			Value:         cell.Formula,
+			Raw:           cell.Formula,
+			Status:        StatusOK,
+		}
+	}
+	return newTypedReturnLine(dml, cell.Text(mode), date1904)
+}
+
 func validateInputs(sheet, cellRef, value string) error {
 	if sheet == "" {
 		return fmt.Errorf("sheet parameter is required")
@@ -72,87 +197,150 @@ func NewReturn(name string, dm *Datamap, returnLines []ReturnLine) (*Return, err
 
 	return &Return{
 		Name:        name,
+		DatamapID:   dm.ID,
+		Revision:    dm.Revision,
 		ReturnLines: returnLines,
 	}, nil
 }
 
+// ParseXLSX reads the value of each cell pointed at by dm from the spreadsheet at
+// filePath. Despite its name, the spreadsheet can be in any format OpenSpreadsheet
+// understands, and the ReturnLines are the same whichever it is. Cells holding a
+// formula are read as the result last calculated when the spreadsheet was saved.
 func ParseXLSX(filePath string, dm *Datamap) (*Return, error) {
-	// Use tealeg/xlsx to parse the Excel file
-	wb, err := xlsx.OpenFile(filePath)
+	return ParseXLSXMode(filePath, dm, ValueCached)
+}
+
+// ParseXLSXMode does the same as ParseXLSX, reading each cell according to mode.
+func ParseXLSXMode(filePath string, dm *Datamap, mode ValueMode) (*Return, error) {
+	ss, err := OpenSpreadsheet(filePath)
 	if err != nil {
 		return nil, err
 	}
+	return parseSpreadsheet(ss, filepath.Base(filePath), dm, mode)
+}
 
-	// Get the set of sheets from the Datamap
-	sheets := GetSheetsFromDM(*dm)
-
-	// Loop through all DatamapLines
+// parseSpreadsheet reads each cell pointed at by dm from ss, according to mode, into a
+// Return with the given name.
+func parseSpreadsheet(ss Spreadsheet, name string, dm *Datamap, mode ValueMode) (*Return, error) {
 	returnLines := []ReturnLine{}
 	for _, dml := range dm.DMLs {
-		// Check if the sheet for this DatamapLine is in the set of sheets
-		if !contains(sheets, dml.Sheet) {
-			continue
-		}
-
-		sh, ok := wb.Sheet[dml.Sheet]
-		if !ok {
-			return nil, fmt.Errorf("sheet %s not found in Excel file", dml.Sheet)
-		}
-
-		col, row, err := xlsx.GetCoordsFromCellIDString(dml.CellRef)
+		// A line whose CellRef is a defined name is read from wherever the name
+		// refers to, though the ReturnLine keeps the name.
+		target, err := resolveLine(ss, dml)
 		if err != nil {
 			return nil, err
 		}
-		cell, err := sh.Cell(row, col)
-		if err != nil {
-			return nil, err
+		if !ss.HasSheet(target.Sheet) {
+			return nil, fmt.Errorf("sheet %s not found in spreadsheet", target.Sheet)
+		}
+
+		var rl ReturnLine
+		if normaliseDataType(dml.DataType) == TypeTable {
+			rl, err = newTableReturnLine(ss, target, mode)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			cell, err := ss.Cell(target.Sheet, target.CellRef)
+			if err != nil {
+				return nil, err
+			}
+			rl = newCellReturnLine(target, cell, mode, ss.Date1904())
 		}
-		returnLines = append(returnLines, ReturnLine{
-			Sheet:   dml.Sheet,
-			CellRef: dml.CellRef,
-			Value:   cell.Value, // or cell.FormattedValue() if you need formatted values
-		})
+		rl.Sheet, rl.CellRef = dml.Sheet, dml.CellRef
+		returnLines = append(returnLines, rl)
 	}
 
-	// Here we create a new Return object with the name of the Excel file and the ReturnLines slice
-	// that we just populated
-	rtn, err := NewReturn(filepath.Base(filePath), dm, returnLines)
+	// Here we create a new Return object with the name of the spreadsheet and the
+	// ReturnLines slice that we just populated
+	rtn, err := NewReturn(name, dm, returnLines)
 	if err != nil {
 		return nil, err
 	}
+	rtn.ValueMode = mode
 	return rtn, nil
 }
 
-func contains(slice []string, str string) bool {
-	for _, s := range slice {
-		if s == str {
-			return true
-		}
+// isArchiveJunk reports whether a file extracted from an archive is operating system
+// metadata, such as the __MACOSX directory or ._ files macOS adds to zip files.
+func isArchiveJunk(relPath string) bool {
+	if strings.HasPrefix(filepath.ToSlash(relPath), "__MACOSX/") {
+		return true
 	}
-	return false
+	return strings.HasPrefix(filepath.Base(relPath), ".")
 }
 
+// PrepareFiles returns the paths of the files in fp, ready to be parsed.
 func PrepareFiles(fp FilePreparer) ([]string, error) {
-	ch := make(chan string, 100)
+	return fp.Prepare()
+}
 
-	go func() {
-		defer close(ch)
-		files, err := fp.Prepare()
-		if err != nil {
-			ch <- err.Error()
-		}
+// ParseResult is the outcome of parsing one workbook with ParseWorkbooks. Exactly one
+// of Return and Err is set.
+type ParseResult struct {
+	Path   string
+	Return *Return
+	Err    error
+}
 
-		for _, f := range files {
-			ch <- f
+// safeParseXLSX calls ParseXLSXMode, turning a panic from the spreadsheet library into
+// an error so that one malformed workbook can't take down the goroutine parsing it.
+func safeParseXLSX(filePath string, dm *Datamap, mode ValueMode) (rtn *Return, err error) {
+	defer func() {
+		if pv := recover(); pv != nil {
+			rtn = nil
+			err = fmt.Errorf("cannot parse workbook: %v", pv)
 		}
 	}()
+	return ParseXLSXMode(filePath, dm, mode)
+}
 
-	var files []string
-	for f := range ch {
-		files = append(files, f)
+// ParseWorkbooks parses each of paths against dm, reading cells according to mode and
+// using up to concurrency goroutines.
+// The results are in the same order as paths, whichever order the workbooks finish
+// in. If ctx is cancelled, workbooks which haven't yet been started are given
+// ctx.Err() as their error.
+func ParseWorkbooks(ctx context.Context, paths []string, dm *Datamap, concurrency int, mode ValueMode) []ParseResult {
+	results := make([]ParseResult, len(paths))
+	for i, p := range paths {
+		results[i].Path = p
 	}
+	concurrency = max(1, min(concurrency, len(paths)))
 
-	return files, nil
+	// Each worker writes only to the results for the indexes it receives, so no
+	// further synchronisation is needed.
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for range concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				if err := ctx.Err(); err != nil {
+					results[i].Err = err
+					continue
+				}
+				results[i].Return, results[i].Err = safeParseXLSX(paths[i], dm, mode)
+			}
+		}()
+	}
+
+send:
+	for i := range paths {
+		select {
+		case indexes <- i:
+		case <-ctx.Done():
+			for j := i; j < len(paths); j++ {
+				results[j].Err = ctx.Err()
+			}
+			break send
+		}
+	}
+	close(indexes)
+	wg.Wait()
+
+	return results
 }
 
 func (fp *DirectoryFilePackage) Prepare() ([]string, error) {
@@ -163,25 +351,395 @@ func (fp *DirectoryFilePackage) Prepare() ([]string, error) {
 	return files, nil
 }
 
+// Prepare extracts each file in the zip archive into fp.Dir and returns their paths.
+// Entries whose names would place them outside fp.Dir are rejected, as are archives
+// which exceed the maxZipEntries, maxZipEntrySize or maxZipTotalSize limits. As a
+// return is named after its file, an archive holding two files with the same name,
+// whether in different folders or not, is rejected with ErrZipDuplicate.
 func (fp *ZipFilePackage) Prepare() ([]string, error) {
-	files, err := zip.OpenReader(fp.FilePath)
+	zr, err := zip.OpenReader(fp.FilePath)
 	if err != nil {
 		return nil, err
 	}
-	defer files.Close()
+	defer zr.Close()
+
+	if len(zr.File) > maxZipEntries {
+		return nil, ErrZipTooManyFiles
+	}
+
 	out := []string{}
-	for _, file := range files.File {
-		out = append(out, file.Name)
+	names := map[string]string{}
+	var total int64
+	for _, zf := range zr.File {
+		if zf.FileInfo().IsDir() {
+			continue
+		}
+		if !filepath.IsLocal(zf.Name) {
+			return nil, fmt.Errorf("%w: %s", ErrZipUnsafePath, zf.Name)
+		}
+		if !isArchiveJunk(zf.Name) {
+			name := path.Base(zf.Name)
+			if other, ok := names[name]; ok {
+				return nil, fmt.Errorf("%w: %s and %s", ErrZipDuplicate, other, zf.Name)
+			}
+			names[name] = zf.Name
+		}
+
+		dst := filepath.Join(fp.Dir, zf.Name)
+		n, err := extractZipFile(zf, dst, min(maxZipEntrySize, maxZipTotalSize-total))
+		if err != nil {
+			return nil, err
+		}
+		total += n
+		out = append(out, dst)
 	}
 	return out, nil
 }
 
+// extractZipFile writes the contents of zf to dst, failing with ErrZipTooLarge if it
+// turns out to be more than limit bytes long.
+func extractZipFile(zf *zip.File, dst string, limit int64) (int64, error) {
+	rc, err := zf.Open()
+	if err != nil {
+		return 0, err
+	}
+	defer rc.Close()
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return 0, err
+	}
+	f, err := os.Create(dst)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	// Read one byte past the limit so that we can tell if it was exceeded
+	n, err := io.Copy(f, io.LimitReader(rc, limit+1))
+	if err != nil {
+		return n, err
+	}
+	if n > limit {
+		return n, fmt.Errorf("%w: %s", ErrZipTooLarge, zf.Name)
+	}
+	return n, f.Close()
+}
+
 // NewDirectoryFilePackage creates a new DirectoryFilePackage object with the given filePath to the directory
 func NewDirectoryFilePackage(filePath string) *DirectoryFilePackage {
 	return &DirectoryFilePackage{FileSource{FilePath: filePath}}
 }
 
-// NewZipFilePackage creates a new ZipFilePackage object with the given filePath to the zip file
-func NewZipFilePackage(filePath string) *ZipFilePackage {
-	return &ZipFilePackage{FileSource{FilePath: filePath}}
+// NewZipFilePackage creates a new ZipFilePackage object with the given filePath to the zip file,
+// which will be extracted into dir
+func NewZipFilePackage(filePath, dir string) *ZipFilePackage {
+	return &ZipFilePackage{FileSource: FileSource{FilePath: filePath}, Dir: dir}
+}
+
+// nullInt64 converts an id which is 0 when unset into a value which is stored as NULL.
+func nullInt64(id int64) sql.NullInt64 {
+	return sql.NullInt64{Int64: id, Valid: id > 0}
+}
+
+// Insert saves a Return and all of its ReturnLines in a single transaction, setting
+// rtn.ID and rtn.Created.
+func (m *returnModel) Insert(rtn *Return) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if rtn.ProjectMatch == "" {
+		rtn.ProjectMatch = MatchUnmatched
+	}
+	if rtn.ValueMode == "" {
+		rtn.ValueMode = ValueCached
+	}
+	candidates, err := projectCandidates(rtn.ProjectCandidates)
+	if err != nil {
+		return err
+	}
+	err = tx.QueryRowContext(ctx, `INSERT INTO returns
+		(name, datamap_id, revision, value_mode, period_id, project, project_id, project_match, project_candidates, created)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, CURRENT_TIMESTAMP)
+		RETURNING id, created`,
+		rtn.Name,
+		nullInt64(rtn.DatamapID),
+		sql.NullInt32{Int32: int32(rtn.Revision), Valid: rtn.DatamapID > 0},
+		rtn.ValueMode,
+		nullInt64(rtn.PeriodID),
+		sql.NullString{String: rtn.Project, Valid: rtn.PeriodID > 0},
+		nullInt64(rtn.ProjectID),
+		rtn.ProjectMatch,
+		candidates,
+	).Scan(&rtn.ID, &rtn.Created)
+	if err != nil {
+		return err
+	}
+
+	stmt, err := tx.PrepareContext(ctx, `INSERT INTO return_lines
+		(return_id, datamap_line_id, key, sheet, cellref, data_type, value, raw, status, messages)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, rl := range rtn.ReturnLines {
+		// The value is stored in its string form, which converts back to the same
+		// value when read. If it couldn't be converted, we store the raw string so
+		// that the conversion fails in the same way.
+		value := formatValue(rl.Value)
+		if rl.Value == nil {
+			value = rl.Raw
+		}
+		status := rl.Status
+		if status == "" {
+			status = StatusOK
+		}
+		messages, err := json.Marshal(rl.Messages)
+		if err != nil {
+			return err
+		}
+		_, err = stmt.ExecContext(ctx,
+			rtn.ID,
+			nullInt64(rl.DatamapLineID),
+			rl.Key,
+			rl.Sheet,
+			rl.CellRef,
+			normaliseDataType(rl.DataType),
+			value,
+			rl.Raw,
+			status,
+			string(messages))
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Get retrieves the Return with the given id along with its ReturnLines.
+// ErrRecordNotFound is returned if there is no matching return.
+func (m *returnModel) Get(id int64) (*Return, error) {
+	rtn, err := m.GetHeader(id)
+	if err != nil {
+		return nil, err
+	}
+
+	rtn.ReturnLines, err = m.GetLines(rtn.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	return rtn, nil
+}
+
+// GetHeader retrieves the Return with the given id without its ReturnLines, for when
+// only the details of the return are needed. ErrRecordNotFound is returned if there
+// is no matching return.
+func (m *returnModel) GetHeader(id int64) (*Return, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `SELECT ` + returnColumns + `
+		FROM returns
+		WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rtn, err := scanReturn(m.DB.QueryRowContext(ctx, query, id))
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return rtn, nil
+}
+
+// returnColumns are the columns of the returns table read by scanReturn.
+const returnColumns = `id, name, datamap_id, revision, value_mode, period_id, project, project_id, project_match, project_candidates, created`
+
+// scanReturn reads a Return, without its lines, from the returnColumns of row.
+func scanReturn(row interface{ Scan(...any) error }, extra ...any) (*Return, error) {
+	var rtn Return
+	var datamapID, periodID, projectID sql.NullInt64
+	var revision sql.NullInt32
+	var project, candidates sql.NullString
+
+	dest := append(extra,
+		&rtn.ID,
+		&rtn.Name,
+		&datamapID,
+		&revision,
+		&rtn.ValueMode,
+		&periodID,
+		&project,
+		&projectID,
+		&rtn.ProjectMatch,
+		&candidates,
+		&rtn.Created,
+	)
+	if err := row.Scan(dest...); err != nil {
+		return nil, err
+	}
+	rtn.DatamapID = datamapID.Int64
+	rtn.Revision = int(revision.Int32)
+	rtn.PeriodID = periodID.Int64
+	rtn.Project = project.String
+	rtn.ProjectID = projectID.Int64
+	if candidates.Valid {
+		if err := json.Unmarshal([]byte(candidates.String), &rtn.ProjectCandidates); err != nil {
+			return nil, err
+		}
+	}
+	return &rtn, nil
+}
+
+// projectCandidates converts the candidate projects of an ambiguous match into the
+// JSON in which they are stored, or NULL if there are none.
+func projectCandidates(ids []int64) (sql.NullString, error) {
+	if len(ids) == 0 {
+		return sql.NullString{}, nil
+	}
+	b, err := json.Marshal(ids)
+	if err != nil {
+		return sql.NullString{}, err
+	}
+	return sql.NullString{String: string(b), Valid: true}, nil
+}
+
+// SetProject records the outcome of matching the return with the given id to a
+// project, replacing any earlier one. ErrRecordNotFound is returned if there is no
+// matching return.
+func (m *returnModel) SetProject(id int64, match ProjectMatch) error {
+	candidates, err := projectCandidates(match.Candidates)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, `UPDATE returns
+		SET project_id = $1, project_match = $2, project_candidates = $3
+		WHERE id = $4`, nullInt64(match.ProjectID), match.Status, candidates, id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+// GetLines retrieves the ReturnLines of the return with the given id, in the order in
+// which they were parsed.
+func (m *returnModel) GetLines(returnID int64) ([]ReturnLine, error) {
+	query := `SELECT datamap_line_id, key, sheet, cellref, data_type, value, raw, status, messages
+		FROM return_lines
+		WHERE return_id = $1
+		ORDER BY return_line_id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, returnID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rls := []ReturnLine{}
+	for rows.Next() {
+		var rl ReturnLine
+		var datamapLineID sql.NullInt64
+		var value, messages string
+		err := rows.Scan(
+			&datamapLineID,
+			&rl.Key,
+			&rl.Sheet,
+			&rl.CellRef,
+			&rl.DataType,
+			&value,
+			&rl.Raw,
+			&rl.Status,
+			&messages,
+		)
+		if err != nil {
+			return nil, err
+		}
+		rl.DatamapLineID = datamapLineID.Int64
+		// A value which failed to convert when parsed will fail again here, and
+		// the failure is already recorded in Messages.
+		rl.Value, _ = ConvertValue(rl.DataType, value, false)
+		err = json.Unmarshal([]byte(messages), &rl.Messages)
+		if err != nil {
+			return nil, err
+		}
+		rls = append(rls, rl)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return rls, nil
+}
+
+// GetAll returns a page of returns, without their lines, which match q. Search is
+// looked for in the return's name and project (case-insensitively).
+func (m *returnModel) GetAll(q ReturnQuery, filters Filters) ([]*Return, Metadata, error) {
+	query := fmt.Sprintf(`SELECT count(*) OVER(), `+returnColumns+`
+		FROM returns
+		WHERE ($1 = '' OR LOWER(name) LIKE '%%' || LOWER($1) || '%%' ESCAPE '\' OR LOWER(project) LIKE '%%' || LOWER($1) || '%%' ESCAPE '\')
+		AND ($2 = 0 OR datamap_id = $2)
+		AND ($3 = 0 OR period_id = $3)
+		AND ($4 = 0 OR project_id = $4)
+		AND ($5 = '' OR project_match = $5)
+		ORDER BY %s %s, id ASC
+		LIMIT $6 OFFSET $7`, filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, escapeLike(q.Search), q.DatamapID, q.PeriodID, q.ProjectID, q.ProjectMatch,
+		filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	returns := []*Return{}
+
+	for rows.Next() {
+		rtn, err := scanReturn(rows, &totalRecords)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		returns = append(returns, rtn)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return returns, metadata, nil
 }
@@ -1,10 +1,18 @@
 package main
 
 import (
+	"archive/zip"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
 	"reflect"
 	"slices"
 	"testing"
 	"time"
+
+	"github.com/tealeg/xlsx/v3"
 )
 
 func TestCreateNewReturn(t *testing.T) {
@@ -41,6 +49,17 @@ func TestCreateNewReturn(t *testing.T) {
 	}
 }
 
+func TestNewReturnRecordsDatamapRevision(t *testing.T) {
+	dm := &Datamap{ID: 3, Revision: 7}
+	rt, err := NewReturn("test name", dm, []ReturnLine{{Sheet: "stabs", CellRef: "C1", Value: "Knocker"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rt.DatamapID != 3 || rt.Revision != 7 {
+		t.Errorf("NewReturn() linked to datamap %d revision %d, expected datamap 3 revision 7", rt.DatamapID, rt.Revision)
+	}
+}
+
 func TestNewReturnLine(t *testing.T) {
 	rl, err := NewReturnLine("stabs", "C1", "Knocker")
 	if err != nil {
@@ -103,6 +122,10 @@ func TestHelper_validateSpreadsheetCell(t *testing.T) {
 	if validateSpreadsheetCell("A10") != true {
 		t.Errorf("Helper.validateSpreadsheetCell() did not return true")
 	}
+
+	if validateSpreadsheetCell("XFE1") != false {
+		t.Errorf("Helper.validateSpreadsheetCell() did not return false")
+	}
 }
 
 func TestParseXLSX(t *testing.T) {
@@ -118,17 +141,17 @@ func TestParseXLSX(t *testing.T) {
 			filePath: "../../testdata/valid_excel.xlsx",
 			dm: &Datamap{
 				DMLs: []DatamapLine{
-					{Sheet: "Sheet1", CellRef: "A1"},
-					{Sheet: "Sheet1", CellRef: "B1"},
-					{Sheet: "Sheet2", CellRef: "C1"},
+					{ID: 1, Key: "Key 1", Sheet: "Sheet1", CellRef: "A1"},
+					{ID: 2, Key: "Key 2", Sheet: "Sheet1", CellRef: "B1"},
+					{ID: 3, Key: "Key 3", Sheet: "Sheet2", CellRef: "C1"},
 				},
 			},
 			want: &Return{
 				Name: "valid_excel.xlsx",
 				ReturnLines: []ReturnLine{
-					{Sheet: "Sheet1", CellRef: "A1", Value: "Value 1"},
-					{Sheet: "Sheet1", CellRef: "B1", Value: "Value 2"},
-					{Sheet: "Sheet2", CellRef: "C1", Value: "Value 3"},
+					{DatamapLineID: 1, Key: "Key 1", Sheet: "Sheet1", CellRef: "A1", Value: "Value 1"},
+					{DatamapLineID: 2, Key: "Key 2", Sheet: "Sheet1", CellRef: "B1", Value: "Value 2"},
+					{DatamapLineID: 3, Key: "Key 3", Sheet: "Sheet2", CellRef: "C1", Value: "Value 3"},
 				},
 			},
 			wantErr: false,
@@ -160,6 +183,12 @@ func TestParseXLSX(t *testing.T) {
 				if got.ReturnLines[i].CellRef != tt.want.ReturnLines[i].CellRef {
 					t.Errorf("ParseXLSX() ReturnLines[%d].CellRef = %v, want %v", i, got.ReturnLines[i].CellRef, tt.want.ReturnLines[i].CellRef)
 				}
+				if got.ReturnLines[i].DatamapLineID != tt.want.ReturnLines[i].DatamapLineID {
+					t.Errorf("ParseXLSX() ReturnLines[%d].DatamapLineID = %v, want %v", i, got.ReturnLines[i].DatamapLineID, tt.want.ReturnLines[i].DatamapLineID)
+				}
+				if got.ReturnLines[i].Key != tt.want.ReturnLines[i].Key {
+					t.Errorf("ParseXLSX() ReturnLines[%d].Key = %v, want %v", i, got.ReturnLines[i].Key, tt.want.ReturnLines[i].Key)
+				}
 				if got.ReturnLines[i].Value != tt.want.ReturnLines[i].Value {
 					t.Errorf("ParseXLSX() ReturnLines[%d].Value = %v, want %v", i, got.ReturnLines[i].Value, tt.want.ReturnLines[i].Value)
 				}
@@ -180,12 +209,361 @@ func TestPrepareFiles(t *testing.T) {
 }
 
 func TestUnzipFiles(t *testing.T) {
-	fp := NewZipFilePackage("../../testdata/test.zip")
+	dir := t.TempDir()
+	fp := NewZipFilePackage("../../testdata/test.zip", dir)
 	files, err := PrepareFiles(fp)
 	if err != nil {
 		t.Error(err)
 	}
-	if !slices.Contains(files, "valid_excel.xlsx") {
-		t.Errorf("Prepare() did not return test.xlsx")
+	extracted := filepath.Join(dir, "valid_excel.xlsx")
+	if !slices.Contains(files, extracted) {
+		t.Fatalf("Prepare() did not return %s, got %v", extracted, files)
+	}
+	if _, err := ParseXLSX(extracted, &Datamap{DMLs: []DatamapLine{{Sheet: "Sheet1", CellRef: "A1"}}}); err != nil {
+		t.Errorf("cannot parse extracted file: %v", err)
+	}
+}
+
+func writeTestZip(t *testing.T, files map[string][]byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "test.zip")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zw := zip.NewWriter(f)
+	for name, contents := range files {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(contents); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestUnzipFilesRejectsUnsafePaths(t *testing.T) {
+	for _, name := range []string{"../evil.xlsx", "/etc/evil.xlsx", "returns/../../evil.xlsx"} {
+		t.Run(name, func(t *testing.T) {
+			zipPath := writeTestZip(t, map[string][]byte{name: []byte("bobbins")})
+			fp := NewZipFilePackage(zipPath, t.TempDir())
+			_, err := fp.Prepare()
+			if !errors.Is(err, ErrZipUnsafePath) {
+				t.Errorf("Prepare() error = %v, expected ErrZipUnsafePath", err)
+			}
+		})
+	}
+}
+
+func TestUnzipFilesRejectsDuplicateNames(t *testing.T) {
+	tests := []struct {
+		name  string
+		files []string
+	}{
+		{"different folders", []string{"north/return.xlsx", "south/return.xlsx"}},
+		{"repeated", []string{"return.xlsx", "other.xlsx", "return.xlsx"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// writeTestZip can't repeat a name, so the archive is written here
+			zipPath := filepath.Join(t.TempDir(), "test.zip")
+			f, err := os.Create(zipPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			zw := zip.NewWriter(f)
+			for _, name := range tt.files {
+				w, err := zw.Create(name)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, err := w.Write([]byte("bobbins")); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := zw.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = NewZipFilePackage(zipPath, t.TempDir()).Prepare()
+			if !errors.Is(err, ErrZipDuplicate) {
+				t.Errorf("Prepare() error = %v, expected ErrZipDuplicate", err)
+			}
+		})
+	}
+
+	// The files macOS adds to an archive may share names
+	zipPath := writeTestZip(t, map[string][]byte{
+		"north/return.xlsx": []byte("bobbins"),
+		"north/.DS_Store":   []byte("bobbins"),
+		"south/.DS_Store":   []byte("bobbins"),
+	})
+	if _, err := NewZipFilePackage(zipPath, t.TempDir()).Prepare(); err != nil {
+		t.Errorf("Prepare() of an archive with repeated metadata files error = %v", err)
+	}
+}
+
+func TestUnzipFilesRejectsLargeFiles(t *testing.T) {
+	// highly compressible, so the archive itself is tiny
+	zipPath := writeTestZip(t, map[string][]byte{"bomb.xlsx": make([]byte, maxZipEntrySize+1)})
+	fp := NewZipFilePackage(zipPath, t.TempDir())
+	_, err := fp.Prepare()
+	if !errors.Is(err, ErrZipTooLarge) {
+		t.Errorf("Prepare() error = %v, expected ErrZipTooLarge", err)
+	}
+}
+
+func TestPrepareFilesRejectsMaliciousArchives(t *testing.T) {
+	tooMany := map[string][]byte{}
+	for i := 0; i <= maxZipEntries; i++ {
+		tooMany[fmt.Sprintf("return_%03d.xlsx", i)] = []byte("bobbins")
+	}
+
+	tests := []struct {
+		name  string
+		files map[string][]byte
+		want  error
+	}{
+		{"zip slip", map[string][]byte{"ok.xlsx": []byte("bobbins"), "../evil.xlsx": []byte("bobbins")}, ErrZipUnsafePath},
+		{"absolute path", map[string][]byte{"/tmp/evil.xlsx": []byte("bobbins")}, ErrZipUnsafePath},
+		{"zip bomb", map[string][]byte{"bomb.xlsx": make([]byte, maxZipEntrySize+1)}, ErrZipTooLarge},
+		{"too many files", tooMany, ErrZipTooManyFiles},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			dir := filepath.Join(root, "files")
+			files, err := PrepareFiles(NewZipFilePackage(writeTestZip(t, tt.files), dir))
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("PrepareFiles() error = %v, expected %v", err, tt.want)
+			}
+			if files != nil {
+				t.Errorf("PrepareFiles() files = %v, expected none", files)
+			}
+			if _, err := os.Stat(filepath.Join(root, "evil.xlsx")); !os.IsNotExist(err) {
+				t.Errorf("archive wrote evil.xlsx outside %s", dir)
+			}
+		})
+	}
+}
+
+func TestIsWorkbook(t *testing.T) {
+	dir := t.TempDir()
+	xlsx, err := os.ReadFile("../../testdata/valid_excel.xlsx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	renamed := filepath.Join(dir, "return.bin")
+	notWorkbook := filepath.Join(dir, "notes.xlsx")
+	if err := os.WriteFile(renamed, xlsx, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(notWorkbook, []byte("not a workbook"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, want := range map[string]bool{
+		"../../testdata/valid_excel.xlsx":      true,
+		"../../resources/test_two_sheets.xlsm": true,
+		renamed:                                true,
+		notWorkbook:                            false,
+		"../../testdata/test.zip":              false,
+		filepath.Join(dir, "missing.xlsx"):     false,
+	} {
+		if got := isWorkbook(name); got != want {
+			t.Errorf("isWorkbook(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestParseXLSXMacroEnabled(t *testing.T) {
+	dm := &Datamap{DMLs: []DatamapLine{
+		{Key: "Project/Programme Name", Sheet: "rpt_template", DataType: "TEXT", CellRef: "E6"},
+	}}
+
+	rtn, err := ParseXLSX("../../resources/test_two_sheets.xlsm", dm)
+	if err != nil {
+		t.Fatalf("ParseXLSX() error = %v", err)
+	}
+	if got := rtn.ReturnLines[0].Value; got != "Two Step Shuffle" {
+		t.Errorf("ParseXLSX() value = %v, want Two Step Shuffle", got)
+	}
+	if rtn.Name != "test_two_sheets.xlsm" {
+		t.Errorf("ParseXLSX() name = %q, want test_two_sheets.xlsm", rtn.Name)
+	}
+}
+
+func TestIsArchiveJunk(t *testing.T) {
+	for name, want := range map[string]bool{
+		"__MACOSX/._return.xlsx": true,
+		"returns/._return.xlsx":  true,
+		".DS_Store":              true,
+		"returns/return.xlsx":    false,
+	} {
+		if got := isArchiveJunk(name); got != want {
+			t.Errorf("isArchiveJunk(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
+
+// loadTestDatamap reads the sample datamap in resources/datamap.csv.
+func loadTestDatamap(tb testing.TB) *Datamap {
+	tb.Helper()
+	f, err := os.Open("../../resources/datamap.csv")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer f.Close()
+	dmls, err := readDatamapCSV(f)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return &Datamap{Name: "sample", DMLs: dmls}
+}
+
+// writeTestWorkbook saves a workbook to path with every cell referenced by dm
+// holding the key of its DatamapLine.
+func writeTestWorkbook(tb testing.TB, path string, dm *Datamap) {
+	tb.Helper()
+	wb := xlsx.NewFile()
+	for _, dml := range dm.DMLs {
+		sh, ok := wb.Sheet[dml.Sheet]
+		if !ok {
+			var err error
+			sh, err = wb.AddSheet(dml.Sheet)
+			if err != nil {
+				tb.Fatal(err)
+			}
+		}
+		col, row, err := xlsx.GetCoordsFromCellIDString(dml.CellRef)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		cell, err := sh.Cell(row, col)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		cell.SetString(dml.Key)
+	}
+	if err := wb.Save(path); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+func TestReturnGetHeader(t *testing.T) {
+	app := newTestApp(t)
+	datamapID := insertTestDatamap(t, app, []DatamapLine{{Key: "Key 1", Sheet: "Sheet1", DataType: "TEXT", CellRef: "A1"}})
+	dm, err := app.models.Datamaps.Get(datamapID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rtn, err := ParseXLSX("../../testdata/valid_excel.xlsx", dm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := app.models.Returns.Insert(rtn); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := app.models.Returns.GetHeader(rtn.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Name != "valid_excel.xlsx" || got.DatamapID != datamapID || got.Revision != 1 || got.ReturnLines != nil {
+		t.Errorf("GetHeader() = %+v, want the return without its lines", got)
+	}
+	if _, err := app.models.Returns.GetHeader(rtn.ID + 1); !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("GetHeader() of a missing return error = %v, want ErrRecordNotFound", err)
+	}
+}
+
+func TestParseWorkbooks(t *testing.T) {
+	dm := &Datamap{DMLs: []DatamapLine{
+		{Key: "Key 1", Sheet: "Sheet1", CellRef: "A1"},
+		{Key: "Key 3", Sheet: "Sheet2", CellRef: "C1"},
+	}}
+	paths := []string{
+		"../../testdata/valid_excel.xlsx",
+		"../../testdata/missing.xlsx",
+		"../../testdata/valid_excel.xlsx",
+		"../../testdata/test.zip",
+		"../../testdata/valid_excel.xlsx",
+	}
+
+	results := ParseWorkbooks(context.Background(), paths, dm, 3, ValueCached)
+
+	if len(results) != len(paths) {
+		t.Fatalf("ParseWorkbooks() returned %d results, expected %d", len(results), len(paths))
+	}
+	for i, res := range results {
+		if res.Path != paths[i] {
+			t.Errorf("results[%d].Path = %s, expected %s", i, res.Path, paths[i])
+		}
+		wantErr := i == 1 || i == 3
+		if (res.Err != nil) != wantErr {
+			t.Errorf("results[%d].Err = %v, wantErr %v", i, res.Err, wantErr)
+		}
+		if !wantErr && (res.Return == nil || res.Return.ReturnLines[1].Value != "Value 3") {
+			t.Errorf("results[%d].Return = %+v, expected Value 3 in C1", i, res.Return)
+		}
+	}
+}
+
+func TestParseWorkbooksCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	paths := []string{"../../testdata/valid_excel.xlsx", "../../testdata/valid_excel.xlsx"}
+	results := ParseWorkbooks(ctx, paths, &Datamap{DMLs: []DatamapLine{{Sheet: "Sheet1", CellRef: "A1"}}}, 2, ValueCached)
+
+	for i, res := range results {
+		if !errors.Is(res.Err, context.Canceled) {
+			t.Errorf("results[%d].Err = %v, expected context.Canceled", i, res.Err)
+		}
+	}
+}
+
+func BenchmarkParseXLSX(b *testing.B) {
+	dm := loadTestDatamap(b)
+	path := filepath.Join(b.TempDir(), "return.xlsx")
+	writeTestWorkbook(b, path, dm)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := ParseXLSX(path, dm); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkParseWorkbooks(b *testing.B) {
+	dm := loadTestDatamap(b)
+	dir := b.TempDir()
+	var paths []string
+	for i := 0; i < 16; i++ {
+		path := filepath.Join(dir, fmt.Sprintf("return_%02d.xlsx", i))
+		writeTestWorkbook(b, path, dm)
+		paths = append(paths, path)
+	}
+
+	for _, concurrency := range []int{1, 4, 8} {
+		b.Run(fmt.Sprintf("concurrency_%d", concurrency), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				for _, res := range ParseWorkbooks(context.Background(), paths, dm, concurrency, ValueCached) {
+					if res.Err != nil {
+						b.Fatal(res.Err)
+					}
+				}
+			}
+		})
 	}
 }
@@ -24,11 +24,57 @@ func (app *application) routes() *http.ServeMux {
 	mux := http.NewServeMux()
 
 	mux.HandleFunc("GET /v1/healthcheck", app.healthcheckHandler)
-	mux.HandleFunc("GET /v1/getdatamap/{id}", app.getJSONForDatamap) // TODO: not yet implemented
-	mux.HandleFunc("POST /v1/return", app.createReturnHandler)
-	mux.HandleFunc("POST /v1/datamapsave", app.saveDatamapHandler)
-	mux.HandleFunc("POST /v1/datamap", app.createDatamapHandler)
-	mux.HandleFunc("POST /v1/datamapline", app.createDatamapLine)
+	mux.HandleFunc("GET /v1/getdatamap/{id}", app.getJSONForDatamap)
+	mux.HandleFunc("POST /v1/return", app.allowUpload(app.createReturnHandler))
+	mux.HandleFunc("GET /v1/returns", app.listReturnsHandler)
+	mux.HandleFunc("POST /v1/returns/batch", app.allowUpload(app.createReturnBatchHandler))
+	mux.HandleFunc("GET /v1/jobs/{id}", app.showJobHandler)
+	mux.HandleFunc("GET /v1/returns/{id}", app.showReturnHandler)
+	mux.HandleFunc("GET /v1/returns/{id}/report", app.showReturnReportHandler)
+	mux.HandleFunc("PUT /v1/returns/{id}/project", app.setReturnProjectHandler)
+	mux.HandleFunc("POST /v1/returns/{id}/project/rematch", app.rematchReturnProjectHandler)
+	mux.HandleFunc("POST /v1/datamapsave", app.allowUpload(app.saveDatamapHandler))
+	mux.HandleFunc("POST /v1/datamap", app.allowUpload(app.createDatamapHandler))
+	mux.HandleFunc("POST /v1/datamapline", app.createDatamapLineByBody)
+	mux.HandleFunc("GET /v1/datamaps", app.listDatamapsHandler)
+	mux.HandleFunc("POST /v1/datamaps/draft", app.allowUpload(app.draftDatamapHandler))
 	mux.HandleFunc("GET /v1/datamaps/{id}", app.showDatamapHandler)
+	mux.HandleFunc("PUT /v1/datamaps/{id}", app.updateDatamapHandler)
+	mux.HandleFunc("PATCH /v1/datamaps/{id}", app.updateDatamapHandler)
+	mux.HandleFunc("DELETE /v1/datamaps/{id}", app.deleteDatamapHandler)
+	mux.HandleFunc("GET /v1/datamaps/{id}/export", app.exportDatamapHandler)
+	mux.HandleFunc("GET /v1/datamaps/{a}/diff/{b}", app.diffDatamapsHandler)
+	mux.HandleFunc("GET /v1/datamaps/{id}/master", app.showDatamapMasterHandler)
+	mux.HandleFunc("POST /v1/datamaps/{id}/populate", app.allowUpload(app.populateTemplateHandler))
+	mux.HandleFunc("POST /v1/datamaps/{id}/check", app.allowUpload(app.checkTemplateHandler))
+	mux.HandleFunc("GET /v1/datamaps/{id}/identity", app.showIdentityKeysHandler)
+	mux.HandleFunc("PUT /v1/datamaps/{id}/identity", app.updateIdentityKeysHandler)
+	mux.HandleFunc("DELETE /v1/datamaps/{id}/identity", app.deleteIdentityKeysHandler)
+	mux.HandleFunc("GET /v1/datamaps/{id}/revisions", app.listDatamapRevisionsHandler)
+	mux.HandleFunc("POST /v1/datamaps/{id}/revisions", app.createDatamapRevisionHandler)
+	mux.HandleFunc("GET /v1/datamaps/{id}/revisions/{revision}", app.showDatamapRevisionHandler)
+	mux.HandleFunc("GET /v1/datamaps/{id}/lines", app.listDatamapLinesHandler)
+	mux.HandleFunc("POST /v1/datamaps/{id}/lines", app.createDatamapLine)
+	mux.HandleFunc("GET /v1/datamaps/{id}/lines/{lineID}", app.showDatamapLineHandler)
+	mux.HandleFunc("PUT /v1/datamaps/{id}/lines/{lineID}", app.updateDatamapLineHandler)
+	mux.HandleFunc("PATCH /v1/datamaps/{id}/lines/{lineID}", app.updateDatamapLineHandler)
+	mux.HandleFunc("DELETE /v1/datamaps/{id}/lines/{lineID}", app.deleteDatamapLineHandler)
+	mux.HandleFunc("POST /v1/periods", app.createPeriodHandler)
+	mux.HandleFunc("GET /v1/periods", app.listPeriodsHandler)
+	mux.HandleFunc("GET /v1/periods/{id}", app.showPeriodHandler)
+	mux.HandleFunc("PUT /v1/periods/{id}", app.updatePeriodHandler)
+	mux.HandleFunc("PATCH /v1/periods/{id}", app.updatePeriodHandler)
+	mux.HandleFunc("DELETE /v1/periods/{id}", app.deletePeriodHandler)
+	mux.HandleFunc("GET /v1/periods/{id}/status", app.showPeriodStatusHandler)
+	mux.HandleFunc("GET /v1/periods/{id}/master", app.showPeriodMasterHandler)
+	mux.HandleFunc("GET /v1/periods/{id}/returns", app.listPeriodReturnsHandler)
+	mux.HandleFunc("POST /v1/periods/{id}/returns", app.attachPeriodReturnHandler)
+	mux.HandleFunc("DELETE /v1/periods/{id}/returns/{returnID}", app.detachPeriodReturnHandler)
+	mux.HandleFunc("POST /v1/projects", app.createProjectHandler)
+	mux.HandleFunc("GET /v1/projects", app.listProjectsHandler)
+	mux.HandleFunc("GET /v1/projects/{id}", app.showProjectHandler)
+	mux.HandleFunc("PUT /v1/projects/{id}", app.updateProjectHandler)
+	mux.HandleFunc("PATCH /v1/projects/{id}", app.updateProjectHandler)
+	mux.HandleFunc("DELETE /v1/projects/{id}", app.deleteProjectHandler)
 	return mux
 }
@@ -0,0 +1,295 @@
+// dbasik provides a service with which to convert spreadsheets containing
+// data to JSON for further processing.
+
+// Copyright (C) 2024 M R Lemon
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// The statuses given to each ReturnLine by validation
+const (
+	StatusOK      = "ok"
+	StatusWarning = "warning"
+	StatusError   = "error"
+)
+
+// Rules are the optional checks made on the value of a cell when a return is parsed.
+// Min and Max apply to numeric types and MinDate and MaxDate (inclusive, in ISO 8601
+// form) to DATE and DATETIME. Pattern is matched against the raw string held in the
+// cell and Allowed against the converted value. A blank cell only fails Required.
+// Failures are reported as errors, or as warnings if Warn is set; a value which cannot
+// be converted to the line's DataType is always an error.
+type Rules struct {
+	Required bool     `json:"required,omitempty" yaml:"required,omitempty"`
+	Min      *float64 `json:"min,omitempty" yaml:"min,omitempty"`
+	Max      *float64 `json:"max,omitempty" yaml:"max,omitempty"`
+	Pattern  string   `json:"pattern,omitempty" yaml:"pattern,omitempty"`
+	Allowed  []string `json:"allowed,omitempty" yaml:"allowed,omitempty"`
+	MinDate  string   `json:"min_date,omitempty" yaml:"min_date,omitempty"`
+	MaxDate  string   `json:"max_date,omitempty" yaml:"max_date,omitempty"`
+	Warn     bool     `json:"warn,omitempty" yaml:"warn,omitempty"`
+}
+
+// Value stores Rules in the database as JSON. A nil *Rules is stored as NULL.
+func (r Rules) Value() (driver.Value, error) {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+// Scan reads Rules stored by Value.
+func (r *Rules) Scan(src any) error {
+	switch src := src.(type) {
+	case []byte:
+		return json.Unmarshal(src, r)
+	case string:
+		return json.Unmarshal([]byte(src), r)
+	default:
+		return fmt.Errorf("cannot scan %T into Rules", src)
+	}
+}
+
+// isNumericType reports whether values of dataType are numbers.
+func isNumericType(dataType string) bool {
+	return PermittedValue(normaliseDataType(dataType), TypeNumber, TypeInteger, TypePercentage, TypeCurrency, TypeGBP)
+}
+
+// isDateType reports whether values of dataType are dates.
+func isDateType(dataType string) bool {
+	return PermittedValue(normaliseDataType(dataType), TypeDate, TypeDateTime)
+}
+
+// ValidateRules checks that rules make sense for a line of the given data type. Errors
+// are keyed on "rules.<field>".
+func ValidateRules(v *Validator, dataType string, rules *Rules) {
+	if rules == nil {
+		return
+	}
+
+	if rules.Min != nil || rules.Max != nil {
+		v.Check(isNumericType(dataType), "rules.min", "can only be used with numeric data types")
+	}
+	if rules.Min != nil && rules.Max != nil {
+		v.Check(*rules.Min <= *rules.Max, "rules.max", "must not be less than min")
+	}
+
+	if rules.Pattern != "" {
+		_, err := regexp.Compile(rules.Pattern)
+		v.Check(err == nil, "rules.pattern", "must be a valid regular expression")
+	}
+
+	for _, allowed := range rules.Allowed {
+		_, err := ConvertValue(dataType, allowed, false)
+		v.Check(err == nil, "rules.allowed", "must only contain values of the line's data type")
+	}
+
+	for field, date := range map[string]string{"rules.min_date": rules.MinDate, "rules.max_date": rules.MaxDate} {
+		if date == "" {
+			continue
+		}
+		v.Check(isDateType(dataType), field, "can only be used with DATE and DATETIME")
+		_, err := ConvertValue(TypeDate, date, false)
+		v.Check(err == nil, field, "must be a date")
+	}
+}
+
+// Check returns a message for each rule which rl fails. rl.Value must already have
+// been converted to the line's data type.
+func (r *Rules) Check(rl ReturnLine) []string {
+	if r == nil {
+		return nil
+	}
+
+	if rl.Value == nil || strings.TrimSpace(formatValue(rl.Value)) == "" {
+		if r.Required {
+			return []string{"a value is required"}
+		}
+		return nil
+	}
+
+	var messages []string
+
+	if f, ok := numericValue(rl.Value); ok {
+		if r.Min != nil && f < *r.Min {
+			messages = append(messages, fmt.Sprintf("must be at least %s", formatValue(*r.Min)))
+		}
+		if r.Max != nil && f > *r.Max {
+			messages = append(messages, fmt.Sprintf("must be no more than %s", formatValue(*r.Max)))
+		}
+	}
+
+	if r.Pattern != "" {
+		// ValidateRules has already checked that the pattern compiles
+		if re, err := regexp.Compile(r.Pattern); err == nil && !re.MatchString(rl.Raw) {
+			messages = append(messages, fmt.Sprintf("must match the pattern %s", r.Pattern))
+		}
+	}
+
+	if len(r.Allowed) > 0 && !r.allows(rl) {
+		messages = append(messages, fmt.Sprintf("must be one of: %s", strings.Join(r.Allowed, ", ")))
+	}
+
+	if isDateType(rl.DataType) {
+		date, _ := rl.Value.(string)
+		if r.MinDate != "" && date < dateBound(rl.DataType, r.MinDate) {
+			messages = append(messages, fmt.Sprintf("must not be before %s", r.MinDate))
+		}
+		if r.MaxDate != "" && date > dateBound(rl.DataType, r.MaxDate) {
+			messages = append(messages, fmt.Sprintf("must not be after %s", r.MaxDate))
+		}
+	}
+
+	return messages
+}
+
+// allows reports whether the value of rl is in r.Allowed, comparing converted values
+// so that, for example, "1,000" is allowed for a NUMBER line which allows "1000".
+func (r *Rules) allows(rl ReturnLine) bool {
+	for _, allowed := range r.Allowed {
+		value, err := ConvertValue(rl.DataType, allowed, false)
+		if err != nil {
+			continue
+		}
+		if s, ok := value.(string); ok && strings.EqualFold(strings.TrimSpace(s), strings.TrimSpace(formatValue(rl.Value))) {
+			return true
+		}
+		if value == rl.Value {
+			return true
+		}
+	}
+	return false
+}
+
+// numericValue returns v as a float64 if it is a number.
+func numericValue(v any) (float64, bool) {
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case int64:
+		return float64(v), true
+	}
+	return 0, false
+}
+
+// dateBound converts a date rule to the form of a value of dataType, so that the two
+// can be compared as strings.
+func dateBound(dataType, date string) string {
+	bound, err := ConvertValue(dataType, date, false)
+	if err != nil {
+		return date
+	}
+	return formatValue(bound)
+}
+
+// validateReturnLine sets the Status and Messages of rl, which has been converted from
+// the cell pointed at by dml. convErr is the error from the conversion, if any.
+func validateReturnLine(rl *ReturnLine, dml DatamapLine, convErr error) {
+	rl.Status = StatusOK
+	rl.Messages = nil
+
+	if convErr != nil {
+		rl.Status = StatusError
+		rl.Messages = []string{convErr.Error()}
+		return
+	}
+
+	rl.Messages = dml.Rules.Check(*rl)
+	if len(rl.Messages) > 0 {
+		rl.Status = StatusError
+		if dml.Rules.Warn {
+			rl.Status = StatusWarning
+		}
+	}
+}
+
+// ReportCounts holds the number of ReturnLines with each status.
+type ReportCounts struct {
+	OK      int `json:"ok"`
+	Warning int `json:"warning"`
+	Error   int `json:"error"`
+}
+
+// ValidationReport is the data-quality report for a stored Return.
+type ValidationReport struct {
+	ReturnID int64        `json:"return_id"`
+	Name     string       `json:"name"`
+	Counts   ReportCounts `json:"counts"`
+	Lines    []ReturnLine `json:"lines"`
+}
+
+// NewValidationReport creates the report for rtn. If statuses are given, only lines
+// with one of them are included, though the counts always cover every line.
+func NewValidationReport(rtn *Return, statuses ...string) *ValidationReport {
+	report := &ValidationReport{
+		ReturnID: rtn.ID,
+		Name:     rtn.Name,
+		Lines:    []ReturnLine{},
+	}
+
+	for _, rl := range rtn.ReturnLines {
+		switch rl.Status {
+		case StatusWarning:
+			report.Counts.Warning++
+		case StatusError:
+			report.Counts.Error++
+		default:
+			report.Counts.OK++
+		}
+		if len(statuses) == 0 || PermittedValue(rl.Status, statuses...) {
+			report.Lines = append(report.Lines, rl)
+		}
+	}
+
+	return report
+}
+
+// WriteCSV writes the lines of the report as CSV with a header row, in a form which can
+// be sent back to whoever submitted the return.
+func (vr *ValidationReport) WriteCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	err := cw.Write([]string{"key", "sheet", "cellref", "datatype", "value", "status", "messages"})
+	if err != nil {
+		return err
+	}
+
+	for _, rl := range vr.Lines {
+		err := cw.Write([]string{
+			rl.Key,
+			rl.Sheet,
+			rl.CellRef,
+			rl.DataType,
+			rl.Raw,
+			rl.Status,
+			strings.Join(rl.Messages, "; "),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+func TestValidateRules(t *testing.T) {
+	tests := []struct {
+		name     string
+		dataType string
+		rules    *Rules
+		wantKeys []string
+	}{
+		{"no rules", "TEXT", nil, nil},
+		{"valid number range", "NUMBER", &Rules{Min: ptr(0.0), Max: ptr(100.0)}, nil},
+		{"range on text", "TEXT", &Rules{Min: ptr(0.0)}, []string{"rules.min"}},
+		{"min above max", "GBP", &Rules{Min: ptr(10.0), Max: ptr(1.0)}, []string{"rules.max"}},
+		{"bad pattern", "TEXT", &Rules{Pattern: "[a-"}, []string{"rules.pattern"}},
+		{"allowed of wrong type", "INTEGER", &Rules{Allowed: []string{"1", "two"}}, []string{"rules.allowed"}},
+		{"valid date range", "DATE", &Rules{MinDate: "2024-04-01", MaxDate: "2025-03-31"}, nil},
+		{"date range on number", "NUMBER", &Rules{MinDate: "2024-04-01"}, []string{"rules.min_date"}},
+		{"bad date", "DATE", &Rules{MaxDate: "soon"}, []string{"rules.max_date"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := NewValidator()
+			ValidateRules(v, tt.dataType, tt.rules)
+			if len(v.Errors) != len(tt.wantKeys) {
+				t.Fatalf("ValidateRules() errors = %v, want keys %v", v.Errors, tt.wantKeys)
+			}
+			for _, key := range tt.wantKeys {
+				if _, ok := v.Errors[key]; !ok {
+					t.Errorf("ValidateRules() did not report %q, got %v", key, v.Errors)
+				}
+			}
+		})
+	}
+}
+
+func TestNewTypedReturnLineValidation(t *testing.T) {
+	tests := []struct {
+		name         string
+		dml          DatamapLine
+		raw          string
+		wantStatus   string
+		wantMessages int
+	}{
+		{"no rules", DatamapLine{DataType: "TEXT"}, "anything", StatusOK, 0},
+		{"required and blank", DatamapLine{DataType: "TEXT", Rules: &Rules{Required: true}}, " ", StatusError, 1},
+		{"required number blank", DatamapLine{DataType: "NUMBER", Rules: &Rules{Required: true}}, "", StatusError, 1},
+		{"blank not required", DatamapLine{DataType: "NUMBER", Rules: &Rules{Min: ptr(1.0)}}, "", StatusOK, 0},
+		{"text in number", DatamapLine{DataType: "NUMBER", Rules: &Rules{Warn: true}}, "TBC", StatusError, 1},
+		{"below min", DatamapLine{DataType: "GBP", Rules: &Rules{Min: ptr(0.0)}}, "-£5", StatusError, 1},
+		{"above max as warning", DatamapLine{DataType: "PERCENTAGE", Rules: &Rules{Max: ptr(1.0), Warn: true}}, "120%", StatusWarning, 1},
+		{"within range", DatamapLine{DataType: "INTEGER", Rules: &Rules{Min: ptr(1.0), Max: ptr(10.0)}}, "10", StatusOK, 0},
+		{"pattern fails", DatamapLine{DataType: "TEXT", Rules: &Rules{Pattern: `^GMPP-\d+$`}}, "1234", StatusError, 1},
+		{"pattern matches", DatamapLine{DataType: "TEXT", Rules: &Rules{Pattern: `^GMPP-\d+$`}}, "GMPP-1234", StatusOK, 0},
+		{"allowed text ignores case", DatamapLine{DataType: "TEXT", Rules: &Rules{Allowed: []string{"Red", "Amber", "Green"}}}, "amber", StatusOK, 0},
+		{"not allowed", DatamapLine{DataType: "TEXT", Rules: &Rules{Allowed: []string{"Red", "Amber", "Green"}}}, "Blue", StatusError, 1},
+		{"allowed number", DatamapLine{DataType: "NUMBER", Rules: &Rules{Allowed: []string{"1000"}}}, "1,000", StatusOK, 0},
+		{"serial date before range", DatamapLine{DataType: "DATE", Rules: &Rules{MinDate: "2024-07-02"}}, "45474", StatusError, 1},
+		{"datetime on last day", DatamapLine{DataType: "DATETIME", Rules: &Rules{MinDate: "2024-07-01", MaxDate: "2024-07-01"}}, "45474", StatusOK, 0},
+		{"several failures", DatamapLine{DataType: "NUMBER", Rules: &Rules{Max: ptr(1.0), Pattern: `^\d$`}}, "25", StatusError, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rl := newTypedReturnLine(tt.dml, tt.raw, false)
+			if rl.Status != tt.wantStatus || len(rl.Messages) != tt.wantMessages {
+				t.Errorf("newTypedReturnLine() status = %q, messages = %q; want %q with %d messages",
+					rl.Status, rl.Messages, tt.wantStatus, tt.wantMessages)
+			}
+		})
+	}
+}
+
+func TestValidationReport(t *testing.T) {
+	rtn := &Return{
+		ID:   3,
+		Name: "return.xlsx",
+		ReturnLines: []ReturnLine{
+			{Key: "Project Name", Sheet: "Introduction", CellRef: "C5", DataType: "TEXT", Raw: "Knocker", Status: StatusOK},
+			{Key: "Total Cost", Sheet: "9 - Costs", CellRef: "D10", DataType: "GBP", Raw: "TBC", Status: StatusError, Messages: []string{"cannot convert \"TBC\" to GBP"}},
+			{Key: "RAG", Sheet: "Introduction", CellRef: "C9", DataType: "TEXT", Raw: "Blue", Status: StatusWarning, Messages: []string{"must be one of: Red, Green", "must match the pattern ^[RG]"}},
+		},
+	}
+
+	report := NewValidationReport(rtn)
+	if want := (ReportCounts{OK: 1, Warning: 1, Error: 1}); report.Counts != want {
+		t.Errorf("NewValidationReport() counts = %+v, want %+v", report.Counts, want)
+	}
+	if len(report.Lines) != 3 {
+		t.Errorf("NewValidationReport() has %d lines, want 3", len(report.Lines))
+	}
+
+	report = NewValidationReport(rtn, StatusError, StatusWarning)
+	var keys []string
+	for _, rl := range report.Lines {
+		keys = append(keys, rl.Key)
+	}
+	if want := []string{"Total Cost", "RAG"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("NewValidationReport() lines = %v, want %v", keys, want)
+	}
+	if report.Counts.OK != 1 {
+		t.Errorf("NewValidationReport() counts = %+v, want every line counted", report.Counts)
+	}
+
+	var buf bytes.Buffer
+	if err := report.WriteCSV(&buf); err != nil {
+		t.Fatal(err)
+	}
+	want := strings.Join([]string{
+		"key,sheet,cellref,datatype,value,status,messages",
+		`Total Cost,9 - Costs,D10,GBP,TBC,error,"cannot convert ""TBC"" to GBP"`,
+		`RAG,Introduction,C9,TEXT,Blue,warning,"must be one of: Red, Green; must match the pattern ^[RG]"`,
+		"",
+	}, "\n")
+	if buf.String() != want {
+		t.Errorf("WriteCSV() =\n%s\nwant\n%s", buf.String(), want)
+	}
+}
@@ -0,0 +1,701 @@
+// dbasik provides a service with which to convert spreadsheets containing
+// data to JSON for further processing.
+
+// Copyright (C) 2024 M R Lemon
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/tealeg/xlsx/v3"
+)
+
+// Spreadsheet is read by ParseXLSX. Each supported file format has an implementation,
+// opened by OpenSpreadsheet.
+type Spreadsheet interface {
+	// HasSheet reports whether the spreadsheet has a sheet called name.
+	HasSheet(name string) bool
+	// Cell returns the contents of the cell at cellRef, in A1 format, on the named
+	// sheet. An empty cell, or one outside the used area of the sheet, is the zero
+	// SpreadsheetCell.
+	Cell(sheet, cellRef string) (SpreadsheetCell, error)
+	// DefinedName returns the sheet and the cell or range, in A1 form, which the
+	// defined name refers to when it is used on sheet.
+	DefinedName(sheet, name string) (string, string, error)
+	// Date1904 reports whether numeric dates count days from 1904 rather than 1900.
+	Date1904() bool
+}
+
+// ValueMode chooses what is read from each cell of a return, which matters for cells
+// holding a formula.
+type ValueMode string
+
+// Values of ValueMode
+const (
+	ValueCached    ValueMode = "cached"    // the result last calculated by the spreadsheet application
+	ValueFormatted ValueMode = "formatted" // the result as displayed, with its number format applied
+	ValueFormula   ValueMode = "formula"   // the formula itself, e.g. =SUM(C5:C9)
+)
+
+// ValueModes holds every ValueMode, for validation.
+var ValueModes = []ValueMode{ValueCached, ValueFormatted, ValueFormula}
+
+// SpreadsheetCell is the contents of one cell of a Spreadsheet.
+type SpreadsheetCell struct {
+	Value     string // the stored value, or the cached result of a formula
+	Formatted string // the value as it is displayed
+	Formula   string // the formula, starting with "=", if the cell holds one
+	Error     string // the error value, e.g. #REF!, if the cell holds one
+}
+
+// Text returns the string read from c for mode. A cell without a formula reads as its
+// value in ValueFormula mode.
+func (c SpreadsheetCell) Text(mode ValueMode) string {
+	switch mode {
+	case ValueFormatted:
+		return c.Formatted
+	case ValueFormula:
+		if c.Formula != "" {
+			return c.Formula
+		}
+	}
+	return c.Value
+}
+
+// excelErrors holds the error values which Excel shows in a cell whose formula
+// can't be calculated.
+var excelErrors = map[string]bool{
+	"#NULL!":         true,
+	"#DIV/0!":        true,
+	"#VALUE!":        true,
+	"#REF!":          true,
+	"#NAME?":         true,
+	"#NUM!":          true,
+	"#N/A":           true,
+	"#GETTING_DATA":  true,
+	"#SPILL!":        true,
+	"#CALC!":         true,
+	"#FIELD!":        true,
+	"#BLOCKED!":      true,
+	"#CONNECT!":      true,
+	"#BUSY!":         true,
+	"#UNKNOWN!":      true,
+	"#EXTERNAL!":     true,
+	"#PYTHON!":       true,
+	"#TIMEOUT!":      true,
+	"#BLOCKED_DATA!": true,
+}
+
+// isSpreadsheetError reports whether s is an error value, either one of Excel's or
+// one of LibreOffice's, such as Err:502.
+func isSpreadsheetError(s string) bool {
+	return excelErrors[s] || strings.HasPrefix(s, "Err:")
+}
+
+// formulaText returns formula with the leading "=" which is shown in the formula bar,
+// and which neither Excel nor OpenDocument store. OpenDocument formulas also carry a
+// namespace prefix, such as "of:", which is removed.
+func formulaText(formula string) string {
+	if formula == "" {
+		return ""
+	}
+	if i := strings.Index(formula, ":="); i >= 0 && !strings.ContainsAny(formula[:i], "=([.") {
+		formula = formula[i+1:]
+	}
+	if !strings.HasPrefix(formula, "=") {
+		formula = "=" + formula
+	}
+	return formula
+}
+
+// Formats of spreadsheet which can be read but which aren't Excel workbooks
+var (
+	FormatODS    = &WorkbookFormat{Name: "ods", Ext: ".ods", ContentType: "application/vnd.oasis.opendocument.spreadsheet"}
+	FormatCSVZip = &WorkbookFormat{Name: "csv", Ext: ".zip", ContentType: "application/zip"}
+)
+
+// DetectSpreadsheetFormat works out the format of the spreadsheet in r from its
+// content: one of the Excel workbook formats, an OpenDocument spreadsheet or a zip
+// archive holding a CSV file for each sheet. It returns ErrNotWorkbook if r is none
+// of these.
+func DetectSpreadsheetFormat(r io.ReaderAt, size int64) (*WorkbookFormat, error) {
+	format, err := DetectWorkbookFormat(r, size)
+	if !errors.Is(err, ErrNotWorkbook) {
+		return format, err
+	}
+
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, ErrNotWorkbook
+	}
+	if mimetype, err := readZipFile(zr, "mimetype"); err == nil {
+		if strings.TrimSpace(string(mimetype)) == FormatODS.ContentType {
+			return FormatODS, nil
+		}
+		return nil, ErrNotWorkbook
+	}
+	if len(csvSheetFiles(zr)) > 0 {
+		return FormatCSVZip, nil
+	}
+	return nil, ErrNotWorkbook
+}
+
+// DetectSpreadsheetFile does the same as DetectSpreadsheetFormat for the file at
+// filePath.
+func DetectSpreadsheetFile(filePath string) (*WorkbookFormat, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return DetectSpreadsheetFormat(f, fi.Size())
+}
+
+// OpenSpreadsheet opens the spreadsheet at filePath with the reader for its format.
+func OpenSpreadsheet(filePath string) (Spreadsheet, error) {
+	format, err := DetectSpreadsheetFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	switch format {
+	case FormatODS:
+		return openODS(filePath)
+	case FormatCSVZip:
+		return openCSVZip(filePath)
+	default:
+		return openXLSX(filePath)
+	}
+}
+
+// xlsxSpreadsheet reads Excel workbooks, using tealeg/xlsx. The defined names are read
+// separately, as tealeg/xlsx doesn't tell those belonging to the first sheet apart
+// from those belonging to the workbook. They are only read the first time a name is
+// looked up, so most workbooks are opened once, and a workbook whose names can't be
+// read can still be read by cell reference.
+type xlsxSpreadsheet struct {
+	path      string
+	wb        *xlsx.File
+	names     definedNames
+	namesRead bool
+	namesErr  error
+}
+
+func openXLSX(filePath string) (*xlsxSpreadsheet, error) {
+	wb, err := xlsx.OpenFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	return &xlsxSpreadsheet{path: filePath, wb: wb}, nil
+}
+
+// readNames reads the defined names of the workbook, the first time it is called.
+func (s *xlsxSpreadsheet) readNames() error {
+	if s.namesRead {
+		return s.namesErr
+	}
+	s.namesRead = true
+
+	zr, err := zip.OpenReader(s.path)
+	if err != nil {
+		s.namesErr = err
+		return err
+	}
+	defer zr.Close()
+	book, err := readWorkbookParts(&zr.Reader)
+	if err != nil {
+		s.namesErr = err
+		return err
+	}
+	s.names = book.names
+	return nil
+}
+
+func (s *xlsxSpreadsheet) HasSheet(name string) bool {
+	_, ok := s.wb.Sheet[name]
+	return ok
+}
+
+func (s *xlsxSpreadsheet) Cell(sheet, cellRef string) (SpreadsheetCell, error) {
+	sh, ok := s.wb.Sheet[sheet]
+	if !ok {
+		return SpreadsheetCell{}, fmt.Errorf("sheet %s not found", sheet)
+	}
+	col, row, err := xlsx.GetCoordsFromCellIDString(cellRef)
+	if err != nil {
+		return SpreadsheetCell{}, err
+	}
+	cell, err := sh.Cell(row, col)
+	if err != nil {
+		return SpreadsheetCell{}, err
+	}
+
+	c := SpreadsheetCell{Value: cell.Value, Formula: formulaText(cell.Formula())}
+	// FormattedValue returns the unformatted value along with any error, which is
+	// the best we can show for a number format it doesn't understand.
+	c.Formatted, _ = cell.FormattedValue()
+	if cell.Type() == xlsx.CellTypeError {
+		c.Error = cell.Value
+		c.Formatted = cell.Value
+	}
+	return c, nil
+}
+
+func (s *xlsxSpreadsheet) DefinedName(sheet, name string) (string, string, error) {
+	if err := s.readNames(); err != nil {
+		return "", "", fmt.Errorf("%w %s cannot be looked up: %v", ErrDefinedName, name, err)
+	}
+	return s.names.resolve(sheet, name)
+}
+
+func (s *xlsxSpreadsheet) Date1904() bool {
+	return s.wb.Date1904
+}
+
+// gridSheet holds the non-empty cells of a sheet, keyed by zero-based row and column.
+// Runs of identical rows, which OpenDocument stores once with a repeat count, are
+// stored once with the range of rows they cover.
+type gridSheet struct {
+	rows []gridRow
+}
+
+type gridRow struct {
+	first, last int // the rows covered
+	cells       map[int]SpreadsheetCell
+}
+
+func (g *gridSheet) cell(row, col int) SpreadsheetCell {
+	i := sort.Search(len(g.rows), func(i int) bool { return g.rows[i].last >= row })
+	if i == len(g.rows) || g.rows[i].first > row {
+		return SpreadsheetCell{}
+	}
+	return g.rows[i].cells[col]
+}
+
+// gridSpreadsheet is a Spreadsheet whose sheets have been read into memory.
+type gridSpreadsheet struct {
+	sheets map[string]*gridSheet
+	names  definedNames
+}
+
+func (s *gridSpreadsheet) HasSheet(name string) bool {
+	_, ok := s.sheets[name]
+	return ok
+}
+
+func (s *gridSpreadsheet) Cell(sheet, cellRef string) (SpreadsheetCell, error) {
+	g, ok := s.sheets[sheet]
+	if !ok {
+		return SpreadsheetCell{}, fmt.Errorf("sheet %s not found", sheet)
+	}
+	col, row, err := xlsx.GetCoordsFromCellIDString(cellRef)
+	if err != nil {
+		return SpreadsheetCell{}, err
+	}
+	return g.cell(row, col), nil
+}
+
+func (s *gridSpreadsheet) DefinedName(sheet, name string) (string, string, error) {
+	return s.names.resolve(sheet, name)
+}
+
+// Date1904 is always false, as neither OpenDocument nor CSV store dates as numbers.
+func (s *gridSpreadsheet) Date1904() bool {
+	return false
+}
+
+// The largest sheet we read, which is the same as the largest Excel allows
+const (
+	maxSheetRows = 1 << 20
+	maxSheetCols = 1 << 14
+)
+
+// OpenDocument namespaces used in content.xml
+const (
+	odsTableNS  = "urn:oasis:names:tc:opendocument:xmlns:table:1.0"
+	odsOfficeNS = "urn:oasis:names:tc:opendocument:xmlns:office:1.0"
+	odsTextNS   = "urn:oasis:names:tc:opendocument:xmlns:text:1.0"
+)
+
+// openODS reads the sheets of an OpenDocument spreadsheet. The value of a typed cell
+// is the value it stores rather than the text it displays, which is its formatted
+// value: the number for floats, percentages and currencies, the ISO 8601 date for
+// dates and true or false for booleans, so that converting it gives the same result
+// as the same cell in Excel.
+func openODS(filePath string) (*gridSpreadsheet, error) {
+	zr, err := zip.OpenReader(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	var content *zip.File
+	for _, f := range zr.File {
+		if f.Name == "content.xml" {
+			content = f
+		}
+	}
+	if content == nil {
+		return nil, errors.New("content.xml not found in OpenDocument spreadsheet")
+	}
+	rc, err := content.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	ss := &gridSpreadsheet{sheets: make(map[string]*gridSheet)}
+	dec := xml.NewDecoder(io.LimitReader(rc, maxZipEntrySize))
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		se, ok := tok.(xml.StartElement)
+		if !ok || se.Name.Space != odsTableNS {
+			continue
+		}
+		switch se.Name.Local {
+		case "named-range":
+			ss.names = append(ss.names, newODSName(se, ""))
+		case "table":
+			name := odsAttr(se, odsTableNS, "name")
+			sheet, names, err := readODSTable(dec, name)
+			if err != nil {
+				return nil, fmt.Errorf("sheet %s: %w", name, err)
+			}
+			ss.sheets[name] = sheet
+			ss.names = append(ss.names, names...)
+		}
+	}
+
+	return ss, nil
+}
+
+// readODSTable reads the rows of the table called name, whose start element has just
+// been read from dec, up to and including its end element. It also returns the names
+// which belong to the table.
+func readODSTable(dec *xml.Decoder, name string) (*gridSheet, definedNames, error) {
+	sheet := &gridSheet{}
+	var names definedNames
+	row := 0
+
+	for depth := 1; depth > 0; {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, nil, err
+		}
+		switch t := tok.(type) {
+		case xml.EndElement:
+			depth--
+		case xml.StartElement:
+			if t.Name.Space != odsTableNS || t.Name.Local != "table-row" {
+				// Rows may be wrapped in header-rows, row-group and similar elements
+				if t.Name.Space == odsTableNS && t.Name.Local == "table" {
+					if err := dec.Skip(); err != nil {
+						return nil, nil, err
+					}
+					continue
+				}
+				if t.Name.Space == odsTableNS && t.Name.Local == "named-range" {
+					names = append(names, newODSName(t, name))
+				}
+				depth++
+				continue
+			}
+
+			repeat := odsRepeat(t, "number-rows-repeated")
+			cells, err := readODSRow(dec)
+			if err != nil {
+				return nil, nil, err
+			}
+			if len(cells) > 0 && row < maxSheetRows {
+				sheet.rows = append(sheet.rows, gridRow{first: row, last: min(row+repeat, maxSheetRows) - 1, cells: cells})
+			}
+			row += repeat
+		}
+	}
+
+	return sheet, names, nil
+}
+
+// newODSName creates the definedName for the named-range element se, belonging to
+// the sheet scope.
+func newODSName(se xml.StartElement, scope string) definedName {
+	address := odsAttr(se, odsTableNS, "cell-range-address")
+	dn := definedName{Name: odsAttr(se, odsTableNS, "name"), Scope: scope, Target: address}
+	dn.Sheet, dn.Ref, dn.err = parseODSAddress(address)
+	return dn
+}
+
+// readODSRow reads the cells of the row whose start element has just been read from
+// dec, up to and including its end element.
+func readODSRow(dec *xml.Decoder) (map[int]SpreadsheetCell, error) {
+	cells := make(map[int]SpreadsheetCell)
+	col := 0
+
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.EndElement:
+			return cells, nil
+		case xml.StartElement:
+			repeat := odsRepeat(t, "number-columns-repeated")
+			cell, err := readODSCell(dec, t)
+			if err != nil {
+				return nil, err
+			}
+			if cell != (SpreadsheetCell{}) {
+				for c := col; c < min(col+repeat, maxSheetCols); c++ {
+					cells[c] = cell
+				}
+			}
+			col += repeat
+		}
+	}
+}
+
+// readODSCell returns the contents of the table-cell (or covered-table-cell) element
+// start, reading up to and including its end element.
+func readODSCell(dec *xml.Decoder, start xml.StartElement) (SpreadsheetCell, error) {
+	text, err := readODSText(dec)
+	if err != nil {
+		return SpreadsheetCell{}, err
+	}
+
+	cell := SpreadsheetCell{
+		Value:     text,
+		Formatted: text,
+		Formula:   formulaText(odsAttr(start, odsTableNS, "formula")),
+	}
+	// A formula which can't be calculated is saved with the error as its text
+	if cell.Formula != "" && isSpreadsheetError(text) {
+		cell.Error = text
+		return cell, nil
+	}
+
+	switch odsAttr(start, odsOfficeNS, "value-type") {
+	case "float", "percentage", "currency":
+		cell.Value = odsAttr(start, odsOfficeNS, "value")
+	case "date":
+		cell.Value = odsAttr(start, odsOfficeNS, "date-value")
+	case "boolean":
+		cell.Value = odsAttr(start, odsOfficeNS, "boolean-value")
+	}
+	return cell, nil
+}
+
+// readODSText returns the text of the paragraphs inside the element whose start has
+// just been read from dec, one paragraph per line, reading up to and including its
+// end element.
+func readODSText(dec *xml.Decoder) (string, error) {
+	var b strings.Builder
+	paragraphs := 0
+
+	for depth := 1; depth > 0; {
+		tok, err := dec.Token()
+		if err != nil {
+			return "", err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			depth++
+			if t.Name.Space == odsOfficeNS && t.Name.Local == "annotation" {
+				// Comments aren't part of the cell's value
+				if err := dec.Skip(); err != nil {
+					return "", err
+				}
+				depth--
+				continue
+			}
+			if t.Name.Space != odsTextNS {
+				continue
+			}
+			switch t.Name.Local {
+			case "p", "h":
+				if paragraphs > 0 {
+					b.WriteByte('\n')
+				}
+				paragraphs++
+			case "s":
+				n, err := strconv.Atoi(odsAttr(t, odsTextNS, "c"))
+				if err != nil || n < 1 {
+					n = 1
+				}
+				b.WriteString(strings.Repeat(" ", min(n, 1000)))
+			case "tab":
+				b.WriteByte('\t')
+			case "line-break":
+				b.WriteByte('\n')
+			case "note":
+				if err := dec.Skip(); err != nil {
+					return "", err
+				}
+				depth--
+			}
+		case xml.EndElement:
+			depth--
+		case xml.CharData:
+			if depth > 1 {
+				b.Write(t)
+			}
+		}
+	}
+
+	return b.String(), nil
+}
+
+func odsAttr(se xml.StartElement, space, local string) string {
+	for _, a := range se.Attr {
+		if a.Name.Space == space && a.Name.Local == local {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// odsRepeat returns the value of the repeat attribute called local on se, which is 1
+// if it isn't set.
+func odsRepeat(se xml.StartElement, local string) int {
+	n, err := strconv.Atoi(odsAttr(se, odsTableNS, local))
+	if err != nil || n < 1 {
+		return 1
+	}
+	return n
+}
+
+// csvSheetFiles returns the CSV files in zr, ignoring operating system junk.
+func csvSheetFiles(zr *zip.Reader) []*zip.File {
+	var files []*zip.File
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() || isArchiveJunk(f.Name) {
+			continue
+		}
+		if strings.EqualFold(path.Ext(f.Name), ".csv") {
+			files = append(files, f)
+		}
+	}
+	return files
+}
+
+// utf8BOM is the byte order mark which Excel puts at the start of CSV files it saves
+var utf8BOM = []byte("\xef\xbb\xbf")
+
+// openCSVZip reads a zip archive of CSV files, one per sheet. Each sheet is named after
+// its file, without the .csv extension, and the first record of a file is row 1. CSV
+// holds only what was displayed, so a cell's value and formatted value are the same
+// and there are no formulas, but the error values Excel displays are recognised.
+func openCSVZip(filePath string) (*gridSpreadsheet, error) {
+	zr, err := zip.OpenReader(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	ss := &gridSpreadsheet{sheets: make(map[string]*gridSheet)}
+	for _, f := range csvSheetFiles(&zr.Reader) {
+		name := strings.TrimSuffix(path.Base(f.Name), path.Ext(f.Name))
+		if _, ok := ss.sheets[name]; ok {
+			return nil, fmt.Errorf("more than one CSV file for sheet %s", name)
+		}
+
+		sheet, err := readCSVSheet(f)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", f.Name, err)
+		}
+		ss.sheets[name] = sheet
+	}
+
+	return ss, nil
+}
+
+func readCSVSheet(f *zip.File) (*gridSheet, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	data, err := io.ReadAll(io.LimitReader(rc, maxZipEntrySize))
+	if err != nil {
+		return nil, err
+	}
+
+	cr := csv.NewReader(bytes.NewReader(bytes.TrimPrefix(data, utf8BOM)))
+	cr.FieldsPerRecord = -1
+	cr.LazyQuotes = true
+
+	// The csv package skips blank lines, so the row of each record is worked out from
+	// the line it starts on and the lines taken up by the records before it.
+	sheet := &gridSheet{}
+	row, lastLine := -1, 0
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		line, _ := cr.FieldPos(0)
+		row += line - lastLine
+		last := len(record) - 1
+		lastLine, _ = cr.FieldPos(last)
+		lastLine += strings.Count(record[last], "\n")
+		if row >= maxSheetRows {
+			break
+		}
+
+		cells := make(map[int]SpreadsheetCell)
+		for col, value := range record[:min(len(record), maxSheetCols)] {
+			if value == "" {
+				continue
+			}
+			cell := SpreadsheetCell{Value: value, Formatted: value}
+			if excelErrors[value] {
+				cell.Error = value
+			}
+			cells[col] = cell
+		}
+		if len(cells) > 0 {
+			sheet.rows = append(sheet.rows, gridRow{first: row, last: row, cells: cells})
+		}
+	}
+
+	return sheet, nil
+}
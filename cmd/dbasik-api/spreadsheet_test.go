@@ -0,0 +1,292 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseSpreadsheetFormats(t *testing.T) {
+	dm := &Datamap{DMLs: []DatamapLine{
+		{ID: 1, Key: "Key 1", Sheet: "Sheet1", DataType: "TEXT", CellRef: "A1"},
+		{ID: 2, Key: "Key 2", Sheet: "Sheet1", DataType: "TEXT", CellRef: "B1"},
+		{ID: 3, Key: "Key 3", Sheet: "Sheet2", DataType: "TEXT", CellRef: "C1"},
+		{ID: 4, Key: "Key 4", Sheet: "Sheet2", DataType: "TEXT", CellRef: "C2"},
+	}}
+
+	want, err := ParseXLSX("../../testdata/valid_excel.xlsx", dm)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, filePath := range []string{"../../testdata/valid_ods.ods", "../../testdata/valid_csv.zip"} {
+		t.Run(filePath, func(t *testing.T) {
+			got, err := ParseXLSX(filePath, dm)
+			if err != nil {
+				t.Fatalf("ParseXLSX() error = %v", err)
+			}
+			if !reflect.DeepEqual(got.ReturnLines, want.ReturnLines) {
+				t.Errorf("ParseXLSX() ReturnLines = %+v, want %+v", got.ReturnLines, want.ReturnLines)
+			}
+		})
+	}
+}
+
+func TestParseSpreadsheetMissingSheet(t *testing.T) {
+	dm := &Datamap{DMLs: []DatamapLine{{Key: "Key 1", Sheet: "Sheet9", CellRef: "A1"}}}
+	for _, filePath := range []string{"../../testdata/valid_ods.ods", "../../testdata/valid_csv.zip"} {
+		if _, err := ParseXLSX(filePath, dm); err == nil || !strings.Contains(err.Error(), "Sheet9") {
+			t.Errorf("ParseXLSX(%s) error = %v, want sheet not found", filePath, err)
+		}
+	}
+}
+
+const testODSContent = `<?xml version="1.0" encoding="UTF-8"?>
+<office:document-content xmlns:office="urn:oasis:names:tc:opendocument:xmlns:office:1.0" xmlns:table="urn:oasis:names:tc:opendocument:xmlns:table:1.0" xmlns:text="urn:oasis:names:tc:opendocument:xmlns:text:1.0">
+<office:body><office:spreadsheet>
+<table:table table:name="Costs">
+<table:table-header-rows>
+<table:table-row><table:table-cell office:value-type="string"><text:p>Item</text:p></table:table-cell><table:table-cell office:value-type="string"><text:p>Amount</text:p></table:table-cell></table:table-row>
+</table:table-header-rows>
+<table:table-row table:number-rows-repeated="3"><table:table-cell office:value-type="string"><text:p>Same</text:p></table:table-cell><table:table-cell table:number-columns-repeated="2" office:value-type="float" office:value="1250.5"><text:p>£1,250.50</text:p></table:table-cell></table:table-row>
+<table:table-row><table:table-cell office:value-type="percentage" office:value="0.25"><text:p>25%</text:p></table:table-cell><table:table-cell office:value-type="date" office:date-value="2024-04-01"><text:p>01/04/24</text:p></table:table-cell><table:table-cell office:value-type="boolean" office:boolean-value="true"><text:p>TRUE</text:p></table:table-cell></table:table-row>
+<table:table-row><table:table-cell table:formula="of:=SUM([.C2:.C4])" office:value-type="float" office:value="3751.5"><text:p>£3,751.50</text:p></table:table-cell><table:table-cell table:formula="of:=1/0" office:value-type="float" office:value="0"><text:p>#DIV/0!</text:p></table:table-cell><table:table-cell table:formula="of:=[.Z99]+" office:value-type="string" office:string-value=""><text:p>Err:502</text:p></table:table-cell></table:table-row>
+<table:table-row><table:covered-table-cell/><table:table-cell office:value-type="string"><text:p>two<text:s text:c="3"/>spaces<office:annotation><text:p>a note</text:p></office:annotation></text:p><text:p>second line</text:p></table:table-cell></table:table-row>
+</table:table>
+</office:spreadsheet></office:body>
+</office:document-content>`
+
+func TestOpenODS(t *testing.T) {
+	path := writeTestZip(t, map[string][]byte{
+		"mimetype":    []byte(FormatODS.ContentType),
+		"content.xml": []byte(testODSContent),
+	})
+
+	ss, err := OpenSpreadsheet(path)
+	if err != nil {
+		t.Fatalf("OpenSpreadsheet() error = %v", err)
+	}
+
+	tests := []struct {
+		cellRef string
+		want    string
+	}{
+		{"A1", "Item"},
+		{"B1", "Amount"},
+		{"A2", "Same"},
+		{"A4", "Same"},
+		{"C4", "1250.5"},
+		{"D4", ""},
+		{"A5", "0.25"},
+		{"B5", "2024-04-01"},
+		{"C5", "true"},
+		{"A7", ""},
+		{"B7", "two   spaces\nsecond line"},
+		{"A100", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.cellRef, func(t *testing.T) {
+			got, err := ss.Cell("Costs", tt.cellRef)
+			if err != nil {
+				t.Fatalf("Cell() error = %v", err)
+			}
+			if got.Value != tt.want {
+				t.Errorf("Cell().Value = %q, want %q", got.Value, tt.want)
+			}
+		})
+	}
+
+	formulas := map[string]SpreadsheetCell{
+		"C4": {Value: "1250.5", Formatted: "£1,250.50"},
+		"A6": {Value: "3751.5", Formatted: "£3,751.50", Formula: "=SUM([.C2:.C4])"},
+		"B6": {Value: "#DIV/0!", Formatted: "#DIV/0!", Formula: "=1/0", Error: "#DIV/0!"},
+		"C6": {Value: "Err:502", Formatted: "Err:502", Formula: "=[.Z99]+", Error: "Err:502"},
+	}
+	for cellRef, want := range formulas {
+		if got, _ := ss.Cell("Costs", cellRef); got != want {
+			t.Errorf("Cell(%s) = %+v, want %+v", cellRef, got, want)
+		}
+	}
+
+	// Typed values convert the same way as their Excel equivalents
+	rl := newTypedReturnLine(DatamapLine{Sheet: "Costs", CellRef: "B5", DataType: "DATE"}, "2024-04-01", ss.Date1904())
+	if rl.Value != "2024-04-01" || rl.Status != StatusOK {
+		t.Errorf("newTypedReturnLine() = %+v, want 2024-04-01", rl)
+	}
+}
+
+func TestOpenCSVZip(t *testing.T) {
+	path := writeTestZip(t, map[string][]byte{
+		"returns/Introduction.csv":    []byte("\xef\xbb\xbfProject Name,\"Big, Bridge\"\r\n\r\nStart,01/04/2024\r\nNotes,\"line one\r\nline two\"\r\nEnd,31/03/2025\r\n"),
+		"__MACOSX/._Introduction.csv": []byte("bobbins"),
+		"README.txt":                  []byte("bobbins"),
+	})
+
+	ss, err := OpenSpreadsheet(path)
+	if err != nil {
+		t.Fatalf("OpenSpreadsheet() error = %v", err)
+	}
+	if !ss.HasSheet("Introduction") || ss.HasSheet("README") {
+		t.Fatalf("HasSheet() did not find only the CSV sheet")
+	}
+
+	for cellRef, want := range map[string]string{
+		"A1": "Project Name", "B1": "Big, Bridge", "A2": "", "B3": "01/04/2024",
+		"B4": "line one\nline two", "A5": "End", "B5": "31/03/2025",
+	} {
+		if got, _ := ss.Cell("Introduction", cellRef); got.Value != want {
+			t.Errorf("Value(%s) = %q, want %q", cellRef, got, want)
+		}
+	}
+}
+
+func TestOpenCSVZipErrors(t *testing.T) {
+	path := writeTestZip(t, map[string][]byte{"Costs.csv": []byte("Total,#DIV/0!,#NOTANERROR\r\n")})
+
+	ss, err := OpenSpreadsheet(path)
+	if err != nil {
+		t.Fatalf("OpenSpreadsheet() error = %v", err)
+	}
+	if got, _ := ss.Cell("Costs", "B1"); got.Error != "#DIV/0!" {
+		t.Errorf("Cell(B1).Error = %q, want #DIV/0!", got.Error)
+	}
+	if got, _ := ss.Cell("Costs", "C1"); got.Error != "" {
+		t.Errorf("Cell(C1).Error = %q, want none", got.Error)
+	}
+}
+
+func TestOpenCSVZipDuplicateSheets(t *testing.T) {
+	path := writeTestZip(t, map[string][]byte{
+		"a/Sheet1.csv": []byte("1"),
+		"b/Sheet1.csv": []byte("2"),
+	})
+	if _, err := OpenSpreadsheet(path); err == nil {
+		t.Error("OpenSpreadsheet() error = nil, want duplicate sheet error")
+	}
+}
+
+func TestDetectSpreadsheetFile(t *testing.T) {
+	tests := []struct {
+		name     string
+		filePath string
+		want     *WorkbookFormat
+		wantErr  error
+	}{
+		{"xlsx", "../../testdata/valid_excel.xlsx", FormatXLSX, nil},
+		{"xlsm", "../../resources/test_two_sheets.xlsm", FormatXLSM, nil},
+		{"ods", "../../testdata/valid_ods.ods", FormatODS, nil},
+		{"csv zip", "../../testdata/valid_csv.zip", FormatCSVZip, nil},
+		{"zip of workbooks", "../../testdata/test.zip", nil, ErrNotWorkbook},
+		{"csv", "../../resources/datamap.csv", nil, ErrNotWorkbook},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := DetectSpreadsheetFile(tt.filePath)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("DetectSpreadsheetFile() error = %v, want %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("DetectSpreadsheetFile() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	other := writeTestZip(t, map[string][]byte{"mimetype": []byte("application/vnd.oasis.opendocument.text")})
+	if _, err := DetectSpreadsheetFile(other); !errors.Is(err, ErrNotWorkbook) {
+		t.Errorf("DetectSpreadsheetFile() error = %v for an OpenDocument text file, want ErrNotWorkbook", err)
+	}
+}
+
+func TestParseXLSXValueModes(t *testing.T) {
+	dm := &Datamap{DMLs: []DatamapLine{
+		{Key: "Staff", Sheet: "9 - Costs", DataType: "NUMBER", CellRef: "B2"},
+		{Key: "Total", Sheet: "9 - Costs", DataType: "NUMBER", CellRef: "B4"},
+		{Key: "Per unit", Sheet: "9 - Costs", DataType: "NUMBER", CellRef: "B5"},
+		{Key: "Lookup", Sheet: "9 - Costs", DataType: "TEXT", CellRef: "B6"},
+		{Key: "Broken", Sheet: "9 - Costs", DataType: "NUMBER", CellRef: "B7"},
+		{Key: "Label", Sheet: "9 - Costs", DataType: "TEXT", CellRef: "B8"},
+		{Key: "Share", Sheet: "9 - Costs", DataType: "PERCENTAGE", CellRef: "B9"},
+	}}
+
+	type line struct {
+		DataType string
+		Value    any
+		Raw      string
+		Status   string
+	}
+	divErr := line{"NUMBER", nil, "#DIV/0!", StatusError}
+	naErr := line{"TEXT", nil, "#N/A", StatusError}
+	refErr := line{"NUMBER", nil, "#REF!", StatusError}
+
+	tests := []struct {
+		mode ValueMode
+		want []line
+	}{
+		{ValueCached, []line{
+			{"NUMBER", 1000.0, "1000", StatusOK},
+			{"NUMBER", 1250.5, "1250.5", StatusOK},
+			divErr, naErr, refErr,
+			{"TEXT", "Total costs", "Total costs", StatusOK},
+			{"PERCENTAGE", 0.2, "0.2", StatusOK},
+		}},
+		{ValueFormatted, []line{
+			{"NUMBER", 1000.0, "1000.00", StatusOK},
+			{"NUMBER", 1250.5, "1250.50", StatusOK},
+			divErr, naErr, refErr,
+			{"TEXT", "Total costs", "Total costs", StatusOK},
+			{"PERCENTAGE", 0.2, "20.00%", StatusOK},
+		}},
+		{ValueFormula, []line{
+			{"NUMBER", 1000.0, "1000", StatusOK},
+			{"TEXT", "=SUM(B2:B3)", "=SUM(B2:B3)", StatusOK},
+			{"NUMBER", nil, "=B4/0", StatusError},
+			{"TEXT", nil, `=VLOOKUP("x",A1:B4,2,FALSE)`, StatusError},
+			{"NUMBER", nil, "=#REF!+1", StatusError},
+			{"TEXT", `=A4&" costs"`, `=A4&" costs"`, StatusOK},
+			{"TEXT", "=B3/B4", "=B3/B4", StatusOK},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.mode), func(t *testing.T) {
+			rtn, err := ParseXLSXMode("../../testdata/formulas.xlsx", dm, tt.mode)
+			if err != nil {
+				t.Fatalf("ParseXLSXMode() error = %v", err)
+			}
+			for i, rl := range rtn.ReturnLines {
+				got := line{rl.DataType, rl.Value, rl.Raw, rl.Status}
+				if !reflect.DeepEqual(got, tt.want[i]) {
+					t.Errorf("%s = %+v, want %+v", rl.Key, got, tt.want[i])
+				}
+			}
+		})
+	}
+
+	rtn, err := ParseXLSX("../../testdata/formulas.xlsx", dm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := rtn.ReturnLines[2].Messages; len(got) != 1 || got[0] != "cell contains the error #DIV/0!" {
+		t.Errorf("ParseXLSX() messages = %v, want the #DIV/0! error", got)
+	}
+}
+
+func TestFormulaText(t *testing.T) {
+	tests := map[string]string{
+		"":                   "",
+		"SUM(B2:B3)":         "=SUM(B2:B3)",
+		"=SUM(B2:B3)":        "=SUM(B2:B3)",
+		"of:=SUM([.A1:.A3])": "=SUM([.A1:.A3])",
+		"msoxl:=A1*2":        "=A1*2",
+		`IF(A1="a:=b",1,2)`:  `=IF(A1="a:=b",1,2)`,
+		"of:=[.A1]=[.B1]":    "=[.A1]=[.B1]",
+	}
+	for formula, want := range tests {
+		if got := formulaText(formula); got != want {
+			t.Errorf("formulaText(%q) = %q, want %q", formula, got, want)
+		}
+	}
+}
@@ -0,0 +1,275 @@
+// dbasik provides a service with which to convert spreadsheets containing
+// data to JSON for further processing.
+
+// Copyright (C) 2024 M R Lemon
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/tealeg/xlsx/v3"
+)
+
+// maxTableCells is the largest number of cells a TABLE line may read from a return.
+const maxTableCells = 100_000
+
+// cellRange is a rectangle of cells, with zero-based rows and columns. An open range
+// has no last row: it runs down the sheet until the first blank row.
+type cellRange struct {
+	firstCol, firstRow int
+	lastCol, lastRow   int
+	open               bool
+}
+
+var rxCellRange = regexp.MustCompile(`^([A-Z]+[1-9][0-9]*):([A-Z]+)([1-9][0-9]*)?$`)
+
+// parseCellRange parses a range such as B5:F40, or an open range such as B5:F.
+func parseCellRange(ref string) (cellRange, error) {
+	m := rxCellRange.FindStringSubmatch(ref)
+	if m == nil {
+		return cellRange{}, fmt.Errorf("%q is not a range such as B5:F40 or B5:F", ref)
+	}
+
+	var rng cellRange
+	var err error
+	rng.firstCol, rng.firstRow, err = xlsx.GetCoordsFromCellIDString(m[1])
+	if err != nil {
+		return cellRange{}, err
+	}
+	if m[3] == "" {
+		rng.lastCol = xlsx.ColLettersToIndex(m[2])
+		rng.open = true
+	} else {
+		rng.lastCol, rng.lastRow, err = xlsx.GetCoordsFromCellIDString(m[2] + m[3])
+		if err != nil {
+			return cellRange{}, err
+		}
+	}
+
+	if rng.lastCol < rng.firstCol || (!rng.open && rng.lastRow < rng.firstRow) {
+		return cellRange{}, fmt.Errorf("%q ends before it starts", ref)
+	}
+	if rng.lastCol >= maxSheetCols || rng.firstRow >= maxSheetRows || rng.lastRow >= maxSheetRows {
+		return cellRange{}, fmt.Errorf("%q is outside the largest possible sheet", ref)
+	}
+	if !rng.open && rng.cols()*(rng.lastRow-rng.firstRow+1) > maxTableCells {
+		return cellRange{}, fmt.Errorf("%q covers more than %d cells", ref, maxTableCells)
+	}
+	return rng, nil
+}
+
+func (rng cellRange) cols() int {
+	return rng.lastCol - rng.firstCol + 1
+}
+
+// TableColumn gives the data type of one column of a TABLE line. Name is the heading
+// of the column in an open range, and its letter, such as "C", in a closed one.
+type TableColumn struct {
+	Name     string `json:"name" yaml:"name"`
+	DataType string `json:"datatype" yaml:"datatype"`
+}
+
+// TableColumns are stored in the database as JSON. No columns are stored as NULL.
+type TableColumns []TableColumn
+
+func (tc TableColumns) Value() (driver.Value, error) {
+	if len(tc) == 0 {
+		return nil, nil
+	}
+	b, err := json.Marshal([]TableColumn(tc))
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+func (tc *TableColumns) Scan(src any) error {
+	switch src := src.(type) {
+	case nil:
+		*tc = nil
+		return nil
+	case []byte:
+		return json.Unmarshal(src, (*[]TableColumn)(tc))
+	case string:
+		return json.Unmarshal([]byte(src), (*[]TableColumn)(tc))
+	default:
+		return fmt.Errorf("cannot scan %T into TableColumns", src)
+	}
+}
+
+// dataType returns the data type of the column called name, which is TEXT if it
+// isn't one of tc.
+func (tc TableColumns) dataType(name string) string {
+	for _, c := range tc {
+		if c.Name == name {
+			return c.DataType
+		}
+	}
+	return TypeText
+}
+
+// ValidateTableLine checks the fields of a DatamapLine which are particular to its
+// DataType being TABLE, or not.
+func ValidateTableLine(v *Validator, dml DatamapLine) {
+	if normaliseDataType(dml.DataType) != TypeTable {
+		v.Check(validateSpreadsheetCell(dml.CellRef) || validateDefinedName(dml.CellRef), "cellref",
+			"must be a cell reference in A1 format or a defined name")
+		v.Check(len(dml.Columns) == 0, "columns", "can only be used with TABLE")
+		return
+	}
+
+	v.Check(validateSpreadsheetRange(dml.CellRef) || validateDefinedName(dml.CellRef), "cellref",
+		fmt.Sprintf("must be a range of up to %d cells such as B5:F40, B5:F for a table with a header row, or a defined name", maxTableCells))
+	v.Check(dml.Rules == nil, "rules", "cannot be used with TABLE")
+
+	names := make(map[string]bool, len(dml.Columns))
+	for _, c := range dml.Columns {
+		v.Check(c.Name != "", "columns", "must each have a name")
+		v.Check(!names[c.Name], "columns", "must not have duplicate names")
+		v.Check(ValidDataType(c.DataType) && normaliseDataType(c.DataType) != TypeTable, "columns",
+			"must each have a data type other than TABLE")
+		names[c.Name] = true
+	}
+}
+
+// errBlankRow ends an open range.
+var errBlankRow = errors.New("blank row")
+
+// newTableReturnLine reads the TABLE pointed at by dml from ss into a ReturnLine whose
+// Value is a list of records, one per row, each keyed by column name. The cells of an
+// open range's first row are its column names; otherwise the columns are named by
+// their letters. Each cell is read according to mode and converted to the data type
+// of its column, as with any other cell. Blank rows are left out, and end an open
+// range. Raw holds the rows' raw strings, as JSON.
+func newTableReturnLine(ss Spreadsheet, dml DatamapLine, mode ValueMode) (ReturnLine, error) {
+	rng, err := parseCellRange(dml.CellRef)
+	if err != nil {
+		return ReturnLine{}, err
+	}
+
+	rl := ReturnLine{
+		DatamapLineID: dml.ID,
+		Key:           dml.Key,
+		Sheet:         dml.Sheet,
+		CellRef:       dml.CellRef,
+		DataType:      TypeTable,
+		Status:        StatusOK,
+	}
+
+	names := make([]string, rng.cols())
+	for i := range names {
+		names[i] = xlsx.ColIndexToLetters(rng.firstCol + i)
+	}
+	firstRow := rng.firstRow
+	if rng.open {
+		seen := make(map[string]bool)
+		for i := range names {
+			cell, err := ss.Cell(dml.Sheet, xlsx.GetCellIDStringFromCoords(rng.firstCol+i, firstRow))
+			if err != nil {
+				return ReturnLine{}, err
+			}
+			// A column without a heading, or with the same heading as one before
+			// it, keeps its letter
+			if name := strings.TrimSpace(cell.Value); name != "" && !seen[name] {
+				names[i] = name
+			}
+			seen[names[i]] = true
+		}
+		firstRow++
+	}
+
+	records := []map[string]any{}
+	raws := []map[string]string{}
+	lastRow := rng.lastRow
+	if rng.open {
+		lastRow = min(maxSheetRows, firstRow+maxTableCells/rng.cols()) - 1
+	}
+	for row := firstRow; row <= lastRow; row++ {
+		record, raw, messages, err := readTableRow(ss, dml, names, rng.firstCol, row, mode)
+		if errors.Is(err, errBlankRow) {
+			if rng.open {
+				break
+			}
+			continue
+		}
+		if err != nil {
+			return ReturnLine{}, err
+		}
+		records = append(records, record)
+		raws = append(raws, raw)
+		rl.Messages = append(rl.Messages, messages...)
+	}
+
+	rawJSON, err := json.Marshal(raws)
+	if err != nil {
+		return ReturnLine{}, err
+	}
+	rl.Value = records
+	rl.Raw = string(rawJSON)
+	if len(rl.Messages) > 0 {
+		rl.Status = StatusError
+	}
+	return rl, nil
+}
+
+// readTableRow reads one row of a TABLE, returning errBlankRow if all of its cells are
+// empty. The messages from each cell which can't be converted are prefixed with the
+// cell's reference.
+func readTableRow(ss Spreadsheet, dml DatamapLine, names []string, firstCol, row int, mode ValueMode) (map[string]any, map[string]string, []string, error) {
+	record := make(map[string]any, len(names))
+	raw := make(map[string]string, len(names))
+	var messages []string
+	blank := true
+
+	for i, name := range names {
+		cellRef := xlsx.GetCellIDStringFromCoords(firstCol+i, row)
+		cell, err := ss.Cell(dml.Sheet, cellRef)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if cell != (SpreadsheetCell{}) {
+			blank = false
+		}
+
+		col := DatamapLine{Key: name, Sheet: dml.Sheet, CellRef: cellRef, DataType: dml.Columns.dataType(name)}
+		crl := newCellReturnLine(col, cell, mode, ss.Date1904())
+		record[name] = crl.Value
+		raw[name] = crl.Raw
+		for _, msg := range crl.Messages {
+			messages = append(messages, cellRef+": "+msg)
+		}
+	}
+
+	if blank {
+		return nil, nil, nil, errBlankRow
+	}
+	return record, raw, messages, nil
+}
+
+// parseTable converts the JSON form of a TABLE value, as stored by formatValue, back
+// to its records.
+func parseTable(s string) ([]map[string]any, error) {
+	var records []map[string]any
+	if err := json.Unmarshal([]byte(s), &records); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
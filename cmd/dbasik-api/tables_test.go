@@ -0,0 +1,233 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/tealeg/xlsx/v3"
+)
+
+func TestParseCellRange(t *testing.T) {
+	tests := []struct {
+		ref     string
+		want    cellRange
+		wantErr bool
+	}{
+		{ref: "B5:F40", want: cellRange{firstCol: 1, firstRow: 4, lastCol: 5, lastRow: 39}},
+		{ref: "B4:F", want: cellRange{firstCol: 1, firstRow: 3, lastCol: 5, open: true}},
+		{ref: "A1:A1", want: cellRange{}},
+		{ref: "AA10:AB", want: cellRange{firstCol: 26, firstRow: 9, lastCol: 27, open: true}},
+		{ref: "B5", wantErr: true},
+		{ref: "F5:B40", wantErr: true},
+		{ref: "B40:F5", wantErr: true},
+		{ref: "B0:F5", wantErr: true},
+		{ref: "b5:f40", wantErr: true},
+		{ref: "A1:XFE1", wantErr: true},
+		{ref: "A1:Z100000", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.ref, func(t *testing.T) {
+			got, err := parseCellRange(tt.ref)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseCellRange() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("parseCellRange() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateTableLine(t *testing.T) {
+	tests := []struct {
+		name string
+		dml  DatamapLine
+		want []string
+	}{
+		{
+			name: "closed range",
+			dml:  DatamapLine{DataType: "TABLE", CellRef: "B5:F40", Columns: TableColumns{{Name: "C", DataType: "DATE"}}},
+		},
+		{
+			name: "open range",
+			dml:  DatamapLine{DataType: "table", CellRef: "B4:F"},
+		},
+		{
+			name: "single cell table",
+			dml:  DatamapLine{DataType: "TABLE", CellRef: "B4"},
+			want: []string{"cellref"},
+		},
+		{
+			name: "range for a cell",
+			dml:  DatamapLine{DataType: "TEXT", CellRef: "B4:F"},
+			want: []string{"cellref"},
+		},
+		{
+			name: "columns for a cell",
+			dml:  DatamapLine{DataType: "TEXT", CellRef: "B4", Columns: TableColumns{{Name: "B", DataType: "TEXT"}}},
+			want: []string{"columns"},
+		},
+		{
+			name: "rules for a table",
+			dml:  DatamapLine{DataType: "TABLE", CellRef: "B4:F", Rules: &Rules{Required: true}},
+			want: []string{"rules"},
+		},
+		{
+			name: "bad columns",
+			dml:  DatamapLine{DataType: "TABLE", CellRef: "B4:F", Columns: TableColumns{{Name: "Date", DataType: "TABLE"}}},
+			want: []string{"columns"},
+		},
+		{
+			name: "duplicate columns",
+			dml:  DatamapLine{DataType: "TABLE", CellRef: "B4:F", Columns: TableColumns{{Name: "Date", DataType: "DATE"}, {Name: "Date", DataType: "TEXT"}}},
+			want: []string{"columns"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := NewValidator()
+			ValidateTableLine(v, tt.dml)
+			var got []string
+			for field := range v.Errors {
+				got = append(got, field)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ValidateTableLine() errors = %v, want %v", v.Errors, tt.want)
+			}
+		})
+	}
+}
+
+// writeMilestones saves a workbook with a table of milestones on sheet "6a", headed in
+// row 4, with a blank row after the third milestone.
+func writeMilestones(tb testing.TB) string {
+	tb.Helper()
+	wb := xlsx.NewFile()
+	sh, err := wb.AddSheet("6a")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	set := func(cellRef string, value any) {
+		col, row, err := xlsx.GetCoordsFromCellIDString(cellRef)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		cell, err := sh.Cell(row, col)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		switch value := value.(type) {
+		case string:
+			cell.SetString(value)
+		case float64:
+			cell.SetFloat(value)
+		}
+	}
+
+	// tealeg/xlsx only saves rows which are added in order
+	set("B4", "Milestone")
+	set("C4", "Date")
+	set("E4", "Cost")
+	set("F4", "Milestone")
+	set("B5", "Start")
+	set("C5", 45383.0)
+	set("E5", 1000.0)
+	set("B6", "Design")
+	set("C6", "soon")
+	set("F6", "late")
+	set("B7", "Build")
+	set("C7", 45748.0)
+	set("E7", 2500.5)
+	set("B9", "Orphan")
+	set("C9", 45931.0)
+
+	path := filepath.Join(tb.TempDir(), "milestones.xlsx")
+	if err := wb.Save(path); err != nil {
+		tb.Fatal(err)
+	}
+	return path
+}
+
+func TestParseXLSXTable(t *testing.T) {
+	path := writeMilestones(t)
+	columns := TableColumns{{Name: "Date", DataType: "DATE"}, {Name: "Cost", DataType: "NUMBER"}}
+
+	t.Run("open", func(t *testing.T) {
+		dm := &Datamap{DMLs: []DatamapLine{{Key: "Milestones", Sheet: "6a", DataType: "TABLE", CellRef: "B4:F", Columns: columns}}}
+		rtn, err := ParseXLSX(path, dm)
+		if err != nil {
+			t.Fatalf("ParseXLSX() error = %v", err)
+		}
+		rl := rtn.ReturnLines[0]
+
+		want := []map[string]any{
+			{"Milestone": "Start", "Date": "2024-04-01", "D": "", "Cost": 1000.0, "F": ""},
+			{"Milestone": "Design", "Date": nil, "D": "", "Cost": nil, "F": "late"},
+			{"Milestone": "Build", "Date": "2025-04-01", "D": "", "Cost": 2500.5, "F": ""},
+		}
+		if !reflect.DeepEqual(rl.Value, want) {
+			t.Errorf("ParseXLSX() Value = %v, want %v", rl.Value, want)
+		}
+		if rl.DataType != TypeTable || rl.Status != StatusError {
+			t.Errorf("ParseXLSX() DataType, Status = %s, %s, want TABLE, error", rl.DataType, rl.Status)
+		}
+		wantMessages := []string{`C6: cannot convert "soon" to DATE`}
+		if !reflect.DeepEqual(rl.Messages, wantMessages) {
+			t.Errorf("ParseXLSX() Messages = %v, want %v", rl.Messages, wantMessages)
+		}
+
+		// The stored form converts back to the same records
+		got, err := ConvertValue(rl.DataType, formatValue(rl.Value), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("ConvertValue() = %v, want %v", got, want)
+		}
+	})
+
+	t.Run("closed", func(t *testing.T) {
+		dm := &Datamap{DMLs: []DatamapLine{{Key: "Milestones", Sheet: "6a", DataType: "TABLE", CellRef: "B5:C10", Columns: TableColumns{{Name: "C", DataType: "DATE"}}}}}
+		rtn, err := ParseXLSX(path, dm)
+		if err != nil {
+			t.Fatalf("ParseXLSX() error = %v", err)
+		}
+		rl := rtn.ReturnLines[0]
+
+		want := []map[string]any{
+			{"B": "Start", "C": "2024-04-01"},
+			{"B": "Design", "C": nil},
+			{"B": "Build", "C": "2025-04-01"},
+			{"B": "Orphan", "C": "2025-10-01"},
+		}
+		if !reflect.DeepEqual(rl.Value, want) {
+			t.Errorf("ParseXLSX() Value = %v, want %v", rl.Value, want)
+		}
+		wantRaw := `[{"B":"Start","C":"45383"},{"B":"Design","C":"soon"},{"B":"Build","C":"45748"},{"B":"Orphan","C":"45931"}]`
+		if rl.Raw != wantRaw {
+			t.Errorf("ParseXLSX() Raw = %s, want %s", rl.Raw, wantRaw)
+		}
+	})
+}
+
+func TestParseCSVZipTable(t *testing.T) {
+	path := writeTestZip(t, map[string][]byte{
+		"6a.csv": []byte(",,,\r\n,Milestone,Date\r\n,Start,01/04/2024\r\n,Build,01/04/2025\r\n"),
+	})
+	dm := &Datamap{DMLs: []DatamapLine{{Key: "Milestones", Sheet: "6a", DataType: "TABLE", CellRef: "B2:C", Columns: TableColumns{{Name: "Date", DataType: "DATE"}}}}}
+
+	rtn, err := ParseXLSX(path, dm)
+	if err != nil {
+		t.Fatalf("ParseXLSX() error = %v", err)
+	}
+	want := []map[string]any{
+		{"Milestone": "Start", "Date": "2024-04-01"},
+		{"Milestone": "Build", "Date": "2025-04-01"},
+	}
+	if got := rtn.ReturnLines[0].Value; !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseXLSX() Value = %v, want %v", got, want)
+	}
+}
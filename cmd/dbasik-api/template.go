@@ -0,0 +1,536 @@
+// dbasik provides a service with which to convert spreadsheets containing
+// data to JSON for further processing.
+
+// Copyright (C) 2024 M R Lemon
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+package main
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/tealeg/xlsx/v3"
+)
+
+// templateCell is what we need to know about a cell of a template. text is true if
+// its value is a string rather than a number, boolean or error.
+type templateCell struct {
+	style   int
+	value   string
+	formula bool
+	text    bool
+}
+
+// templateValidation is a data validation applied to the cells in sqref
+type templateValidation struct {
+	typ      string
+	sqref    string
+	formula1 string
+}
+
+// templateSheet holds the cells of a worksheet of a template which are in its XML,
+// keyed by their zero-based column and row, and the styles of its rows and columns
+// for the cells which aren't. comments holds the text of the notes on its cells,
+// keyed in the same way.
+type templateSheet struct {
+	name        string
+	cells       map[[2]int]templateCell
+	comments    map[[2]int]string
+	rowStyles   map[int]int
+	colStyles   []colStyle
+	used        [4]int // first column, first row, last column and last row
+	hasUsed     bool
+	protected   bool
+	validations []templateValidation
+}
+
+type colStyle struct {
+	min, max, style int // min and max are one-based, as in the XML
+}
+
+// inUsedRange reports whether the cell is within the used range of the sheet, as
+// given by its dimension element or, without one, the cells it holds.
+func (sh *templateSheet) inUsedRange(col, row int) bool {
+	return sh.hasUsed && col >= sh.used[0] && row >= sh.used[1] && col <= sh.used[2] && row <= sh.used[3]
+}
+
+func (sh *templateSheet) usedRange() string {
+	if !sh.hasUsed {
+		return "(empty)"
+	}
+	first := xlsx.GetCellIDStringFromCoords(sh.used[0], sh.used[1])
+	last := xlsx.GetCellIDStringFromCoords(sh.used[2], sh.used[3])
+	if first == last {
+		return first
+	}
+	return first + ":" + last
+}
+
+// cell returns the cell at col and row and its style, which for a cell which isn't
+// in the XML is that of its row or column.
+func (sh *templateSheet) cell(col, row int) (templateCell, int) {
+	if cell, ok := sh.cells[[2]int{col, row}]; ok {
+		return cell, cell.style
+	}
+	if style, ok := sh.rowStyles[row]; ok {
+		return templateCell{}, style
+	}
+	for _, cs := range sh.colStyles {
+		if col+1 >= cs.min && col+1 <= cs.max {
+			return templateCell{}, cs.style
+		}
+	}
+	return templateCell{}, 0
+}
+
+// validationsFor returns the data validations applied to the cell at col and row.
+func (sh *templateSheet) validationsFor(col, row int) []templateValidation {
+	var out []templateValidation
+	for _, dv := range sh.validations {
+		for _, ref := range strings.Fields(dv.sqref) {
+			if refContains(ref, col, row) {
+				out = append(out, dv)
+				break
+			}
+		}
+	}
+	return out
+}
+
+// refContains reports whether ref, a cell such as C5 or a range such as C5:C9, holds
+// the cell at col and row.
+func refContains(ref string, col, row int) bool {
+	first, last, _ := strings.Cut(strings.ReplaceAll(ref, "$", ""), ":")
+	if last == "" {
+		last = first
+	}
+	c1, r1, err := xlsx.GetCoordsFromCellIDString(first)
+	if err != nil {
+		return false
+	}
+	c2, r2, err := xlsx.GetCoordsFromCellIDString(last)
+	if err != nil {
+		return false
+	}
+	return col >= min(c1, c2) && col <= max(c1, c2) && row >= min(r1, r2) && row <= max(r1, r2)
+}
+
+// xmlRichText is the text of a shared or inline string, which is either plain or a
+// run of formatted pieces.
+type xmlRichText struct {
+	T string `xml:"t"`
+	R []struct {
+		T string `xml:"t"`
+	} `xml:"r"`
+}
+
+func (rt xmlRichText) text() string {
+	if len(rt.R) == 0 {
+		return rt.T
+	}
+	var sb strings.Builder
+	for _, r := range rt.R {
+		sb.WriteString(r.T)
+	}
+	return sb.String()
+}
+
+// templateReader reads the parts of a template as CheckTemplate and DraftDatamap need
+// them.
+type templateReader struct {
+	src    *zip.Reader
+	book   *workbookParts
+	styles []cellStyle
+	shared []string
+	sheets map[string]*templateSheet
+}
+
+// cellStyle is what we need to know about a cell style: whether it unlocks its cells,
+// the colour it fills them with, as six upper-case hex digits, and the code of its
+// number format.
+type cellStyle struct {
+	unlocked bool
+	fill     string
+	numFmt   string
+}
+
+// builtinNumFmts are the codes of the built-in number formats which a style may use
+// without defining them. Those for currencies depend on the locale, so stand for any.
+var builtinNumFmts = map[int]string{
+	1: "0", 2: "0.00", 3: "#,##0", 4: "#,##0.00",
+	5: "£#,##0", 6: "£#,##0", 7: "£#,##0.00", 8: "£#,##0.00",
+	9: "0%", 10: "0.00%", 11: "0.00E+00", 12: "# ?/?", 13: "# ??/??",
+	14: "dd/mm/yyyy", 15: "d-mmm-yy", 16: "d-mmm", 17: "mmm-yy",
+	18: "h:mm AM/PM", 19: "h:mm:ss AM/PM", 20: "h:mm", 21: "h:mm:ss", 22: "m/d/yy h:mm",
+	37: "#,##0", 38: "#,##0", 39: "#,##0.00", 40: "#,##0.00",
+	41: "#,##0", 42: "£#,##0", 43: "#,##0.00", 44: "£#,##0.00",
+	45: "mm:ss", 46: "[h]:mm:ss", 47: "mm:ss.0", 48: "##0.0E+0", 49: "@",
+}
+
+// readStyles reads the cell styles of the workbook. Cells are locked unless their
+// style says otherwise.
+func (tr *templateReader) readStyles() error {
+	if tr.book.styles == "" {
+		return nil
+	}
+	data, err := readZipFile(tr.src, tr.book.styles)
+	if err != nil {
+		return err
+	}
+	var styles struct {
+		NumFmts []struct {
+			ID   int    `xml:"numFmtId,attr"`
+			Code string `xml:"formatCode,attr"`
+		} `xml:"numFmts>numFmt"`
+		Fills []struct {
+			Pattern struct {
+				Type    string `xml:"patternType,attr"`
+				FgColor struct {
+					RGB string `xml:"rgb,attr"`
+				} `xml:"fgColor"`
+			} `xml:"patternFill"`
+		} `xml:"fills>fill"`
+		Xfs []struct {
+			NumFmtID   int `xml:"numFmtId,attr"`
+			FillID     int `xml:"fillId,attr"`
+			Protection *struct {
+				Locked string `xml:"locked,attr"`
+			} `xml:"protection"`
+		} `xml:"cellXfs>xf"`
+	}
+	if err := xml.Unmarshal(data, &styles); err != nil {
+		return fmt.Errorf("%s: %w", tr.book.styles, err)
+	}
+
+	numFmts := make(map[int]string, len(styles.NumFmts))
+	for _, nf := range styles.NumFmts {
+		numFmts[nf.ID] = nf.Code
+	}
+	tr.styles = make([]cellStyle, len(styles.Xfs))
+	for i, xf := range styles.Xfs {
+		style := &tr.styles[i]
+		style.unlocked = xf.Protection != nil && (xf.Protection.Locked == "0" || xf.Protection.Locked == "false")
+		if code, ok := numFmts[xf.NumFmtID]; ok {
+			style.numFmt = code
+		} else {
+			style.numFmt = builtinNumFmts[xf.NumFmtID]
+		}
+		// Colours are written as ARGB, and a fill which is a theme colour has none
+		if xf.FillID >= 0 && xf.FillID < len(styles.Fills) {
+			fill := styles.Fills[xf.FillID].Pattern
+			if fill.Type == "solid" && len(fill.FgColor.RGB) >= 6 {
+				style.fill = strings.ToUpper(fill.FgColor.RGB[len(fill.FgColor.RGB)-6:])
+			}
+		}
+	}
+	return nil
+}
+
+// style returns the cell style numbered i, or the default style if there is no such
+// style.
+func (tr *templateReader) style(i int) cellStyle {
+	if i < 0 || i >= len(tr.styles) {
+		return cellStyle{}
+	}
+	return tr.styles[i]
+}
+
+func (tr *templateReader) isLocked(style int) bool {
+	return !tr.style(style).unlocked
+}
+
+// sharedStrings reads the shared strings of the workbook the first time they are
+// needed.
+func (tr *templateReader) sharedStrings() ([]string, error) {
+	if tr.shared != nil || tr.book.sharedStrings == "" {
+		return tr.shared, nil
+	}
+	data, err := readZipFile(tr.src, tr.book.sharedStrings)
+	if err != nil {
+		return nil, err
+	}
+	var sst struct {
+		Items []xmlRichText `xml:"si"`
+	}
+	if err := xml.Unmarshal(data, &sst); err != nil {
+		return nil, fmt.Errorf("%s: %w", tr.book.sharedStrings, err)
+	}
+	tr.shared = make([]string, len(sst.Items))
+	for i, si := range sst.Items {
+		tr.shared[i] = si.text()
+	}
+	return tr.shared, nil
+}
+
+// sheet reads the worksheet called name the first time it is needed. It returns nil
+// if the workbook has no such sheet.
+func (tr *templateReader) sheet(name string) (*templateSheet, error) {
+	if sh, ok := tr.sheets[name]; ok {
+		return sh, nil
+	}
+	sheetPath, ok := tr.book.sheets[name]
+	if !ok {
+		return nil, nil
+	}
+	data, err := readZipFile(tr.src, sheetPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var ws struct {
+		Dimension *struct {
+			Ref string `xml:"ref,attr"`
+		} `xml:"dimension"`
+		Cols []struct {
+			Min   int `xml:"min,attr"`
+			Max   int `xml:"max,attr"`
+			Style int `xml:"style,attr"`
+		} `xml:"cols>col"`
+		Rows []struct {
+			R            int    `xml:"r,attr"`
+			S            int    `xml:"s,attr"`
+			CustomFormat string `xml:"customFormat,attr"`
+			Cells        []struct {
+				R  string       `xml:"r,attr"`
+				S  int          `xml:"s,attr"`
+				T  string       `xml:"t,attr"`
+				F  *struct{}    `xml:"f"`
+				V  string       `xml:"v"`
+				IS *xmlRichText `xml:"is"`
+			} `xml:"c"`
+		} `xml:"sheetData>row"`
+		Protection *struct {
+			Sheet string `xml:"sheet,attr"`
+		} `xml:"sheetProtection"`
+		Validations []struct {
+			Type     string `xml:"type,attr"`
+			Sqref    string `xml:"sqref,attr"`
+			Formula1 string `xml:"formula1"`
+		} `xml:"dataValidations>dataValidation"`
+		// Validations which refer to other sheets are written by Excel 2010 and
+		// later in an extension
+		ExtValidations []struct {
+			Type     string `xml:"type,attr"`
+			Sqref    string `xml:"sqref"`
+			Formula1 string `xml:"formula1>f"`
+		} `xml:"extLst>ext>dataValidations>dataValidation"`
+	}
+	if err := xml.Unmarshal(data, &ws); err != nil {
+		return nil, fmt.Errorf("%s: %w", sheetPath, err)
+	}
+
+	shared, err := tr.sharedStrings()
+	if err != nil {
+		return nil, err
+	}
+
+	sh := &templateSheet{name: name, cells: make(map[[2]int]templateCell), rowStyles: make(map[int]int)}
+	sh.protected = ws.Protection != nil && (ws.Protection.Sheet == "1" || ws.Protection.Sheet == "true")
+	for _, c := range ws.Cols {
+		sh.colStyles = append(sh.colStyles, colStyle{min: c.Min, max: c.Max, style: c.Style})
+	}
+
+	// Rows and cells may leave out their references, in which case they follow on
+	// from the one before
+	row := -1
+	for _, xr := range ws.Rows {
+		row++
+		if xr.R > 0 {
+			row = xr.R - 1
+		}
+		if xr.CustomFormat == "1" || xr.CustomFormat == "true" {
+			sh.rowStyles[row] = xr.S
+		}
+		col := -1
+		for _, xc := range xr.Cells {
+			col++
+			if xc.R != "" {
+				if c, _, err := xlsx.GetCoordsFromCellIDString(xc.R); err == nil {
+					col = c
+				}
+			}
+
+			cell := templateCell{style: xc.S, value: xc.V, formula: xc.F != nil}
+			switch xc.T {
+			case "s":
+				if i, err := strconv.Atoi(xc.V); err == nil && i >= 0 && i < len(shared) {
+					cell.value = shared[i]
+				}
+				cell.text = true
+			case "inlineStr":
+				if xc.IS != nil {
+					cell.value = xc.IS.text()
+				}
+				cell.text = true
+			case "str":
+				cell.text = true
+			}
+			sh.cells[[2]int{col, row}] = cell
+			sh.extend(col, row)
+		}
+	}
+
+	if ws.Dimension != nil {
+		first, last, _ := strings.Cut(ws.Dimension.Ref, ":")
+		if last == "" {
+			last = first
+		}
+		c1, r1, err1 := xlsx.GetCoordsFromCellIDString(first)
+		c2, r2, err2 := xlsx.GetCoordsFromCellIDString(last)
+		if err1 == nil && err2 == nil {
+			sh.used = [4]int{c1, r1, c2, r2}
+			sh.hasUsed = true
+		}
+	}
+
+	for _, dv := range ws.Validations {
+		sh.validations = append(sh.validations, templateValidation{typ: dv.Type, sqref: dv.Sqref, formula1: dv.Formula1})
+	}
+	for _, dv := range ws.ExtValidations {
+		sh.validations = append(sh.validations, templateValidation{typ: dv.Type, sqref: dv.Sqref, formula1: dv.Formula1})
+	}
+
+	if sh.comments, err = tr.readComments(sheetPath); err != nil {
+		return nil, err
+	}
+
+	tr.sheets[name] = sh
+	return sh, nil
+}
+
+// readComments reads the notes on the cells of the worksheet at sheetPath, which are
+// found through the sheet's relationships. A sheet without relationships has none.
+func (tr *templateReader) readComments(sheetPath string) (map[[2]int]string, error) {
+	comments := make(map[[2]int]string)
+	relsPath := relationshipsPath(sheetPath)
+	found := false
+	for _, f := range tr.src.File {
+		if f.Name == relsPath {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return comments, nil
+	}
+
+	rels, err := readRelationships(tr.src, sheetPath)
+	if err != nil {
+		return nil, err
+	}
+	for _, rel := range rels {
+		if !strings.HasSuffix(rel.Type, "/comments") {
+			continue
+		}
+		data, err := readZipFile(tr.src, rel.Target)
+		if err != nil {
+			return nil, err
+		}
+		var cs struct {
+			Comments []struct {
+				Ref  string      `xml:"ref,attr"`
+				Text xmlRichText `xml:"text"`
+			} `xml:"commentList>comment"`
+		}
+		if err := xml.Unmarshal(data, &cs); err != nil {
+			return nil, fmt.Errorf("%s: %w", rel.Target, err)
+		}
+		for _, c := range cs.Comments {
+			if col, row, err := xlsx.GetCoordsFromCellIDString(c.Ref); err == nil {
+				comments[[2]int{col, row}] = c.Text.text()
+			}
+		}
+	}
+	return comments, nil
+}
+
+// listItems returns the values offered by a list validation whose source is formula,
+// which is either the values themselves, such as "Yes,No", or a reference to the cells
+// holding them, such as $H$1:$H$3, Lists!$A$1:$A$9 or a defined name. ok is false if
+// the source is a formula we can't follow.
+func (tr *templateReader) listItems(sh *templateSheet, formula string) (items []string, ok bool, err error) {
+	formula = strings.TrimSpace(formula)
+	if strings.HasPrefix(formula, `"`) && strings.HasSuffix(formula, `"`) && len(formula) > 1 {
+		for _, item := range strings.Split(formula[1:len(formula)-1], ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		return items, true, nil
+	}
+
+	sheetName, ref, err := parseExcelReference(formula)
+	if err != nil {
+		switch {
+		case validateDefinedName(formula):
+			if sheetName, ref, err = tr.book.DefinedName(sh.name, formula); err != nil {
+				return nil, false, nil
+			}
+		case validateSpreadsheetCell(strings.ReplaceAll(formula, "$", "")) || validateSpreadsheetRange(strings.ReplaceAll(formula, "$", "")):
+			sheetName, ref = sh.name, strings.ReplaceAll(formula, "$", "")
+		default:
+			return nil, false, nil
+		}
+	}
+
+	src, err := tr.sheet(sheetName)
+	if err != nil || src == nil {
+		return nil, false, err
+	}
+	first, last, _ := strings.Cut(ref, ":")
+	if last == "" {
+		last = first
+	}
+	c1, r1, err1 := xlsx.GetCoordsFromCellIDString(first)
+	c2, r2, err2 := xlsx.GetCoordsFromCellIDString(last)
+	if err1 != nil || err2 != nil {
+		// An open range, which a list can't use
+		return nil, false, nil
+	}
+
+	// The range may cover whole columns, so look through the cells there are rather
+	// than every cell of the range
+	var coords [][2]int
+	for coord, cell := range src.cells {
+		if coord[0] >= c1 && coord[0] <= c2 && coord[1] >= r1 && coord[1] <= r2 && strings.TrimSpace(cell.value) != "" {
+			coords = append(coords, coord)
+		}
+	}
+	sort.Slice(coords, func(i, j int) bool {
+		if coords[i][1] != coords[j][1] {
+			return coords[i][1] < coords[j][1]
+		}
+		return coords[i][0] < coords[j][0]
+	})
+	for _, coord := range coords {
+		items = append(items, src.cells[coord].value)
+	}
+	return items, true, nil
+}
+
+// extend grows the used range of a sheet without a dimension element to include the
+// cell at col and row.
+func (sh *templateSheet) extend(col, row int) {
+	if !sh.hasUsed {
+		sh.used = [4]int{col, row, col, row}
+		sh.hasUsed = true
+		return
+	}
+	sh.used = [4]int{min(sh.used[0], col), min(sh.used[1], row), max(sh.used[2], col), max(sh.used[3], row)}
+}
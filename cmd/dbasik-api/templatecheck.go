@@ -0,0 +1,196 @@
+// dbasik provides a service with which to convert spreadsheets containing
+// data to JSON for further processing.
+
+// Copyright (C) 2024 M R Lemon
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+package main
+
+import (
+	"archive/zip"
+	"fmt"
+	"strings"
+
+	"github.com/tealeg/xlsx/v3"
+)
+
+// The problems CheckTemplate can find with a DatamapLine
+const (
+	ProblemMissingSheet = "missing_sheet"
+	ProblemDefinedName  = "defined_name"
+	ProblemOutsideRange = "outside_used_range"
+	ProblemFormula      = "formula"
+	ProblemLocked       = "locked"
+	ProblemValidation   = "validation"
+)
+
+// TemplateIssue is a problem found with the cell a DatamapLine points at in a template.
+type TemplateIssue struct {
+	Key     string `json:"key"`
+	Sheet   string `json:"sheet"`
+	CellRef string `json:"cellref"`
+	Problem string `json:"problem"`
+	Message string `json:"message"`
+}
+
+// TemplateCheck is the result of checking a datamap against a template with
+// CheckTemplate. OK is true if no issues were found.
+type TemplateCheck struct {
+	OK     bool            `json:"ok"`
+	Lines  int             `json:"lines"`
+	Issues []TemplateIssue `json:"issues"`
+}
+
+func (tc *TemplateCheck) add(dml DatamapLine, problem, format string, args ...any) {
+	tc.Issues = append(tc.Issues, TemplateIssue{
+		Key:     dml.Key,
+		Sheet:   dml.Sheet,
+		CellRef: dml.CellRef,
+		Problem: problem,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+// CheckTemplate checks that each line of dm points at a cell of the blank template
+// workbook src which can be filled in, reporting lines whose sheet doesn't exist (as
+// ParseXLSX would fail to read them), whose defined name can't be resolved, and whose
+// cell is outside the used range of its sheet, holds a formula, is locked on a
+// protected sheet, or has a data validation which doesn't fit the line's data type.
+// Only the sheet and the first cell of a TABLE line's range are checked.
+func CheckTemplate(src *zip.Reader, dm *Datamap) (*TemplateCheck, error) {
+	book, err := readWorkbookParts(src)
+	if err != nil {
+		return nil, err
+	}
+	tr := &templateReader{src: src, book: book, sheets: make(map[string]*templateSheet)}
+	if err := tr.readStyles(); err != nil {
+		return nil, err
+	}
+
+	result := &TemplateCheck{Lines: len(dm.DMLs), Issues: []TemplateIssue{}}
+	for _, dml := range dm.DMLs {
+		if _, ok := book.sheets[dml.Sheet]; !ok {
+			result.add(dml, ProblemMissingSheet, "sheet %s not found", dml.Sheet)
+			continue
+		}
+		target, err := resolveLine(book, dml)
+		if err != nil {
+			result.add(dml, ProblemDefinedName, "%s", err)
+			continue
+		}
+		sh, err := tr.sheet(target.Sheet)
+		if err != nil {
+			return nil, err
+		}
+		if sh == nil {
+			result.add(dml, ProblemMissingSheet, "sheet %s not found", target.Sheet)
+			continue
+		}
+
+		isTable := normaliseDataType(dml.DataType) == TypeTable
+		var col, row int
+		if isTable {
+			rng, err := parseCellRange(target.CellRef)
+			if err != nil {
+				return nil, err
+			}
+			col, row = rng.firstCol, rng.firstRow
+		} else if col, row, err = xlsx.GetCoordsFromCellIDString(target.CellRef); err != nil {
+			return nil, err
+		}
+
+		if !sh.inUsedRange(col, row) {
+			result.add(dml, ProblemOutsideRange, "%s is outside the used range %s of sheet %s",
+				xlsx.GetCellIDStringFromCoords(col, row), sh.usedRange(), target.Sheet)
+		}
+		if isTable {
+			continue
+		}
+
+		cell, style := sh.cell(col, row)
+		switch {
+		case cell.formula:
+			result.add(dml, ProblemFormula, "%s!%s holds a formula, so no value can be entered in it", target.Sheet, target.CellRef)
+		case sh.protected && tr.isLocked(style):
+			result.add(dml, ProblemLocked, "%s!%s is locked and sheet %s is protected", target.Sheet, target.CellRef, target.Sheet)
+		}
+
+		for _, dv := range sh.validationsFor(col, row) {
+			msg, err := tr.checkValidation(sh, dv, dml)
+			if err != nil {
+				return nil, err
+			}
+			if msg != "" {
+				result.add(dml, ProblemValidation, "%s!%s %s", target.Sheet, target.CellRef, msg)
+			}
+		}
+	}
+
+	result.OK = len(result.Issues) == 0
+	return result, nil
+}
+
+// numericTypes are the data types whose values are numbers
+var numericTypes = []string{TypeNumber, TypeInteger, TypePercentage, TypeCurrency, TypeGBP}
+
+// checkValidation returns why the data validation dv on the cell of dml doesn't fit
+// the line, or "" if it does. A list must only offer values which can be converted to
+// the line's data type, and the same values as any allowed by its rules; whole number
+// and decimal validations need a numeric line and date and time validations a DATE or
+// DATETIME one.
+func (tr *templateReader) checkValidation(sh *templateSheet, dv templateValidation, dml DatamapLine) (string, error) {
+	dataType := normaliseDataType(dml.DataType)
+	switch dv.typ {
+	case "whole", "decimal":
+		if !PermittedValue(dataType, numericTypes...) {
+			return fmt.Sprintf("only accepts numbers, but the line is %s", dataType), nil
+		}
+	case "date", "time":
+		if !PermittedValue(dataType, TypeDate, TypeDateTime) {
+			return fmt.Sprintf("only accepts a %s, but the line is %s", dv.typ, dataType), nil
+		}
+	case "list":
+		items, ok, err := tr.listItems(sh, dv.formula1)
+		if err != nil || !ok {
+			return "", err
+		}
+		for _, item := range items {
+			if _, err := ConvertValue(dataType, item, tr.book.date1904); err != nil {
+				return fmt.Sprintf("has a list offering %q, which is not a valid %s", item, dataType), nil
+			}
+		}
+		if dml.Rules != nil && len(dml.Rules.Allowed) > 0 && !sameValues(items, dml.Rules.Allowed) {
+			return fmt.Sprintf("has a list offering %s, but the line allows %s",
+				strings.Join(items, ", "), strings.Join(dml.Rules.Allowed, ", ")), nil
+		}
+	}
+	return "", nil
+}
+
+// sameValues reports whether a and b hold the same values, in any order.
+func sameValues(a, b []string) bool {
+	count := make(map[string]int, len(a))
+	for _, s := range a {
+		count[s]++
+	}
+	for _, s := range b {
+		count[s]--
+	}
+	for _, n := range count {
+		if n != 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"archive/zip"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func openTemplate(t *testing.T, path string) *zip.Reader {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return openZip(t, data)
+}
+
+func TestCheckTemplate(t *testing.T) {
+	dm := &Datamap{DMLs: []DatamapLine{
+		{Key: "Project Name", Sheet: "Introduction", DataType: "TEXT", CellRef: "C5"},
+		{Key: "Budget", Sheet: "Introduction", DataType: "NUMBER", CellRef: "Budget"},
+		{Key: "Start", Sheet: "Introduction", DataType: "DATE", CellRef: "C6"},
+		{Key: "Total", Sheet: "Introduction", DataType: "NUMBER", CellRef: "C7"},
+		{Key: "Locked", Sheet: "Introduction", DataType: "TEXT", CellRef: "C8"},
+		{Key: "Label", Sheet: "Introduction", DataType: "TEXT", CellRef: "B8"},
+		{Key: "Ready", Sheet: "Introduction", DataType: "BOOL", CellRef: "C9"},
+		{Key: "RAG", Sheet: "Introduction", DataType: "TEXT", CellRef: "C10", Rules: &Rules{Allowed: []string{"Red", "Amber"}}},
+		{Key: "RAG by name", Sheet: "Introduction", DataType: "TEXT", CellRef: "D10", Rules: &Rules{Allowed: []string{"Green", "Amber", "Red"}}},
+		{Key: "Far away", Sheet: "Introduction", DataType: "TEXT", CellRef: "Z99"},
+		{Key: "Summary", Sheet: "Summary", DataType: "TEXT", CellRef: "A1"},
+		{Key: "Nameless", Sheet: "Introduction", DataType: "TEXT", CellRef: "Nope"},
+		{Key: "Colours", Sheet: "Lists", DataType: "TABLE", CellRef: "A1:A"},
+	}}
+
+	result, err := CheckTemplate(openTemplate(t, "../../testdata/check_template.xlsx"), dm)
+	if err != nil {
+		t.Fatalf("CheckTemplate() error = %v", err)
+	}
+
+	want := []TemplateIssue{
+		{Key: "Start", Sheet: "Introduction", CellRef: "C6", Problem: ProblemValidation, Message: "Introduction!C6 only accepts numbers, but the line is DATE"},
+		{Key: "Total", Sheet: "Introduction", CellRef: "C7", Problem: ProblemFormula, Message: "Introduction!C7 holds a formula, so no value can be entered in it"},
+		{Key: "Locked", Sheet: "Introduction", CellRef: "C8", Problem: ProblemLocked, Message: "Introduction!C8 is locked and sheet Introduction is protected"},
+		{Key: "Label", Sheet: "Introduction", CellRef: "B8", Problem: ProblemLocked, Message: "Introduction!B8 is locked and sheet Introduction is protected"},
+		{Key: "Ready", Sheet: "Introduction", CellRef: "C9", Problem: ProblemValidation, Message: `Introduction!C9 has a list offering "Maybe", which is not a valid BOOL`},
+		{Key: "RAG", Sheet: "Introduction", CellRef: "C10", Problem: ProblemValidation, Message: "Introduction!C10 has a list offering Red, Amber, Green, but the line allows Red, Amber"},
+		{Key: "Far away", Sheet: "Introduction", CellRef: "Z99", Problem: ProblemOutsideRange, Message: "Z99 is outside the used range B5:D10 of sheet Introduction"},
+		{Key: "Far away", Sheet: "Introduction", CellRef: "Z99", Problem: ProblemLocked, Message: "Introduction!Z99 is locked and sheet Introduction is protected"},
+		{Key: "Summary", Sheet: "Summary", CellRef: "A1", Problem: ProblemMissingSheet, Message: "sheet Summary not found"},
+		{Key: "Nameless", Sheet: "Introduction", CellRef: "Nope", Problem: ProblemDefinedName, Message: "defined name Nope not found in spreadsheet"},
+	}
+	if !reflect.DeepEqual(result.Issues, want) {
+		t.Errorf("CheckTemplate() issues =\n%+v\nwant\n%+v", result.Issues, want)
+	}
+	if result.OK || result.Lines != len(dm.DMLs) {
+		t.Errorf("CheckTemplate() OK, Lines = %v, %d, want false, %d", result.OK, result.Lines, len(dm.DMLs))
+	}
+}
+
+func TestCheckTemplateOK(t *testing.T) {
+	// A workbook written by tealeg/xlsx has no protection, so nothing is locked
+	dm := &Datamap{DMLs: []DatamapLine{
+		{Key: "Project Name", Sheet: "Introduction", DataType: "TEXT", CellRef: "ProjectName"},
+		{Key: "Milestones", Sheet: "6a - Milestones", DataType: "TABLE", CellRef: "Milestones"},
+	}}
+	result, err := CheckTemplate(openTemplate(t, "../../testdata/defined_names.xlsx"), dm)
+	if err != nil {
+		t.Fatalf("CheckTemplate() error = %v", err)
+	}
+	if !result.OK || len(result.Issues) != 0 {
+		t.Errorf("CheckTemplate() = %+v, want no issues", result)
+	}
+}
+
+func TestRefContains(t *testing.T) {
+	tests := []struct {
+		ref      string
+		col, row int
+		want     bool
+	}{
+		{"C5", 2, 4, true},
+		{"$C$5", 2, 4, true},
+		{"C5", 2, 5, false},
+		{"C5:D9", 3, 8, true},
+		{"C5:D9", 4, 8, false},
+		{"D9:C5", 2, 4, true},
+		{"Sheet!C5", 2, 4, false},
+	}
+
+	for _, tt := range tests {
+		if got := refContains(tt.ref, tt.col, tt.row); got != tt.want {
+			t.Errorf("refContains(%q, %d, %d) = %v, want %v", tt.ref, tt.col, tt.row, got, tt.want)
+		}
+	}
+}
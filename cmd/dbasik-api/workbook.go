@@ -0,0 +1,155 @@
+// dbasik provides a service with which to convert spreadsheets containing
+// data to JSON for further processing.
+
+// Copyright (C) 2024 M R Lemon
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// WorkbookFormat describes one of the Excel workbook formats we can read and write.
+type WorkbookFormat struct {
+	Name        string `json:"name"`
+	Ext         string `json:"ext"`
+	ContentType string `json:"content_type"`
+	Macros      bool   `json:"macros"`
+}
+
+// The workbook formats we support, keyed by the content type of their workbook part
+// as declared in [Content_Types].xml.
+var (
+	FormatXLSX = &WorkbookFormat{Name: "xlsx", Ext: ".xlsx", ContentType: "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"}
+	FormatXLSM = &WorkbookFormat{Name: "xlsm", Ext: ".xlsm", ContentType: "application/vnd.ms-excel.sheet.macroEnabled.12", Macros: true}
+	FormatXLTX = &WorkbookFormat{Name: "xltx", Ext: ".xltx", ContentType: "application/vnd.openxmlformats-officedocument.spreadsheetml.template"}
+	FormatXLTM = &WorkbookFormat{Name: "xltm", Ext: ".xltm", ContentType: "application/vnd.ms-excel.template.macroEnabled.12", Macros: true}
+
+	workbookFormats = map[string]*WorkbookFormat{
+		"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml":    FormatXLSX,
+		"application/vnd.ms-excel.sheet.macroEnabled.main+xml":                          FormatXLSM,
+		"application/vnd.openxmlformats-officedocument.spreadsheetml.template.main+xml": FormatXLTX,
+		"application/vnd.ms-excel.template.macroEnabled.main+xml":                       FormatXLTM,
+	}
+)
+
+// ErrLegacyWorkbook is returned for files in the binary .xls format, which is also the
+// container used for password-protected workbooks.
+var ErrLegacyWorkbook = errors.New("legacy .xls and password-protected workbooks are not supported")
+
+var (
+	zipMagic = []byte("PK\x03\x04")
+	oleMagic = []byte("\xd0\xcf\x11\xe0\xa1\xb1\x1a\xe1")
+)
+
+// DetectWorkbookFormat works out the format of the workbook in r from its content,
+// whatever the file is called. It returns ErrNotWorkbook if r isn't an Excel workbook
+// and ErrLegacyWorkbook if it is one we can't read.
+func DetectWorkbookFormat(r io.ReaderAt, size int64) (*WorkbookFormat, error) {
+	magic := make([]byte, len(oleMagic))
+	n, _ := r.ReadAt(magic, 0)
+	magic = magic[:n]
+
+	switch {
+	case bytes.HasPrefix(magic, oleMagic):
+		return nil, ErrLegacyWorkbook
+	case !bytes.HasPrefix(magic, zipMagic):
+		return nil, ErrNotWorkbook
+	}
+
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, ErrNotWorkbook
+	}
+	return detectPackageFormat(zr)
+}
+
+// DetectWorkbookFile does the same as DetectWorkbookFormat for the file at filePath.
+func DetectWorkbookFile(filePath string) (*WorkbookFormat, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return DetectWorkbookFormat(f, fi.Size())
+}
+
+// detectPackageFormat looks up the content type of the workbook part of the package
+// zr, which tells us which kind of workbook it is.
+func detectPackageFormat(zr *zip.Reader) (*WorkbookFormat, error) {
+	rels, err := readRelationships(zr, "")
+	if err != nil {
+		return nil, ErrNotWorkbook
+	}
+	var bookPath string
+	for _, rel := range rels {
+		if strings.HasSuffix(rel.Type, "/officeDocument") {
+			bookPath = rel.Target
+		}
+	}
+
+	data, err := readZipFile(zr, "[Content_Types].xml")
+	if err != nil {
+		return nil, ErrNotWorkbook
+	}
+	var types struct {
+		Overrides []struct {
+			PartName    string `xml:"PartName,attr"`
+			ContentType string `xml:"ContentType,attr"`
+		} `xml:"Override"`
+	}
+	if err := xml.Unmarshal(data, &types); err != nil {
+		return nil, ErrNotWorkbook
+	}
+
+	for _, o := range types.Overrides {
+		if strings.TrimPrefix(o.PartName, "/") != bookPath {
+			continue
+		}
+		if format, ok := workbookFormats[o.ContentType]; ok {
+			return format, nil
+		}
+	}
+	return nil, ErrNotWorkbook
+}
+
+// isWorkbook reports whether the file at filePath is a spreadsheet which ParseXLSX can
+// read, going by its content.
+func isWorkbook(filePath string) bool {
+	_, err := DetectSpreadsheetFile(filePath)
+	return err == nil
+}
+
+// workbookFilename returns name with the extension for format, replacing any other
+// extension, so that a workbook we send back opens in the right application.
+func workbookFilename(name string, format *WorkbookFormat) string {
+	name = filepath.Base(name)
+	if strings.EqualFold(filepath.Ext(name), format.Ext) {
+		return name
+	}
+	return strings.TrimSuffix(name, filepath.Ext(name)) + format.Ext
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDetectWorkbookFormat(t *testing.T) {
+	dir := t.TempDir()
+	xlsm, err := os.ReadFile("../../resources/test_two_sheets.xlsm")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A macro-enabled workbook uploaded with the wrong extension
+	misnamed := filepath.Join(dir, "return.xlsx")
+	if err := os.WriteFile(misnamed, xlsm, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	legacy := filepath.Join(dir, "return.xls")
+	if err := os.WriteFile(legacy, append([]byte(oleMagic), make([]byte, 504)...), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	text := filepath.Join(dir, "notes.xlsx")
+	if err := os.WriteFile(text, []byte("PK but not really"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path    string
+		want    *WorkbookFormat
+		wantErr error
+	}{
+		{"../../testdata/valid_excel.xlsx", FormatXLSX, nil},
+		{"../../resources/test_two_sheets.xlsm", FormatXLSM, nil},
+		{misnamed, FormatXLSM, nil},
+		{legacy, nil, ErrLegacyWorkbook},
+		{text, nil, ErrNotWorkbook},
+		{"../../testdata/test.zip", nil, ErrNotWorkbook},
+		{"../../resources/datamap.csv", nil, ErrNotWorkbook},
+	}
+
+	for _, tt := range tests {
+		t.Run(filepath.Base(tt.path), func(t *testing.T) {
+			got, err := DetectWorkbookFile(tt.path)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("DetectWorkbookFile() error = %v, want %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("DetectWorkbookFile() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWorkbookFilename(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		format *WorkbookFormat
+		want   string
+	}{
+		{"template.xlsm", FormatXLSM, "template.xlsm"},
+		{"TEMPLATE.XLSM", FormatXLSM, "TEMPLATE.XLSM"},
+		{"template.xlsx", FormatXLSM, "template.xlsm"},
+		{"template", FormatXLSX, "template.xlsx"},
+	} {
+		if got := workbookFilename(tt.name, tt.format); got != tt.want {
+			t.Errorf("workbookFilename(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPopulateTemplateKeepsMacros(t *testing.T) {
+	template, err := os.ReadFile("../../resources/test_two_sheets.xlsm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dm := &Datamap{DMLs: []DatamapLine{
+		{Key: "Project/Programme Name", Sheet: "rpt_template", DataType: "TEXT", CellRef: "E6"},
+	}}
+
+	var buf bytes.Buffer
+	_, err = PopulateTemplate(openZip(t, template), &buf, dm, TypedValues(dm, map[string]string{"Project/Programme Name": "Knocker"}, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	format, err := DetectWorkbookFormat(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil || format != FormatXLSM {
+		t.Errorf("populated workbook format = %v, %v; want xlsm", format, err)
+	}
+	want, _ := readZipFile(openZip(t, template), "xl/vbaProject.bin")
+	got, err := readZipFile(openZip(t, buf.Bytes()), "xl/vbaProject.bin")
+	if err != nil || len(want) == 0 || !bytes.Equal(got, want) {
+		t.Errorf("populated workbook did not keep the VBA project: %v", err)
+	}
+}
@@ -0,0 +1,827 @@
+// dbasik provides a service with which to convert spreadsheets containing
+// data to JSON for further processing.
+
+// Copyright (C) 2024 M R Lemon
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tealeg/xlsx/v3"
+)
+
+// ErrNotWorkbook is returned when a file which should be an Excel workbook isn't one
+var ErrNotWorkbook = errors.New("file is not an Excel workbook")
+
+// SkippedLine records a DatamapLine whose value could not be written to a template.
+type SkippedLine struct {
+	Key     string `json:"key"`
+	Sheet   string `json:"sheet"`
+	CellRef string `json:"cellref"`
+	Reason  string `json:"reason"`
+}
+
+// Populated summarises the result of PopulateTemplate.
+type Populated struct {
+	Written int           `json:"written"`
+	Skipped []SkippedLine `json:"skipped"`
+}
+
+// pendingCell is a value waiting to be written into a sheet
+type pendingCell struct {
+	dml DatamapLine
+	rl  ReturnLine
+}
+
+// PopulateTemplate is the inverse of ParseXLSX. It writes the value for each key of dm
+// found in values into the cell the key's DatamapLine points at in the template
+// workbook src, and writes the filled workbook to dst. Keys without a value are left
+// as they are in the template.
+//
+// Only the worksheets which are written to are changed, and within them only the
+// target cells, which keep their style. A date written to a cell without a style is
+// given one with a date format, which is added to the workbook's styles. Every other
+// part of the workbook, including any VBA project, is copied across untouched. Cells holding a formula are never
+// overwritten; they are reported in Populated.Skipped along with lines whose sheet
+// doesn't exist and TABLE lines.
+func PopulateTemplate(src *zip.Reader, dst io.Writer, dm *Datamap, values map[string]ReturnLine) (*Populated, error) {
+	book, err := readWorkbookParts(src)
+	if err != nil {
+		return nil, err
+	}
+
+	dates := &workbookDates{date1904: book.date1904}
+	if book.styles != "" {
+		data, err := readZipFile(src, book.styles)
+		if err != nil {
+			return nil, err
+		}
+		dates.readStyles(data)
+	}
+
+	result := &Populated{Skipped: []SkippedLine{}}
+	writes := make(map[string]map[int]map[int]pendingCell)
+
+	for _, dml := range dm.DMLs {
+		rl, ok := values[dml.Key]
+		if !ok || (rl.Value == nil && rl.Raw == "") {
+			continue
+		}
+
+		if normaliseDataType(dml.DataType) == TypeTable {
+			result.skip(dml, "TABLE lines cannot be written to a template")
+			continue
+		}
+		target, err := resolveLine(book, dml)
+		if err != nil {
+			result.skip(dml, err.Error())
+			continue
+		}
+		sheetPath, ok := book.sheets[target.Sheet]
+		if !ok {
+			result.skip(dml, fmt.Sprintf("sheet %s not found", target.Sheet))
+			continue
+		}
+		col, row, err := xlsx.GetCoordsFromCellIDString(target.CellRef)
+		if err != nil {
+			result.skip(dml, err.Error())
+			continue
+		}
+
+		if writes[sheetPath] == nil {
+			writes[sheetPath] = make(map[int]map[int]pendingCell)
+		}
+		if writes[sheetPath][row+1] == nil {
+			writes[sheetPath][row+1] = make(map[int]pendingCell)
+		}
+		writes[sheetPath][row+1][col+1] = pendingCell{dml: dml, rl: rl}
+	}
+
+	patched := make(map[string][]byte)
+	for sheetPath, rows := range writes {
+		data, err := readZipFile(src, sheetPath)
+		if err != nil {
+			return nil, err
+		}
+		patched[sheetPath], err = patchSheet(data, rows, dates, result)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", sheetPath, err)
+		}
+	}
+
+	// Formulas which depend on the cells we've written need recalculating when the
+	// workbook is next opened
+	if result.Written > 0 {
+		patched[book.path] = recalculateOnLoad(book.xml)
+	}
+	if dates.used {
+		patched[book.styles] = dates.addStyles()
+	}
+
+	zw := zip.NewWriter(dst)
+	for _, f := range src.File {
+		data, ok := patched[f.Name]
+		if !ok {
+			if err := zw.Copy(f); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: f.Name, Method: zip.Deflate, Modified: f.Modified})
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// ReturnValues returns the values of rtn keyed by datamap key, for PopulateTemplate.
+// If a key appears more than once, the first value is used.
+func ReturnValues(rtn *Return) map[string]ReturnLine {
+	values := make(map[string]ReturnLine, len(rtn.ReturnLines))
+	for _, rl := range rtn.ReturnLines {
+		if _, ok := values[rl.Key]; !ok {
+			values[rl.Key] = rl
+		}
+	}
+	return values
+}
+
+// TypedValues converts raw string values, keyed by datamap key, according to the data
+// types of the lines of dm, for PopulateTemplate. Keys which aren't in dm are ignored.
+func TypedValues(dm *Datamap, raw map[string]string, date1904 bool) map[string]ReturnLine {
+	values := make(map[string]ReturnLine, len(raw))
+	for _, dml := range dm.DMLs {
+		if _, ok := values[dml.Key]; ok {
+			continue
+		}
+		if s, ok := raw[dml.Key]; ok {
+			values[dml.Key] = newTypedReturnLine(dml, s, date1904)
+		}
+	}
+	return values
+}
+
+func (p *Populated) skip(dml DatamapLine, reason string) {
+	p.Skipped = append(p.Skipped, SkippedLine{Key: dml.Key, Sheet: dml.Sheet, CellRef: dml.CellRef, Reason: reason})
+}
+
+// workbookParts holds what we need from the workbook part of an .xlsx package: its
+// path and contents, the path of each worksheet by name and the names in the order of
+// the workbook's tabs, the paths of its styles and shared strings, its defined names
+// and the date system in use.
+type workbookParts struct {
+	path          string
+	xml           []byte
+	sheets        map[string]string
+	sheetNames    []string
+	styles        string
+	sharedStrings string
+	names         definedNames
+	date1904      bool
+}
+
+// readWorkbookParts finds the workbook part of the package src through the package
+// relationships, and the worksheets through the workbook's relationships.
+func readWorkbookParts(src *zip.Reader) (*workbookParts, error) {
+	rels, err := readRelationships(src, "")
+	if err != nil {
+		return nil, ErrNotWorkbook
+	}
+
+	book := &workbookParts{sheets: make(map[string]string)}
+	for _, rel := range rels {
+		if strings.HasSuffix(rel.Type, "/officeDocument") {
+			book.path = rel.Target
+		}
+	}
+	if book.path == "" {
+		return nil, ErrNotWorkbook
+	}
+
+	book.xml, err = readZipFile(src, book.path)
+	if err != nil {
+		return nil, err
+	}
+
+	var wb struct {
+		WorkbookPr struct {
+			Date1904 string `xml:"date1904,attr"`
+		} `xml:"workbookPr"`
+		Sheets []struct {
+			Name string `xml:"name,attr"`
+			ID   string `xml:"http://schemas.openxmlformats.org/officeDocument/2006/relationships id,attr"`
+		} `xml:"sheets>sheet"`
+		DefinedNames []struct {
+			Name         string `xml:"name,attr"`
+			LocalSheetID *int   `xml:"localSheetId,attr"`
+			Target       string `xml:",chardata"`
+		} `xml:"definedNames>definedName"`
+	}
+	if err := xml.Unmarshal(book.xml, &wb); err != nil {
+		return nil, fmt.Errorf("%s: %w", book.path, err)
+	}
+	book.date1904 = wb.WorkbookPr.Date1904 == "1" || wb.WorkbookPr.Date1904 == "true"
+
+	bookRels, err := readRelationships(src, book.path)
+	if err != nil {
+		return nil, err
+	}
+	for _, sheet := range wb.Sheets {
+		if target, ok := bookRels[sheet.ID]; ok {
+			book.sheets[sheet.Name] = target.Target
+			book.sheetNames = append(book.sheetNames, sheet.Name)
+		}
+	}
+	for _, rel := range bookRels {
+		switch {
+		case strings.HasSuffix(rel.Type, "/styles"):
+			book.styles = rel.Target
+		case strings.HasSuffix(rel.Type, "/sharedStrings"):
+			book.sharedStrings = rel.Target
+		}
+	}
+
+	// A name which belongs to a sheet gives the sheet's position in the workbook
+	for _, dn := range wb.DefinedNames {
+		scope := ""
+		if dn.LocalSheetID != nil {
+			if *dn.LocalSheetID < 0 || *dn.LocalSheetID >= len(wb.Sheets) {
+				continue
+			}
+			scope = wb.Sheets[*dn.LocalSheetID].Name
+		}
+		book.names = append(book.names, newDefinedName(dn.Name, scope, dn.Target))
+	}
+
+	return book, nil
+}
+
+func (b *workbookParts) DefinedName(sheet, name string) (string, string, error) {
+	return b.names.resolve(sheet, name)
+}
+
+type relationship struct {
+	ID     string `xml:"Id,attr"`
+	Type   string `xml:"Type,attr"`
+	Target string `xml:"Target,attr"`
+}
+
+// readRelationships reads the relationships of the part at partPath, or of the package
+// itself if partPath is empty, keyed by id. Targets are resolved to paths within the
+// package.
+func readRelationships(src *zip.Reader, partPath string) (map[string]relationship, error) {
+	dir, _ := path.Split(partPath)
+	relsPath := relationshipsPath(partPath)
+
+	data, err := readZipFile(src, relsPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var rels struct {
+		Relationships []relationship `xml:"Relationship"`
+	}
+	if err := xml.Unmarshal(data, &rels); err != nil {
+		return nil, fmt.Errorf("%s: %w", relsPath, err)
+	}
+
+	out := make(map[string]relationship, len(rels.Relationships))
+	for _, rel := range rels.Relationships {
+		if strings.HasPrefix(rel.Target, "/") {
+			rel.Target = strings.TrimPrefix(rel.Target, "/")
+		} else {
+			rel.Target = path.Join(dir, rel.Target)
+		}
+		out[rel.ID] = rel
+	}
+	return out, nil
+}
+
+// relationshipsPath returns the path of the relationships of the part at partPath,
+// or of the package if partPath is empty.
+func relationshipsPath(partPath string) string {
+	dir, file := path.Split(partPath)
+	return path.Join(dir, "_rels", file+".rels")
+}
+
+// readZipFile returns the contents of the file called name in src.
+func readZipFile(src *zip.Reader, name string) ([]byte, error) {
+	for _, f := range src.File {
+		if f.Name != name {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+		return io.ReadAll(rc)
+	}
+	return nil, fmt.Errorf("%s not found in workbook", name)
+}
+
+// xmlElement is an element found in XML by scanXML. The element is data[start:end],
+// its start tag data[start:tagEnd] and its content data[tagEnd:innerEnd]; for a
+// self-closing element the content is empty and innerEnd is end.
+type xmlElement struct {
+	xml.StartElement
+	start, tagEnd, innerEnd, end int
+}
+
+// prefix returns the namespace prefix of the element, with its colon, or "".
+func (el *xmlElement) prefix() string {
+	if el.Name.Space == "" {
+		return ""
+	}
+	return el.Name.Space + ":"
+}
+
+// selfClosing reports whether the element was written as a single tag, e.g. <row/>.
+func (el *xmlElement) selfClosing() bool {
+	return el.innerEnd == el.end
+}
+
+// attr returns the value of the unprefixed attribute called name, or "".
+func (el *xmlElement) attr(name string) string {
+	for _, a := range el.Attr {
+		if a.Name.Space == "" && a.Name.Local == name {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// startTag returns the start tag of the element, leaving out any unprefixed attribute
+// called omit.
+func (el *xmlElement) startTag(omit string) string {
+	var b bytes.Buffer
+	b.WriteString("<" + el.prefix() + el.Name.Local)
+	for _, a := range el.Attr {
+		if a.Name.Space == "" && a.Name.Local == omit {
+			continue
+		}
+		b.WriteByte(' ')
+		if a.Name.Space != "" {
+			b.WriteString(a.Name.Space + ":")
+		}
+		b.WriteString(a.Name.Local + `="`)
+		xml.EscapeText(&b, []byte(a.Value))
+		b.WriteByte('"')
+	}
+	b.WriteByte('>')
+	return b.String()
+}
+
+// scanXML reads data token by token, calling visit with the local names of each
+// element and its ancestors, outermost first, once the element has been read. visit
+// returns false to stop the scan. Names are matched without their namespace prefix, so
+// that worksheets written with a prefix, e.g. <x:row>, are read like any other.
+func scanXML(data []byte, visit func(path []string, el *xmlElement) bool) error {
+	d := xml.NewDecoder(bytes.NewReader(data))
+	var path []string
+	var open []*xmlElement
+	for {
+		start := int(d.InputOffset())
+		tok, err := d.RawToken()
+		if errors.Is(err, io.EOF) {
+			if len(open) > 0 {
+				return fmt.Errorf("element %s is not closed", open[len(open)-1].Name.Local)
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		end := int(d.InputOffset())
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			path = append(path, t.Name.Local)
+			open = append(open, &xmlElement{StartElement: t.Copy(), start: start, tagEnd: end})
+		case xml.EndElement:
+			if len(open) == 0 || open[len(open)-1].Name != t.Name {
+				return fmt.Errorf("unexpected end element %s", t.Name.Local)
+			}
+			el := open[len(open)-1]
+			el.innerEnd, el.end = start, end
+			if !visit(path, el) {
+				return nil
+			}
+			path, open = path[:len(path)-1], open[:len(open)-1]
+		}
+	}
+}
+
+// sheetRow is a row of a worksheet, along with its cells.
+type sheetRow struct {
+	*xmlElement
+	cells []sheetCell
+}
+
+// sheetCell is a cell of a worksheet; formula is set if it holds a formula.
+type sheetCell struct {
+	*xmlElement
+	formula bool
+}
+
+// readSheetData finds the sheetData element of the worksheet XML data, and its rows.
+func readSheetData(data []byte) (*xmlElement, []sheetRow, error) {
+	var sheetData *xmlElement
+	var rows []sheetRow
+	var cells []sheetCell
+	formula := false
+
+	err := scanXML(data, func(path []string, el *xmlElement) bool {
+		switch strings.Join(path, "/") {
+		case "worksheet/sheetData/row/c/f":
+			formula = true
+		case "worksheet/sheetData/row/c":
+			cells = append(cells, sheetCell{xmlElement: el, formula: formula})
+			formula = false
+		case "worksheet/sheetData/row":
+			rows = append(rows, sheetRow{xmlElement: el, cells: cells})
+			cells = nil
+		case "worksheet/sheetData":
+			sheetData = el
+			return false
+		}
+		return true
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if sheetData == nil {
+		return nil, nil, errors.New("worksheet has no sheetData")
+	}
+	return sheetData, rows, nil
+}
+
+// patchSheet writes the pending cells, keyed by one-based row and column number, into
+// the worksheet XML data. Everything other than the rows written to is copied across
+// byte for byte.
+func patchSheet(data []byte, rows map[int]map[int]pendingCell, dates *workbookDates, result *Populated) ([]byte, error) {
+	sheetData, existing, err := readSheetData(data)
+	if err != nil {
+		return nil, err
+	}
+	prefix := sheetData.prefix()
+
+	pending := make([]int, 0, len(rows))
+	for r := range rows {
+		pending = append(pending, r)
+	}
+	sort.Ints(pending)
+
+	var b bytes.Buffer
+	if sheetData.selfClosing() {
+		b.Write(data[:sheetData.start])
+		b.WriteString(sheetData.startTag(""))
+	} else {
+		b.Write(data[:sheetData.tagEnd])
+	}
+
+	offset, rowNum := sheetData.tagEnd, 0
+	for _, row := range existing {
+		if n, err := strconv.Atoi(row.attr("r")); err == nil {
+			rowNum = n
+		} else {
+			rowNum++
+		}
+
+		// Rows which don't exist yet go in before the first row after them
+		for len(pending) > 0 && pending[0] < rowNum {
+			b.Write(data[offset:row.start])
+			offset = row.start
+			b.WriteString(newRow(prefix, pending[0], rows[pending[0]], dates, result))
+			pending = pending[1:]
+		}
+
+		b.Write(data[offset:row.start])
+		if len(pending) > 0 && pending[0] == rowNum {
+			b.WriteString(patchRow(data, prefix, row, rowNum, rows[rowNum], dates, result))
+			pending = pending[1:]
+		} else {
+			b.Write(data[row.start:row.end])
+		}
+		offset = row.end
+	}
+	b.Write(data[offset:sheetData.innerEnd])
+
+	for _, r := range pending {
+		b.WriteString(newRow(prefix, r, rows[r], dates, result))
+	}
+	if sheetData.selfClosing() {
+		b.WriteString("</" + prefix + "sheetData>")
+		b.Write(data[sheetData.end:])
+	} else {
+		b.Write(data[sheetData.innerEnd:])
+	}
+
+	return growDimension(b.Bytes(), rows)
+}
+
+// growDimension widens the used range recorded in the dimension element of the
+// worksheet XML data to take in the cells in rows. Readers may rely on the dimension
+// to know how much of the sheet to read.
+func growDimension(data []byte, rows map[int]map[int]pendingCell) ([]byte, error) {
+	var dimension *xmlElement
+	err := scanXML(data, func(path []string, el *xmlElement) bool {
+		switch strings.Join(path, "/") {
+		case "worksheet/dimension":
+			dimension = el
+			return false
+		case "worksheet/sheetData":
+			return false
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	if dimension == nil {
+		return data, nil
+	}
+
+	from, to, _ := strings.Cut(dimension.attr("ref"), ":")
+	if to == "" {
+		to = from
+	}
+	minCol, minRow, err := xlsx.GetCoordsFromCellIDString(from)
+	if err != nil {
+		return data, nil
+	}
+	maxCol, maxRow, err := xlsx.GetCoordsFromCellIDString(to)
+	if err != nil {
+		return data, nil
+	}
+
+	for r, cells := range rows {
+		for c := range cells {
+			minCol, maxCol = min(minCol, c-1), max(maxCol, c-1)
+			minRow, maxRow = min(minRow, r-1), max(maxRow, r-1)
+		}
+	}
+
+	ref := xlsx.GetCellIDStringFromCoords(minCol, minRow) + ":" + xlsx.GetCellIDStringFromCoords(maxCol, maxRow)
+	prefix := dimension.prefix()
+	var b bytes.Buffer
+	b.Write(data[:dimension.start])
+	fmt.Fprintf(&b, `<%sdimension ref="%s"/>`, prefix, ref)
+	b.Write(data[dimension.end:])
+	return b.Bytes(), nil
+}
+
+// newRow returns the XML for a row which doesn't exist in the template.
+func newRow(prefix string, rowNum int, cells map[int]pendingCell, dates *workbookDates, result *Populated) string {
+	return patchRow(nil, prefix, sheetRow{}, rowNum, cells, dates, result)
+}
+
+// patchRow returns the XML for row, read from the worksheet XML data, with the pending
+// cells written into it. If row has no element, a new row is written.
+func patchRow(data []byte, prefix string, row sheetRow, rowNum int, cells map[int]pendingCell, dates *workbookDates, result *Populated) string {
+	pending := make([]int, 0, len(cells))
+	for c := range cells {
+		pending = append(pending, c)
+	}
+	sort.Ints(pending)
+
+	var b strings.Builder
+	offset, contentEnd := 0, 0
+	if row.xmlElement == nil {
+		fmt.Fprintf(&b, `<%srow r="%d">`, prefix, rowNum)
+	} else {
+		// The spans attribute is an optional hint which may no longer be right
+		b.WriteString(row.startTag("spans"))
+		offset, contentEnd = row.tagEnd, row.innerEnd
+	}
+
+	colNum := 0
+	for _, cell := range row.cells {
+		if col, _, err := xlsx.GetCoordsFromCellIDString(cell.attr("r")); err == nil {
+			colNum = col + 1
+		} else {
+			colNum++
+		}
+
+		for len(pending) > 0 && pending[0] < colNum {
+			b.Write(data[offset:cell.start])
+			offset = cell.start
+			b.WriteString(newCell(prefix, pending[0], rowNum, "", cells[pending[0]], dates, result))
+			pending = pending[1:]
+		}
+
+		b.Write(data[offset:cell.start])
+		offset = cell.end
+		if len(pending) == 0 || pending[0] != colNum {
+			b.Write(data[cell.start:cell.end])
+			continue
+		}
+
+		pc := cells[colNum]
+		pending = pending[1:]
+		if cell.formula {
+			result.skip(pc.dml, "cell contains a formula")
+			b.Write(data[cell.start:cell.end])
+			continue
+		}
+		b.WriteString(newCell(prefix, colNum, rowNum, cell.attr("s"), pc, dates, result))
+	}
+
+	// Any cells after the last one in the row go straight after it, ahead of anything
+	// else the row might contain
+	for _, c := range pending {
+		b.WriteString(newCell(prefix, c, rowNum, "", cells[c], dates, result))
+	}
+	b.Write(data[offset:contentEnd])
+
+	b.WriteString("</" + prefix + "row>")
+	return b.String()
+}
+
+// newCell returns the XML for a cell holding the value of pc, with the given style.
+func newCell(prefix string, colNum, rowNum int, style string, pc pendingCell, dates *workbookDates, result *Populated) string {
+	attrs := fmt.Sprintf(` r="%s"`, xlsx.GetCellIDStringFromCoords(colNum-1, rowNum-1))
+	if style != "" {
+		attrs += fmt.Sprintf(` s="%s"`, style)
+	}
+
+	result.Written++
+
+	var value string
+	switch v := pc.rl.Value.(type) {
+	case nil:
+		// A value which couldn't be converted is written as it was submitted
+		return fmt.Sprintf(`<%sc%s t="inlineStr">%s</%sc>`, prefix, attrs, inlineString(prefix, pc.rl.Raw), prefix)
+	case string:
+		t, err := parseISODate(pc.rl.DataType, v)
+		if err != nil {
+			return fmt.Sprintf(`<%sc%s t="inlineStr">%s</%sc>`, prefix, attrs, inlineString(prefix, v), prefix)
+		}
+		value = formatValue(xlsx.TimeToExcelTime(t, dates.date1904))
+		if style == "" {
+			if style = dates.style(pc.rl.DataType); style != "" {
+				attrs += fmt.Sprintf(` s="%s"`, style)
+			}
+		}
+	case bool:
+		value = "0"
+		if v {
+			value = "1"
+		}
+		attrs += ` t="b"`
+	default:
+		value = formatValue(v)
+	}
+
+	return fmt.Sprintf(`<%sc%s><%sv>%s</%sv></%sc>`, prefix, attrs, prefix, value, prefix, prefix)
+}
+
+// workbookDates holds what is needed to write dates into the worksheets of a workbook:
+// its date system, and its styles part, to which cell styles with a date format are
+// added for date cells without a style of their own. Without one a date shows as a
+// bare serial number.
+type workbookDates struct {
+	date1904 bool
+	styles   []byte
+	cellXfs  *xmlElement // nil if the workbook has no cell styles to add to
+	xfCount  int
+	used     bool
+}
+
+// readStyles finds the cell styles in the styles part data.
+func (d *workbookDates) readStyles(data []byte) {
+	d.styles = data
+	err := scanXML(data, func(path []string, el *xmlElement) bool {
+		switch strings.Join(path, "/") {
+		case "styleSheet/cellXfs/xf":
+			d.xfCount++
+		case "styleSheet/cellXfs":
+			d.cellXfs = el
+			return false
+		}
+		return true
+	})
+	if err != nil {
+		d.cellXfs = nil
+	}
+}
+
+// style returns the index of the cell style for a date cell holding a value of
+// dataType, or "" if the workbook has no cell styles to add one to. The styles are
+// numbered from the end of the existing ones, in the order addStyles writes them.
+func (d *workbookDates) style(dataType string) string {
+	if d.cellXfs == nil {
+		return ""
+	}
+	d.used = true
+	if normaliseDataType(dataType) == TypeDateTime {
+		return strconv.Itoa(d.xfCount + 1)
+	}
+	return strconv.Itoa(d.xfCount)
+}
+
+// addStyles returns the styles part with the date and date-time styles added to the
+// end of its cell styles. They use the built-in number formats for a short date and a
+// date and time.
+func (d *workbookDates) addStyles() []byte {
+	prefix := d.cellXfs.prefix()
+	for i, a := range d.cellXfs.Attr {
+		if a.Name.Space == "" && a.Name.Local == "count" {
+			d.cellXfs.Attr[i].Value = strconv.Itoa(d.xfCount + 2)
+		}
+	}
+
+	var b bytes.Buffer
+	b.Write(d.styles[:d.cellXfs.start])
+	b.WriteString(d.cellXfs.startTag(""))
+	if !d.cellXfs.selfClosing() {
+		b.Write(d.styles[d.cellXfs.tagEnd:d.cellXfs.innerEnd])
+	}
+	for _, numFmt := range []int{14, 22} {
+		fmt.Fprintf(&b, `<%sxf numFmtId="%d" fontId="0" fillId="0" borderId="0" xfId="0" applyNumberFormat="1"/>`, prefix, numFmt)
+	}
+	b.WriteString("</" + prefix + "cellXfs>")
+	b.Write(d.styles[d.cellXfs.end:])
+	return b.Bytes()
+}
+
+// inlineString returns the content of an inline string cell holding s.
+func inlineString(prefix, s string) string {
+	var b bytes.Buffer
+	xml.EscapeText(&b, []byte(s))
+	return fmt.Sprintf(`<%sis><%st xml:space="preserve">%s</%st></%sis>`, prefix, prefix, b.String(), prefix, prefix)
+}
+
+// parseISODate parses a DATE or DATETIME value converted by ConvertValue. It returns an
+// error for values of any other type.
+func parseISODate(dataType, v string) (time.Time, error) {
+	switch normaliseDataType(dataType) {
+	case TypeDate:
+		return time.Parse(isoDate, v)
+	case TypeDateTime:
+		return time.Parse(isoDateTime, v)
+	}
+	return time.Time{}, fmt.Errorf("%s is not a date type", dataType)
+}
+
+// recalculateOnLoad sets fullCalcOnLoad on the calcPr element of the workbook XML, if
+// it has one, so that Excel recalculates formulas when the workbook is opened.
+func recalculateOnLoad(data []byte) []byte {
+	var calcPr *xmlElement
+	err := scanXML(data, func(path []string, el *xmlElement) bool {
+		if strings.Join(path, "/") == "workbook/calcPr" {
+			calcPr = el
+			return false
+		}
+		return true
+	})
+	if err != nil || calcPr == nil || calcPr.attr("fullCalcOnLoad") != "" {
+		return data
+	}
+
+	calcPr.Attr = append(calcPr.Attr, xml.Attr{Name: xml.Name{Local: "fullCalcOnLoad"}, Value: "1"})
+	tag := calcPr.startTag("")
+	end := calcPr.tagEnd
+	if calcPr.selfClosing() {
+		tag = strings.TrimSuffix(tag, ">") + "/>"
+		end = calcPr.end
+	}
+
+	var b bytes.Buffer
+	b.Write(data[:calcPr.start])
+	b.WriteString(tag)
+	b.Write(data[end:])
+	return b.Bytes()
+}
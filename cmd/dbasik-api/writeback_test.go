@@ -0,0 +1,295 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// openZip opens the zip archive held in data.
+func openZip(tb testing.TB, data []byte) *zip.Reader {
+	tb.Helper()
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return zr
+}
+
+func TestPopulateTemplate(t *testing.T) {
+	template, err := os.ReadFile("../../resources/test_two_sheets.xlsm")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dm := &Datamap{DMLs: []DatamapLine{
+		{Key: "Project Name", Sheet: "rpt_template", DataType: "TEXT", CellRef: "E6"},
+		{Key: "Empty Row", Sheet: "rpt_template", DataType: "TEXT", CellRef: "A1"},
+		{Key: "Between Cells", Sheet: "rpt_template", DataType: "NUMBER", CellRef: "G3"},
+		{Key: "Start Date", Sheet: "rpt_template", DataType: "DATE", CellRef: "E10"},
+		{Key: "Approved", Sheet: "rpt_template", DataType: "BOOL", CellRef: "F10"},
+		{Key: "New Row", Sheet: "rpt_template", DataType: "GBP", CellRef: "C500"},
+		{Key: "Unconverted", Sheet: "rpt_template", DataType: "INTEGER", CellRef: "C501"},
+		{Key: "Escaped", Sheet: "dropdowns", DataType: "TEXT", CellRef: "B2"},
+		{Key: "Total", Sheet: "rpt_template", DataType: "NUMBER", CellRef: "E113"},
+		{Key: "Missing Sheet", Sheet: "Nowhere", DataType: "TEXT", CellRef: "A1"},
+		{Key: "No Value", Sheet: "rpt_template", DataType: "TEXT", CellRef: "E7"},
+		{Key: "Finish Date", Sheet: "rpt_template", DataType: "DATE", CellRef: "C502"},
+	}}
+	values := TypedValues(dm, map[string]string{
+		"Project Name":  "Knocker <Phase 2> & Co",
+		"Empty Row":     "top",
+		"Between Cells": "1,234.5",
+		"Start Date":    "2024-07-01",
+		"Approved":      "yes",
+		"New Row":       "£99.99",
+		"Unconverted":   "lots",
+		"Escaped":       `"quoted" & <tagged>`,
+		"Total":         "42",
+		"Missing Sheet": "x",
+		"Finish Date":   "2025-03-31",
+	}, false)
+
+	var buf bytes.Buffer
+	result, err := PopulateTemplate(openZip(t, template), &buf, dm, values)
+	if err != nil {
+		t.Fatalf("PopulateTemplate() error = %v", err)
+	}
+	if result.Written != 9 {
+		t.Errorf("PopulateTemplate() wrote %d cells, want 9", result.Written)
+	}
+	var skipped []string
+	for _, s := range result.Skipped {
+		skipped = append(skipped, s.Key)
+	}
+	if strings.Join(skipped, ",") != "Missing Sheet,Total" {
+		t.Errorf("PopulateTemplate() skipped %v, want [Missing Sheet Total]", skipped)
+	}
+
+	// Everything other than the worksheets, workbook and styles must be untouched,
+	// including the VBA project
+	before, after := openZip(t, template), openZip(t, buf.Bytes())
+	if len(before.File) != len(after.File) {
+		t.Fatalf("populated workbook has %d parts, want %d", len(after.File), len(before.File))
+	}
+	for i, f := range before.File {
+		if after.File[i].Name != f.Name {
+			t.Fatalf("part %d is %s, want %s", i, after.File[i].Name, f.Name)
+		}
+		if strings.HasPrefix(f.Name, "xl/worksheets/") || f.Name == "xl/workbook.xml" || f.Name == "xl/styles.xml" {
+			continue
+		}
+		want, _ := readZipFile(before, f.Name)
+		got, _ := readZipFile(after, f.Name)
+		if !bytes.Equal(got, want) {
+			t.Errorf("part %s was changed", f.Name)
+		}
+	}
+
+	// Parsing the populated workbook must give back what was written
+	path := filepath.Join(t.TempDir(), "populated.xlsm")
+	if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	parseDM := &Datamap{DMLs: dm.DMLs[:9]}
+	rtn, err := ParseXLSX(path, parseDM)
+	if err != nil {
+		t.Fatalf("ParseXLSX() of populated workbook error = %v", err)
+	}
+	want := map[string]any{
+		"Project Name":  "Knocker <Phase 2> & Co",
+		"Empty Row":     "top",
+		"Between Cells": 1234.5,
+		"Start Date":    "2024-07-01",
+		"Approved":      true,
+		"New Row":       99.99,
+		"Unconverted":   nil,
+		"Escaped":       `"quoted" & <tagged>`,
+	}
+	for _, rl := range rtn.ReturnLines {
+		w, ok := want[rl.Key]
+		if !ok {
+			continue
+		}
+		if rl.Value != w {
+			t.Errorf("%s = %#v, want %#v", rl.Key, rl.Value, w)
+		}
+	}
+	if raw := rtn.ReturnLines[6].Raw; raw != "lots" {
+		t.Errorf("Unconverted was written as %q, want the raw value", raw)
+	}
+
+	// The existing style of a cell is kept
+	sheet, err := readZipFile(after, "xl/worksheets/sheet1.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(sheet, []byte(`<c r="E10" s="12">`)) {
+		t.Errorf("E10 lost its style")
+	}
+	// A date in a new cell is given a date format, so that it doesn't show as a number
+	styles, err := readZipFile(after, "xl/styles.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var xfCount int
+	err = scanXML(styles, func(path []string, el *xmlElement) bool {
+		if strings.Join(path, "/") == "styleSheet/cellXfs" {
+			xfCount, _ = strconv.Atoi(el.attr("count"))
+			return false
+		}
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(styles, []byte(`<xf numFmtId="14" fontId="0" fillId="0" borderId="0" xfId="0" applyNumberFormat="1"/>`)) {
+		t.Errorf("styles.xml has no date style")
+	}
+	if want := fmt.Sprintf(`<c r="C502" s="%d">`, xfCount-2); !bytes.Contains(sheet, []byte(want)) {
+		t.Errorf("C502 was not given the date style, want %s", want)
+	}
+
+	book, _ := readZipFile(after, "xl/workbook.xml")
+	if bytes.Count(book, []byte("fullCalcOnLoad")) != 1 {
+		t.Errorf("workbook.xml has a repeated fullCalcOnLoad: %s", book)
+	}
+}
+
+func TestPatchSheet(t *testing.T) {
+	dml := DatamapLine{Key: "k", DataType: "NUMBER"}
+	cell := func(raw string) pendingCell {
+		return pendingCell{dml: dml, rl: newTypedReturnLine(dml, raw, false)}
+	}
+
+	tests := []struct {
+		name  string
+		sheet string
+		rows  map[int]map[int]pendingCell
+		want  string
+	}{
+		{
+			name:  "empty sheetData",
+			sheet: `<worksheet><sheetData/></worksheet>`,
+			rows:  map[int]map[int]pendingCell{2: {2: cell("1")}},
+			want:  `<worksheet><sheetData><row r="2"><c r="B2"><v>1</v></c></row></sheetData></worksheet>`,
+		},
+		{
+			name:  "rows before, between and after",
+			sheet: `<worksheet><sheetData><row r="2" spans="1:3"><c r="A2"/><c r="C2" s="4"><v>9</v></c></row><row r="5"/></sheetData></worksheet>`,
+			rows: map[int]map[int]pendingCell{
+				1: {1: cell("1")},
+				2: {2: cell("2"), 3: cell("3"), 4: cell("4")},
+				3: {1: cell("5")},
+				6: {1: cell("6")},
+			},
+			want: `<worksheet><sheetData><row r="1"><c r="A1"><v>1</v></c></row>` +
+				`<row r="2"><c r="A2"/><c r="B2"><v>2</v></c><c r="C2" s="4"><v>3</v></c><c r="D2"><v>4</v></c></row>` +
+				`<row r="3"><c r="A3"><v>5</v></c></row><row r="5"/><row r="6"><c r="A6"><v>6</v></c></row></sheetData></worksheet>`,
+		},
+		{
+			name:  "dimension grows",
+			sheet: `<worksheet><dimension ref="B2"/><sheetData/></worksheet>`,
+			rows:  map[int]map[int]pendingCell{1: {3: cell("1")}},
+			want:  `<worksheet><dimension ref="B1:C2"/><sheetData><row r="1"><c r="C1"><v>1</v></c></row></sheetData></worksheet>`,
+		},
+		{
+			name:  "namespace prefix",
+			sheet: `<x:worksheet><x:sheetData><x:row r="1"><x:c r="A1"><x:f>B1</x:f></x:c></x:row></x:sheetData></x:worksheet>`,
+			rows:  map[int]map[int]pendingCell{1: {1: cell("1"), 2: cell("2")}},
+			want:  `<x:worksheet><x:sheetData><x:row r="1"><x:c r="A1"><x:f>B1</x:f></x:c><x:c r="B1"><x:v>2</x:v></x:c></x:row></x:sheetData></x:worksheet>`,
+		},
+		{
+			name:  "self-closing row",
+			sheet: `<worksheet><sheetData><row r="1" ht="20" customHeight="1"/><row r="2"/></sheetData></worksheet>`,
+			rows:  map[int]map[int]pendingCell{1: {2: cell("1")}},
+			want:  `<worksheet><sheetData><row r="1" ht="20" customHeight="1"><c r="B1"><v>1</v></c></row><row r="2"/></sheetData></worksheet>`,
+		},
+		{
+			name: "attribute order and quoting",
+			sheet: `<worksheet><sheetData><row spans='1:3' r='2'><c s='4' r='A2'><v>9</v></c>` +
+				`<c t="s" r="C2" s="5"><f t="shared" si="0"/></c></row></sheetData></worksheet>`,
+			rows: map[int]map[int]pendingCell{2: {1: cell("1"), 3: cell("3")}},
+			want: `<worksheet><sheetData><row r="2"><c r="A2" s="4"><v>1</v></c>` +
+				`<c t="s" r="C2" s="5"><f t="shared" si="0"/></c></row></sheetData></worksheet>`,
+		},
+		{
+			name: "declared namespace prefix",
+			sheet: `<x:worksheet xmlns:x="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:x14ac="http://schemas.microsoft.com/office/spreadsheetml/2009/9/ac">` +
+				`<x:dimension ref="A1"/><x:cols><x:col min="1" max="2"/></x:cols><x:sheetData>` +
+				`<x:row r="1" x14ac:dyDescent="0.25"><x:c r="A1"/></x:row></x:sheetData></x:worksheet>`,
+			rows: map[int]map[int]pendingCell{1: {2: cell("2")}, 3: {1: cell("3")}},
+			want: `<x:worksheet xmlns:x="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:x14ac="http://schemas.microsoft.com/office/spreadsheetml/2009/9/ac">` +
+				`<x:dimension ref="A1:B3"/><x:cols><x:col min="1" max="2"/></x:cols><x:sheetData>` +
+				`<x:row r="1" x14ac:dyDescent="0.25"><x:c r="A1"/><x:c r="B1"><x:v>2</x:v></x:c></x:row>` +
+				`<x:row r="3"><x:c r="A3"><x:v>3</x:v></x:c></x:row></x:sheetData></x:worksheet>`,
+		}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := patchSheet([]byte(tt.sheet), tt.rows, &workbookDates{}, &Populated{})
+			if err != nil {
+				t.Fatalf("patchSheet() error = %v", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("patchSheet() =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPopulateTemplateNotWorkbook(t *testing.T) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, _ := zw.Create("notes.txt")
+	io.WriteString(w, "not a workbook")
+	zw.Close()
+
+	_, err := PopulateTemplate(openZip(t, buf.Bytes()), io.Discard, &Datamap{}, nil)
+	if err != ErrNotWorkbook {
+		t.Errorf("PopulateTemplate() error = %v, want ErrNotWorkbook", err)
+	}
+}
+
+func TestRecalculateOnLoad(t *testing.T) {
+	tests := []struct {
+		name string
+		book string
+		want string
+	}{
+		{
+			name: "self-closing calcPr",
+			book: `<workbook><sheets/><calcPr calcId="191029"/></workbook>`,
+			want: `<workbook><sheets/><calcPr calcId="191029" fullCalcOnLoad="1"/></workbook>`,
+		},
+		{
+			name: "namespace prefix",
+			book: `<x:workbook><x:calcPr calcId='1'></x:calcPr></x:workbook>`,
+			want: `<x:workbook><x:calcPr calcId="1" fullCalcOnLoad="1"></x:calcPr></x:workbook>`,
+		},
+		{
+			name: "already set",
+			book: `<workbook><calcPr fullCalcOnLoad="1" calcId="1"/></workbook>`,
+			want: `<workbook><calcPr fullCalcOnLoad="1" calcId="1"/></workbook>`,
+		},
+		{
+			name: "no calcPr",
+			book: `<workbook><sheets/></workbook>`,
+			want: `<workbook><sheets/></workbook>`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := string(recalculateOnLoad([]byte(tt.book))); got != tt.want {
+				t.Errorf("recalculateOnLoad() =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
@@ -6,6 +6,7 @@ require (
 	github.com/joho/godotenv v1.5.1
 	github.com/mattn/go-sqlite3 v1.14.16
 	github.com/tealeg/xlsx/v3 v3.3.6
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -0,0 +1,12 @@
+-- Only the lines of the current revision of each datamap are kept
+DELETE FROM datamap_lines WHERE revision_id IN (
+  SELECT r.id FROM datamap_revisions r
+  INNER JOIN datamaps d ON d.id = r.datamap_id
+  WHERE r.revision <> d.revision
+);
+
+DROP INDEX IF EXISTS datamap_lines_revision_line_idx;
+ALTER TABLE datamap_lines DROP COLUMN IF EXISTS line_id;
+ALTER TABLE datamap_lines DROP COLUMN IF EXISTS revision_id;
+ALTER TABLE datamaps DROP COLUMN IF EXISTS revision;
+DROP TABLE IF EXISTS datamap_revisions;
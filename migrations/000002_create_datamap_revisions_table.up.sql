@@ -0,0 +1,28 @@
+CREATE TABLE IF NOT EXISTS datamap_revisions (
+  id bigserial PRIMARY KEY,
+  datamap_id bigint NOT NULL REFERENCES datamaps ON DELETE CASCADE,
+  revision integer NOT NULL,
+  created timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+  UNIQUE (datamap_id, revision)
+);
+
+ALTER TABLE datamaps ADD COLUMN revision integer NOT NULL DEFAULT 1;
+
+-- Existing datamaps and their lines become revision 1
+INSERT INTO datamap_revisions (datamap_id, revision, created)
+  SELECT id, 1, created FROM datamaps;
+
+ALTER TABLE datamap_lines ADD COLUMN revision_id bigint REFERENCES datamap_revisions ON DELETE CASCADE;
+
+UPDATE datamap_lines SET revision_id = (
+  SELECT r.id FROM datamap_revisions r
+  WHERE r.datamap_id = datamap_lines.datamap_id AND r.revision = 1
+);
+
+-- line_id identifies a line across revisions: it is the id of the line's first row
+-- and is copied to the rows which hold the line in later revisions
+ALTER TABLE datamap_lines ADD COLUMN line_id bigint;
+
+UPDATE datamap_lines SET line_id = datamap_line_id;
+
+CREATE UNIQUE INDEX IF NOT EXISTS datamap_lines_revision_line_idx ON datamap_lines (revision_id, line_id);
@@ -0,0 +1,19 @@
+CREATE TABLE IF NOT EXISTS returns (
+  id bigserial PRIMARY KEY,
+  name text NOT NULL,
+  datamap_id bigint REFERENCES datamaps ON DELETE SET NULL,
+  revision integer,
+  created timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS return_lines (
+  return_line_id bigserial PRIMARY KEY,
+  return_id bigint NOT NULL REFERENCES returns ON DELETE CASCADE,
+  datamap_line_id bigint REFERENCES datamap_lines ON DELETE SET NULL,
+  key text,
+  sheet text,
+  cellref text,
+  value text
+);
+
+CREATE INDEX IF NOT EXISTS return_lines_return_id_idx ON return_lines (return_id);
@@ -0,0 +1,22 @@
+CREATE TABLE IF NOT EXISTS jobs (
+  id bigserial PRIMARY KEY,
+  status text NOT NULL DEFAULT 'pending',
+  datamap_id bigint NOT NULL REFERENCES datamaps ON DELETE CASCADE,
+  revision integer NOT NULL,
+  dir text NOT NULL,
+  created timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+  updated timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS job_items (
+  job_item_id bigserial PRIMARY KEY,
+  job_id bigint NOT NULL REFERENCES jobs ON DELETE CASCADE,
+  file text NOT NULL,
+  path text NOT NULL,
+  status text NOT NULL DEFAULT 'pending',
+  return_id bigint REFERENCES returns ON DELETE SET NULL,
+  error text NOT NULL DEFAULT ''
+);
+
+CREATE INDEX IF NOT EXISTS job_items_job_id_idx ON job_items (job_id);
+CREATE INDEX IF NOT EXISTS job_items_status_idx ON job_items (status);
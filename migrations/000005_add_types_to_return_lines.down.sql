@@ -0,0 +1,2 @@
+ALTER TABLE return_lines DROP COLUMN IF EXISTS raw;
+ALTER TABLE return_lines DROP COLUMN IF EXISTS data_type;
@@ -0,0 +1,5 @@
+ALTER TABLE return_lines ADD COLUMN data_type text NOT NULL DEFAULT 'TEXT';
+ALTER TABLE return_lines ADD COLUMN raw text;
+
+-- Until now every value was stored as the raw string from the cell
+UPDATE return_lines SET raw = value;
@@ -0,0 +1,4 @@
+ALTER TABLE return_lines DROP COLUMN IF EXISTS messages;
+ALTER TABLE return_lines DROP COLUMN IF EXISTS status;
+
+ALTER TABLE datamap_lines DROP COLUMN IF EXISTS rules;
@@ -0,0 +1,4 @@
+ALTER TABLE datamap_lines ADD COLUMN rules text;
+
+ALTER TABLE return_lines ADD COLUMN status text NOT NULL DEFAULT 'ok';
+ALTER TABLE return_lines ADD COLUMN messages text NOT NULL DEFAULT 'null';
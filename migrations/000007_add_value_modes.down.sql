@@ -0,0 +1,3 @@
+ALTER TABLE datamaps DROP COLUMN IF EXISTS value_mode;
+ALTER TABLE returns DROP COLUMN IF EXISTS value_mode;
+ALTER TABLE jobs DROP COLUMN IF EXISTS value_mode;
@@ -0,0 +1,7 @@
+ALTER TABLE jobs ADD COLUMN value_mode text NOT NULL DEFAULT 'cached';
+
+-- What was read from cells holding a formula when the return was parsed
+ALTER TABLE returns ADD COLUMN value_mode text NOT NULL DEFAULT 'cached';
+
+-- The value mode used for returns parsed against the datamap unless one is requested
+ALTER TABLE datamaps ADD COLUMN value_mode text NOT NULL DEFAULT 'cached';
@@ -0,0 +1 @@
+ALTER TABLE datamap_lines DROP COLUMN IF EXISTS table_columns;
@@ -0,0 +1 @@
+ALTER TABLE datamap_lines ADD COLUMN table_columns text;
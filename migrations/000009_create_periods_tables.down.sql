@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS returns_period_id_idx;
+ALTER TABLE returns DROP COLUMN IF EXISTS project;
+ALTER TABLE returns DROP COLUMN IF EXISTS period_id;
+DROP TABLE IF EXISTS period_projects;
+DROP TABLE IF EXISTS periods;
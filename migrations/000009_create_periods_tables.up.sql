@@ -0,0 +1,21 @@
+CREATE TABLE IF NOT EXISTS periods (
+  id bigserial PRIMARY KEY,
+  name text NOT NULL UNIQUE,
+  description text NOT NULL DEFAULT '',
+  datamap_id bigint NOT NULL REFERENCES datamaps ON DELETE CASCADE,
+  revision integer NOT NULL,
+  created timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
+
+-- The projects expected to submit a return for the period, in the order given
+CREATE TABLE IF NOT EXISTS period_projects (
+  period_id bigint NOT NULL REFERENCES periods ON DELETE CASCADE,
+  position integer NOT NULL,
+  project text NOT NULL,
+  PRIMARY KEY (period_id, position)
+);
+
+ALTER TABLE returns ADD COLUMN period_id bigint REFERENCES periods ON DELETE SET NULL;
+ALTER TABLE returns ADD COLUMN project text;
+
+CREATE INDEX IF NOT EXISTS returns_period_id_idx ON returns (period_id);
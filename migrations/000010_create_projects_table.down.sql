@@ -0,0 +1,6 @@
+DROP INDEX IF EXISTS returns_project_id_idx;
+ALTER TABLE returns DROP COLUMN IF EXISTS project_candidates;
+ALTER TABLE returns DROP COLUMN IF EXISTS project_match;
+ALTER TABLE returns DROP COLUMN IF EXISTS project_id;
+ALTER TABLE datamaps DROP COLUMN IF EXISTS identity_keys;
+DROP TABLE IF EXISTS projects;
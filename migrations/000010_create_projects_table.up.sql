@@ -0,0 +1,17 @@
+CREATE TABLE IF NOT EXISTS projects (
+  id bigserial PRIMARY KEY,
+  name text NOT NULL UNIQUE,
+  department text NOT NULL DEFAULT '',
+  delivery_body text NOT NULL DEFAULT '',
+  gmpp_id text UNIQUE,
+  created timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
+
+-- The keys of the datamap whose values identify the project a return comes from
+ALTER TABLE datamaps ADD COLUMN identity_keys text;
+
+ALTER TABLE returns ADD COLUMN project_id bigint REFERENCES projects ON DELETE SET NULL;
+ALTER TABLE returns ADD COLUMN project_match text NOT NULL DEFAULT 'unmatched';
+ALTER TABLE returns ADD COLUMN project_candidates text;
+
+CREATE INDEX IF NOT EXISTS returns_project_id_idx ON returns (project_id);